@@ -0,0 +1,158 @@
+package novagate
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// WithAdminAPI starts the gateway admin API (see NewAdminHandler) on addr.
+// Use an empty addr to disable it (the default). The API changes live
+// routing: bind it to a private interface.
+func WithAdminAPI(addr string) ServeOption {
+	return func(o *serveOptions) {
+		o.adminAddr = addr
+	}
+}
+
+// SplitState is the admin API view of a Splitter.
+type SplitState struct {
+	Command uint16         `json:"command"`
+	Sticky  Stickiness     `json:"sticky"`
+	Weights map[string]int `json:"weights"`
+}
+
+// CacheState is the admin API view of a ResponseCache.
+type CacheState struct {
+	Command  uint16 `json:"command"`
+	TTL      string `json:"ttl"`
+	Capacity int    `json:"capacity"`
+	Entries  int    `json:"entries"`
+}
+
+// NewAdminHandler returns the admin API of router:
+//
+//	GET /admin/splits        list every traffic split (SplitState)
+//	PUT /admin/splits/{id}   body = {"target": weight, ...}; id is decimal or 0x-prefixed hex
+//	GET /admin/faults        the fault injection state (FaultState)
+//	PUT /admin/faults        body = {"enabled": bool, "rules": [FaultRule, ...]}; omitted fields are kept
+//	GET /admin/caches        list every response cache (CacheState)
+//	DELETE /admin/caches/{id}[?principal=p]  drop the cached responses (of principal p); answers {"removed": n}
+//	GET /debug/vars          expvar metrics, including per-target split and per-command cache counters
+//
+// The fault endpoints answer 404 unless a FaultInjector was installed with
+// Router.InjectFaults.
+func NewAdminHandler(router *Router) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/splits", func(w http.ResponseWriter, r *http.Request) {
+		states := []SplitState{}
+		for _, s := range router.Splitters() {
+			states = append(states, splitState(s))
+		}
+		writeHTTPJSON(w, http.StatusOK, states)
+	})
+	mux.HandleFunc("PUT /admin/splits/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := commandIDParam(w, r)
+		if !ok {
+			return
+		}
+		s := router.splitter(id)
+		if s == nil {
+			writeHTTPError(w, http.StatusNotFound, fmt.Errorf("no split for command 0x%04X", id))
+			return
+		}
+		var weights map[string]int
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&weights); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := s.SetWeights(weights); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeHTTPJSON(w, http.StatusOK, splitState(s))
+	})
+	mux.HandleFunc("GET /admin/faults", func(w http.ResponseWriter, r *http.Request) {
+		f := router.FaultInjector()
+		if f == nil {
+			writeHTTPError(w, http.StatusNotFound, errNoFaultInjector)
+			return
+		}
+		writeHTTPJSON(w, http.StatusOK, f.State())
+	})
+	mux.HandleFunc("PUT /admin/faults", func(w http.ResponseWriter, r *http.Request) {
+		f := router.FaultInjector()
+		if f == nil {
+			writeHTTPError(w, http.StatusNotFound, errNoFaultInjector)
+			return
+		}
+		var req struct {
+			Enabled *bool        `json:"enabled"`
+			Rules   *[]FaultRule `json:"rules"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err)
+			return
+		}
+		st := f.State()
+		if req.Enabled != nil {
+			st.Enabled = *req.Enabled
+		}
+		if req.Rules != nil {
+			st.Rules = *req.Rules
+		}
+		if err := f.Set(st); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeHTTPJSON(w, http.StatusOK, f.State())
+	})
+	mux.HandleFunc("GET /admin/caches", func(w http.ResponseWriter, r *http.Request) {
+		states := []CacheState{}
+		for _, c := range router.Caches() {
+			cfg := c.Config()
+			states = append(states, CacheState{Command: c.cmd, TTL: cfg.TTL.String(), Capacity: cfg.Capacity, Entries: c.Len()})
+		}
+		writeHTTPJSON(w, http.StatusOK, states)
+	})
+	mux.HandleFunc("DELETE /admin/caches/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := commandIDParam(w, r)
+		if !ok {
+			return
+		}
+		c := router.Cache(id)
+		if c == nil {
+			writeHTTPError(w, http.StatusNotFound, fmt.Errorf("no cache for command 0x%04X", id))
+			return
+		}
+		var n int
+		if q := r.URL.Query(); q.Has("principal") {
+			n = c.InvalidatePrincipal(q.Get("principal"))
+		} else {
+			n = c.Purge()
+		}
+		writeHTTPJSON(w, http.StatusOK, map[string]int{"removed": n})
+	})
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	return mux
+}
+
+// commandIDParam parses the {id} path value, decimal or 0x-prefixed hex,
+// answering 400 if it is not a command id.
+func commandIDParam(w http.ResponseWriter, r *http.Request) (uint16, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 0, 16)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Errorf("invalid command id %q", r.PathValue("id")))
+		return 0, false
+	}
+	return uint16(id), true
+}
+
+var errNoFaultInjector = errors.New("fault injection is not installed")
+
+func splitState(s *Splitter) SplitState {
+	return SplitState{Command: s.cmd, Sticky: s.sticky, Weights: s.Weights()}
+}
@@ -0,0 +1,216 @@
+package novagate
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// AdmissionConfig configures connection admission control.
+type AdmissionConfig struct {
+	// MaxConns caps concurrent connections across all listeners. 0 = unlimited.
+	MaxConns int
+	// MaxConnsPerIP caps concurrent connections per source IP. 0 = unlimited.
+	MaxConnsPerIP int
+	// Allow, when non-empty, admits only source IPs inside one of these
+	// CIDRs (a bare IP means a single address).
+	Allow []string
+	// Deny rejects source IPs inside these CIDRs; it wins over Allow.
+	Deny []string
+}
+
+// Admission decides whether an accepted connection may be served.
+// It is safe for concurrent use; SetCIDRs swaps the lists at runtime.
+//
+// Connections without an IP source address (Unix sockets) skip the per-IP
+// cap and the CIDR lists but count towards MaxConns.
+type Admission struct {
+	maxConns int
+	maxPerIP int
+
+	rules atomic.Pointer[cidrRules]
+
+	mu    sync.Mutex
+	total int
+	perIP map[netip.Addr]int
+}
+
+type cidrRules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// NewAdmission validates cfg and returns an Admission.
+func NewAdmission(cfg AdmissionConfig) (*Admission, error) {
+	a := &Admission{
+		maxConns: cfg.MaxConns,
+		maxPerIP: cfg.MaxConnsPerIP,
+		perIP:    map[netip.Addr]int{},
+	}
+	if err := a.SetCIDRs(cfg.Allow, cfg.Deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetCIDRs replaces the allow and deny lists. Connections that are already
+// established are not re-checked.
+func (a *Admission) SetCIDRs(allow, deny []string) error {
+	r := &cidrRules{}
+	var err error
+	if r.allow, err = parsePrefixes(allow); err != nil {
+		return err
+	}
+	if r.deny, err = parsePrefixes(deny); err != nil {
+		return err
+	}
+	a.rules.Store(r)
+	return nil
+}
+
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("novagate: invalid CIDR %q: %w", s, err)
+			}
+			out = append(out, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("novagate: invalid CIDR %q: %w", s, err)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// Conns returns the number of admitted connections currently open.
+func (a *Admission) Conns() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.total
+}
+
+// admit checks a new connection from remote. On success the returned release
+// must be called once the connection closes; otherwise code and reason
+// describe the rejection.
+func (a *Admission) admit(remote net.Addr) (release func(), code uint16, reason string) {
+	ip, hasIP := remoteIP(remote)
+	if hasIP {
+		rules := a.rules.Load()
+		if containsIP(rules.deny, ip) || (len(rules.allow) > 0 && !containsIP(rules.allow, ip)) {
+			return nil, protocol.CloseAccessDenied, "access denied"
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxConns > 0 && a.total >= a.maxConns {
+		return nil, protocol.CloseTooManyConnections, "too many connections"
+	}
+	if hasIP && a.maxPerIP > 0 && a.perIP[ip] >= a.maxPerIP {
+		return nil, protocol.CloseTooManyConnectionsPerIP, "too many connections from " + ip.String()
+	}
+	a.total++
+	if hasIP {
+		a.perIP[ip]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.total--
+			if hasIP {
+				if a.perIP[ip]--; a.perIP[ip] <= 0 {
+					delete(a.perIP, ip)
+				}
+			}
+		})
+	}, 0, ""
+}
+
+func remoteIP(addr net.Addr) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, ok := netip.AddrFromSlice(a.IP)
+		return ip.Unmap(), ok
+	case nil:
+		return netip.Addr{}, false
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
+
+func containsIP(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithAdmission enables connection admission control. Rejected connections
+// receive a CtrlClose control frame carrying the reason before being closed.
+func WithAdmission(a *Admission) ServeOption {
+	return func(o *serveOptions) {
+		o.admission = a
+	}
+}
+
+// rejectWriteTimeout bounds the close-reason write to a rejected client.
+const rejectWriteTimeout = time.Second
+
+// admitConn applies so.admission to c. When c is rejected it is sent a close
+// reason, closed, and ok is false.
+func admitConn(c net.Conn, so serveOptions) (release func(), ok bool) {
+	admitted, code, reason := func() {}, uint16(0), ""
+	if so.admission != nil {
+		admitted, code, reason = so.admission.admit(c.RemoteAddr())
+	}
+	if admitted != nil {
+		metricConnsOpen.Add(1)
+		return func() {
+			admitted()
+			metricConnsOpen.Add(-1)
+		}, true
+	}
+
+	metricAdmissionRejected.Add(1)
+	switch code {
+	case protocol.CloseAccessDenied:
+		metricAdmissionDenied.Add(1)
+	case protocol.CloseTooManyConnections:
+		metricAdmissionMaxConns.Add(1)
+	case protocol.CloseTooManyConnectionsPerIP:
+		metricAdmissionMaxPerIP.Add(1)
+	}
+	frame, err := protocol.EncodeMessageFrameTo(nil, protocol.FlagControl, &protocol.Message{
+		Command: protocol.CtrlClose,
+		Payload: protocol.EncodeCloseReason(code, reason),
+	})
+	if err == nil {
+		_ = writeAll(c, frame, rejectWriteTimeout)
+	}
+	_ = c.Close()
+	return nil, false
+}
@@ -0,0 +1,147 @@
+package novagate
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func tcpAddr(s string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(s), Port: 1234}
+}
+
+func TestAdmissionCIDRRules(t *testing.T) {
+	if _, err := NewAdmission(AdmissionConfig{Allow: []string{"10.0.0.0/33"}}); err == nil {
+		t.Fatal("expected invalid CIDR error")
+	}
+
+	a, err := NewAdmission(AdmissionConfig{Allow: []string{"10.0.0.0/8", "192.168.1.7"}, Deny: []string{"10.1.0.0/16"}})
+	if err != nil {
+		t.Fatalf("NewAdmission: %v", err)
+	}
+	for _, tc := range []struct {
+		ip   string
+		code uint16
+		ok   bool
+	}{
+		{"10.2.3.4", 0, true},
+		{"192.168.1.7", 0, true},
+		{"::ffff:10.2.3.4", 0, true},
+		{"10.1.2.3", protocol.CloseAccessDenied, false},
+		{"192.168.1.8", protocol.CloseAccessDenied, false},
+	} {
+		release, code, _ := a.admit(tcpAddr(tc.ip))
+		if (release != nil) != tc.ok || code != tc.code {
+			t.Fatalf("%s: admitted=%v code=%d", tc.ip, release != nil, code)
+		}
+		if release != nil {
+			release()
+		}
+	}
+
+	// Reload: drop the allow list, deny everything in 10/8.
+	if err := a.SetCIDRs(nil, []string{"10.0.0.0/8"}); err != nil {
+		t.Fatalf("SetCIDRs: %v", err)
+	}
+	if release, _, _ := a.admit(tcpAddr("10.2.3.4")); release != nil {
+		t.Fatal("reloaded deny list not applied")
+	}
+	if release, _, _ := a.admit(tcpAddr("172.16.0.1")); release == nil {
+		t.Fatal("address outside the reloaded lists rejected")
+	}
+}
+
+func TestAdmissionConnectionCaps(t *testing.T) {
+	a, _ := NewAdmission(AdmissionConfig{MaxConns: 3, MaxConnsPerIP: 2})
+
+	r1, _, _ := a.admit(tcpAddr("1.1.1.1"))
+	r2, _, _ := a.admit(tcpAddr("1.1.1.1"))
+	if r1 == nil || r2 == nil {
+		t.Fatal("connections under the caps rejected")
+	}
+	if r, code, _ := a.admit(tcpAddr("1.1.1.1")); r != nil || code != protocol.CloseTooManyConnectionsPerIP {
+		t.Fatalf("per-IP cap not enforced: code=%d", code)
+	}
+	r3, _, _ := a.admit(&net.UnixAddr{Name: "@", Net: "unix"})
+	if r3 == nil {
+		t.Fatal("unix connection rejected")
+	}
+	if r, code, _ := a.admit(tcpAddr("2.2.2.2")); r != nil || code != protocol.CloseTooManyConnections {
+		t.Fatalf("global cap not enforced: code=%d", code)
+	}
+
+	r1()
+	r1() // release is idempotent
+	if a.Conns() != 2 {
+		t.Fatalf("Conns = %d, want 2", a.Conns())
+	}
+	if r, _, _ := a.admit(tcpAddr("1.1.1.1")); r == nil {
+		t.Fatal("slot not freed after release")
+	}
+}
+
+func expectCloseReason(t *testing.T, c net.Conn, want uint16) {
+	t.Helper()
+	r := &frameReader{c: c}
+	frame, m, err := r.next(2 * time.Second)
+	if err != nil {
+		t.Fatalf("read close frame: %v", err)
+	}
+	if !protocol.IsControl(frame.Flags) || m.Command != protocol.CtrlClose {
+		t.Fatalf("expected CtrlClose, got flags=%d cmd=0x%04X", frame.Flags, m.Command)
+	}
+	code, reason, err := protocol.DecodeCloseReason(m.Payload)
+	if err != nil || code != want {
+		t.Fatalf("close reason = %d %q %v, want code %d", code, reason, err, want)
+	}
+	if _, _, err := r.next(2 * time.Second); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF after close frame, got %v", err)
+	}
+}
+
+func TestAdmissionRejectsWithCloseReason(t *testing.T) {
+	for _, tr := range []string{TransportNet, TransportNetpoll} {
+		t.Run(tr, func(t *testing.T) {
+			a, _ := NewAdmission(AdmissionConfig{MaxConns: 1})
+			rejected := metricAdmissionRejected.Value()
+			first := serveForTest(t, WithTransport(tr), WithAdmission(a))
+			if resp := pingRoundTrip(t, first, 1, []byte("first")); resp.RequestID != 1 {
+				t.Fatalf("unexpected response %+v", resp)
+			}
+
+			second, err := net.Dial("tcp", first.RemoteAddr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer second.Close()
+			expectCloseReason(t, second, protocol.CloseTooManyConnections)
+			if metricAdmissionRejected.Value() <= rejected {
+				t.Fatal("rejection not counted")
+			}
+
+			first.Close()
+			deadline := time.Now().Add(2 * time.Second)
+			for a.Conns() != 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			third, err := net.Dial("tcp", first.RemoteAddr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer third.Close()
+			if resp := pingRoundTrip(t, third, 3, []byte("third")); resp.RequestID != 3 {
+				t.Fatalf("unexpected response %+v", resp)
+			}
+		})
+	}
+}
+
+func TestAdmissionDeniedCIDR(t *testing.T) {
+	a, _ := NewAdmission(AdmissionConfig{Deny: []string{"127.0.0.0/8"}})
+	c := serveForTest(t, WithAdmission(a))
+	expectCloseReason(t, c, protocol.CloseAccessDenied)
+}
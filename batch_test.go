@@ -0,0 +1,188 @@
+package novagate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func TestBatchFrameDispatchesEachMessage(t *testing.T) {
+	c := serveForTest(t)
+	fr := &frameReader{c: c}
+
+	msgs := make([]*protocol.Message, 3)
+	for i := range msgs {
+		msgs[i] = &protocol.Message{Command: protocol.CmdPing, RequestID: uint64(10 + i), Payload: []byte(fmt.Sprintf("m%d", i))}
+	}
+	for _, flags := range []uint8{0, protocol.FlagCompressed} {
+		wire, err := protocol.EncodeBatchFrameTo(nil, flags, msgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Write(wire); err != nil {
+			t.Fatal(err)
+		}
+
+		f, _, err := fr.next(2 * time.Second)
+		if err != nil {
+			t.Fatalf("flags=%#x: read: %v", flags, err)
+		}
+		if f.Flags != flags|protocol.FlagBatch {
+			t.Fatalf("flags=%#x: response flags %#x", flags, f.Flags)
+		}
+		body, err := protocol.DecodeFrameBody(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resps, err := protocol.DecodeBatch(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resps) != len(msgs) {
+			t.Fatalf("flags=%#x: %d responses, want %d", flags, len(resps), len(msgs))
+		}
+		for i, r := range resps {
+			if r.RequestID != msgs[i].RequestID || string(r.Payload) != string(msgs[i].Payload) {
+				t.Fatalf("response %d = %+v", i, r)
+			}
+		}
+	}
+}
+
+func TestOneWayBatchSendsNoResponse(t *testing.T) {
+	c := serveForTest(t)
+	wire, err := protocol.EncodeBatchFrameTo(nil, protocol.FlagOneWay, []*protocol.Message{
+		{Command: protocol.CmdPing, RequestID: 1},
+		{Command: protocol.CmdPing, RequestID: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(wire); err != nil {
+		t.Fatal(err)
+	}
+	// The next response on the connection must belong to the plain ping.
+	if m := pingRoundTrip(t, c, 3, []byte("x")); m.RequestID != 3 {
+		t.Fatalf("RequestID = %d, want 3", m.RequestID)
+	}
+}
+
+// readBatch reads the next batch frame from fr and returns its messages.
+func readBatch(t *testing.T, fr *frameReader) (*protocol.Frame, []*protocol.Message) {
+	t.Helper()
+	_ = fr.c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	tmp := make([]byte, 64<<10)
+	for {
+		f, n, err := protocol.Decode(fr.buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f != nil {
+			f.Body = bytes.Clone(f.Body)
+			fr.buf = fr.buf[n:]
+			body, err := protocol.DecodeFrameBody(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs, err := f.DecodeBatch(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f, msgs
+		}
+		m, err := fr.c.Read(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fr.buf = append(fr.buf, tmp[:m]...)
+	}
+}
+
+func TestBatchResponsesFollowRoutePoliciesAndFrameLimit(t *testing.T) {
+	const (
+		cmdAlways uint16 = 0x0F01
+		cmdSized  uint16 = 0x0F02
+	)
+	setup := func(r *Router) error {
+		echo := func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			return &protocol.Message{Command: m.Command, RequestID: m.RequestID, Payload: m.Payload}, nil
+		}
+		if err := r.Route(cmdAlways, echo, RouteConfig{Compression: CompressionAlways}); err != nil {
+			return err
+		}
+		// cmdSized answers with as many bytes as its payload asks for.
+		r.Register(cmdSized, func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			n, err := strconv.Atoi(string(m.Payload))
+			if err != nil {
+				return nil, err
+			}
+			return &protocol.Message{Command: m.Command, Payload: make([]byte, n)}, nil
+		})
+		return echoSetup(r)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = ServeWithContext(ctx, ln, setup) }()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fr := &frameReader{c: c}
+	send := func(msgs ...*protocol.Message) {
+		t.Helper()
+		wire, err := protocol.EncodeBatchFrameTo(nil, 0, msgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Write(wire); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A route that always compresses compresses the batch it is part of.
+	send(&protocol.Message{Command: protocol.CmdPing, RequestID: 1}, &protocol.Message{Command: cmdAlways, RequestID: 2})
+	if f, msgs := readBatch(t, fr); f.Flags&protocol.FlagCompressed == 0 || len(msgs) != 2 {
+		t.Fatalf("flags %#x, %d responses; want a compressed batch of 2", f.Flags, len(msgs))
+	}
+
+	// Responses over MaxFrameBody together are split across frames, and one
+	// that cannot fit a frame on its own is answered with StatusTooLarge.
+	size := func(n int) []byte { return []byte(strconv.Itoa(n)) }
+	send(
+		&protocol.Message{Command: cmdSized, RequestID: 1, Payload: size(protocol.MaxFrameBody / 2)},
+		&protocol.Message{Command: cmdSized, RequestID: 2, Payload: size(protocol.MaxFrameBody / 2)},
+		&protocol.Message{Command: cmdSized, RequestID: 3, Payload: size(protocol.MaxFrameBody + 1)},
+		&protocol.Message{Command: cmdSized, RequestID: 4, Payload: size(1)},
+	)
+	var got []*protocol.Message
+	for frames := 1; len(got) < 4; frames++ {
+		if frames > 2 {
+			t.Fatalf("responses spread over more than 2 frames: %d so far", len(got))
+		}
+		_, msgs := readBatch(t, fr)
+		got = append(got, msgs...)
+	}
+	for i, m := range got {
+		if m.RequestID != uint64(i+1) {
+			t.Fatalf("response %d answers request %d", i, m.RequestID)
+		}
+	}
+	code, _, err := protocol.DecodeErrorReply(got[2].Payload)
+	if got[2].Command != protocol.CmdError || err != nil || code != protocol.StatusTooLarge {
+		t.Fatalf("oversized response = %+v, want StatusTooLarge", got[2])
+	}
+	if len(got[0].Payload) != protocol.MaxFrameBody/2 || len(got[3].Payload) != 1 {
+		t.Fatal("responses lost their payloads")
+	}
+}
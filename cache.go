@@ -0,0 +1,264 @@
+package novagate
+
+import (
+	"context"
+	"crypto/sha256"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gogogo1024/novagate/codec"
+	"github.com/gogogo1024/novagate/internal/lru"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// Default response cache settings (see CacheConfig).
+const (
+	DefaultCacheTTL      = 30 * time.Second
+	DefaultCacheCapacity = 10000
+)
+
+// CacheConfig configures a ResponseCache. Zero values take the defaults.
+type CacheConfig struct {
+	// TTL is how long a response is served from the cache (default 30s).
+	TTL time.Duration
+	// Capacity bounds the number of responses kept; the least recently used
+	// is evicted first (default 10000).
+	Capacity int
+	// Principal isolates the responses of each caller it returns. Without
+	// it responses are keyed by the PrincipalKey metadata entry (default
+	// DefaultPrincipalKey), which clients set freely: it scopes invalidation,
+	// not access, so only cache data every caller may read.
+	Principal    PrincipalFunc
+	PrincipalKey string
+	// ContentType is the codec of requests that name none (see
+	// codec.MetadataKey). Responses are encoded like their request, so
+	// requests naming different codecs never share one.
+	ContentType string
+}
+
+// cacheStats publishes per-command counters under "caches" in the novagate
+// expvar map: caches["0x<cmd>"] = {hits, misses, coalesced, evictions,
+// invalidations, entries}.
+var cacheStats = func() *expvar.Map {
+	m := new(expvar.Map)
+	metrics.Set("caches", m)
+	return m
+}()
+
+// ResponseCache serves repeated requests of a read-only command from memory.
+// Requests are identified by principal, content type and a SHA-256 hash of
+// the payload;
+// unless CacheConfig.Principal authenticates the principal, a client can read
+// any response cached for the same payload.
+// Concurrent identical requests are coalesced: one runs and the others share
+// its outcome. Only responses are cached; errors and requests without a
+// response are not.
+//
+// Handlers changing the data behind the command call Invalidate,
+// InvalidatePrincipal or Purge; the admin API exposes the latter two (see
+// NewAdminHandler). A response still being computed when the cache is
+// invalidated is returned to its callers but not cached.
+type ResponseCache struct {
+	cmd uint16
+	cfg CacheConfig
+
+	mu       sync.Mutex
+	entries  *lru.Cache[cacheKey, *protocol.Message]
+	inflight map[cacheKey]*cacheCall
+	// gen counts invalidations, so that responses computed before one are
+	// not stored after it.
+	gen uint64
+
+	hits, misses, coalesced, evictions, invalidations *expvar.Int
+}
+
+type cacheKey struct {
+	principal   string
+	contentType string
+	sum         [sha256.Size]byte
+}
+
+// cacheCall is a request running under some key.
+type cacheCall struct {
+	done chan struct{}
+	resp *protocol.Message
+	err  error
+	// abandoned is set when the caller that ran it gave up; waiters run the
+	// request themselves rather than sharing its cancellation.
+	abandoned bool
+}
+
+// NewResponseCache returns the response cache of cmd; set it as the Cache
+// of the command's RouteConfig, or install its Middleware with Router.Use.
+func NewResponseCache(cmd uint16, cfg CacheConfig) (*ResponseCache, error) {
+	if cfg.TTL < 0 || cfg.Capacity < 0 {
+		return nil, fmt.Errorf("command 0x%04X: negative cache ttl or capacity", cmd)
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = DefaultCacheTTL
+	}
+	if cfg.Capacity == 0 {
+		cfg.Capacity = DefaultCacheCapacity
+	}
+	if cfg.PrincipalKey == "" {
+		cfg.PrincipalKey = DefaultPrincipalKey
+	}
+	c := &ResponseCache{
+		cmd:           cmd,
+		cfg:           cfg,
+		entries:       lru.New[cacheKey, *protocol.Message](cfg.Capacity),
+		inflight:      make(map[cacheKey]*cacheCall),
+		hits:          new(expvar.Int),
+		misses:        new(expvar.Int),
+		coalesced:     new(expvar.Int),
+		evictions:     new(expvar.Int),
+		invalidations: new(expvar.Int),
+	}
+	stats := new(expvar.Map)
+	stats.Set("hits", c.hits)
+	stats.Set("misses", c.misses)
+	stats.Set("coalesced", c.coalesced)
+	stats.Set("evictions", c.evictions)
+	stats.Set("invalidations", c.invalidations)
+	stats.Set("entries", expvar.Func(func() any { return c.Len() }))
+	cacheStats.Set(fmt.Sprintf("0x%04X", cmd), stats)
+	return c, nil
+}
+
+// Command returns the cached command.
+func (c *ResponseCache) Command() uint16 { return c.cmd }
+
+// Config returns the settings of the cache, defaults applied.
+func (c *ResponseCache) Config() CacheConfig { return c.cfg }
+
+// Len returns the number of responses held, expired ones included until they
+// are looked up or evicted.
+func (c *ResponseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.Len()
+}
+
+// Middleware returns the middleware caching the command; other commands pass
+// through untouched.
+func (c *ResponseCache) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			if m.Command != c.cmd {
+				return next(ctx, m)
+			}
+			key := cacheKey{principal: c.principal(ctx, m), contentType: c.contentType(m), sum: sha256.Sum256(m.Payload)}
+			for {
+				c.mu.Lock()
+				if resp, ok := c.entries.Get(key); ok {
+					c.mu.Unlock()
+					c.hits.Add(1)
+					return cachedResponse(resp, m), nil
+				}
+				call, running := c.inflight[key]
+				if !running {
+					call = &cacheCall{done: make(chan struct{})}
+					c.inflight[key] = call
+				}
+				gen := c.gen
+				c.mu.Unlock()
+				if !running {
+					c.misses.Add(1)
+					return c.run(ctx, key, gen, call, next, m)
+				}
+
+				select {
+				case <-call.done:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+				if !call.abandoned {
+					c.coalesced.Add(1)
+					if call.err != nil || call.resp == nil {
+						return nil, call.err
+					}
+					return cachedResponse(call.resp, m), nil
+				}
+			}
+		}
+	}
+}
+
+func (c *ResponseCache) principal(ctx context.Context, m *protocol.Message) string {
+	if c.cfg.Principal != nil {
+		return c.cfg.Principal(ctx, m)
+	}
+	return m.Metadata[c.cfg.PrincipalKey]
+}
+
+func (c *ResponseCache) contentType(m *protocol.Message) string {
+	if ct := m.Metadata[codec.MetadataKey]; ct != "" {
+		return ct
+	}
+	return c.cfg.ContentType
+}
+
+// run serves m as the request running under key, and caches its response
+// unless the cache was invalidated since gen.
+func (c *ResponseCache) run(ctx context.Context, key cacheKey, gen uint64, call *cacheCall, next Handler, m *protocol.Message) (*protocol.Message, error) {
+	resp, err := next(ctx, m)
+	call.err = err
+	call.abandoned = err != nil && ctx.Err() != nil
+	if err == nil && resp != nil {
+		// The response may alias the request buffer; keep a copy.
+		call.resp = resp.Clone()
+	}
+
+	c.mu.Lock()
+	if c.inflight[key] == call {
+		delete(c.inflight, key)
+	}
+	if call.resp != nil && c.gen == gen {
+		c.evictions.Add(int64(c.entries.Set(key, call.resp, c.cfg.TTL)))
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return resp, err
+}
+
+// Invalidate drops the responses cached for the request of principal with
+// payload, in every content type, and reports whether there were any.
+func (c *ResponseCache) Invalidate(principal string, payload []byte) bool {
+	sum := sha256.Sum256(payload)
+	return c.invalidate(func(k cacheKey) bool { return k.principal == principal && k.sum == sum }) > 0
+}
+
+// InvalidatePrincipal drops every response cached for principal and returns
+// how many there were.
+func (c *ResponseCache) InvalidatePrincipal(principal string) int {
+	return c.invalidate(func(k cacheKey) bool { return k.principal == principal })
+}
+
+// Purge drops every cached response and returns how many there were.
+func (c *ResponseCache) Purge() int {
+	return c.invalidate(func(cacheKey) bool { return true })
+}
+
+func (c *ResponseCache) invalidate(match func(cacheKey) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	// Requests arriving from now on must not join a call started before.
+	for k := range c.inflight {
+		if match(k) {
+			delete(c.inflight, k)
+		}
+	}
+	n := c.entries.RemoveFunc(func(k cacheKey, _ *protocol.Message) bool { return match(k) })
+	c.invalidations.Add(1)
+	return n
+}
+
+// cachedResponse returns a copy of the cached response resp for the request m.
+func cachedResponse(resp *protocol.Message, m *protocol.Message) *protocol.Message {
+	out := resp.Clone()
+	out.RequestID = m.RequestID
+	return out
+}
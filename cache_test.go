@@ -0,0 +1,258 @@
+package novagate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/codec"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// lookupHandler answers "<principal>:<payload>#<call number>".
+func lookupHandler(calls *atomic.Int64) Handler {
+	return func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		n := calls.Add(1)
+		return &protocol.Message{Command: m.Command, RequestID: m.RequestID, Payload: []byte(m.Metadata["principal"] + ":" + string(m.Payload) + "#" + string(rune('0'+n)))}, nil
+	}
+}
+
+func TestResponseCacheKeysAndEviction(t *testing.T) {
+	var calls atomic.Int64
+	c, err := NewResponseCache(protocol.CmdUserLogin, CacheConfig{TTL: 50 * time.Millisecond, Capacity: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.Middleware()(lookupHandler(&calls))
+	expect := func(id uint64, principal, payload, want string) {
+		t.Helper()
+		resp, err := h(context.Background(), &protocol.Message{Command: protocol.CmdUserLogin, RequestID: id, Metadata: map[string]string{"principal": principal}, Payload: []byte(payload)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Payload) != want || resp.RequestID != id {
+			t.Fatalf("request %d (%s, %s) = %q for request %d, want %q", id, principal, payload, resp.Payload, resp.RequestID, want)
+		}
+	}
+
+	expect(1, "alice", "u1", "alice:u1#1")
+	expect(2, "alice", "u1", "alice:u1#1")
+	expect(3, "bob", "u1", "bob:u1#2")
+	expect(4, "alice", "u2", "alice:u2#3") // evicts alice:u1, the least recently used
+	expect(5, "bob", "u1", "bob:u1#2")
+	expect(6, "alice", "u1", "alice:u1#4")
+	if n := c.Len(); n != 2 {
+		t.Fatalf("cache holds %d responses, want 2", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	expect(7, "alice", "u1", "alice:u1#5")
+
+	if !c.Invalidate("alice", []byte("u1")) || c.Invalidate("alice", []byte("u1")) {
+		t.Fatal("Invalidate did not report the cached response once")
+	}
+	expect(8, "alice", "u1", "alice:u1#6")
+	expect(9, "bob", "u9", "bob:u9#7")
+	if n := c.InvalidatePrincipal("alice"); n != 1 {
+		t.Fatalf("InvalidatePrincipal removed %d, want 1", n)
+	}
+	expect(10, "bob", "u9", "bob:u9#7")
+	if n := c.Purge(); n != 1 || c.Len() != 0 {
+		t.Fatalf("Purge removed %d, left %d", n, c.Len())
+	}
+
+	// Other commands and failures are not cached.
+	fails := 0
+	h = c.Middleware()(func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		fails++
+		return nil, ErrOverloaded
+	})
+	for range 2 {
+		if _, err := h(context.Background(), &protocol.Message{Command: protocol.CmdUserLogin}); !errors.Is(err, ErrOverloaded) {
+			t.Fatal(err)
+		}
+		_, _ = h(context.Background(), &protocol.Message{Command: protocol.CmdPing})
+	}
+	if fails != 4 {
+		t.Fatalf("handler ran %d times, want 4", fails)
+	}
+}
+
+func TestResponseCacheKeysContentType(t *testing.T) {
+	var calls atomic.Int64
+	c, err := NewResponseCache(protocol.CmdUserLogin, CacheConfig{ContentType: codec.JSONName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.Middleware()(lookupHandler(&calls))
+	call := func(ct string) string {
+		t.Helper()
+		m := &protocol.Message{Command: protocol.CmdUserLogin, Payload: []byte("u1")}
+		if ct != "" {
+			m.Metadata = map[string]string{codec.MetadataKey: ct}
+		}
+		resp, err := h(context.Background(), m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(resp.Payload)
+	}
+	if got := call(codec.JSONName); got != ":u1#1" {
+		t.Fatalf("json = %q", got)
+	}
+	// A msgpack response is not served to a json request, nor the reverse.
+	if got := call(codec.MsgPackName); got != ":u1#2" {
+		t.Fatalf("msgpack = %q, want a response of its own", got)
+	}
+	// Requests naming no codec share the responses of the default.
+	if got := call(""); got != ":u1#1" {
+		t.Fatalf("default = %q, want the json response", got)
+	}
+	if !c.Invalidate("", []byte("u1")) || c.Len() != 0 {
+		t.Fatalf("Invalidate left %d responses", c.Len())
+	}
+}
+
+type testPrincipalKey struct{}
+
+// testPrincipal stands in for an authenticated identity kept in the context.
+func testPrincipal(ctx context.Context, m *protocol.Message) string {
+	p, _ := ctx.Value(testPrincipalKey{}).(string)
+	return p
+}
+
+func TestResponseCacheAuthenticatedPrincipal(t *testing.T) {
+	var calls atomic.Int64
+	c, err := NewResponseCache(protocol.CmdUserLogin, CacheConfig{Principal: testPrincipal})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.Middleware()(lookupHandler(&calls))
+	call := func(as, claimed string) string {
+		ctx := context.WithValue(context.Background(), testPrincipalKey{}, as)
+		resp, err := h(ctx, &protocol.Message{Command: protocol.CmdUserLogin, Metadata: map[string]string{"principal": claimed}, Payload: []byte("me")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(resp.Payload)
+	}
+	if got := call("alice", "alice"); got != "alice:me#1" {
+		t.Fatalf("alice = %q", got)
+	}
+	// Claiming alice in metadata does not reach her response.
+	if got := call("mallory", "alice"); got != "alice:me#2" {
+		t.Fatalf("mallory = %q, want a response of her own", got)
+	}
+	if n := c.InvalidatePrincipal("mallory"); n != 1 {
+		t.Fatalf("InvalidatePrincipal(mallory) = %d", n)
+	}
+}
+
+func TestResponseCacheCoalescesConcurrentMisses(t *testing.T) {
+	c, err := NewResponseCache(protocol.CmdUserLogin, CacheConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	var calls atomic.Int64
+	h := c.Middleware()(func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		calls.Add(1)
+		<-release
+		return &protocol.Message{Command: m.Command, Payload: []byte("profile")}, nil
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := h(context.Background(), &protocol.Message{Command: protocol.CmdUserLogin, RequestID: uint64(i), Payload: []byte("u1")})
+			if err == nil && string(resp.Payload) != "profile" {
+				err = errors.New("wrong payload " + string(resp.Payload))
+			}
+			errs <- err
+		}()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for calls.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("request did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// Invalidating now keeps the running response out of the cache.
+	c.Purge()
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("handler ran %d times for concurrent identical requests", n)
+	}
+	if n := c.Len(); n != 0 {
+		t.Fatalf("response started before Purge was cached (%d entries)", n)
+	}
+}
+
+func TestRouteCacheBypassesRateLimit(t *testing.T) {
+	var calls atomic.Int64
+	c, err := NewResponseCache(protocol.CmdUserLogin, CacheConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter()
+	if err := r.Route(protocol.CmdUserLogin, lookupHandler(&calls), RouteConfig{RateLimit: 0.001, Burst: 1, Cache: c}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Cache(protocol.CmdUserLogin) != c || r.Cache(protocol.CmdPing) != nil {
+		t.Fatal("Router.Cache does not return the route's cache")
+	}
+	for range 3 {
+		if _, err := r.Dispatch(context.Background(), &protocol.Message{Command: protocol.CmdUserLogin, Payload: []byte("u1")}); err != nil {
+			t.Fatalf("cached request: %v", err)
+		}
+	}
+	if _, err := r.Dispatch(context.Background(), &protocol.Message{Command: protocol.CmdUserLogin, Payload: []byte("u2")}); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("uncached request over the limit: %v", err)
+	}
+
+	srv := httptest.NewServer(NewAdminHandler(r))
+	defer srv.Close()
+	do := func(method, path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+	if code, body := do(http.MethodGet, "/admin/caches"); code != http.StatusOK || !strings.Contains(body, `"entries":1`) || !strings.Contains(body, `"ttl":"30s"`) {
+		t.Fatalf("GET /admin/caches = %d %s", code, body)
+	}
+	if code, body := do(http.MethodDelete, "/admin/caches/0x0101?principal=bob"); code != http.StatusOK || !strings.Contains(body, `"removed":0`) {
+		t.Fatalf("DELETE for bob = %d %s", code, body)
+	}
+	if code, body := do(http.MethodDelete, "/admin/caches/0x0101"); code != http.StatusOK || !strings.Contains(body, `"removed":1`) {
+		t.Fatalf("DELETE = %d %s", code, body)
+	}
+	if code, _ := do(http.MethodDelete, "/admin/caches/0x0001"); code != http.StatusNotFound {
+		t.Fatalf("DELETE of an uncached command = %d, want 404", code)
+	}
+}
@@ -0,0 +1,80 @@
+package novagate
+
+import (
+	"bytes"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/gogogo1024/novagate/internal/capture"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// WithCapture records every decoded request and response to path as JSON
+// Lines (see docs/traffic-capture.md); cmd/replay can replay the result.
+//
+// The file is rotated once it exceeds maxBytes, keeping maxFiles old files
+// (path.1 is the newest). Use maxBytes <= 0 to disable rotation.
+func WithCapture(path string, maxBytes int64, maxFiles int) ServeOption {
+	return func(o *serveOptions) {
+		o.capturePath = path
+		o.captureMaxBytes = maxBytes
+		o.captureMaxFiles = maxFiles
+	}
+}
+
+func openCapture(so *serveOptions) (func(), error) {
+	if so.capturePath == "" {
+		return func() {}, nil
+	}
+	w, err := capture.NewWriter(so.capturePath, so.captureMaxBytes, so.captureMaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	so.capture = w
+	captureWriters.Store(w, struct{}{})
+	return func() {
+		_ = w.Close()
+		captureDroppedClosed.Add(int64(w.Dropped()))
+		captureWriters.Delete(w)
+	}, nil
+}
+
+// captureWriters holds the open capture writers, whose dropped records are
+// published as "capture_dropped" with those of the closed ones.
+var (
+	captureWriters       sync.Map
+	captureDroppedClosed expvar.Int
+)
+
+func init() {
+	metrics.Set("capture_dropped", expvar.Func(func() any {
+		n := captureDroppedClosed.Value()
+		captureWriters.Range(func(w, _ any) bool {
+			n += int64(w.(*capture.Writer).Dropped())
+			return true
+		})
+		return n
+	}))
+}
+
+// captureMessage queues m for the capture writer, off the connection's read
+// loop. The payload is copied since it may alias the connection buffer. When
+// the writer falls behind records are dropped, never the request.
+func captureMessage(w *capture.Writer, connID uint64, dir string, flags uint8, m *protocol.Message) {
+	if w == nil {
+		return
+	}
+	// A record holds one message, whether or not it arrived in a batch, and
+	// replays as version 1, which has no metadata.
+	flags &^= protocol.FlagBatch | protocol.FlagMetadata
+	w.Enqueue(&capture.Record{
+		Time:      time.Now(),
+		ConnID:    connID,
+		Dir:       dir,
+		Flags:     flags,
+		Command:   m.Command,
+		RequestID: m.RequestID,
+		Payload:   bytes.Clone(m.Payload),
+	})
+}
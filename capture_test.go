@@ -0,0 +1,55 @@
+package novagate
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/internal/capture"
+)
+
+func TestWithCaptureRecordsRequestAndResponse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cap.jsonl")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeWithContext(ctx, listener, echoSetup, WithCapture(path, 0, 0))
+	}()
+
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	pingRoundTrip(t, c, 11, []byte("captured"))
+	c.Close()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for server to stop")
+	}
+
+	recs, err := capture.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("records=%d, want 2", len(recs))
+	}
+	if recs[0].Dir != capture.DirIn || recs[1].Dir != capture.DirOut {
+		t.Fatalf("unexpected directions: %q, %q", recs[0].Dir, recs[1].Dir)
+	}
+	if recs[0].ConnID == 0 || recs[0].ConnID != recs[1].ConnID {
+		t.Fatalf("conn ids: %d, %d", recs[0].ConnID, recs[1].ConnID)
+	}
+	if recs[1].RequestID != 11 || string(recs[1].Payload) != "captured" {
+		t.Fatalf("unexpected response record %+v", recs[1])
+	}
+}
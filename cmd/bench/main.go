@@ -0,0 +1,566 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "bench:", err)
+		os.Exit(1)
+	}
+}
+
+type benchConfig struct {
+	addr        string
+	conns       int
+	depth       int
+	duration    time.Duration
+	requests    int64
+	payload     sizeDist
+	gzipRatio   float64
+	oneWayRatio float64
+	commands    weightedCommands
+	jsonOut     bool
+	timeout     time.Duration
+}
+
+func run() error {
+	cfg, err := parseFlags()
+	if err != nil {
+		return err
+	}
+	res := runBench(cfg)
+	if cfg.jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	res.print()
+	return nil
+}
+
+func parseFlags() (benchConfig, error) {
+	addr := flag.String("addr", "127.0.0.1:9000", "gateway address")
+	conns := flag.Int("conns", 10, "number of connections")
+	depth := flag.Int("depth", 1, "pipelining depth (outstanding requests per connection)")
+	duration := flag.Duration("duration", 10*time.Second, "test duration")
+	requests := flag.Int64("requests", 0, "stop after this many requests in total (0 = until -duration)")
+	payload := flag.String("payload", "64", "payload size: N, MIN-MAX (uniform) or N:weight,M:weight")
+	gzipRatio := flag.Float64("gzip", 0, "fraction of requests sent with FlagCompressed (0..1)")
+	oneWayRatio := flag.Float64("oneway", 0, "fraction of requests sent with FlagOneWay (0..1)")
+	cmds := flag.String("cmds", "0x0001", "command mix: 0x0001:80,0x0101:20")
+	jsonOut := flag.Bool("json", false, "print the result as JSON")
+	timeout := flag.Duration("timeout", 5*time.Second, "per-request response timeout")
+	flag.Parse()
+
+	sizes, err := parseSizeDist(*payload)
+	if err != nil {
+		return benchConfig{}, err
+	}
+	commands, err := parseCommandMix(*cmds)
+	if err != nil {
+		return benchConfig{}, err
+	}
+	if *conns <= 0 || *depth <= 0 {
+		return benchConfig{}, errors.New("-conns and -depth must be positive")
+	}
+	return benchConfig{
+		addr:        *addr,
+		conns:       *conns,
+		depth:       *depth,
+		duration:    *duration,
+		requests:    *requests,
+		payload:     sizes,
+		gzipRatio:   *gzipRatio,
+		oneWayRatio: *oneWayRatio,
+		commands:    commands,
+		jsonOut:     *jsonOut,
+		timeout:     *timeout,
+	}, nil
+}
+
+// sizeDist picks payload sizes either uniformly in [min,max] or from weighted buckets.
+type sizeDist struct {
+	min, max int
+	buckets  []weighted[int]
+}
+
+func (d sizeDist) pick(rng *rand.Rand) int {
+	if len(d.buckets) > 0 {
+		return pickWeighted(rng, d.buckets)
+	}
+	if d.max <= d.min {
+		return d.min
+	}
+	return d.min + rng.Intn(d.max-d.min+1)
+}
+
+// maxPayload is the largest payload that fits in a request frame.
+const maxPayload = protocol.MaxFrameBody - protocol.MessageHeaderLen
+
+func parseSizeDist(v string) (sizeDist, error) {
+	var d sizeDist
+	if strings.Contains(v, ":") {
+		buckets, err := parseWeighted(v, func(s string) (int, error) {
+			n, err := strconv.Atoi(s)
+			if err == nil && n < 0 {
+				err = errors.New("negative size")
+			}
+			return n, err
+		})
+		if err != nil {
+			return sizeDist{}, err
+		}
+		d.buckets = buckets
+		for _, b := range buckets {
+			d.max = max(d.max, b.value)
+		}
+	} else if lo, hi, ok := strings.Cut(v, "-"); ok {
+		min, err1 := strconv.Atoi(lo)
+		max, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || min < 0 || max < min {
+			return sizeDist{}, fmt.Errorf("invalid payload range %q", v)
+		}
+		d = sizeDist{min: min, max: max}
+	} else {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return sizeDist{}, fmt.Errorf("invalid payload size %q", v)
+		}
+		d = sizeDist{min: n, max: n}
+	}
+	if d.max > maxPayload {
+		return sizeDist{}, fmt.Errorf("payload size %d exceeds the frame limit of %d bytes", d.max, maxPayload)
+	}
+	return d, nil
+}
+
+type weightedCommands []weighted[uint16]
+
+func parseCommandMix(v string) (weightedCommands, error) {
+	return parseWeighted(v, func(s string) (uint16, error) {
+		u, err := strconv.ParseUint(s, 0, 16)
+		return uint16(u), err
+	})
+}
+
+type weighted[T any] struct {
+	value  T
+	weight int
+}
+
+// parseWeighted parses "a:3,b:1"; a missing weight counts as 1.
+func parseWeighted[T any](v string, parse func(string) (T, error)) ([]weighted[T], error) {
+	var out []weighted[T]
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		raw, w, hasWeight := strings.Cut(item, ":")
+		val, err := parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q: %w", raw, err)
+		}
+		weight := 1
+		if hasWeight {
+			weight, err = strconv.Atoi(w)
+			if err != nil || weight <= 0 {
+				return nil, fmt.Errorf("invalid weight in %q", item)
+			}
+		}
+		out = append(out, weighted[T]{value: val, weight: weight})
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("empty list %q", v)
+	}
+	return out, nil
+}
+
+func pickWeighted[T any](rng *rand.Rand, items []weighted[T]) T {
+	total := 0
+	for _, it := range items {
+		total += it.weight
+	}
+	n := rng.Intn(total)
+	for _, it := range items {
+		if n < it.weight {
+			return it.value
+		}
+		n -= it.weight
+	}
+	return items[len(items)-1].value
+}
+
+// connStats is owned by one connection and merged at the end.
+type connStats struct {
+	sent       int64
+	oneWay     int64
+	ok         int64
+	latencies  []time.Duration
+	errors     map[string]int64
+	bytesOut   int64
+	bytesIn    int64
+	compressed int64
+}
+
+func (s *connStats) addError(kind string) {
+	if s.errors == nil {
+		s.errors = map[string]int64{}
+	}
+	s.errors[kind]++
+}
+
+func runBench(cfg benchConfig) *benchResult {
+	var (
+		wg       sync.WaitGroup
+		budget   atomic.Int64
+		mu       sync.Mutex
+		perConn  []*connStats
+		deadline = time.Now().Add(cfg.duration)
+	)
+	budget.Store(cfg.requests)
+
+	start := time.Now()
+	for i := 0; i < cfg.conns; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			st := runConn(cfg, deadline, &budget, rand.New(rand.NewSource(seed)))
+			mu.Lock()
+			perConn = append(perConn, st)
+			mu.Unlock()
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	return summarize(cfg, perConn, time.Since(start))
+}
+
+// takeBudget reports whether another request may be sent.
+func takeBudget(cfg benchConfig, deadline time.Time, budget *atomic.Int64) bool {
+	if time.Now().After(deadline) {
+		return false
+	}
+	if cfg.requests > 0 && budget.Add(-1) < 0 {
+		return false
+	}
+	return true
+}
+
+func runConn(cfg benchConfig, deadline time.Time, budget *atomic.Int64, rng *rand.Rand) *connStats {
+	st := &connStats{}
+	conn, err := net.DialTimeout("tcp", cfg.addr, 3*time.Second)
+	if err != nil {
+		st.addError("dial")
+		return st
+	}
+	defer conn.Close()
+
+	var (
+		mu       sync.Mutex
+		inflight = map[uint64]time.Time{}
+		slots    = make(chan struct{}, cfg.depth)
+		readErr  = make(chan error, 1)
+	)
+	go func() {
+		readErr <- readLoop(conn, func(m *protocol.Message, wireLen int) {
+			mu.Lock()
+			sentAt, ok := inflight[m.RequestID]
+			delete(inflight, m.RequestID)
+			st.bytesIn += int64(wireLen)
+			switch {
+			case !ok:
+				st.addError("unexpected_response")
+			case m.Command == protocol.CmdError:
+				st.addError(statusErrorKind(m.Payload))
+			default:
+				st.ok++
+				st.latencies = append(st.latencies, time.Since(sentAt))
+			}
+			mu.Unlock()
+			if ok {
+				<-slots
+			}
+		})
+	}()
+
+	var reqID uint64
+	payload := make([]byte, 0, 1024)
+send:
+	for takeBudget(cfg, deadline, budget) {
+		select {
+		case slots <- struct{}{}:
+		case err := <-readErr:
+			readErr <- err
+			break send
+		case <-time.After(cfg.timeout):
+			mu.Lock()
+			st.addError("timeout")
+			mu.Unlock()
+			break send
+		}
+
+		reqID++
+		size := cfg.payload.pick(rng)
+		payload = payload[:0]
+		for len(payload) < size {
+			payload = append(payload, byte('a'+len(payload)%26))
+		}
+		flags := uint8(0)
+		if rng.Float64() < cfg.gzipRatio {
+			flags |= protocol.FlagCompressed
+		}
+		oneWay := rng.Float64() < cfg.oneWayRatio
+		if oneWay {
+			flags |= protocol.FlagOneWay
+		}
+
+		wire, err := encodeRequest(pickWeighted(rng, cfg.commands), reqID, flags, payload)
+		if err != nil {
+			mu.Lock()
+			st.addError("encode")
+			mu.Unlock()
+			<-slots
+			continue
+		}
+
+		mu.Lock()
+		if !oneWay {
+			inflight[reqID] = time.Now()
+		}
+		st.sent++
+		st.bytesOut += int64(len(wire))
+		if flags&protocol.FlagCompressed != 0 {
+			st.compressed++
+		}
+		if oneWay {
+			st.oneWay++
+		}
+		mu.Unlock()
+
+		_ = conn.SetWriteDeadline(time.Now().Add(cfg.timeout))
+		if _, err := conn.Write(wire); err != nil {
+			mu.Lock()
+			st.addError("write")
+			mu.Unlock()
+			break
+		}
+		if oneWay {
+			<-slots
+		}
+	}
+
+	// Drain outstanding responses.
+	waitUntil := time.Now().Add(cfg.timeout)
+	for time.Now().Before(waitUntil) {
+		mu.Lock()
+		n := len(inflight)
+		mu.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	_ = conn.Close()
+	err = <-readErr
+
+	mu.Lock()
+	defer mu.Unlock()
+	for range inflight {
+		st.addError("timeout")
+	}
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		st.addError("read")
+	}
+	return st
+}
+
+func encodeRequest(cmd uint16, reqID uint64, flags uint8, payload []byte) ([]byte, error) {
+	msgBytes, err := protocol.EncodeMessage(&protocol.Message{Command: cmd, RequestID: reqID, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	frameFlags, body, err := protocol.EncodeFrameBody(flags, msgBytes)
+	if err != nil {
+		return nil, err
+	}
+	return protocol.Encode(&protocol.Frame{Flags: frameFlags, Body: body}), nil
+}
+
+// statusErrorKind names the error reply payload p in the error counts,
+// e.g. "status_1".
+func statusErrorKind(p []byte) string {
+	code, _, err := protocol.DecodeErrorReply(p)
+	if err != nil {
+		return "status_invalid"
+	}
+	return "status_" + strconv.Itoa(int(code))
+}
+
+func readLoop(conn net.Conn, onMsg func(*protocol.Message, int)) error {
+	buf := make([]byte, 0, 64*1024)
+	tmp := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(tmp)
+		if n > 0 {
+			buf = append(buf, tmp[:n]...)
+			consumed := 0
+			for {
+				frame, frameLen, derr := protocol.Decode(buf[consumed:])
+				if derr != nil {
+					return derr
+				}
+				if frame == nil {
+					break
+				}
+				body, derr := protocol.DecodeFrameBody(frame)
+				if derr != nil {
+					return derr
+				}
+				m, derr := frame.DecodeMessage(body)
+				if derr != nil {
+					return derr
+				}
+				consumed += frameLen
+				if protocol.IsControl(frame.Flags) {
+					if err := answerControl(conn, m); err != nil {
+						return err
+					}
+					continue
+				}
+				onMsg(m, frameLen)
+			}
+			buf = append(buf[:0], buf[consumed:]...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// answerControl replies to server heartbeats so long runs are not cut off.
+func answerControl(conn net.Conn, m *protocol.Message) error {
+	if m.Command != protocol.CtrlPing {
+		return nil
+	}
+	pong, err := protocol.EncodeMessageFrameTo(nil, protocol.FlagControl, &protocol.Message{Command: protocol.CtrlPong, RequestID: m.RequestID, Payload: m.Payload})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(pong)
+	return err
+}
+
+type latencySummary struct {
+	MinMS  float64 `json:"min_ms"`
+	MeanMS float64 `json:"mean_ms"`
+	P50MS  float64 `json:"p50_ms"`
+	P99MS  float64 `json:"p99_ms"`
+	P999MS float64 `json:"p999_ms"`
+	MaxMS  float64 `json:"max_ms"`
+}
+
+type benchResult struct {
+	Addr        string           `json:"addr"`
+	Conns       int              `json:"conns"`
+	Depth       int              `json:"depth"`
+	DurationSec float64          `json:"duration_sec"`
+	Sent        int64            `json:"sent"`
+	OneWay      int64            `json:"one_way"`
+	Compressed  int64            `json:"compressed"`
+	Responses   int64            `json:"responses"`
+	QPS         float64          `json:"qps"`
+	Latency     latencySummary   `json:"latency"`
+	Errors      map[string]int64 `json:"errors"`
+	BytesOut    int64            `json:"bytes_out"`
+	BytesIn     int64            `json:"bytes_in"`
+}
+
+func summarize(cfg benchConfig, perConn []*connStats, elapsed time.Duration) *benchResult {
+	res := &benchResult{
+		Addr:        cfg.addr,
+		Conns:       cfg.conns,
+		Depth:       cfg.depth,
+		DurationSec: elapsed.Seconds(),
+		Errors:      map[string]int64{},
+	}
+	var all []time.Duration
+	for _, st := range perConn {
+		res.Sent += st.sent
+		res.OneWay += st.oneWay
+		res.Compressed += st.compressed
+		res.Responses += st.ok
+		res.BytesOut += st.bytesOut
+		res.BytesIn += st.bytesIn
+		for k, v := range st.errors {
+			res.Errors[k] += v
+		}
+		all = append(all, st.latencies...)
+	}
+	if elapsed > 0 {
+		res.QPS = float64(res.Sent) / elapsed.Seconds()
+	}
+	res.Latency = summarizeLatency(all)
+	return res
+}
+
+func summarizeLatency(all []time.Duration) latencySummary {
+	if len(all) == 0 {
+		return latencySummary{}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	var sum time.Duration
+	for _, d := range all {
+		sum += d
+	}
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	pct := func(p float64) float64 {
+		idx := int(p * float64(len(all)-1))
+		return ms(all[idx])
+	}
+	return latencySummary{
+		MinMS:  ms(all[0]),
+		MeanMS: ms(sum / time.Duration(len(all))),
+		P50MS:  pct(0.50),
+		P99MS:  pct(0.99),
+		P999MS: pct(0.999),
+		MaxMS:  ms(all[len(all)-1]),
+	}
+}
+
+func (r *benchResult) print() {
+	fmt.Printf("target:     %s conns=%d depth=%d\n", r.Addr, r.Conns, r.Depth)
+	fmt.Printf("duration:   %.2fs\n", r.DurationSec)
+	fmt.Printf("requests:   sent=%d responses=%d one-way=%d compressed=%d\n", r.Sent, r.Responses, r.OneWay, r.Compressed)
+	fmt.Printf("throughput: %.0f req/s\n", r.QPS)
+	fmt.Printf("latency:    min=%.3fms mean=%.3fms p50=%.3fms p99=%.3fms p999=%.3fms max=%.3fms\n",
+		r.Latency.MinMS, r.Latency.MeanMS, r.Latency.P50MS, r.Latency.P99MS, r.Latency.P999MS, r.Latency.MaxMS)
+	fmt.Printf("wire:       out=%d bytes in=%d bytes\n", r.BytesOut, r.BytesIn)
+	if len(r.Errors) == 0 {
+		fmt.Println("errors:     none")
+		return
+	}
+	kinds := make([]string, 0, len(r.Errors))
+	for k := range r.Errors {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	for _, k := range kinds {
+		fmt.Printf("errors:     %s=%d\n", k, r.Errors[k])
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func TestParseSizeDist(t *testing.T) {
+	d, err := parseSizeDist("16-32")
+	if err != nil || d.min != 16 || d.max != 32 {
+		t.Fatalf("range: %+v err=%v", d, err)
+	}
+	d, err = parseSizeDist("64:3,1024:1")
+	if err != nil || len(d.buckets) != 2 || d.buckets[1].value != 1024 || d.buckets[1].weight != 1 {
+		t.Fatalf("buckets: %+v err=%v", d, err)
+	}
+	if _, err := parseSizeDist("32-16"); err == nil {
+		t.Fatalf("expected error for inverted range")
+	}
+	for _, v := range []string{strconv.Itoa(maxPayload + 1), "0-" + strconv.Itoa(protocol.MaxFrameBody), "64:1,2000000:1"} {
+		if _, err := parseSizeDist(v); err == nil {
+			t.Fatalf("expected error for payload %q over the frame limit", v)
+		}
+	}
+	if _, err := parseSizeDist(strconv.Itoa(maxPayload)); err != nil {
+		t.Fatalf("largest payload rejected: %v", err)
+	}
+}
+
+func TestRunBenchCountsErrorReplies(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = novagate.ServeWithContext(ctx, ln, func(r *novagate.Router) error {
+			r.Register(protocol.CmdPing, func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+				return nil, novagate.ErrOverloaded
+			})
+			return nil
+		})
+	}()
+
+	res := runBench(benchConfig{
+		addr:     ln.Addr().String(),
+		conns:    1,
+		depth:    1,
+		duration: 5 * time.Second,
+		requests: 10,
+		payload:  sizeDist{min: 1, max: 1},
+		commands: weightedCommands{{value: protocol.CmdPing, weight: 1}},
+		timeout:  2 * time.Second,
+	})
+	failed := res.Errors["status_"+strconv.Itoa(int(protocol.StatusOverloaded))]
+	if res.Sent != 10 || res.Responses != 0 || failed != 10 || len(res.Errors) != 1 {
+		t.Fatalf("sent=%d responses=%d errors=%v; want the 10 error replies counted as errors", res.Sent, res.Responses, res.Errors)
+	}
+}
+
+func TestParseCommandMix(t *testing.T) {
+	mix, err := parseCommandMix("0x0001:80,0x0101")
+	if err != nil {
+		t.Fatalf("parseCommandMix: %v", err)
+	}
+	if len(mix) != 2 || mix[0].value != 0x0001 || mix[0].weight != 80 || mix[1].weight != 1 {
+		t.Fatalf("unexpected mix: %+v", mix)
+	}
+	if _, err := parseCommandMix("0x10000"); err == nil {
+		t.Fatalf("expected error for out-of-range command")
+	}
+}
+
+func TestSummarizeLatencyPercentiles(t *testing.T) {
+	var all []time.Duration
+	for i := 1; i <= 1000; i++ {
+		all = append(all, time.Duration(i)*time.Millisecond)
+	}
+	s := summarizeLatency(all)
+	if s.P50MS != 500 || s.P99MS != 990 || s.P999MS != 999 || s.MaxMS != 1000 {
+		t.Fatalf("unexpected percentiles: %+v", s)
+	}
+}
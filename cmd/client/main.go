@@ -22,6 +22,7 @@ type clientConfig struct {
 	flagsHex string
 	payload  string
 	reqID    uint64
+	version  uint8
 }
 
 func run() error {
@@ -43,7 +44,7 @@ func run() error {
 		RequestID: cfg.reqID,
 		Payload:   []byte(cfg.payload),
 	}
-	if err := sendRequest(conn, flags, req); err != nil {
+	if err := sendRequest(conn, cfg.version, flags, req); err != nil {
 		return err
 	}
 
@@ -67,6 +68,7 @@ func parseFlags() clientConfig {
 	flagsHex := flag.String("flags", "0x00", "frame flags in hex, e.g. 0x04 for one-way")
 	payloadStr := flag.String("payload", "ping", "payload string")
 	reqID := flag.Uint64("id", 1, "request id")
+	version := flag.Uint("version", uint(protocol.FrameVersion), "frame version: 1, or 2 for compact varint headers")
 	flag.Parse()
 
 	return clientConfig{
@@ -75,6 +77,7 @@ func parseFlags() clientConfig {
 		flagsHex: *flagsHex,
 		payload:  *payloadStr,
 		reqID:    *reqID,
+		version:  uint8(*version),
 	}
 }
 
@@ -94,16 +97,11 @@ func dial(addr string, timeout time.Duration) (net.Conn, error) {
 	return net.DialTimeout("tcp", addr, timeout)
 }
 
-func sendRequest(conn net.Conn, flags uint8, req *protocol.Message) error {
-	msgBytes, err := protocol.EncodeMessage(req)
+func sendRequest(conn net.Conn, version, flags uint8, req *protocol.Message) error {
+	frameBytes, err := protocol.AppendFrame(nil, version, flags, req)
 	if err != nil {
 		return err
 	}
-	frameFlags, frameBody, err := protocol.EncodeFrameBody(flags, msgBytes)
-	if err != nil {
-		return err
-	}
-	frameBytes := protocol.Encode(&protocol.Frame{Flags: frameFlags, Body: frameBody})
 
 	_, err = conn.Write(frameBytes)
 	return err
@@ -118,16 +116,24 @@ func readResponse(conn net.Conn, timeout time.Duration) (*protocol.Message, erro
 		n, err := conn.Read(tmp)
 		if n > 0 {
 			buf = append(buf, tmp[:n]...)
-			frame, _, derr := protocol.Decode(buf)
-			if derr != nil {
-				return nil, derr
-			}
-			if frame != nil {
+			for {
+				frame, frameLen, derr := protocol.Decode(buf)
+				if derr != nil {
+					return nil, derr
+				}
+				if frame == nil {
+					break
+				}
+				// Skip server heartbeats; this client only waits for one response.
+				if protocol.IsControl(frame.Flags) {
+					buf = buf[frameLen:]
+					continue
+				}
 				respBody, err := protocol.DecodeFrameBody(frame)
 				if err != nil {
 					return nil, err
 				}
-				return protocol.DecodeMessage(respBody)
+				return frame.DecodeMessage(respBody)
 			}
 		}
 		if err != nil {
@@ -142,5 +148,11 @@ func printSentOneWay(req *protocol.Message) {
 }
 
 func printResponse(resp *protocol.Message) {
+	if resp.Command == protocol.CmdError {
+		if code, msg, err := protocol.DecodeErrorReply(resp.Payload); err == nil {
+			fmt.Printf("error: request_id=%d code=%d message=%q\n", resp.RequestID, code, msg)
+			return
+		}
+	}
 	fmt.Printf("resp: cmd=0x%04X request_id=%d payload=%q\n", resp.Command, resp.RequestID, string(resp.Payload))
 }
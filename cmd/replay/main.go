@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogogo1024/novagate/internal/capture"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func main() {
+	code, err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		os.Exit(2)
+	}
+	os.Exit(code)
+}
+
+type replayConfig struct {
+	addr     string
+	captures []string
+	speed    float64
+	timeout  time.Duration
+	maxDiffs int
+}
+
+func parseFlags() replayConfig {
+	addr := flag.String("addr", "127.0.0.1:9000", "gateway address")
+	captures := flag.String("capture", "", "comma-separated capture files (rotated files may be listed in any order)")
+	speed := flag.Float64("speed", 1, "replay speed factor; 2 = twice as fast, 0 = as fast as possible")
+	timeout := flag.Duration("timeout", 5*time.Second, "how long to wait for outstanding responses per connection")
+	maxDiffs := flag.Int("max-diffs", 20, "maximum number of diffs to print")
+	flag.Parse()
+
+	return replayConfig{
+		addr:     *addr,
+		captures: splitList(*captures),
+		speed:    *speed,
+		timeout:  *timeout,
+		maxDiffs: *maxDiffs,
+	}
+}
+
+func run() (int, error) {
+	cfg := parseFlags()
+	if len(cfg.captures) == 0 {
+		return 0, fmt.Errorf("-capture is required")
+	}
+
+	start := time.Now()
+	report, errs, err := replay(cfg)
+	if err != nil {
+		return 0, err
+	}
+	report.print(cfg.maxDiffs, time.Since(start), errs)
+	if report.ok() && len(errs) == 0 {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// replay sends the inbound records of cfg.captures to cfg.addr, one
+// connection per captured connection, and compares the responses with the
+// recorded ones. errs lists the connections that failed along the way.
+func replay(cfg replayConfig) (diffReport, []string, error) {
+	records, err := loadRecords(cfg.captures)
+	if err != nil {
+		return diffReport{}, nil, err
+	}
+	plan := buildPlan(records)
+	if len(plan.conns) == 0 {
+		return diffReport{}, nil, fmt.Errorf("no inbound records in capture")
+	}
+
+	start := time.Now()
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		actuals = map[msgKey]*protocol.Message{}
+		errs    []string
+	)
+	for connID, ins := range plan.conns {
+		wg.Add(1)
+		go func(connID uint64, ins []*capture.Record) {
+			defer wg.Done()
+			got, err := replayConn(cfg, start, plan.origin, ins, plan.expectedPerConn[connID])
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("conn %d: %v", connID, err))
+			}
+			for req, m := range got {
+				actuals[msgKey{conn: connID, req: req}] = m
+			}
+		}(connID, ins)
+	}
+	wg.Wait()
+	sort.Strings(errs)
+	return diff(plan.expected, actuals), errs, nil
+}
+
+func loadRecords(paths []string) ([]*capture.Record, error) {
+	var all []*capture.Record
+	for _, p := range paths {
+		recs, err := capture.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, recs...)
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Time.Before(all[j].Time) })
+	return all, nil
+}
+
+type msgKey struct {
+	conn uint64
+	req  uint64
+}
+
+type replayPlan struct {
+	origin          time.Time
+	conns           map[uint64][]*capture.Record
+	expected        map[msgKey]*capture.Record
+	expectedPerConn map[uint64]int
+}
+
+func buildPlan(records []*capture.Record) replayPlan {
+	plan := replayPlan{
+		conns:           map[uint64][]*capture.Record{},
+		expected:        map[msgKey]*capture.Record{},
+		expectedPerConn: map[uint64]int{},
+	}
+	for _, rec := range records {
+		switch rec.Dir {
+		case capture.DirIn:
+			if plan.origin.IsZero() {
+				plan.origin = rec.Time
+			}
+			plan.conns[rec.ConnID] = append(plan.conns[rec.ConnID], rec)
+		case capture.DirOut:
+			key := msgKey{conn: rec.ConnID, req: rec.RequestID}
+			if _, dup := plan.expected[key]; !dup {
+				plan.expectedPerConn[rec.ConnID]++
+			}
+			plan.expected[key] = rec
+		}
+	}
+	return plan
+}
+
+// replayConn sends ins over a fresh connection, pacing them relative to
+// origin, and collects responses by RequestID until want have arrived or the
+// timeout elapses after the last send.
+func replayConn(cfg replayConfig, start, origin time.Time, ins []*capture.Record, want int) (map[uint64]*protocol.Message, error) {
+	conn, err := net.DialTimeout("tcp", cfg.addr, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	got := map[uint64]*protocol.Message{}
+	var mu sync.Mutex
+	readDone := make(chan error, 1)
+	go func() {
+		readDone <- readResponses(conn, func(m *protocol.Message) {
+			mu.Lock()
+			got[m.RequestID] = m
+			mu.Unlock()
+		})
+	}()
+
+	for _, rec := range ins {
+		if cfg.speed > 0 {
+			due := start.Add(time.Duration(float64(rec.Time.Sub(origin)) / cfg.speed))
+			time.Sleep(time.Until(due))
+		}
+		if err := sendRecord(conn, rec); err != nil {
+			return got, err
+		}
+	}
+
+	deadline := time.Now().Add(cfg.timeout)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(got)
+		mu.Unlock()
+		if n >= want {
+			break
+		}
+		select {
+		case err := <-readDone:
+			mu.Lock()
+			defer mu.Unlock()
+			return copyResults(got), err
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return copyResults(got), nil
+}
+
+func copyResults(in map[uint64]*protocol.Message) map[uint64]*protocol.Message {
+	out := make(map[uint64]*protocol.Message, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
+
+func sendRecord(conn net.Conn, rec *capture.Record) error {
+	msgBytes, err := protocol.EncodeMessage(&protocol.Message{Command: rec.Command, RequestID: rec.RequestID, Payload: rec.Payload})
+	if err != nil {
+		return err
+	}
+	flags, body, err := protocol.EncodeFrameBody(rec.Flags, msgBytes)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(protocol.Encode(&protocol.Frame{Flags: flags, Body: body}))
+	return err
+}
+
+func readResponses(conn net.Conn, onMsg func(*protocol.Message)) error {
+	buf := make([]byte, 0, 8*1024)
+	tmp := make([]byte, 4*1024)
+	for {
+		n, err := conn.Read(tmp)
+		if n > 0 {
+			buf = append(buf, tmp[:n]...)
+			for {
+				frame, frameLen, derr := protocol.Decode(buf)
+				if derr != nil {
+					return derr
+				}
+				if frame == nil {
+					break
+				}
+				body, derr := protocol.DecodeFrameBody(frame)
+				if derr != nil {
+					return derr
+				}
+				m, derr := frame.DecodeMessage(body)
+				if derr != nil {
+					return derr
+				}
+				buf = buf[frameLen:]
+				if protocol.IsControl(frame.Flags) {
+					if m.Command == protocol.CtrlPing {
+						pong, _ := protocol.EncodeMessageFrameTo(nil, protocol.FlagControl, &protocol.Message{Command: protocol.CtrlPong, RequestID: m.RequestID, Payload: m.Payload})
+						if _, err := conn.Write(pong); err != nil {
+							return err
+						}
+					}
+					continue
+				}
+				m.Payload = append([]byte(nil), m.Payload...)
+				onMsg(m)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type diffReport struct {
+	matched    int
+	mismatched []string
+	missing    []string
+	unexpected []string
+}
+
+func diff(expected map[msgKey]*capture.Record, actual map[msgKey]*protocol.Message) diffReport {
+	var r diffReport
+	for key, want := range expected {
+		got, ok := actual[key]
+		if !ok {
+			r.missing = append(r.missing, fmt.Sprintf("conn=%d req=%d cmd=0x%04X: no response", key.conn, key.req, want.Command))
+			continue
+		}
+		if got.Command != want.Command || !bytes.Equal(got.Payload, want.Payload) {
+			r.mismatched = append(r.mismatched, fmt.Sprintf(
+				"conn=%d req=%d: recorded cmd=0x%04X payload=%q, replayed cmd=0x%04X payload=%q",
+				key.conn, key.req, want.Command, want.Payload, got.Command, got.Payload,
+			))
+			continue
+		}
+		r.matched++
+	}
+	for key, got := range actual {
+		if _, ok := expected[key]; !ok {
+			r.unexpected = append(r.unexpected, fmt.Sprintf("conn=%d req=%d cmd=0x%04X: response not in capture", key.conn, key.req, got.Command))
+		}
+	}
+	sort.Strings(r.mismatched)
+	sort.Strings(r.missing)
+	sort.Strings(r.unexpected)
+	return r
+}
+
+func (r diffReport) ok() bool {
+	return len(r.mismatched) == 0 && len(r.missing) == 0 && len(r.unexpected) == 0
+}
+
+func (r diffReport) print(maxDiffs int, elapsed time.Duration, errs []string) {
+	fmt.Printf("replayed in %s: matched=%d mismatched=%d missing=%d unexpected=%d\n",
+		elapsed.Round(time.Millisecond), r.matched, len(r.mismatched), len(r.missing), len(r.unexpected))
+	printed := 0
+	for _, group := range [][]string{errs, r.mismatched, r.missing, r.unexpected} {
+		for _, line := range group {
+			if printed >= maxDiffs {
+				return
+			}
+			fmt.Printf("- %s\n", line)
+			printed++
+		}
+	}
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// serveForTest serves a router answering CmdPing with reply(payload) and
+// returns its address.
+func serveForTest(t *testing.T, reply func([]byte) []byte, opts ...novagate.ServeOption) (string, func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- novagate.ServeWithContext(ctx, ln, func(r *novagate.Router) error {
+			r.Register(protocol.CmdPing, func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+				return &protocol.Message{Command: m.Command, RequestID: m.RequestID, Payload: reply(m.Payload)}, nil
+			})
+			return nil
+		}, opts...)
+	}()
+	stop := func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("server did not stop")
+		}
+	}
+	t.Cleanup(cancel)
+	return ln.Addr().String(), stop
+}
+
+// ping sends the payloads over one connection and waits for every response.
+func ping(t *testing.T, addr string, payloads ...string) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i, p := range payloads {
+		msg, _ := protocol.EncodeMessage(&protocol.Message{Command: protocol.CmdPing, RequestID: uint64(i + 1), Payload: []byte(p)})
+		if _, err := c.Write(protocol.Encode(&protocol.Frame{Body: msg})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := make(chan struct{}, len(payloads))
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	go func() { _ = readResponses(c, func(*protocol.Message) { got <- struct{}{} }) }()
+	for range payloads {
+		select {
+		case <-got:
+		case <-time.After(2 * time.Second):
+			t.Fatal("response missing")
+		}
+	}
+}
+
+func TestReplayRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cap.jsonl")
+	echo := func(p []byte) []byte { return p }
+	addr, stop := serveForTest(t, echo, novagate.WithCapture(path, 0, 0))
+	ping(t, addr, "a", "b", "c")
+	ping(t, addr, "d")
+	stop()
+
+	cfg := replayConfig{captures: []string{path}, timeout: 2 * time.Second}
+	cfg.addr, _ = serveForTest(t, echo)
+	report, errs, err := replay(cfg)
+	if err != nil || len(errs) != 0 {
+		t.Fatalf("replay: %v %v", err, errs)
+	}
+	if !report.ok() || report.matched != 4 {
+		t.Fatalf("replay against the same handler: %+v", report)
+	}
+
+	// A backend answering differently shows up as mismatches.
+	cfg.addr, _ = serveForTest(t, bytes.ToUpper)
+	report, errs, err = replay(cfg)
+	if err != nil || len(errs) != 0 {
+		t.Fatalf("replay: %v %v", err, errs)
+	}
+	if report.ok() || report.matched != 0 || len(report.mismatched) != 4 {
+		t.Fatalf("replay against a changed handler: %+v", report)
+	}
+}
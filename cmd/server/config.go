@@ -1,18 +1,24 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/gogogo1024/novagate"
+	"github.com/gogogo1024/novagate/dedup"
+	"github.com/gogogo1024/novagate/discovery"
+	"github.com/gogogo1024/novagate/protocol"
 	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
 	"gopkg.in/yaml.v3"
 )
 
@@ -96,6 +102,53 @@ func (yc *yamlConfig) getString(path string) (string, bool, error) {
 	return s, true, nil
 }
 
+// getStringList reads a YAML sequence of non-empty strings.
+func (yc *yamlConfig) getStringList(path string) ([]string, bool, error) {
+	v, ok := yc.get(path)
+	if !ok {
+		return nil, false, nil
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, true, fmt.Errorf("yaml %s must be a list of strings", path)
+	}
+	out := make([]string, 0, len(items))
+	for i, item := range items {
+		s, ok := item.(string)
+		if !ok || s == "" {
+			return nil, true, fmt.Errorf("yaml %s[%d] must be a non-empty string", path, i)
+		}
+		out = append(out, s)
+	}
+	return out, true, nil
+}
+
+func (yc *yamlConfig) getInt(path string) (int, bool, error) {
+	v, ok := yc.get(path)
+	if !ok {
+		return 0, false, nil
+	}
+	n, ok := v.(int)
+	if !ok {
+		return 0, true, fmt.Errorf("yaml %s must be an integer", path)
+	}
+	return n, true, nil
+}
+
+func (yc *yamlConfig) getFloat(path string) (float64, bool, error) {
+	v, ok := yc.get(path)
+	if !ok {
+		return 0, false, nil
+	}
+	switch n := v.(type) {
+	case float64:
+		return n, true, nil
+	case int:
+		return float64(n), true, nil
+	}
+	return 0, true, fmt.Errorf("yaml %s must be a number", path)
+}
+
 func (yc *yamlConfig) getDuration(path string) (time.Duration, bool, error) {
 	s, ok, err := yc.getString(path)
 	if err != nil || !ok {
@@ -112,16 +165,58 @@ type serverConfig struct {
 	addr         string
 	idleTimeout  time.Duration
 	writeTimeout time.Duration
+	// listen holds extra listener URLs (unix://, ws://, tcp://) served next to addr.
+	listen []string
+	// httpAddr enables the HTTP/JSON bridge when non-empty.
+	httpAddr string
+	// adminAddr enables the admin API (traffic split weights) when non-empty.
+	adminAddr string
+	// transport selects the connection model: "net" (default) or "netpoll".
+	transport string
+	// capture* enable wire-level traffic capture when capturePath is non-empty.
+	capturePath     string
+	captureMaxBytes int64
+	captureMaxFiles int
+	// writeBatch* tune response write coalescing; zero values keep the defaults.
+	writeBatchBytes int
+	writeBatchDelay time.Duration
+	// liveness holds the heartbeat and TCP keepalive settings.
+	liveness livenessValues
+	// admission is nil unless the YAML has an admission section.
+	admission *novagate.AdmissionConfig
+	// proxyProtocol is nil unless proxy_protocol.enabled is true.
+	proxyProtocol *novagate.ProxyProtocolConfig
+	// limiter is nil unless limiter.enabled is true.
+	limiter *limiterValues
+	// resilience holds the per-command backend policies.
+	resilience []resilienceValues
+	// commands is the declared routing table; empty means the built-in one.
+	commands []novagate.CommandSpec
+	// discovery is nil unless the YAML has a discovery section.
+	discovery *discoveryValues
+	// faults is the initial fault injection state, disabled by default and
+	// changed at runtime through the admin API.
+	faults novagate.FaultState
+	// dedup is the store of idempotent commands; nil means in memory.
+	dedup *dedupValues
 
 	addrSource         configSource
 	idleTimeoutSource  configSource
 	writeTimeoutSource configSource
+	listenSource       configSource
+	httpAddrSource     configSource
+	adminAddrSource    configSource
+	transportSource    configSource
 
 	dotenvPath   string
 	dotenvLoaded bool
 
 	configPath   string
 	configLoaded bool
+
+	// exportCommandsPath, when set, makes the server write the command table
+	// (JSON or YAML, by extension) after setup and exit instead of serving.
+	exportCommandsPath string
 }
 
 func loadConfig() (serverConfig, error) {
@@ -149,6 +244,12 @@ func loadConfig() (serverConfig, error) {
 	addr := fs.String("addr", addrDefault, "listen address")
 	idleTimeout := fs.Duration("idle-timeout", idleTimeoutDefault, "connection idle timeout (0 to disable)")
 	writeTimeout := fs.Duration("write-timeout", writeTimeoutDefault, "response write timeout (0 to disable)")
+	listen := fs.String("listen", strings.Join(listenDefault(fileVals, envVals), ","), "comma-separated extra listener URLs, e.g. unix:///tmp/novagate.sock,ws://:9080/ws")
+	httpAddr := fs.String("http-addr", stringDefault(fileVals.httpAddr, envVals.httpAddr), "HTTP/JSON bridge listen address (empty to disable)")
+	adminAddr := fs.String("admin-addr", stringDefault(fileVals.adminAddr, envVals.adminAddr), "admin API listen address (empty to disable); keep it private")
+	transport := fs.String("transport", stringDefault(fileVals.transport, envVals.transport), "connection model: net (goroutine per connection) or netpoll (event loop)")
+	capturePath := fs.String("capture", fileVals.capturePath, "record decoded frames to this JSON Lines file (empty to disable)")
+	exportCommands := fs.String("export-commands", "", "write the command table to this .json/.yaml file and exit")
 	_ = fs.Parse(os.Args[1:])
 
 	flagSetFlags := visitedFlags(fs)
@@ -162,7 +263,26 @@ func loadConfig() (serverConfig, error) {
 		addr:         *addr,
 		idleTimeout:  *idleTimeout,
 		writeTimeout: *writeTimeout,
-		addrSource:   pickSource(isFlagSet("addr", flagSetFlags), envVals.addrOK, fileVals.addrOK),
+		listen:       splitList(*listen),
+		httpAddr:     *httpAddr,
+		adminAddr:    *adminAddr,
+		transport:    *transport,
+
+		capturePath:     *capturePath,
+		captureMaxBytes: fileVals.captureMaxBytes,
+		captureMaxFiles: fileVals.captureMaxFiles,
+		writeBatchBytes: fileVals.writeBatchBytes,
+		writeBatchDelay: fileVals.writeBatchDelay,
+		liveness:        fileVals.liveness,
+		admission:       fileVals.admission,
+		proxyProtocol:   fileVals.proxyProtocol,
+		limiter:         fileVals.limiter,
+		resilience:      fileVals.resilience,
+		commands:        fileVals.commands,
+		discovery:       fileVals.discovery,
+		faults:          fileVals.faults,
+		dedup:           fileVals.dedup,
+		addrSource:      pickSource(isFlagSet("addr", flagSetFlags), envVals.addrOK, fileVals.addrOK),
 		idleTimeoutSource: pickSource(
 			isFlagSet("idle-timeout", flagSetFlags),
 			envVals.idleTimeoutOK,
@@ -173,18 +293,54 @@ func loadConfig() (serverConfig, error) {
 			envVals.writeTimeoutOK,
 			fileVals.writeTimeoutOK,
 		),
+		listenSource: pickSource(isFlagSet("listen", flagSetFlags), envVals.listenOK, fileVals.listenOK),
+		httpAddrSource: pickSource(
+			isFlagSet("http-addr", flagSetFlags),
+			envVals.httpAddr != "",
+			fileVals.httpAddr != "",
+		),
+		adminAddrSource: pickSource(
+			isFlagSet("admin-addr", flagSetFlags),
+			envVals.adminAddr != "",
+			fileVals.adminAddr != "",
+		),
+		transportSource: pickSource(
+			isFlagSet("transport", flagSetFlags),
+			envVals.transport != "",
+			fileVals.transport != "",
+		),
 		dotenvPath:   dotenvPath,
 		dotenvLoaded: dotenvLoaded,
 		configPath:   finalConfigPath,
 		configLoaded: resolved.loaded,
+
+		exportCommandsPath: *exportCommands,
 	}, nil
 }
 
 func (c serverConfig) serveOptions() []novagate.ServeOption {
-	return []novagate.ServeOption{
+	opts := []novagate.ServeOption{
 		novagate.WithIdleTimeout(c.idleTimeout),
 		novagate.WithWriteTimeout(c.writeTimeout),
+		novagate.WithListenURLs(c.listen...),
+		novagate.WithHTTPBridge(c.httpAddr),
+		novagate.WithAdminAPI(c.adminAddr),
+		novagate.WithTransport(c.transport),
+		novagate.WithCapture(c.capturePath, c.captureMaxBytes, c.captureMaxFiles),
+	}
+	if c.writeBatchBytes != 0 || c.writeBatchDelay != 0 {
+		opts = append(opts, novagate.WithWriteCoalescing(c.writeBatchBytes, c.writeBatchDelay))
+	}
+	if c.liveness.heartbeatInterval > 0 {
+		opts = append(opts, novagate.WithHeartbeat(c.liveness.heartbeatInterval, c.liveness.heartbeatTimeout))
+	}
+	if c.proxyProtocol != nil {
+		opts = append(opts, novagate.WithProxyProtocol(*c.proxyProtocol))
 	}
+	if c.liveness.keepAlive != nil {
+		opts = append(opts, novagate.WithTCPKeepAlive(*c.liveness.keepAlive))
+	}
+	return opts
 }
 
 func isFlagSet(name string, set map[string]bool) bool {
@@ -239,9 +395,31 @@ type fileValues struct {
 	addr           string
 	idleTimeout    time.Duration
 	writeTimeout   time.Duration
+	listen         []string
+	httpAddr       string
+	adminAddr      string
+	transport      string
 	addrOK         bool
 	idleTimeoutOK  bool
 	writeTimeoutOK bool
+	listenOK       bool
+
+	capturePath     string
+	captureMaxBytes int64
+	captureMaxFiles int
+
+	writeBatchBytes int
+	writeBatchDelay time.Duration
+
+	liveness      livenessValues
+	admission     *novagate.AdmissionConfig
+	proxyProtocol *novagate.ProxyProtocolConfig
+	limiter       *limiterValues
+	resilience    []resilienceValues
+	commands      []novagate.CommandSpec
+	discovery     *discoveryValues
+	faults        novagate.FaultState
+	dedup         *dedupValues
 }
 
 func readFileValues(yc *yamlConfig) (fileValues, error) {
@@ -257,23 +435,615 @@ func readFileValues(yc *yamlConfig) (fileValues, error) {
 	if err != nil {
 		return fileValues{}, err
 	}
+	var listen []string
+	listenOK := false
+	if yc != nil {
+		listen, listenOK, err = yc.getStringList("server.listen")
+		if err != nil {
+			return fileValues{}, err
+		}
+	}
+	httpAddr, _, err := yamlStringCompat(yc, "http.addr", "")
+	if err != nil {
+		return fileValues{}, err
+	}
+	adminAddr, _, err := yamlStringCompat(yc, "admin.addr", "")
+	if err != nil {
+		return fileValues{}, err
+	}
+	transport, _, err := yamlStringCompat(yc, "server.transport", "")
+	if err != nil {
+		return fileValues{}, err
+	}
+	capturePath, captureMaxBytes, captureMaxFiles, err := readCaptureValues(yc)
+	if err != nil {
+		return fileValues{}, err
+	}
+	var writeBatchBytes int
+	var writeBatchDelay time.Duration
+	if yc != nil {
+		if writeBatchBytes, _, err = yc.getInt("write.batch_bytes"); err != nil {
+			return fileValues{}, err
+		}
+		if writeBatchDelay, _, err = yc.getDuration("write.batch_delay"); err != nil {
+			return fileValues{}, err
+		}
+	}
+	liveness, err := readLivenessValues(yc)
+	if err != nil {
+		return fileValues{}, err
+	}
+	admission, err := readAdmissionValues(yc)
+	if err != nil {
+		return fileValues{}, err
+	}
+	proxyProtocol, err := readProxyProtocolValues(yc)
+	if err != nil {
+		return fileValues{}, err
+	}
+	limiter, err := readLimiterValues(yc)
+	if err != nil {
+		return fileValues{}, err
+	}
+	resilience, err := readResilienceValues(yc)
+	if err != nil {
+		return fileValues{}, err
+	}
+	commands, err := readCommandValues(yc)
+	if err != nil {
+		return fileValues{}, err
+	}
+	disc, err := readDiscoveryValues(yc)
+	if err != nil {
+		return fileValues{}, err
+	}
+	faults, err := readFaultValues(yc)
+	if err != nil {
+		return fileValues{}, err
+	}
+	dedupVals, err := readDedupValues(yc)
+	if err != nil {
+		return fileValues{}, err
+	}
 	return fileValues{
-		addr:           addr,
-		idleTimeout:    idleTimeout,
-		writeTimeout:   writeTimeout,
+		addr:         addr,
+		idleTimeout:  idleTimeout,
+		writeTimeout: writeTimeout,
+		listen:       listen,
+		httpAddr:     httpAddr,
+		adminAddr:    adminAddr,
+		transport:    transport,
+
+		capturePath:     capturePath,
+		captureMaxBytes: captureMaxBytes,
+		captureMaxFiles: captureMaxFiles,
+
+		writeBatchBytes: writeBatchBytes,
+		writeBatchDelay: writeBatchDelay,
+
+		liveness:      liveness,
+		admission:     admission,
+		proxyProtocol: proxyProtocol,
+		limiter:       limiter,
+		resilience:    resilience,
+		commands:      commands,
+		discovery:     disc,
+		faults:        faults,
+		dedup:         dedupVals,
+
 		addrOK:         addrOK,
 		idleTimeoutOK:  idleOK,
 		writeTimeoutOK: writeOK,
+		listenOK:       listenOK,
 	}, nil
 }
 
+// readCaptureValues reads the capture section; sizes default to 100MB x 5 files.
+func readCaptureValues(yc *yamlConfig) (string, int64, int, error) {
+	maxMB, maxFiles := 100, 5
+	path, _, err := yamlStringCompat(yc, "capture.path", "")
+	if err != nil || yc == nil {
+		return path, int64(maxMB) << 20, maxFiles, err
+	}
+	if v, ok, err := yc.getInt("capture.max_size_mb"); err != nil {
+		return "", 0, 0, err
+	} else if ok {
+		maxMB = v
+	}
+	if v, ok, err := yc.getInt("capture.max_files"); err != nil {
+		return "", 0, 0, err
+	} else if ok {
+		maxFiles = v
+	}
+	return path, int64(maxMB) << 20, maxFiles, nil
+}
+
+type livenessValues struct {
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	keepAlive         *net.KeepAliveConfig
+}
+
+// readLivenessValues reads the heartbeat and tcp_keepalive sections. The
+// keepalive section is only applied when present.
+func readLivenessValues(yc *yamlConfig) (livenessValues, error) {
+	var v livenessValues
+	if yc == nil {
+		return v, nil
+	}
+	var err error
+	if v.heartbeatInterval, _, err = yc.getDuration("heartbeat.interval"); err != nil {
+		return v, err
+	}
+	if v.heartbeatTimeout, _, err = yc.getDuration("heartbeat.timeout"); err != nil {
+		return v, err
+	}
+
+	idle, idleOK, err := yc.getDuration("tcp_keepalive.idle")
+	if err != nil {
+		return v, err
+	}
+	interval, intervalOK, err := yc.getDuration("tcp_keepalive.interval")
+	if err != nil {
+		return v, err
+	}
+	count, countOK, err := yc.getInt("tcp_keepalive.count")
+	if err != nil {
+		return v, err
+	}
+	if idleOK || intervalOK || countOK {
+		v.keepAlive = &net.KeepAliveConfig{Enable: true, Idle: idle, Interval: interval, Count: count}
+	}
+	return v, nil
+}
+
+// readAdmissionValues reads the admission section, or returns nil if absent.
+func readAdmissionValues(yc *yamlConfig) (*novagate.AdmissionConfig, error) {
+	if yc == nil {
+		return nil, nil
+	}
+	if _, ok := yc.get("admission"); !ok {
+		return nil, nil
+	}
+	cfg := &novagate.AdmissionConfig{}
+	var err error
+	if cfg.MaxConns, _, err = yc.getInt("admission.max_conns"); err != nil {
+		return nil, err
+	}
+	if cfg.MaxConnsPerIP, _, err = yc.getInt("admission.max_conns_per_ip"); err != nil {
+		return nil, err
+	}
+	if cfg.Allow, _, err = yc.getStringList("admission.allow"); err != nil {
+		return nil, err
+	}
+	if cfg.Deny, _, err = yc.getStringList("admission.deny"); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readProxyProtocolValues reads the proxy_protocol section, or returns nil
+// unless proxy_protocol.enabled is true.
+func readProxyProtocolValues(yc *yamlConfig) (*novagate.ProxyProtocolConfig, error) {
+	if yc == nil {
+		return nil, nil
+	}
+	v, ok := yc.get("proxy_protocol.enabled")
+	if !ok {
+		return nil, nil
+	}
+	enabled, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("yaml proxy_protocol.enabled must be a boolean")
+	}
+	if !enabled {
+		return nil, nil
+	}
+	cfg := &novagate.ProxyProtocolConfig{}
+	var err error
+	if cfg.Trusted, _, err = yc.getStringList("proxy_protocol.trusted"); err != nil {
+		return nil, err
+	}
+	if v, ok := yc.get("proxy_protocol.required"); ok {
+		if cfg.Required, ok = v.(bool); !ok {
+			return nil, fmt.Errorf("yaml proxy_protocol.required must be a boolean")
+		}
+	}
+	if v, ok := yc.get("proxy_protocol.trust_all"); ok {
+		if cfg.TrustAll, ok = v.(bool); !ok {
+			return nil, fmt.Errorf("yaml proxy_protocol.trust_all must be a boolean")
+		}
+	}
+	if len(cfg.Trusted) == 0 && !cfg.TrustAll {
+		return nil, fmt.Errorf("yaml proxy_protocol.trusted is empty; list the load balancer CIDRs or set trust_all: true")
+	}
+	if cfg.HeaderTimeout, _, err = yc.getDuration("proxy_protocol.header_timeout"); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// limiterValues is the limiter section. Priority classes name commands as
+// "Service.Method"; they are resolved once setup has registered the command
+// table (see limiterValues.config).
+type limiterValues struct {
+	novagate.LimiterConfig
+	critical []string
+	low      []string
+}
+
+// readLimiterValues reads the limiter section, or returns nil unless
+// limiter.enabled is true.
+func readLimiterValues(yc *yamlConfig) (*limiterValues, error) {
+	if yc == nil {
+		return nil, nil
+	}
+	v, ok := yc.get("limiter.enabled")
+	if !ok {
+		return nil, nil
+	}
+	enabled, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("yaml limiter.enabled must be a boolean")
+	}
+	if !enabled {
+		return nil, nil
+	}
+	lv := &limiterValues{}
+	var err error
+	if lv.InitialLimit, _, err = yc.getInt("limiter.initial_limit"); err != nil {
+		return nil, err
+	}
+	if lv.MinLimit, _, err = yc.getInt("limiter.min_limit"); err != nil {
+		return nil, err
+	}
+	if lv.MaxLimit, _, err = yc.getInt("limiter.max_limit"); err != nil {
+		return nil, err
+	}
+	if lv.Tolerance, _, err = yc.getFloat("limiter.tolerance"); err != nil {
+		return nil, err
+	}
+	if lv.critical, _, err = yc.getStringList("limiter.critical"); err != nil {
+		return nil, err
+	}
+	if lv.low, _, err = yc.getStringList("limiter.low"); err != nil {
+		return nil, err
+	}
+	return lv, nil
+}
+
+// config resolves the priority classes to command IDs.
+func (lv *limiterValues) config() (novagate.LimiterConfig, error) {
+	cfg := lv.LimiterConfig
+	cfg.Priorities = make(map[uint16]novagate.Priority)
+	for _, class := range []struct {
+		p       novagate.Priority
+		methods []string
+	}{{novagate.PriorityCritical, lv.critical}, {novagate.PriorityLow, lv.low}} {
+		for _, method := range class.methods {
+			cmd, err := protocol.MapMethodToCommand(method)
+			if err != nil {
+				return cfg, fmt.Errorf("limiter %s command %q: %w", class.p, method, err)
+			}
+			cfg.Priorities[cmd] = class.p
+		}
+	}
+	return cfg, nil
+}
+
+// resilienceValues is one entry of the resilience list: the policy for the
+// command named "Service.Method".
+type resilienceValues struct {
+	method string
+	policy novagate.ResiliencePolicy
+}
+
+// readResilienceValues reads the resilience list. Entries are a list rather
+// than a map keyed by method because method names contain dots.
+func readResilienceValues(yc *yamlConfig) ([]resilienceValues, error) {
+	v, ok := yc.get("resilience")
+	if !ok {
+		return nil, nil
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("yaml resilience must be a list")
+	}
+	out := make([]resilienceValues, 0, len(items))
+	for i, item := range items {
+		data, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("yaml resilience[%d] must be a mapping", i)
+		}
+		rv, err := readResiliencePolicy(&yamlConfig{data: toAnyKeys(data)})
+		if err != nil {
+			return nil, fmt.Errorf("resilience[%d]: %w", i, err)
+		}
+		out = append(out, rv)
+	}
+	return out, nil
+}
+
+func readResiliencePolicy(yc *yamlConfig) (resilienceValues, error) {
+	var rv resilienceValues
+	var err error
+	var ok bool
+	if rv.method, ok, err = yc.getString("method"); err != nil {
+		return rv, err
+	} else if !ok {
+		return rv, errors.New("yaml method is required")
+	}
+	if v, ok := yc.get("idempotent"); ok {
+		if rv.policy.Idempotent, ok = v.(bool); !ok {
+			return rv, fmt.Errorf("yaml idempotent must be a boolean")
+		}
+	}
+	if _, ok := yc.get("breaker"); ok {
+		b := &novagate.BreakerConfig{}
+		if b.FailureThreshold, _, err = yc.getInt("breaker.failure_threshold"); err != nil {
+			return rv, err
+		}
+		if b.OpenTimeout, _, err = yc.getDuration("breaker.open_timeout"); err != nil {
+			return rv, err
+		}
+		if b.HalfOpenProbes, _, err = yc.getInt("breaker.half_open_probes"); err != nil {
+			return rv, err
+		}
+		rv.policy.Breaker = b
+	}
+	if _, ok := yc.get("retry"); ok {
+		r := &novagate.RetryConfig{}
+		if r.MaxAttempts, _, err = yc.getInt("retry.max_attempts"); err != nil {
+			return rv, err
+		}
+		if r.Backoff, _, err = yc.getDuration("retry.backoff"); err != nil {
+			return rv, err
+		}
+		if r.MaxBackoff, _, err = yc.getDuration("retry.max_backoff"); err != nil {
+			return rv, err
+		}
+		rv.policy.Retry = r
+	}
+	if _, ok := yc.get("hedge"); ok {
+		h := &novagate.HedgeConfig{}
+		if h.Delay, _, err = yc.getDuration("hedge.delay"); err != nil {
+			return rv, err
+		}
+		if h.MaxHedges, _, err = yc.getInt("hedge.max_hedges"); err != nil {
+			return rv, err
+		}
+		rv.policy.Hedge = h
+	}
+	return rv, nil
+}
+
+func toAnyKeys(m map[string]interface{}) map[interface{}]interface{} {
+	out := make(map[interface{}]interface{}, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// resiliencePolicies resolves the resilience list to command IDs; call it
+// once setup has registered the command table.
+func (c serverConfig) resiliencePolicies() (map[uint16]novagate.ResiliencePolicy, error) {
+	out := make(map[uint16]novagate.ResiliencePolicy, len(c.resilience))
+	for _, rv := range c.resilience {
+		cmd, err := protocol.MapMethodToCommand(rv.method)
+		if err != nil {
+			return nil, fmt.Errorf("resilience command %q: %w", rv.method, err)
+		}
+		out[cmd] = rv.policy
+	}
+	return out, nil
+}
+
+// readCommandValues reads the commands list (see novagate.CommandSpec).
+func readCommandValues(yc *yamlConfig) ([]novagate.CommandSpec, error) {
+	v, ok := yc.get("commands")
+	if !ok {
+		return nil, nil
+	}
+	var specs []novagate.CommandSpec
+	if err := decodeYAMLValue(v, &specs); err != nil {
+		return nil, fmt.Errorf("yaml commands: %w", err)
+	}
+	if err := novagate.ValidateCommandSpecs(specs); err != nil {
+		return nil, err
+	}
+	return specs, nil
+}
+
+// readFaultValues reads the faults section. Rules are validated here so a
+// typo fails at startup rather than when the injector is switched on.
+func readFaultValues(yc *yamlConfig) (novagate.FaultState, error) {
+	var st novagate.FaultState
+	v, ok := yc.get("faults")
+	if !ok {
+		return st, nil
+	}
+	if err := decodeYAMLValue(v, &st); err != nil {
+		return st, fmt.Errorf("yaml faults: %w", err)
+	}
+	for i, r := range st.Rules {
+		if err := r.Validate(); err != nil {
+			return st, fmt.Errorf("yaml faults.rules[%d]: %w", i, err)
+		}
+	}
+	return st, nil
+}
+
+// dedupValues is the dedup section: where idempotent commands remember
+// their responses.
+type dedupValues struct {
+	store    string // "memory" or "redis"
+	capacity int
+	redis    redis.Options
+	prefix   string
+}
+
+// readDedupValues reads the dedup section, or returns nil if absent.
+func readDedupValues(yc *yamlConfig) (*dedupValues, error) {
+	if _, ok := yc.get("dedup"); !ok {
+		return nil, nil
+	}
+	dv := &dedupValues{}
+	var err error
+	if dv.store, _, err = yc.getString("dedup.store"); err != nil {
+		return nil, err
+	}
+	if dv.capacity, _, err = yc.getInt("dedup.capacity"); err != nil {
+		return nil, err
+	}
+	if dv.redis.Addr, _, err = yc.getString("dedup.redis.addr"); err != nil {
+		return nil, err
+	}
+	if dv.redis.Password, _, err = yc.getString("dedup.redis.password"); err != nil {
+		return nil, err
+	}
+	if dv.redis.DB, _, err = yc.getInt("dedup.redis.db"); err != nil {
+		return nil, err
+	}
+	if dv.prefix, _, err = yc.getString("dedup.redis.prefix"); err != nil {
+		return nil, err
+	}
+	switch dv.store {
+	case "", "memory":
+		dv.store = "memory"
+	case "redis":
+		if dv.redis.Addr == "" {
+			return nil, errors.New("yaml dedup.store redis needs dedup.redis.addr")
+		}
+	default:
+		return nil, fmt.Errorf("yaml dedup.store %q: want memory or redis", dv.store)
+	}
+	return dv, nil
+}
+
+// newStore builds the configured store. An unreachable Redis is only
+// logged: idempotent commands then run unprotected until it comes back.
+func (dv *dedupValues) newStore() dedup.Store {
+	if dv == nil || dv.store == "memory" {
+		var capacity int
+		if dv != nil {
+			capacity = dv.capacity
+		}
+		return dedup.NewMemory(capacity)
+	}
+	opts := dv.redis
+	c := redis.NewClient(&opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.Ping(ctx).Err(); err != nil {
+		log.Printf("novagate dedup: redis %s: %v", opts.Addr, err)
+	}
+	return dedup.NewRedis(c, dv.prefix)
+}
+
+// decodeYAMLValue decodes a value of the generic config map into out,
+// letting yaml struct tags do the field mapping.
+func decodeYAMLValue(v interface{}, out interface{}) error {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(b, out)
+}
+
+// discoveryValues is the discovery section: exactly one endpoint source
+// (static, file or dns) and the balancing policy of upstream commands.
+type discoveryValues struct {
+	static      discovery.Static
+	file        string
+	filePoll    time.Duration
+	dnsDomain   string
+	dnsTTL      time.Duration
+	policy      discovery.Policy
+	dialTimeout time.Duration
+}
+
+// readDiscoveryValues reads the discovery section, or returns nil if absent.
+func readDiscoveryValues(yc *yamlConfig) (*discoveryValues, error) {
+	if _, ok := yc.get("discovery"); !ok {
+		return nil, nil
+	}
+	dv := &discoveryValues{}
+	sources := 0
+	if v, ok := yc.get("discovery.static"); ok {
+		if err := decodeYAMLValue(v, &dv.static); err != nil {
+			return nil, fmt.Errorf("yaml discovery.static: %w", err)
+		}
+		sources++
+	}
+	var err error
+	var ok bool
+	if dv.file, ok, err = yc.getString("discovery.file"); err != nil {
+		return nil, err
+	} else if ok {
+		sources++
+	}
+	if dv.filePoll, _, err = yc.getDuration("discovery.file_poll"); err != nil {
+		return nil, err
+	}
+	if dv.dnsDomain, ok, err = yc.getString("discovery.dns.domain"); err != nil {
+		return nil, err
+	} else if ok {
+		sources++
+	}
+	if dv.dnsTTL, _, err = yc.getDuration("discovery.dns.ttl"); err != nil {
+		return nil, err
+	}
+	if sources != 1 {
+		return nil, errors.New("yaml discovery needs exactly one of static, file or dns.domain")
+	}
+	balancer, _, err := yc.getString("discovery.balancer")
+	if err != nil {
+		return nil, err
+	}
+	switch balancer {
+	case "", "round_robin":
+		dv.policy = discovery.RoundRobin
+	case "consistent_hash":
+		dv.policy = discovery.ConsistentHash
+	default:
+		return nil, fmt.Errorf("yaml discovery.balancer %q: want round_robin or consistent_hash", balancer)
+	}
+	if dv.dialTimeout, _, err = yc.getDuration("discovery.dial_timeout"); err != nil {
+		return nil, err
+	}
+	return dv, nil
+}
+
+// resolver builds the configured resolver; a file source is watched until
+// ctx is done.
+func (dv *discoveryValues) resolver(ctx context.Context) (discovery.Resolver, error) {
+	switch {
+	case dv.static != nil:
+		return dv.static, nil
+	case dv.file != "":
+		f, err := discovery.NewFile(dv.file)
+		if err != nil {
+			return nil, err
+		}
+		go f.Watch(ctx, dv.filePoll)
+		return f, nil
+	}
+	return &discovery.DNSSRV{Domain: dv.dnsDomain, TTL: dv.dnsTTL}, nil
+}
+
 type envValues struct {
 	addr           string
 	idleTimeout    time.Duration
 	writeTimeout   time.Duration
+	listen         []string
+	httpAddr       string
+	adminAddr      string
+	transport      string
 	addrOK         bool
 	idleTimeoutOK  bool
 	writeTimeoutOK bool
+	listenOK       bool
 }
 
 func readEnvValues() (envValues, error) {
@@ -289,13 +1059,34 @@ func readEnvValues() (envValues, error) {
 	if err != nil {
 		return envValues{}, err
 	}
+	listen, listenOK, err := getenvStringStrict("NOVAGATE_LISTEN")
+	if err != nil {
+		return envValues{}, err
+	}
+	httpAddr, _, err := getenvStringStrict("NOVAGATE_HTTP_ADDR")
+	if err != nil {
+		return envValues{}, err
+	}
+	adminAddr, _, err := getenvStringStrict("NOVAGATE_ADMIN_ADDR")
+	if err != nil {
+		return envValues{}, err
+	}
+	transport, _, err := getenvStringStrict("NOVAGATE_TRANSPORT")
+	if err != nil {
+		return envValues{}, err
+	}
 	return envValues{
 		addr:           addr,
 		idleTimeout:    idleTimeout,
 		writeTimeout:   writeTimeout,
+		listen:         splitList(listen),
+		httpAddr:       httpAddr,
+		adminAddr:      adminAddr,
+		transport:      transport,
 		addrOK:         addrOK,
 		idleTimeoutOK:  idleOK,
 		writeTimeoutOK: writeOK,
+		listenOK:       listenOK,
 	}, nil
 }
 
@@ -327,6 +1118,35 @@ func computeDefaults(fileVals fileValues, envVals envValues) (string, time.Durat
 	return addrDefault, idleTimeoutDefault, writeTimeoutDefault
 }
 
+func listenDefault(fileVals fileValues, envVals envValues) []string {
+	if envVals.listenOK {
+		return envVals.listen
+	}
+	if fileVals.listenOK {
+		return fileVals.listen
+	}
+	return nil
+}
+
+// stringDefault returns the env value if set, otherwise the file value.
+func stringDefault(fileVal, envVal string) string {
+	if envVal != "" {
+		return envVal
+	}
+	return fileVal
+}
+
+// splitList splits a comma-separated value, dropping empty items.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
 func visitedFlags(fs *flag.FlagSet) map[string]bool {
 	set := map[string]bool{}
 	fs.Visit(func(f *flag.Flag) {
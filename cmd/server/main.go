@@ -1,38 +1,106 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/gogogo1024/novagate"
-	"github.com/gogogo1024/novagate/internal/dispatcher"
 	"github.com/gogogo1024/novagate/internal/service"
 	"github.com/gogogo1024/novagate/protocol"
 )
 
-func setup(r *novagate.Router) error {
+func setup(r *novagate.Router, cfg serverConfig) error {
+	// Business dispatcher handlers
+	service.RegisterHandlers()
+
+	var err error
+	if len(cfg.commands) > 0 {
+		err = routeCommands(r, cfg)
+	} else {
+		err = bridgeBuiltinCommands(r, cfg)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Invalid payloads are rejected first, before they take a limiter slot
+	// or meet an injected fault.
+	schemas, err := payloadSchemas(cfg)
+	if err != nil {
+		return err
+	}
+	if len(schemas) > 0 {
+		r.Use(novagate.ValidatePayloads(schemas))
+		log.Printf("novagate schemas: validating payloads of %d commands", len(schemas))
+	}
+
+	if cfg.limiter != nil {
+		limCfg, err := cfg.limiter.config()
+		if err != nil {
+			return err
+		}
+		r.Use(novagate.NewAdaptiveLimiter(limCfg).Middleware())
+		log.Printf("novagate limiter: critical=%v low=%v", cfg.limiter.critical, cfg.limiter.low)
+	}
+
+	// Fault injection is always installed, off unless faults.enabled is set,
+	// so it can be switched on through the admin API.
+	faults := novagate.NewFaultInjector()
+	if err := faults.Set(cfg.faults); err != nil {
+		return err
+	}
+	r.InjectFaults(faults)
+	if cfg.faults.Enabled {
+		log.Printf("novagate faults: enabled with %d rules", len(cfg.faults.Rules))
+	}
+	return nil
+}
+
+// bridgeBuiltinCommands serves the built-in command table, used when the YAML
+// declares no commands.
+func bridgeBuiltinCommands(r *novagate.Router, cfg serverConfig) error {
 	// Command table (docs/protocol.md examples)
 	protocol.RegisterFullMethodCommand("NovaService.Ping", protocol.CmdPing)
 	protocol.RegisterFullMethodCommand("UserService.Login", protocol.CmdUserLogin)
 	protocol.RegisterFullMethodCommand("OrderService.Create", protocol.CmdOrderCreate)
 	protocol.SetStrictCommandMapping(true)
 
-	// Business dispatcher handlers
-	service.RegisterHandlers()
-
-	// Protocol router handlers (bridge to dispatcher)
-	bridge := func(cmd uint16) {
-		r.Register(cmd, novagate.BridgeProtocolHandler(cmd, func(ctx context.Context, payload []byte) ([]byte, error) {
-			return dispatcher.Dispatch(ctx, cmd, payload)
-		}))
-	}
-	bridge(protocol.CmdPing)
-	bridge(protocol.CmdUserLogin)
-	bridge(protocol.CmdOrderCreate)
+	// Protocol router handlers (bridge to dispatcher), with the configured
+	// resilience policies around the backend call.
+	policies, err := cfg.resiliencePolicies()
+	if err != nil {
+		return err
+	}
+	bridge := func(cmd uint16) error {
+		fn, err := withResilience(policies, cmd, "", localBackend(cmd))
+		if err != nil {
+			return err
+		}
+		r.Register(cmd, novagate.BridgeProtocolHandler(cmd, fn))
+		return nil
+	}
+	return errors.Join(
+		bridge(protocol.CmdPing),
+		bridge(protocol.CmdUserLogin),
+		bridge(protocol.CmdOrderCreate),
+	)
+}
 
+// exportCommands runs setup against a throwaway router and writes the
+// resulting command table so clients in other languages can load it. setup
+// maps commands strictly, so the explicit entries are the whole table.
+func exportCommands(path string, cfg serverConfig) error {
+	if err := setup(novagate.NewRouter(), cfg); err != nil {
+		return err
+	}
+	table := protocol.ExportCommandTable()
+	if err := protocol.SaveCommandTable(path, table); err != nil {
+		return err
+	}
+	log.Printf("exported %d commands to %s (%s)", len(table.Commands), path, table.Checksum)
 	return nil
 }
 
@@ -47,19 +115,51 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if cfg.exportCommandsPath != "" {
+		if err := exportCommands(cfg.exportCommandsPath, cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	log.Printf(
-		"config: addr=%s(%s) idle-timeout=%s(%s) write-timeout=%s(%s) config=%s(loaded=%t) dotenv=%s(loaded=%t)",
+		"config: addr=%s(%s) idle-timeout=%s(%s) write-timeout=%s(%s) listen=%v(%s) http-addr=%q(%s) transport=%q(%s) config=%s(loaded=%t) dotenv=%s(loaded=%t)",
 		cfg.addr, cfg.addrSource,
 		cfg.idleTimeout, cfg.idleTimeoutSource,
 		cfg.writeTimeout, cfg.writeTimeoutSource,
+		cfg.listen, cfg.listenSource,
+		cfg.httpAddr, cfg.httpAddrSource,
+		cfg.transport, cfg.transportSource,
 		cfg.configPath, cfg.configLoaded,
 		cfg.dotenvPath, cfg.dotenvLoaded,
 	)
 	log.Printf("novagate listening on %s", cfg.addr)
+	for _, u := range cfg.listen {
+		log.Printf("novagate listening on %s", u)
+	}
+	if cfg.capturePath != "" {
+		log.Printf("novagate capturing traffic to %s", cfg.capturePath)
+	}
+	if cfg.httpAddr != "" {
+		log.Printf("novagate http bridge listening on %s", cfg.httpAddr)
+	}
+	if cfg.adminAddr != "" {
+		log.Printf("novagate admin api listening on %s (%s)", cfg.adminAddr, cfg.adminAddrSource)
+	}
+	opts := cfg.serveOptions()
+	if cfg.admission != nil {
+		adm, err := novagate.NewAdmission(*cfg.admission)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, novagate.WithAdmission(adm))
+		reloadAdmissionOnSIGHUP(cfg.configPath, adm)
+		log.Printf("novagate admission: max-conns=%d max-conns-per-ip=%d allow=%v deny=%v (SIGHUP reloads lists)",
+			cfg.admission.MaxConns, cfg.admission.MaxConnsPerIP, cfg.admission.Allow, cfg.admission.Deny)
+	}
 	if err := novagate.ListenAndServeWithOptions(
 		cfg.addr,
-		setup,
-		cfg.serveOptions()...,
+		func(r *novagate.Router) error { return setup(r, cfg) },
+		opts...,
 	); err != nil {
 		log.Fatal(err)
 	}
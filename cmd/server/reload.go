@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gogogo1024/novagate"
+)
+
+// reloadAdmissionOnSIGHUP re-reads the admission allow/deny lists from the
+// config file on SIGHUP. Connection caps and every other setting still need
+// a restart.
+func reloadAdmissionOnSIGHUP(configPath string, adm *novagate.Admission) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := reloadAdmission(configPath, adm); err != nil {
+				log.Printf("admission reload failed, keeping previous lists: %v", err)
+				continue
+			}
+			log.Printf("admission lists reloaded from %s", configPath)
+		}
+	}()
+}
+
+func reloadAdmission(configPath string, adm *novagate.Admission) error {
+	yc, err := readYAMLConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	cfg, err := readAdmissionValues(yc)
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		cfg = &novagate.AdmissionConfig{}
+	}
+	return adm.SetCIDRs(cfg.Allow, cfg.Deny)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gogogo1024/novagate"
+	"github.com/gogogo1024/novagate/dedup"
+	"github.com/gogogo1024/novagate/discovery"
+	"github.com/gogogo1024/novagate/internal/dispatcher"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// routeCommands serves the routing table declared under commands.
+func routeCommands(r *novagate.Router, cfg serverConfig) error {
+	for _, spec := range cfg.commands {
+		protocol.RegisterFullMethodCommand(spec.Method, spec.ID)
+	}
+	protocol.SetStrictCommandMapping(true)
+
+	policies, err := cfg.resiliencePolicies()
+	if err != nil {
+		return err
+	}
+	ups := upstreams{cfg: cfg.discovery, byService: make(map[string]*novagate.Upstream)}
+	// One store serves every idempotent command; keys carry the command.
+	var store dedup.Store
+	for _, spec := range cfg.commands {
+		var targets []novagate.SplitTarget
+		var desc []string
+		for _, t := range spec.Targets() {
+			fn, where, err := ups.backend(spec, t)
+			if err != nil {
+				return err
+			}
+			if spec.Split != nil {
+				where = fmt.Sprintf("%s(%s)=%d", t.Name, where, t.Weight)
+			}
+			desc = append(desc, where)
+			// Every target gets its own breaker, so a failing canary does
+			// not cut off the stable backend.
+			target := ""
+			if spec.Split != nil {
+				target = t.Name
+			}
+			fn, err = withResilience(policies, spec.ID, target, fn)
+			if err != nil {
+				return err
+			}
+			targets = append(targets, novagate.SplitTarget{
+				Name:    t.Name,
+				Weight:  t.Weight,
+				Handler: novagate.BridgeProtocolHandler(spec.ID, fn),
+			})
+		}
+
+		rc := spec.RouteConfig()
+		// Replayed responses skip the mirror: they were compared already.
+		if spec.Idempotency != nil {
+			if store == nil {
+				store = cfg.dedup.newStore()
+			}
+			icfg := spec.Idempotency.IdempotencyConfig()
+			icfg.Store = store
+			idem, err := novagate.NewIdempotency(spec.ID, icfg)
+			if err != nil {
+				return err
+			}
+			rc.Middlewares = append(rc.Middlewares, idem.Middleware())
+			desc = append(desc, "idempotent")
+		}
+		if spec.Mirror != nil {
+			t := spec.Mirror.Target(spec)
+			fn, where, err := ups.backend(spec, t)
+			if err != nil {
+				return err
+			}
+			mcfg := spec.Mirror.MirrorConfig()
+			mcfg.Shadow = novagate.BridgeProtocolHandler(spec.ID, fn)
+			mr, err := novagate.NewMirror(spec.ID, mcfg)
+			if err != nil {
+				return err
+			}
+			rc.Middlewares = append(rc.Middlewares, mr.Middleware())
+			desc = append(desc, fmt.Sprintf("mirror(%s)=%g", where, mcfg.Sample))
+		}
+		if spec.Cache != nil {
+			rc.Cache, err = novagate.NewResponseCache(spec.ID, spec.Cache.CacheConfig(spec.DefaultContentType()))
+			if err != nil {
+				return err
+			}
+			desc = append(desc, "cached")
+		}
+
+		if spec.Split == nil {
+			err = r.Route(spec.ID, targets[0].Handler, rc)
+		} else {
+			var s *novagate.Splitter
+			s, err = novagate.NewSplitter(spec.ID, spec.Split.SplitConfig(targets, nil))
+			if err == nil {
+				err = r.Split(s, rc)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("novagate route: 0x%04X %s -> %s", spec.ID, spec.Method, strings.Join(desc, " "))
+	}
+	return nil
+}
+
+// payloadSchemas loads the payload schemas declared under commands.
+func payloadSchemas(cfg serverConfig) (map[uint16]novagate.CommandSchema, error) {
+	schemas := make(map[uint16]novagate.CommandSchema)
+	for _, spec := range cfg.commands {
+		if spec.Schema == nil {
+			continue
+		}
+		s, err := spec.CommandSchema()
+		if err != nil {
+			return nil, err
+		}
+		schemas[spec.ID] = s
+	}
+	return schemas, nil
+}
+
+// backend returns the backend call of target t of spec, and where it goes.
+func (u *upstreams) backend(spec novagate.CommandSpec, t novagate.SplitTargetSpec) (novagate.BackendFunc, string, error) {
+	if t.Backend == novagate.BackendUpstream {
+		up, err := u.get(t.Service)
+		if err != nil {
+			return nil, "", fmt.Errorf("command %s: %w", spec.Method, err)
+		}
+		return up.Backend(spec.ID), "upstream " + t.Service, nil
+	}
+	if !dispatcher.Has(spec.ID) {
+		return nil, "", fmt.Errorf("command %s: no local handler for 0x%04X", spec.Method, spec.ID)
+	}
+	return localBackend(spec.ID), novagate.BackendLocal, nil
+}
+
+// localBackend forwards to the in-process dispatcher handler of cmd.
+func localBackend(cmd uint16) novagate.BackendFunc {
+	return func(ctx context.Context, payload []byte) ([]byte, error) {
+		return dispatcher.Dispatch(ctx, cmd, payload)
+	}
+}
+
+// withResilience wraps fn in the resilience policy configured for cmd, if
+// any; target names the split target fn serves ("" if cmd is not split).
+func withResilience(policies map[uint16]novagate.ResiliencePolicy, cmd uint16, target string, fn novagate.BackendFunc) (novagate.BackendFunc, error) {
+	p, ok := policies[cmd]
+	if !ok {
+		return fn, nil
+	}
+	res, err := novagate.NewTargetResilience(cmd, target, p)
+	if err != nil {
+		return nil, err
+	}
+	return res.Wrap(fn), nil
+}
+
+// upstreams shares one Upstream, and so one balancer and connection set,
+// between the commands of a service.
+type upstreams struct {
+	cfg       *discoveryValues
+	resolver  discovery.Resolver
+	byService map[string]*novagate.Upstream
+}
+
+func (u *upstreams) get(service string) (*novagate.Upstream, error) {
+	if up, ok := u.byService[service]; ok {
+		return up, nil
+	}
+	if u.cfg == nil {
+		return nil, fmt.Errorf("upstream backend %q needs a discovery section", service)
+	}
+	if u.resolver == nil {
+		// Routes live as long as the process, and so does the file watch.
+		res, err := u.cfg.resolver(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		u.resolver = res
+	}
+	b := discovery.NewBalancer(u.resolver, service, discovery.BalancerConfig{Policy: u.cfg.policy})
+	up := novagate.NewUpstream(b, u.cfg.dialTimeout)
+	u.byService[service] = up
+	return up, nil
+}
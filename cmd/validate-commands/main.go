@@ -7,6 +7,10 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
+
+	"github.com/gogogo1024/novagate"
+	"gopkg.in/yaml.v3"
 )
 
 type loc struct {
@@ -37,6 +41,7 @@ func run() int {
 		serverPath    = flag.String("server", "cmd/server/main.go", "path to server main.go containing setup()")
 		registryPath  = flag.String("registry", "internal/service/registry.go", "path to service handler registry")
 		strictAllDefs = flag.Bool("require-all", false, "if true, require every Cmd* defined in commands.go to be bridged+handled")
+		configPath    = flag.String("config", "", "path to novagate.yaml; if set, also validate its commands routing table")
 	)
 	flag.Parse()
 
@@ -44,14 +49,21 @@ func run() int {
 
 	issues := append([]issue{}, scanIssues...)
 	issues = append(issues, validateConsistency(scan, *strictAllDefs)...)
+	declared := 0
+	if *configPath != "" {
+		var configIssues []issue
+		declared, configIssues = validateConfig(*configPath, scan)
+		issues = append(issues, configIssues...)
+	}
 
 	if len(issues) == 0 {
 		fmt.Printf(
-			"ok: command mappings look consistent (defs=%d mapped=%d bridged=%d handled=%d)\n",
+			"ok: command mappings look consistent (defs=%d mapped=%d bridged=%d handled=%d declared=%d)\n",
 			len(scan.cmdVals),
 			len(scan.server.registered),
 			len(scan.server.bridged),
 			len(scan.handled),
+			declared,
 		)
 		return 0
 	}
@@ -178,6 +190,57 @@ func validateAllDefinedAreWired(scan scanResult) []issue {
 	return issues
 }
 
+// validateConfig checks the commands routing table of a novagate.yaml: the
+// table itself (see novagate.ValidateCommandSpecs), and that every command
+// served locally, by itself or as a split or mirror target, has a dispatcher
+// handler. It returns the number of declared commands.
+func validateConfig(path string, scan scanResult) (int, []issue) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, []issue{{msg: fmt.Sprintf("read %s: %v", path, err)}}
+	}
+	var doc struct {
+		Commands []novagate.CommandSpec `yaml:"commands"`
+	}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return 0, []issue{{msg: fmt.Sprintf("%s: parse commands: %v", path, err)}}
+	}
+
+	var issues []issue
+	if err := novagate.ValidateCommandSpecs(doc.Commands); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			issues = append(issues, issue{msg: fmt.Sprintf("%s: %s", path, line)})
+		}
+	}
+	handled := map[uint16]bool{}
+	for name := range scan.handled {
+		if v, ok := scan.cmdVals[name]; ok {
+			handled[v] = true
+		}
+	}
+	for i, spec := range doc.Commands {
+		if spec.Schema != nil {
+			if _, err := spec.CommandSchema(); err != nil {
+				issues = append(issues, issue{msg: fmt.Sprintf("%s: commands[%d] (%s): %v", path, i, spec.Method, err)})
+			}
+		}
+		if spec.ID == 0 || handled[spec.ID] {
+			continue
+		}
+		targets := spec.Targets()
+		if spec.Mirror != nil {
+			targets = append(targets, spec.Mirror.Target(spec))
+		}
+		for _, t := range targets {
+			if t.Backend == novagate.BackendLocal {
+				issues = append(issues, issue{msg: fmt.Sprintf("%s: commands[%d] (%s): local backend but no dispatcher handler for 0x%04X", path, i, spec.Method, spec.ID)})
+				break
+			}
+		}
+	}
+	return len(doc.Commands), issues
+}
+
 func parseFixed(commandsPath, serverPath, registryPath string) (scanResult, []issue) {
 	pat := defaultPatterns()
 	out := scanResult{
@@ -71,3 +71,43 @@ func joinIssues(issues []issue) string {
 	}
 	return b.String()
 }
+
+func TestValidateConfig_ChecksCommandsTable(t *testing.T) {
+	tmp := t.TempDir()
+	configPath := filepath.Join(tmp, "novagate.yaml")
+	mustWrite(t, configPath, `commands:
+  - id: 0x0001
+    method: "NovaService.Ping"
+    timeout: "1s"
+  - id: 0x0201
+    method: "OrderService.Create"
+    backend: "upstream"
+  - id: 0x0301
+    method: "PayService.Refund"
+  - id: 0x0301
+    method: "PayService.Refund"
+    compression: "zstd"
+`)
+	scan := scanResult{
+		cmdVals: map[string]uint16{"CmdPing": 0x0001},
+		handled: map[string]loc{"CmdPing": {}},
+	}
+
+	declared, issues := validateConfig(configPath, scan)
+	if declared != 4 {
+		t.Fatalf("declared = %d, want 4", declared)
+	}
+	joined := joinIssues(issues)
+	for _, want := range []string{
+		"id 0x0301 already used by commands[2]",
+		`unknown compression policy "zstd"`,
+		"commands[2] (PayService.Refund): local backend but no dispatcher handler for 0x0301",
+	} {
+		if !strings.Contains(joined, want) {
+			t.Fatalf("expected %q, got:\n%s", want, joined)
+		}
+	}
+	if strings.Contains(joined, "OrderService.Create") {
+		t.Fatalf("upstream command needs no local handler, got:\n%s", joined)
+	}
+}
@@ -0,0 +1,81 @@
+// Package codec encodes message payloads. The protocol leaves payload
+// encoding to the application; this package names the encodings a gateway
+// and its clients agree on, and tells them apart by the content type a
+// request carries in Message.Metadata (see MetadataKey).
+//
+// JSON, Protobuf and MsgPack are registered by default; Register adds more.
+package codec
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// MetadataKey is the Message.Metadata key naming the codec of the payload.
+// Version 1 frames cannot carry metadata: their payloads use the command's
+// default content type.
+const MetadataKey = "content-type"
+
+// Names of the built-in codecs.
+const (
+	JSONName     = "json"
+	ProtobufName = "protobuf"
+	MsgPackName  = "msgpack"
+)
+
+// Codec marshals payloads of one content type. Implementations must be safe
+// for concurrent use.
+type Codec interface {
+	// Name is the content type carried under MetadataKey.
+	Name() string
+	Marshal(v any) ([]byte, error)
+	// Unmarshal decodes data into v, a non-nil pointer.
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	mu     sync.RWMutex
+	codecs = map[string]Codec{}
+)
+
+func init() {
+	Register(JSON{})
+	Register(Protobuf{})
+	Register(MsgPack{})
+}
+
+// Register makes c available under its name. It panics if the name is empty
+// or already registered.
+func Register(c Codec) {
+	name := c.Name()
+	if name == "" {
+		panic("codec.Register: empty name")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := codecs[name]; dup {
+		panic(fmt.Sprintf("codec.Register: %q already registered", name))
+	}
+	codecs[name] = c
+}
+
+// Lookup returns the codec registered under name.
+func Lookup(name string) (Codec, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// Names returns the registered content types, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,226 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestRegistry(t *testing.T) {
+	if got := Names(); !reflect.DeepEqual(got, []string{"json", "msgpack", "protobuf"}) {
+		t.Fatalf("Names = %v", got)
+	}
+	if c, ok := Lookup(MsgPackName); !ok || c.Name() != MsgPackName {
+		t.Fatalf("Lookup(msgpack) = %v, %v", c, ok)
+	}
+	if _, ok := Lookup("xml"); ok {
+		t.Fatal("Lookup found an unregistered codec")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a duplicate name did not panic")
+		}
+	}()
+	Register(JSON{})
+}
+
+func TestMsgPackEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		v    any
+		want string
+	}{
+		{nil, "c0"},
+		{true, "c3"},
+		{0, "00"},
+		{127, "7f"},
+		{128, "cc80"},
+		{-1, "ff"},
+		{-33, "d0df"},
+		{int64(math.MinInt64), "d38000000000000000"},
+		{uint64(math.MaxUint64), "cfffffffffffffffff"},
+		{1.5, "cb3ff8000000000000"},
+		{float32(1.5), "ca3fc00000"},
+		{"hi", "a26869"},
+		{strings.Repeat("a", 32), "d920" + strings.Repeat("61", 32)},
+		{[]byte{1, 2}, "c4020102"},
+		{[]int{1, 2, 3}, "93010203"},
+		{map[string]any{"b": 2, "a": 1}, "82a16101a16202"},
+		{struct {
+			Name  string `msgpack:"name"`
+			Age   int    `msgpack:",omitempty"`
+			Skip  bool   `msgpack:"-"`
+			inner int
+		}{Name: "x"}, "81a46e616d65a178"},
+	} {
+		got, err := MsgPack{}.Marshal(tc.v)
+		if err != nil {
+			t.Fatalf("Marshal(%#v): %v", tc.v, err)
+		}
+		if hex.EncodeToString(got) != tc.want {
+			t.Errorf("Marshal(%#v) = %x, want %s", tc.v, got, tc.want)
+		}
+	}
+}
+
+type profile struct {
+	ID     uint32            `msgpack:"id"`
+	Name   string            `msgpack:"name"`
+	Score  float64           `msgpack:"score"`
+	Tags   []string          `msgpack:"tags"`
+	Avatar []byte            `msgpack:"avatar"`
+	Attrs  map[string]string `msgpack:"attrs"`
+	Parent *profile          `msgpack:"parent"`
+	Extra  any               `msgpack:"extra"`
+}
+
+func TestMsgPackRoundTrip(t *testing.T) {
+	in := profile{
+		ID: 7, Name: "alice", Score: -2.25, Tags: []string{"a", "b"}, Avatar: []byte{0, 255},
+		Attrs:  map[string]string{"k": "v"},
+		Parent: &profile{ID: 1, Name: strings.Repeat("p", 300)},
+		Extra:  map[string]any{"n": int64(-5), "list": []any{"x", true, nil, 1.5}},
+	}
+	b, err := MsgPack{}.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out profile
+	if err := (MsgPack{}).Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip:\n got %#v\nwant %#v", out, in)
+	}
+
+	// Unknown fields are skipped.
+	b, _ = MsgPack{}.Marshal(map[string]any{"name": "bob", "unknown": []any{1, map[string]any{"x": 1}}})
+	out = profile{}
+	if err := (MsgPack{}).Unmarshal(b, &out); err != nil || out.Name != "bob" {
+		t.Fatalf("unknown fields: %+v, %v", out, err)
+	}
+}
+
+func TestMsgPackMalformed(t *testing.T) {
+	var p profile
+	var n int8
+	for _, tc := range []struct {
+		data string
+		v    any
+		want string
+	}{
+		{"", &p, "unexpected end"},
+		{"81a46e616d65", &p, "unexpected end"},
+		{"81a46e616d65a178c0", &p, "trailing data"},
+		{"dd7fffffff", new([]int), "unexpected end"},
+		{"dd7fffffff", &p, "unexpected end"},
+		{"81a46e616d6505", &p, "invalid code=5"},
+		{"c1", &n, "invalid code=c1"},
+		{strings.Repeat("91", maxMsgPackDepth+1) + "c0", new(any), "max depth"},
+	} {
+		data, _ := hex.DecodeString(tc.data)
+		err := MsgPack{}.Unmarshal(data, tc.v)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Unmarshal(%s) = %v, want %q", tc.data, err, tc.want)
+		}
+	}
+	if err := (MsgPack{}).Unmarshal([]byte{0xc0}, p); err == nil {
+		t.Error("Unmarshal into a non-pointer succeeded")
+	}
+}
+
+// FuzzDecode checks that Unmarshal never panics on hostile input, and that
+// whatever it accepts into an empty interface survives a round trip.
+func FuzzDecode(f *testing.F) {
+	for _, v := range []any{
+		nil, true, -33, uint64(math.MaxUint64), 1.5, float32(1.5), "hi", []byte{1, 2},
+		[]any{"x", true, nil, 1.5}, map[string]any{"n": int64(-5)}, map[int]string{1: "a"},
+		profile{ID: 7, Name: "alice", Tags: []string{"a"}, Parent: &profile{ID: 1}},
+	} {
+		b, err := MsgPack{}.Marshal(v)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	for _, s := range []string{"81a46e616d65", "dd7fffffff", "cd0100", "c1", "d9ff"} {
+		b, _ := hex.DecodeString(s)
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var p profile
+		_ = MsgPack{}.Unmarshal(data, &p)
+		var n int8
+		_ = MsgPack{}.Unmarshal(data, &n)
+
+		var v any
+		if err := (MsgPack{}).Unmarshal(data, &v); err != nil {
+			return
+		}
+		b, err := MsgPack{}.Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal of decoded %#v: %v", v, err)
+		}
+		var w any
+		if err := (MsgPack{}).Unmarshal(b, &w); err != nil {
+			t.Fatalf("Unmarshal of re-encoded %x: %v", b, err)
+		}
+		if !reflect.DeepEqual(v, w) && !hasNaN(v) {
+			t.Fatalf("round trip:\n got %#v\nwant %#v", w, v)
+		}
+	})
+}
+
+// hasNaN reports whether v holds a NaN, which DeepEqual never matches.
+func hasNaN(v any) bool {
+	switch v := v.(type) {
+	case float64:
+		return math.IsNaN(v)
+	case []any:
+		for _, e := range v {
+			if hasNaN(e) {
+				return true
+			}
+		}
+	case map[string]any:
+		for _, e := range v {
+			if hasNaN(e) {
+				return true
+			}
+		}
+	case map[any]any:
+		for k, e := range v {
+			if hasNaN(k) || hasNaN(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestProtobufAndJSON(t *testing.T) {
+	b, err := Protobuf{}.Marshal(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s wrapperspb.StringValue
+	if err := (Protobuf{}).Unmarshal(b, &s); err != nil || s.GetValue() != "hello" {
+		t.Fatalf("protobuf round trip: %q, %v", s.GetValue(), err)
+	}
+	if _, err := (Protobuf{}).Marshal(struct{}{}); err == nil {
+		t.Fatal("protobuf marshaled a non-proto value")
+	}
+	if err := (Protobuf{}).Unmarshal([]byte{0xff}, &s); err == nil {
+		t.Fatal("protobuf accepted a malformed message")
+	}
+
+	b, err = JSON{}.Marshal(map[string]int{"a": 1})
+	if err != nil || !bytes.Equal(b, []byte(`{"a":1}`)) {
+		t.Fatalf("json: %s, %v", b, err)
+	}
+}
@@ -0,0 +1,12 @@
+package codec
+
+import "encoding/json"
+
+// JSON is the encoding/json codec.
+type JSON struct{}
+
+func (JSON) Name() string { return JSONName }
+
+func (JSON) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (JSON) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
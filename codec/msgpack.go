@@ -0,0 +1,236 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// maxMsgPackDepth bounds the nesting of arrays and maps accepted by
+// Unmarshal, so hostile payloads cannot exhaust the stack of the decoder.
+const maxMsgPackDepth = 100
+
+// MsgPack is a MessagePack codec (https://msgpack.org) backed by
+// github.com/vmihailenco/msgpack/v5. Structs are encoded as maps keyed by
+// field name, or by the name in a `msgpack:"name,omitempty"` tag; "-" skips a
+// field. Keys of map[string]any, map[string]string and map[string]bool are
+// written in sorted order, so equal values of those encode to equal bytes.
+// Go ints take the smallest encoding; sized integers keep their
+// width.
+//
+// Decoding into an empty interface yields nil, bool, int64 (uint64 for the
+// unsigned encodings), float64, string, []byte, []any, map[string]any
+// (map[any]any when a key is not a string) and time.Time for the timestamp
+// extension. Like the library, decoding into a narrower
+// integer type truncates instead of failing.
+type MsgPack struct{}
+
+func (MsgPack) Name() string { return MsgPackName }
+
+func (MsgPack) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+	enc.Reset(&buf)
+	enc.SetSortMapKeys(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (MsgPack) Unmarshal(data []byte, v any) (err error) {
+	if rv := reflect.ValueOf(v); rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("msgpack: Unmarshal needs a non-nil pointer, got %T", v)
+	}
+	if err := checkMsgPackDepth(data); err != nil {
+		return err
+	}
+	// Payloads are untrusted: a decoder panic fails the request, not the
+	// gateway.
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("msgpack: %v", p)
+		}
+	}()
+	r := bytes.NewReader(data)
+	dec := msgpack.GetDecoder()
+	defer msgpack.PutDecoder(dec)
+	dec.Reset(r)
+	dec.UseLooseInterfaceDecoding(true)
+	dec.SetMapDecoder(decodeMsgPackMap)
+	if err := dec.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("msgpack: unexpected end of data: %w", io.ErrUnexpectedEOF)
+		}
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("msgpack: %d bytes of trailing data", r.Len())
+	}
+	return nil
+}
+
+// decodeMsgPackMap decodes a map into map[string]any, or map[any]any when a
+// key is not a string. Keys that cannot be map keys, such as arrays, are
+// rejected.
+func decodeMsgPackMap(d *msgpack.Decoder) (any, error) {
+	n, err := d.DecodeMapLen()
+	if n == -1 || err != nil {
+		return nil, err
+	}
+	strs := make(map[string]any, n)
+	var anys map[any]any
+	for range n {
+		k, err := d.DecodeInterfaceLoose()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.DecodeInterfaceLoose()
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := k.(string); ok && anys == nil {
+			strs[s] = v
+			continue
+		}
+		if k != nil && !reflect.TypeOf(k).Comparable() {
+			return nil, fmt.Errorf("msgpack: invalid map key of type %T", k)
+		}
+		if anys == nil {
+			anys = make(map[any]any, n)
+			for s, v := range strs {
+				anys[s] = v
+			}
+		}
+		anys[k] = v
+	}
+	if anys != nil {
+		return anys, nil
+	}
+	return strs, nil
+}
+
+// checkMsgPackDepth rejects data whose arrays and maps nest deeper than
+// maxMsgPackDepth, and items or containers claiming more bytes than are
+// left, which the decoder would allocate up front. It walks the items
+// without recursion and leaves every other error to the decoder.
+func checkMsgPackDepth(data []byte) error {
+	var open []uint64 // items still expected by each open container
+	for off := 0; off < len(data); {
+		for len(open) > 0 && open[len(open)-1] == 0 {
+			open = open[:len(open)-1]
+		}
+		if len(open) > 0 {
+			open[len(open)-1]--
+		}
+		size, items, ok := msgPackItem(data[off:])
+		if !ok || items > uint64(len(data)-off-size) {
+			return fmt.Errorf("msgpack: unexpected end of data: %w", io.ErrUnexpectedEOF)
+		}
+		off += size
+		if items > 0 {
+			if len(open) == maxMsgPackDepth {
+				return fmt.Errorf("msgpack: exceeds max depth %d", maxMsgPackDepth)
+			}
+			open = append(open, items)
+		}
+	}
+	return nil
+}
+
+// msgPackItem returns the encoded size of the item at the front of b,
+// excluding the items of a container, and how many items a container holds
+// (map entries count twice). ok is false if b is truncated.
+func msgPackItem(b []byte) (size int, items uint64, ok bool) {
+	c := b[0]
+	switch {
+	case c <= 0x7f || c >= 0xe0 || c == 0xc0 || c == 0xc2 || c == 0xc3:
+		return 1, 0, true
+	case c <= 0x8f:
+		return 1, 2 * uint64(c&0x0f), true
+	case c <= 0x9f:
+		return 1, uint64(c & 0x0f), true
+	case c <= 0xbf:
+		return fixed(b, 1+int(c&0x1f))
+	}
+	switch c {
+	case 0xcc, 0xd0:
+		return fixed(b, 2)
+	case 0xcd, 0xd1, 0xd4:
+		return fixed(b, 3)
+	case 0xd5:
+		return fixed(b, 4)
+	case 0xca, 0xce, 0xd2:
+		return fixed(b, 5)
+	case 0xd6:
+		return fixed(b, 6)
+	case 0xcb, 0xcf, 0xd3:
+		return fixed(b, 9)
+	case 0xd7:
+		return fixed(b, 10)
+	case 0xd8:
+		return fixed(b, 18)
+	case 0xc4, 0xd9:
+		return sized(b, 1, 0)
+	case 0xc5, 0xda:
+		return sized(b, 2, 0)
+	case 0xc6, 0xdb:
+		return sized(b, 4, 0)
+	case 0xc7:
+		return sized(b, 1, 1)
+	case 0xc8:
+		return sized(b, 2, 1)
+	case 0xc9:
+		return sized(b, 4, 1)
+	case 0xdc, 0xde:
+		n, ok := length(b, 2)
+		if c == 0xde {
+			n *= 2
+		}
+		return 3, n, ok
+	case 0xdd, 0xdf:
+		n, ok := length(b, 4)
+		if c == 0xdf {
+			n *= 2
+		}
+		return 5, n, ok
+	}
+	// 0xc1 is never used; the decoder reports it.
+	return 1, 0, true
+}
+
+// fixed returns an item of size bytes.
+func fixed(b []byte, size int) (int, uint64, bool) {
+	return size, 0, size <= len(b)
+}
+
+// sized returns a str, bin or ext item whose length takes width bytes after
+// the format byte and is followed by extra bytes (the ext type) and the data.
+func sized(b []byte, width, extra int) (int, uint64, bool) {
+	n, ok := length(b, width)
+	if !ok || n > uint64(len(b)) {
+		return 0, 0, false
+	}
+	return fixed(b, 1+width+extra+int(n))
+}
+
+// length reads the big-endian length of width bytes after the format byte.
+func length(b []byte, width int) (uint64, bool) {
+	if len(b) < 1+width {
+		return 0, false
+	}
+	switch width {
+	case 1:
+		return uint64(b[1]), true
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b[1:])), true
+	default:
+		return uint64(binary.BigEndian.Uint32(b[1:])), true
+	}
+}
@@ -0,0 +1,127 @@
+package novagate
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func TestReadBufferCompactsAndGrows(t *testing.T) {
+	var b readBuffer
+	defer b.release()
+
+	sp := b.space()
+	if len(sp) < minReadSpace {
+		t.Fatalf("space = %d, want >= %d", len(sp), minReadSpace)
+	}
+	b.w += copy(sp, bytes.Repeat([]byte{1}, len(sp)-100))
+	b.consume(10)
+	if b.len() != len(sp)-110 {
+		t.Fatalf("len = %d", b.len())
+	}
+
+	// Not enough tail room: the partial remainder must survive compaction or growth.
+	want := append([]byte(nil), b.unread()...)
+	sp = b.space()
+	if len(sp) < minReadSpace || b.r != 0 || !bytes.Equal(b.unread(), want) {
+		t.Fatalf("after space: r=%d len=%d tail=%d", b.r, b.len(), len(sp))
+	}
+
+	b.consume(b.len())
+	if b.r != 0 || b.w != 0 {
+		t.Fatalf("indices not reset: r=%d w=%d", b.r, b.w)
+	}
+}
+
+func TestHandleConn_PipelinedSplitAndLargeFrames(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	r := NewRouter()
+	_ = echoSetup(r)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = handleConn(context.Background(), conn, r, 5*time.Second, 5*time.Second)
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	encode := func(id uint64, payload []byte) []byte {
+		out, err := protocol.EncodeMessageFrameTo(nil, 0, &protocol.Message{Command: protocol.CmdPing, RequestID: id, Payload: payload})
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		return out
+	}
+	payloads := map[uint64][]byte{
+		1: []byte("a"),
+		2: []byte("b"),
+		3: []byte("c"),
+		4: bytes.Repeat([]byte("split"), 2000),
+		5: bytes.Repeat([]byte("L"), 200*1024),
+		6: []byte("after-large"),
+	}
+
+	// Three frames in one write.
+	var pipelined []byte
+	for id := uint64(1); id <= 3; id++ {
+		pipelined = append(pipelined, encode(id, payloads[id])...)
+	}
+	if _, err := c.Write(pipelined); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// A frame split across writes, with the next frame's head glued to its tail.
+	split := encode(4, payloads[4])
+	large := encode(5, payloads[5])
+	go func() {
+		_, _ = c.Write(split[:5])
+		time.Sleep(10 * time.Millisecond)
+		_, _ = c.Write(split[5:3000])
+		time.Sleep(10 * time.Millisecond)
+		_, _ = c.Write(append(split[3000:], large[:100]...))
+		_, _ = c.Write(large[100:])
+		_, _ = c.Write(encode(6, payloads[6]))
+	}()
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf []byte
+	tmp := make([]byte, 64*1024)
+	for want := uint64(1); want <= 6; {
+		frame, n, err := protocol.Decode(buf)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if frame == nil {
+			m, err := c.Read(tmp)
+			if err != nil {
+				t.Fatalf("read (waiting for req %d): %v", want, err)
+			}
+			buf = append(buf, tmp[:m]...)
+			continue
+		}
+		resp, err := protocol.DecodeMessage(frame.Body)
+		if err != nil {
+			t.Fatalf("decode message: %v", err)
+		}
+		if resp.RequestID != want || !bytes.Equal(resp.Payload, payloads[want]) {
+			t.Fatalf("response %d: got req=%d len=%d", want, resp.RequestID, len(resp.Payload))
+		}
+		buf = buf[n:]
+		want++
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"net"
 	"time"
 
+	"github.com/gogogo1024/novagate/internal/bufpool"
+	"github.com/gogogo1024/novagate/internal/capture"
 	"github.com/gogogo1024/novagate/protocol"
 )
 
@@ -18,16 +20,23 @@ func HandleConn(ctx context.Context, conn net.Conn, router *Router) error {
 var errIdleTimeout = errors.New("novagate: idle timeout")
 
 func handleConn(ctx context.Context, conn net.Conn, router *Router, idleTimeout time.Duration, writeTimeout time.Duration) error {
+	so := defaultServeOptions()
+	so.idleTimeout = idleTimeout
+	so.writeTimeout = writeTimeout
+	return handleConnWithOptions(ctx, conn, router, so)
+}
+
+func handleConnWithOptions(ctx context.Context, conn net.Conn, router *Router, so serveOptions) error {
 	if router == nil {
 		return errors.New("novagate: nil router")
 	}
 
-	state := &connHandlerState{
-		cc:  NewConnContext(),
-		buf: make([]byte, 0, 8*1024),
-		tmp: make([]byte, 4*1024),
-	}
-	defer state.cc.Release(len(state.buf))
+	info := newConnInfo(conn)
+	ctx = withConnInfo(ctx, info)
+	idleTimeout := so.idleTimeout
+
+	state := newConnHandlerState(conn, info, so)
+	defer state.release()
 
 	for {
 		if err := readIntoBuffer(conn, state, idleTimeout); err != nil {
@@ -39,16 +48,105 @@ func handleConn(ctx context.Context, conn net.Conn, router *Router, idleTimeout
 			}
 			return err
 		}
-		if err := processBufferedFrames(ctx, conn, state, router, writeTimeout); err != nil {
+		if err := processBufferedFrames(ctx, state, router); err != nil {
 			return err
 		}
 	}
 }
 
 type connHandlerState struct {
-	cc  *ConnContext
-	buf []byte
-	tmp []byte
+	cc   *ConnContext
+	rb   readBuffer
+	out  *connWriter
+	hb   *heartbeat
+	info *ConnInfo
+	so   serveOptions
+	// corrupt makes the next response frame go out corrupted (FaultCorrupt).
+	corrupt bool
+}
+
+func newConnHandlerState(conn net.Conn, info *ConnInfo, so serveOptions) *connHandlerState {
+	applyKeepAlive(conn, so)
+	out := newConnWriter(conn, so)
+	return &connHandlerState{
+		cc:   NewConnContext(),
+		out:  out,
+		hb:   startHeartbeat(conn, out, so),
+		info: info,
+		so:   so,
+	}
+}
+
+func (s *connHandlerState) release() {
+	s.hb.stop()
+	s.cc.Release(s.rb.len())
+	s.rb.release()
+	s.out.release()
+}
+
+const (
+	readBufferSize = 8 * 1024
+	minReadSpace   = 4 * 1024
+)
+
+// readBuffer holds the unread bytes of a connection in buf[r:w].
+//
+// Reads land directly in buf. Once every buffered byte has been consumed the
+// indices are reset instead of copying, so the usual case of whole frames per
+// read never moves data; only a trailing partial frame is compacted to the
+// front when the tail runs out of room. Storage comes from bufpool and grows
+// by size class for large frames.
+type readBuffer struct {
+	buf  []byte
+	r, w int
+}
+
+func (b *readBuffer) len() int { return b.w - b.r }
+
+func (b *readBuffer) unread() []byte { return b.buf[b.r:b.w] }
+
+// space returns the writable tail, making room for at least minReadSpace bytes.
+func (b *readBuffer) space() []byte {
+	if b.buf == nil {
+		b.buf = bufpool.Get(readBufferSize)
+	}
+	if len(b.buf)-b.w >= minReadSpace {
+		return b.buf[b.w:]
+	}
+	n := b.len()
+	if len(b.buf)-n >= minReadSpace {
+		copy(b.buf, b.buf[b.r:b.w])
+	} else {
+		grown := bufpool.Get(n + minReadSpace)
+		grown = grown[:cap(grown)]
+		copy(grown, b.buf[b.r:b.w])
+		bufpool.Put(b.buf)
+		b.buf = grown
+	}
+	b.r, b.w = 0, n
+	return b.buf[b.w:]
+}
+
+// consume drops n bytes from the front. Frames decoded from those bytes must
+// no longer be referenced.
+func (b *readBuffer) consume(n int) {
+	b.r += n
+	if b.r < b.w {
+		return
+	}
+	b.r, b.w = 0, 0
+	// Give oversized storage back after a large frame instead of pinning it
+	// for the rest of the connection.
+	if len(b.buf) > readBufferSize {
+		b.release()
+	}
+}
+
+func (b *readBuffer) release() {
+	if b.buf != nil {
+		bufpool.Put(b.buf)
+		b.buf = nil
+	}
 }
 
 func readIntoBuffer(conn net.Conn, state *connHandlerState, idleTimeout time.Duration) error {
@@ -58,12 +156,15 @@ func readIntoBuffer(conn net.Conn, state *connHandlerState, idleTimeout time.Dur
 		_ = conn.SetReadDeadline(time.Time{})
 	}
 
-	n, err := conn.Read(state.tmp)
+	n, err := conn.Read(state.rb.space())
 	if n > 0 {
+		state.rb.w += n
+		if state.hb != nil {
+			state.hb.activity()
+		}
 		if !state.cc.Reserve(n) {
 			return errors.New("connection buffer quota exceeded")
 		}
-		state.buf = append(state.buf, state.tmp[:n]...)
 	}
 	if err != nil {
 		if ne, ok := err.(net.Error); ok && ne.Timeout() && idleTimeout > 0 {
@@ -73,74 +174,221 @@ func readIntoBuffer(conn net.Conn, state *connHandlerState, idleTimeout time.Dur
 	return err
 }
 
-func processBufferedFrames(ctx context.Context, conn net.Conn, state *connHandlerState, router *Router, writeTimeout time.Duration) error {
-	consumed := 0
+// processBufferedFrames serves every complete frame in the read buffer and
+// then flushes the responses they produced in one write.
+func processBufferedFrames(ctx context.Context, state *connHandlerState, router *Router) error {
+	err := serveBufferedFrames(ctx, state, router)
+	// Responses to frames served before a failure are still delivered.
+	if ferr := state.out.flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
 
-	for {
-		frame, frameLen, err := protocol.Decode(state.buf[consumed:])
+func serveBufferedFrames(ctx context.Context, state *connHandlerState, router *Router) error {
+	for state.rb.len() > 0 {
+		frame, frameLen, err := protocol.Decode(state.rb.unread())
 		if err != nil {
-			return err
+			return frameError(err)
 		}
 		if frame == nil {
 			break
 		}
 
-		if err := handleFrame(ctx, conn, state, router, frame, writeTimeout); err != nil {
+		if err := handleFrame(ctx, state, router, frame); err != nil {
 			return err
 		}
-		consumed += frameLen
-	}
-
-	if consumed > 0 {
-		state.cc.Release(consumed)
-		copy(state.buf, state.buf[consumed:])
-		state.buf = state.buf[:len(state.buf)-consumed]
+		state.cc.Release(frameLen)
+		state.rb.consume(frameLen)
 	}
 	return nil
 }
 
-func handleFrame(ctx context.Context, conn net.Conn, state *connHandlerState, router *Router, frame *protocol.Frame, writeTimeout time.Duration) error {
-	oneWay := (frame.Flags & protocol.FlagOneWay) != 0
-
+func handleFrame(ctx context.Context, state *connHandlerState, router *Router, frame *protocol.Frame) error {
 	if !state.cc.Allow() {
 		return errors.New("rate limit exceeded")
 	}
 
 	body, err := protocol.DecodeFrameBody(frame)
 	if err != nil {
-		return err
+		return frameError(err)
 	}
 
-	msg, err := protocol.DecodeMessage(body)
+	state.out.negotiate(frame)
+	if frame.Flags&protocol.FlagBatch != 0 {
+		return handleBatch(ctx, state, router, frame, body)
+	}
+
+	msg, err := frame.DecodeMessage(body)
 	if err != nil {
+		return frameError(err)
+	}
+	if protocol.IsControl(frame.Flags) {
+		return handleControl(state, msg)
+	}
+
+	resp, err := dispatchMessage(ctx, state, router, frame.Flags, msg)
+	if err != nil || resp == nil {
 		return err
 	}
 
-	resp, err := router.Dispatch(ctx, msg)
+	outFlags := router.route(msg.Command).responseFlags(frame.Flags)
+	captureMessage(state.so.capture, state.info.ID, capture.DirOut, outFlags, resp)
+
+	out, err := state.out.frame(outFlags, resp)
 	if err != nil {
 		return err
 	}
-	if oneWay || resp == nil {
+	state.corruptFrame(out)
+	return state.out.write(out)
+}
+
+// handleBatch dispatches every message of a FlagBatch frame in order and
+// answers with batch frames holding the responses: one, unless they exceed
+// MaxFrameBody together. The responses are compressed if the request was,
+// subject to the compression policy of their routes (see batchFlags). The
+// frame itself already passed the rate limiter; each further message takes a
+// token of its own.
+func handleBatch(ctx context.Context, state *connHandlerState, router *Router, frame *protocol.Frame, body []byte) error {
+	msgs, err := frame.DecodeBatch(body)
+	if err != nil {
+		return frameError(err)
+	}
+
+	flags := frame.Flags
+	var resps []*protocol.Message
+	var routes []*route
+	for i, msg := range msgs {
+		if i > 0 && !state.cc.Allow() {
+			return errors.New("rate limit exceeded")
+		}
+		resp, err := dispatchMessage(ctx, state, router, flags, msg)
+		if err != nil {
+			return err
+		}
+		if resp != nil {
+			resps = append(resps, resp)
+			routes = append(routes, router.route(msg.Command))
+		}
+	}
+	if len(resps) == 0 {
 		return nil
 	}
 
-	if resp.RequestID == 0 {
-		resp.RequestID = msg.RequestID
+	outFlags := batchFlags(routes, flags) | protocol.FlagBatch
+	// Sizes are taken uncompressed, which compression rarely exceeds, and
+	// with room for metadata headers should any response carry metadata.
+	sizeFlags := outFlags | protocol.FlagMetadata
+	base := state.out.frameSize(sizeFlags)
+	var chunk []*protocol.Message
+	size := base
+	for _, resp := range resps {
+		entry := state.out.frameSize(sizeFlags, resp) - base
+		if base+entry > protocol.MaxFrameBody {
+			resp, _ = errorReply(resp, &StatusError{Code: protocol.StatusTooLarge, Message: "response too large"})
+			entry = state.out.frameSize(sizeFlags, resp) - base
+		}
+		captureMessage(state.so.capture, state.info.ID, capture.DirOut, outFlags, resp)
+		if len(chunk) > 0 && size+entry > protocol.MaxFrameBody {
+			if err := writeBatch(state, outFlags, chunk); err != nil {
+				return err
+			}
+			chunk, size = nil, base
+		}
+		chunk = append(chunk, resp)
+		size += entry
 	}
+	return writeBatch(state, outFlags, chunk)
+}
+
+// batchFlags returns the compression flag of a batch answering requests sent
+// with flags, whose responses come from routes. A route that never
+// compresses keeps the whole batch uncompressed; otherwise it is compressed
+// if any route's policy compresses its response.
+func batchFlags(routes []*route, flags uint8) uint8 {
+	var out uint8
+	for _, rt := range routes {
+		if rt != nil && rt.cfg.Compression == CompressionNever {
+			return 0
+		}
+		out |= rt.responseFlags(flags)
+	}
+	return out
+}
 
-	respBytes, err := protocol.EncodeMessage(resp)
+// writeBatch encodes msgs into one batch frame and queues it. If compression
+// pushes the body past MaxFrameBody the frame is sent uncompressed.
+func writeBatch(state *connHandlerState, flags uint8, msgs []*protocol.Message) error {
+	out, err := state.out.frame(flags, msgs...)
+	if err != nil && flags&protocol.FlagCompressed != 0 {
+		out, err = state.out.frame(flags&^protocol.FlagCompressed, msgs...)
+	}
 	if err != nil {
 		return err
 	}
+	state.corruptFrame(out)
+	return state.out.write(out)
+}
+
+// dispatchMessage routes one business message and returns its response, or
+// nil when there is nothing to send back (one-way request or nil response).
+func dispatchMessage(ctx context.Context, state *connHandlerState, router *Router, flags uint8, msg *protocol.Message) (*protocol.Message, error) {
+	captureMessage(state.so.capture, state.info.ID, capture.DirIn, flags, msg)
 
-	outFlags := frame.Flags & protocol.FlagCompressed
-	outFlags, outBody, err := protocol.EncodeFrameBody(outFlags, respBytes)
+	err := router.route(msg.Command).admit(flags)
+	var resp *protocol.Message
+	if err == nil {
+		if state.hb != nil {
+			state.hb.begin()
+		}
+		resp, err = router.Dispatch(ctx, msg)
+		if state.hb != nil {
+			state.hb.end()
+		}
+	}
+	var fe *faultError
+	if errors.As(err, &fe) {
+		if fe.kind == FaultReset {
+			resetConn(state.out.conn)
+			return nil, err
+		}
+		resp, err = fe.resp, nil
+		state.corrupt = resp != nil && flags&protocol.FlagOneWay == 0
+	}
 	if err != nil {
-		return err
+		reply, ok := errorReply(msg, err)
+		if !ok {
+			return nil, err
+		}
+		resp = reply
+	}
+	if resp == nil || flags&protocol.FlagOneWay != 0 {
+		return nil, nil
 	}
+	if resp.RequestID == 0 {
+		resp.RequestID = msg.RequestID
+	}
+	return resp, nil
+}
+
+// corruptFrame acts out a pending FaultCorrupt on the encoded frame.
+func (s *connHandlerState) corruptFrame(frame []byte) {
+	if s.corrupt {
+		corruptFrame(frame)
+		s.corrupt = false
+	}
+}
 
-	out := protocol.Encode(&protocol.Frame{Flags: outFlags, Body: outBody})
-	return writeAll(conn, out, writeTimeout)
+// frameError counts a frame the connection could not decode, keeping body
+// corruption (a checksum mismatch) apart from malformed frames.
+func frameError(err error) error {
+	var ce *protocol.ChecksumError
+	if errors.As(err, &ce) {
+		metricFramesCorrupt.Add(1)
+	} else {
+		metricFramesMalformed.Add(1)
+	}
+	return err
 }
 
 func writeAll(conn net.Conn, data []byte, writeTimeout time.Duration) error {
@@ -0,0 +1,46 @@
+package novagate
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// ConnInfo describes the connection a message arrived on.
+type ConnInfo struct {
+	// ID is unique per process for the lifetime of the server.
+	ID        uint64
+	LocalAddr net.Addr
+	// RemoteAddr is the client. Behind a load balancer using the PROXY
+	// protocol (WithProxyProtocol) it comes from the PROXY header.
+	RemoteAddr net.Addr
+	// ProxyAddr is the load balancer that sent the PROXY header, or nil.
+	ProxyAddr net.Addr
+}
+
+var connIDSeq atomic.Uint64
+
+func newConnInfo(c net.Conn) *ConnInfo {
+	info := &ConnInfo{
+		ID:         connIDSeq.Add(1),
+		LocalAddr:  c.LocalAddr(),
+		RemoteAddr: c.RemoteAddr(),
+	}
+	if pc, ok := c.(interface{ ProxyAddr() net.Addr }); ok {
+		info.ProxyAddr = pc.ProxyAddr()
+	}
+	return info
+}
+
+type connInfoKey struct{}
+
+func withConnInfo(ctx context.Context, info *ConnInfo) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, info)
+}
+
+// ConnInfoFromContext returns the connection a handler is serving, if any.
+// Messages from the HTTP bridge carry no ConnInfo.
+func ConnInfoFromContext(ctx context.Context) (*ConnInfo, bool) {
+	info, ok := ctx.Value(connInfoKey{}).(*ConnInfo)
+	return info, ok
+}
@@ -0,0 +1,244 @@
+package novagate
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogogo1024/novagate/internal/bufpool"
+	"github.com/gogogo1024/novagate/internal/transport"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// Default write coalescing thresholds (see WithWriteCoalescing).
+const (
+	defaultWriteBatchBytes = 64 * 1024
+	defaultWriteBatchDelay = time.Millisecond
+)
+
+// WithWriteCoalescing configures how responses on one connection are batched.
+//
+// Encoded responses are queued and written with a single vectored write
+// (writev on TCP and Unix sockets) once the connection has no more complete
+// frames buffered. Within a pipelined burst the queue is flushed early when it
+// holds maxBytes, or when its oldest response has waited maxDelay, even while
+// a slow handler is still running.
+// maxBytes <= 0 writes every response on its own; maxDelay <= 0 disables the
+// latency threshold. WithWriteTimeout bounds each flush.
+func WithWriteCoalescing(maxBytes int, maxDelay time.Duration) ServeOption {
+	return func(o *serveOptions) {
+		o.writeBatchBytes = maxBytes
+		o.writeBatchDelay = maxDelay
+	}
+}
+
+type flushReason int
+
+const (
+	flushBatchEnd flushReason = iota
+	flushSize
+	flushLatency
+)
+
+// connWriter queues encoded response frames for one connection.
+type connWriter struct {
+	conn         net.Conn
+	writeTimeout time.Duration
+	maxBytes     int
+	maxDelay     time.Duration
+
+	// Frame options negotiated with the peer (see negotiate).
+	version  atomic.Uint32
+	checksum atomic.Bool
+
+	mu      sync.Mutex
+	pending [][]byte
+	bytes   int
+	oldest  time.Time
+	vec     [][]byte
+	// timer flushes the queue maxDelay after its first frame; err keeps the
+	// failure of such a flush for the next write or flush.
+	timer *time.Timer
+	err   error
+}
+
+func newConnWriter(conn net.Conn, so serveOptions) *connWriter {
+	return &connWriter{
+		conn:         conn,
+		writeTimeout: so.writeTimeout,
+		maxBytes:     so.writeBatchBytes,
+		maxDelay:     so.writeBatchDelay,
+	}
+}
+
+// negotiate adopts the encoding options of a frame received from the peer:
+// once it sends a FrameVersion2 or FlagChecksum frame, every frame written
+// to it afterwards uses that version or carries a checksum too.
+func (w *connWriter) negotiate(f *protocol.Frame) {
+	if f.Version == protocol.FrameVersion2 && w.version.Load() != uint32(protocol.FrameVersion2) {
+		w.version.Store(uint32(protocol.FrameVersion2))
+	}
+	if f.Flags&protocol.FlagChecksum != 0 && !w.checksum.Load() {
+		w.checksum.Store(true)
+	}
+}
+
+// frame encodes msgs into a pooled buffer for write, using the version and
+// checksum negotiated for this connection.
+func (w *connWriter) frame(flags uint8, msgs ...*protocol.Message) ([]byte, error) {
+	version := uint8(w.version.Load())
+	if w.checksum.Load() {
+		flags |= protocol.FlagChecksum
+	}
+	out := bufpool.Get(protocol.FrameSize(version, flags, msgs...))
+	out, err := protocol.AppendFrame(out[:0], version, flags, msgs...)
+	if err != nil {
+		bufpool.Put(out)
+		return nil, err
+	}
+	return out, nil
+}
+
+// frameSize returns the uncompressed length of the frame built by frame.
+func (w *connWriter) frameSize(flags uint8, msgs ...*protocol.Message) int {
+	if w.checksum.Load() {
+		flags |= protocol.FlagChecksum
+	}
+	return protocol.FrameSize(uint8(w.version.Load()), flags, msgs...)
+}
+
+// write queues frame and flushes if a threshold is reached. frame must come
+// from bufpool; the writer returns it to the pool once it has been written.
+func (w *connWriter) write(frame []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		bufpool.Put(frame)
+		return w.err
+	}
+	if len(w.pending) == 0 {
+		w.oldest = time.Now()
+		w.armLocked()
+	}
+	w.pending = append(w.pending, frame)
+	w.bytes += len(frame)
+
+	switch {
+	case w.bytes >= w.maxBytes:
+		return w.flushLocked(flushSize)
+	case w.maxDelay > 0 && time.Since(w.oldest) >= w.maxDelay:
+		return w.flushLocked(flushLatency)
+	}
+	return nil
+}
+
+// flush writes everything queued. The read loop calls it once it runs out of
+// complete frames.
+func (w *connWriter) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return w.flushLocked(flushBatchEnd)
+}
+
+// armLocked starts the latency timer of a new queue. w.mu must be held.
+func (w *connWriter) armLocked() {
+	if w.maxDelay <= 0 {
+		return
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.maxDelay, w.flushDelayed)
+		return
+	}
+	w.timer.Reset(w.maxDelay)
+}
+
+// flushDelayed runs on the latency timer.
+func (w *connWriter) flushDelayed() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// The queue the timer was armed for may be gone; a newer one re-armed it.
+	if w.err != nil || len(w.pending) == 0 || time.Since(w.oldest) < w.maxDelay {
+		return
+	}
+	w.err = w.flushLocked(flushLatency)
+}
+
+func (w *connWriter) flushLocked(reason flushReason) error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+
+	n, err := w.writeLocked()
+
+	metricWriteFlushes.Add(1)
+	metricWriteFrames.Add(int64(len(w.pending)))
+	metricWriteBytes.Add(n)
+	switch reason {
+	case flushSize:
+		metricWriteFlushSize.Add(1)
+	case flushLatency:
+		metricWriteFlushLatency.Add(1)
+	default:
+		metricWriteFlushBatch.Add(1)
+	}
+	if err != nil {
+		metricWriteErrors.Add(1)
+		// A failed transport may still reference the frames; let the GC have them.
+		w.dropLocked(false)
+		return err
+	}
+	w.dropLocked(true)
+	return nil
+}
+
+func (w *connWriter) writeLocked() (int64, error) {
+	if len(w.pending) == 1 {
+		if err := writeAll(w.conn, w.pending[0], w.writeTimeout); err != nil {
+			return 0, err
+		}
+		return int64(len(w.pending[0])), nil
+	}
+
+	if w.writeTimeout > 0 {
+		_ = w.conn.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+		defer func() {
+			_ = w.conn.SetWriteDeadline(time.Time{})
+		}()
+	} else {
+		_ = w.conn.SetWriteDeadline(time.Time{})
+	}
+	w.vec = append(w.vec[:0], w.pending...)
+	return transport.WriteBuffers(w.conn, w.vec)
+}
+
+// release drops anything still queued, e.g. when the connection failed.
+func (w *connWriter) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.dropLocked(true)
+}
+
+func (w *connWriter) dropLocked(recycle bool) {
+	for i, f := range w.pending {
+		if recycle {
+			bufpool.Put(f)
+		}
+		w.pending[i] = nil
+	}
+	for i := range w.vec {
+		w.vec[i] = nil
+	}
+	w.pending = w.pending[:0]
+	w.bytes = 0
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
@@ -0,0 +1,220 @@
+package novagate
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/internal/bufpool"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// recordingConn records every Write on top of fakeConn's deadline tracking.
+type recordingConn struct {
+	*fakeConn
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.writes = append(c.writes, append([]byte(nil), p...))
+	c.mu.Unlock()
+	return c.fakeConn.Write(p)
+}
+
+func (c *recordingConn) written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Join(c.writes, nil)
+}
+
+func pooledFrame(s string) []byte {
+	b := bufpool.Get(len(s))
+	copy(b, s)
+	return b
+}
+
+func TestConnWriterBatchesUntilFlush(t *testing.T) {
+	c := &recordingConn{fakeConn: &fakeConn{}}
+	so := defaultServeOptions()
+	so.writeBatchDelay = 0
+	w := newConnWriter(c, so)
+
+	flushes := metricWriteFlushes.Value()
+	for _, s := range []string{"one", "two", "three"} {
+		if err := w.write(pooledFrame(s)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if got := c.written(); len(got) != 0 {
+		t.Fatalf("wrote %q before flush", got)
+	}
+	if err := w.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if got := string(c.written()); got != "onetwothree" {
+		t.Fatalf("written = %q", got)
+	}
+	if d := metricWriteFlushes.Value() - flushes; d != 1 {
+		t.Fatalf("flushes = %d, want 1", d)
+	}
+	if !c.sawNonZeroDeadline() {
+		t.Fatal(errExpectedSetWriteDeadlineCalled)
+	}
+	if last, _ := c.lastWriteDeadline(); !last.IsZero() {
+		t.Fatalf("write deadline not cleared after flush: %v", last)
+	}
+}
+
+func TestConnWriterFlushesOnThresholds(t *testing.T) {
+	c := &recordingConn{fakeConn: &fakeConn{}}
+	so := defaultServeOptions()
+	so.writeBatchBytes = 8
+	so.writeBatchDelay = 0
+	w := newConnWriter(c, so)
+
+	_ = w.write(pooledFrame("12345"))
+	if len(c.written()) != 0 {
+		t.Fatal("flushed below the size threshold")
+	}
+	_ = w.write(pooledFrame("6789"))
+	if got := string(c.written()); got != "123456789" {
+		t.Fatalf("size threshold: written = %q", got)
+	}
+
+	so.writeBatchBytes = 1 << 20
+	so.writeBatchDelay = 5 * time.Millisecond
+	c = &recordingConn{fakeConn: &fakeConn{}}
+	w = newConnWriter(c, so)
+	// The oldest response goes out after maxDelay without waiting for
+	// another write or the end of the burst.
+	_ = w.write(pooledFrame("a"))
+	time.Sleep(20 * time.Millisecond)
+	if got := string(c.written()); got != "a" {
+		t.Fatalf("latency threshold: written = %q", got)
+	}
+	_ = w.write(pooledFrame("b"))
+	_ = w.write(pooledFrame("c"))
+	time.Sleep(20 * time.Millisecond)
+	if got := string(c.written()); got != "abc" {
+		t.Fatalf("latency threshold, second queue: written = %q", got)
+	}
+	w.release()
+}
+
+func TestHandleConn_PipelinedResponsesCoalesced(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	r := NewRouter()
+	_ = echoSetup(r)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = handleConn(context.Background(), conn, r, 5*time.Second, 5*time.Second)
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	const n = 50
+	frames := metricWriteFrames.Value()
+	flushes := metricWriteFlushes.Value()
+	var burst []byte
+	for id := uint64(1); id <= n; id++ {
+		burst, err = protocol.EncodeMessageFrameTo(burst, 0, &protocol.Message{Command: protocol.CmdPing, RequestID: id, Payload: []byte("p")})
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+	}
+	if _, err := c.Write(burst); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var buf []byte
+	tmp := make([]byte, 4096)
+	for want := uint64(1); want <= n; {
+		frame, size, err := protocol.Decode(buf)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if frame == nil {
+			m, err := c.Read(tmp)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			buf = append(buf, tmp[:m]...)
+			continue
+		}
+		resp, _ := protocol.DecodeMessage(frame.Body)
+		if resp.RequestID != want {
+			t.Fatalf("response order: got %d, want %d", resp.RequestID, want)
+		}
+		buf = buf[size:]
+		want++
+	}
+
+	if d := metricWriteFrames.Value() - frames; d != n {
+		t.Fatalf("frames written = %d, want %d", d, n)
+	}
+	if d := metricWriteFlushes.Value() - flushes; d >= n {
+		t.Fatalf("expected coalesced flushes, got %d for %d frames", d, n)
+	}
+}
+
+func TestHandleConn_SlowHandlerDoesNotHoldQueuedResponses(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	r := NewRouter()
+	_ = echoSetup(r)
+	r.Register(protocol.CmdUserLogin, func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		<-release
+		return &protocol.Message{Command: m.Command, RequestID: m.RequestID}, nil
+	})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = handleConn(context.Background(), conn, r, 5*time.Second, 5*time.Second)
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	// A ping then a slow request in one burst: the ping's response must not
+	// wait for the slow one.
+	burst, _ := protocol.EncodeMessageFrameTo(nil, 0, &protocol.Message{Command: protocol.CmdPing, RequestID: 1})
+	burst, _ = protocol.EncodeMessageFrameTo(burst, 0, &protocol.Message{Command: protocol.CmdUserLogin, RequestID: 2})
+	if _, err := c.Write(burst); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	frame := readRawFrame(t, c)
+	if resp, _ := protocol.DecodeMessage(frame.Body); resp == nil || resp.RequestID != 1 {
+		t.Fatalf("first response = %+v", resp)
+	}
+}
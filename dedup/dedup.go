@@ -0,0 +1,30 @@
+// Package dedup remembers the responses of completed requests for a while,
+// so that a retried request can be answered without running it again.
+//
+// A Store maps a request key to an opaque response value with a TTL: Memory
+// keeps the most recent entries of one process in an LRU, Redis shares them
+// between gateway instances. Before running a request its key is claimed, so
+// that duplicates reaching other instances meanwhile wait for the response
+// instead of running too.
+package dedup
+
+import (
+	"context"
+	"time"
+)
+
+// Store holds responses by request key. Implementations are safe for
+// concurrent use. Values handed to Set and returned by Get must not be
+// modified.
+type Store interface {
+	// Get returns the value stored under key and whether there was one.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores value under key for ttl, replacing a claim.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Claim reserves key for a request about to run, for at most ttl. It
+	// reports false if key is already claimed or holds a value. Get reports
+	// a claimed key as absent.
+	Claim(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Release drops the claim on key, unless a value replaced it.
+	Release(ctx context.Context, key string) error
+}
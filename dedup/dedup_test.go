@@ -0,0 +1,126 @@
+package dedup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMemoryEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory(2)
+	_ = s.Set(ctx, "a", []byte("1"), time.Minute)
+	_ = s.Set(ctx, "b", []byte("2"), time.Minute)
+	if _, ok, _ := s.Get(ctx, "a"); !ok {
+		t.Fatal("a missing")
+	}
+	_ = s.Set(ctx, "c", []byte("3"), time.Minute)
+	if _, ok, _ := s.Get(ctx, "b"); ok {
+		t.Fatal("b survived eviction although a was used more recently")
+	}
+	if v, ok, _ := s.Get(ctx, "a"); !ok || string(v) != "1" {
+		t.Fatalf("a = %q, %v", v, ok)
+	}
+	if n := s.Len(); n != 2 {
+		t.Fatalf("Len = %d, want 2", n)
+	}
+}
+
+func TestMemoryExpires(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory(0)
+	_ = s.Set(ctx, "a", []byte("1"), 20*time.Millisecond)
+	if _, ok, _ := s.Get(ctx, "a"); !ok {
+		t.Fatal("a missing before its TTL")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok, _ := s.Get(ctx, "a"); ok {
+		t.Fatal("a returned after its TTL")
+	}
+	if n := s.Len(); n != 0 {
+		t.Fatalf("Len = %d after expiry, want 0", n)
+	}
+}
+
+func TestMemoryClaims(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory(0)
+	if ok, _ := s.Claim(ctx, "a", time.Minute); !ok {
+		t.Fatal("first claim refused")
+	}
+	if ok, _ := s.Claim(ctx, "a", time.Minute); ok {
+		t.Fatal("second claim granted")
+	}
+	if _, ok, _ := s.Get(ctx, "a"); ok {
+		t.Fatal("claimed key reported as stored")
+	}
+	_ = s.Release(ctx, "a")
+	if ok, _ := s.Claim(ctx, "a", time.Minute); !ok {
+		t.Fatal("claim refused after release")
+	}
+	_ = s.Set(ctx, "a", []byte("1"), time.Minute)
+	_ = s.Release(ctx, "a")
+	if v, ok, _ := s.Get(ctx, "a"); !ok || string(v) != "1" {
+		t.Fatalf("Release dropped a stored value: %q, %v", v, ok)
+	}
+	if ok, _ := s.Claim(ctx, "a", time.Minute); ok {
+		t.Fatal("claim granted over a stored value")
+	}
+	if ok, _ := s.Claim(ctx, "b", 10*time.Millisecond); !ok {
+		t.Fatal("claim of b refused")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if ok, _ := s.Claim(ctx, "b", time.Minute); !ok {
+		t.Fatal("lapsed claim still held")
+	}
+}
+
+// TestRedisStore requires Redis running on localhost:6379.
+func TestRedisStore(t *testing.T) {
+	c := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	ctx := context.Background()
+	if err := c.Ping(ctx).Err(); err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+	defer c.Close()
+
+	s := NewRedis(c, "test:dedup:")
+	defer c.Del(ctx, "test:dedup:k")
+	if _, ok, err := s.Get(ctx, "k"); ok || err != nil {
+		t.Fatalf("Get before Set = %v, %v", ok, err)
+	}
+	if err := s.Set(ctx, "k", []byte("v"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := s.Get(ctx, "k"); !ok || err != nil || string(v) != "v" {
+		t.Fatalf("Get = %q, %v, %v", v, ok, err)
+	}
+	if ttl := c.TTL(ctx, "test:dedup:k").Val(); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("TTL = %v", ttl)
+	}
+
+	defer c.Del(ctx, "test:dedup:c")
+	if ok, err := s.Claim(ctx, "c", time.Minute); !ok || err != nil {
+		t.Fatalf("Claim = %v, %v", ok, err)
+	}
+	if ok, _ := s.Claim(ctx, "c", time.Minute); ok {
+		t.Fatal("second claim granted")
+	}
+	if _, ok, _ := s.Get(ctx, "c"); ok {
+		t.Fatal("claimed key reported as stored")
+	}
+	if err := s.Release(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.Claim(ctx, "k", time.Minute); ok {
+		t.Fatal("claim granted over a stored value")
+	}
+	if err := s.Release(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.Get(ctx, "k"); !ok {
+		t.Fatal("Release dropped a stored value")
+	}
+}
@@ -0,0 +1,78 @@
+package dedup
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gogogo1024/novagate/internal/lru"
+)
+
+// DefaultMemoryCapacity is the number of entries a Memory store keeps by
+// default.
+const DefaultMemoryCapacity = 10000
+
+// Memory is an in-process Store: an LRU of at most capacity entries, each
+// dropped once its TTL has passed.
+type Memory struct {
+	mu      sync.Mutex
+	entries *lru.Cache[string, memoryEntry]
+}
+
+type memoryEntry struct {
+	value   []byte
+	claimed bool
+}
+
+// NewMemory returns a store of capacity entries (DefaultMemoryCapacity if
+// <= 0).
+func NewMemory(capacity int) *Memory {
+	if capacity <= 0 {
+		capacity = DefaultMemoryCapacity
+	}
+	return &Memory{entries: lru.New[string, memoryEntry](capacity)}
+}
+
+func (s *Memory) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries.Get(key)
+	if !ok || e.claimed {
+		return nil, false, nil
+	}
+	return e.value, true, nil
+}
+
+func (s *Memory) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries.Set(key, memoryEntry{value: value}, ttl)
+	return nil
+}
+
+func (s *Memory) Claim(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries.Get(key); ok {
+		return false, nil
+	}
+	s.entries.Set(key, memoryEntry{claimed: true}, ttl)
+	return true, nil
+}
+
+func (s *Memory) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries.Get(key); ok && e.claimed {
+		s.entries.Remove(key)
+	}
+	return nil
+}
+
+// Len returns the number of entries held, expired ones included until they
+// are looked up or evicted.
+func (s *Memory) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries.Len()
+}
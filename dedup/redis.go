@@ -0,0 +1,62 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRedisPrefix is prepended to the keys of a Redis store by default.
+const DefaultRedisPrefix = "novagate:dedup:"
+
+// Redis is a Store shared by every gateway using the same Redis, so a retry
+// landing on another instance is still recognized. Entries expire with the
+// Redis key TTL; claims are keys set with SET NX PX to a marker value.
+type Redis struct {
+	c      redis.UniversalClient
+	prefix string
+}
+
+// NewRedis returns a store using c, with keys under prefix
+// (DefaultRedisPrefix if empty).
+func NewRedis(c redis.UniversalClient, prefix string) *Redis {
+	if prefix == "" {
+		prefix = DefaultRedisPrefix
+	}
+	return &Redis{c: c, prefix: prefix}
+}
+
+// redisClaim marks a claimed key. Stored responses never take this value.
+var redisClaim = []byte("\x00novagate:claim")
+
+// releaseScript deletes KEYS[1] only while it holds the claim marker.
+var releaseScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+
+func (s *Redis) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	v, err := s.c.Get(ctx, s.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if bytes.Equal(v, redisClaim) {
+		return nil, false, nil
+	}
+	return v, true, nil
+}
+
+func (s *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.c.Set(ctx, s.prefix+key, value, ttl).Err()
+}
+
+func (s *Redis) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return s.c.SetNX(ctx, s.prefix+key, redisClaim, ttl).Result()
+}
+
+func (s *Redis) Release(ctx context.Context, key string) error {
+	return releaseScript.Run(ctx, s.c, []string{s.prefix + key}, redisClaim).Err()
+}
@@ -0,0 +1,153 @@
+package discovery
+
+import (
+	"context"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Policy selects how a Balancer spreads calls.
+type Policy int
+
+const (
+	// RoundRobin is smooth weighted round-robin: with weights 3 and 1 the
+	// endpoints are picked a, a, b, a rather than a, a, a, b.
+	RoundRobin Policy = iota
+	// ConsistentHash sends equal keys to the same endpoint, and moves only
+	// about 1/n of the keys when an endpoint joins or leaves.
+	ConsistentHash
+)
+
+// DefaultVirtualNodes is the number of ring points per unit of weight.
+const DefaultVirtualNodes = 100
+
+// BalancerConfig configures a Balancer.
+type BalancerConfig struct {
+	Policy Policy
+	// Key derives the hash key from a request payload for ConsistentHash;
+	// the whole payload by default.
+	Key func(payload []byte) []byte
+	// VirtualNodes is the number of ring points per unit of endpoint weight
+	// (default DefaultVirtualNodes).
+	VirtualNodes int
+}
+
+// Balancer picks an endpoint of one service per call. It resolves on every
+// pick and rebuilds its state whenever the endpoint set changes.
+type Balancer struct {
+	resolver Resolver
+	service  string
+	policy   Policy
+	key      func([]byte) []byte
+	vnodes   int
+
+	mu        sync.Mutex
+	endpoints []Endpoint
+	current   []int       // smooth round-robin state, one per endpoint
+	ring      []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash     uint64
+	endpoint int
+}
+
+// NewBalancer returns a balancer over the endpoints r resolves for service.
+func NewBalancer(r Resolver, service string, cfg BalancerConfig) *Balancer {
+	if cfg.Key == nil {
+		cfg.Key = func(payload []byte) []byte { return payload }
+	}
+	if cfg.VirtualNodes <= 0 {
+		cfg.VirtualNodes = DefaultVirtualNodes
+	}
+	return &Balancer{
+		resolver: r,
+		service:  service,
+		policy:   cfg.Policy,
+		key:      cfg.Key,
+		vnodes:   cfg.VirtualNodes,
+	}
+}
+
+// Service returns the service name the balancer resolves.
+func (b *Balancer) Service() string { return b.service }
+
+// Pick returns the endpoint for a call carrying payload.
+func (b *Balancer) Pick(ctx context.Context, payload []byte) (Endpoint, error) {
+	eps, err := b.resolver.Resolve(ctx, b.service)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	if len(eps) == 0 {
+		return Endpoint{}, ErrNoEndpoints
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !slices.Equal(eps, b.endpoints) {
+		b.rebuild(eps)
+	}
+	if b.policy == ConsistentHash {
+		return b.endpoints[b.lookup(HashKey(b.key(payload)))], nil
+	}
+	return b.endpoints[b.next()], nil
+}
+
+// rebuild resets the state for a new endpoint set. Callers hold b.mu.
+func (b *Balancer) rebuild(eps []Endpoint) {
+	b.endpoints = slices.Clone(eps)
+	b.current = make([]int, len(eps))
+	b.ring = b.ring[:0]
+	if b.policy != ConsistentHash {
+		return
+	}
+	var buf []byte
+	for i, ep := range b.endpoints {
+		for v := range ep.weight() * b.vnodes {
+			buf = strconv.AppendInt(append(append(buf[:0], ep.Addr...), '#'), int64(v), 10)
+			b.ring = append(b.ring, ringPoint{HashKey(buf), i})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+}
+
+// next advances smooth weighted round-robin. Callers hold b.mu.
+func (b *Balancer) next() int {
+	best, total := 0, 0
+	for i, ep := range b.endpoints {
+		w := ep.weight()
+		b.current[i] += w
+		total += w
+		if b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	b.current[best] -= total
+	return best
+}
+
+// lookup returns the endpoint owning h on the ring. Callers hold b.mu.
+func (b *Balancer) lookup(h uint64) int {
+	i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	if i == len(b.ring) {
+		i = 0
+	}
+	return b.ring[i].endpoint
+}
+
+// HashKey is FNV-1a followed by a 64-bit finalizer, which spreads
+// near-identical keys, such as virtual node names, evenly.
+func HashKey(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,49 @@
+// Package discovery maps backend service names to endpoints and spreads
+// calls across them.
+//
+// A service name is the Service part of a "Service.Method" command mapping
+// (see protocol.ServiceName). Resolvers answer which endpoints serve it:
+// Static from configuration, File from a watched file, DNSSRV from DNS SRV
+// records. A Balancer picks one endpoint per call, by weighted round-robin or
+// by consistent hashing on a key derived from the request payload.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Endpoint is one backend instance.
+type Endpoint struct {
+	// Addr is "host:port".
+	Addr string `json:"addr" yaml:"addr"`
+	// Weight is the relative share of traffic; values <= 0 count as 1.
+	Weight int `json:"weight,omitempty" yaml:"weight,omitempty"`
+}
+
+func (e Endpoint) weight() int {
+	return max(e.Weight, 1)
+}
+
+// ErrNoEndpoints is returned when a service has no endpoints.
+var ErrNoEndpoints = errors.New("discovery: no endpoints")
+
+// Resolver returns the current endpoints of a service. Implementations are
+// safe for concurrent use and cheap to call: they refresh in the background
+// or cache, so a Balancer may resolve on every pick. The returned slice must
+// not be modified.
+type Resolver interface {
+	Resolve(ctx context.Context, service string) ([]Endpoint, error)
+}
+
+// Static is a Resolver over a fixed service → endpoints table.
+type Static map[string][]Endpoint
+
+func (s Static) Resolve(_ context.Context, service string) ([]Endpoint, error) {
+	eps := s[service]
+	if len(eps) == 0 {
+		return nil, fmt.Errorf("%w for service %q", ErrNoEndpoints, service)
+	}
+	return eps, nil
+}
@@ -0,0 +1,294 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaticResolve(t *testing.T) {
+	s := Static{"UserService": {{Addr: "10.0.0.1:8001"}}}
+	eps, err := s.Resolve(context.Background(), "UserService")
+	if err != nil || len(eps) != 1 || eps[0].Addr != "10.0.0.1:8001" {
+		t.Fatalf("Resolve = %v, %v", eps, err)
+	}
+	if _, err := s.Resolve(context.Background(), "OrderService"); !errors.Is(err, ErrNoEndpoints) {
+		t.Fatalf("unknown service: err = %v, want ErrNoEndpoints", err)
+	}
+}
+
+func TestFileResolverReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.yaml")
+	write := func(content string, mod time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write("UserService:\n  - addr: 10.0.0.1:8001\n    weight: 2\n", start)
+
+	f, err := NewFile(path)
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	eps, err := f.Resolve(context.Background(), "UserService")
+	if err != nil || !slices.Equal(eps, []Endpoint{{Addr: "10.0.0.1:8001", Weight: 2}}) {
+		t.Fatalf("Resolve = %v, %v", eps, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.Watch(ctx, 5*time.Millisecond)
+
+	write("UserService:\n  - addr: 10.0.0.2:8001\n", start.Add(time.Minute))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		eps, _ = f.Resolve(context.Background(), "UserService")
+		if len(eps) == 1 && eps[0].Addr == "10.0.0.2:8001" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("endpoints not reloaded: %v", eps)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// A broken file keeps the last good table.
+	if err := os.WriteFile(path, []byte("UserService: [\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, start.Add(2*time.Minute), start.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.reload(); err == nil {
+		t.Fatal("reload of a broken file succeeded")
+	}
+	if eps, err := f.Resolve(context.Background(), "UserService"); err != nil || eps[0].Addr != "10.0.0.2:8001" {
+		t.Fatalf("after broken reload: %v, %v", eps, err)
+	}
+}
+
+func TestFileResolverJSONAndValidation(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "endpoints.json")
+	if err := os.WriteFile(good, []byte(`{"OrderService":[{"addr":"10.0.0.3:9000"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(good)
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	if eps, err := f.Resolve(context.Background(), "OrderService"); err != nil || eps[0].Addr != "10.0.0.3:9000" {
+		t.Fatalf("Resolve = %v, %v", eps, err)
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(bad, []byte(`{"OrderService":[{"weight":1}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFile(bad); err == nil {
+		t.Fatal("endpoint without addr accepted")
+	}
+	if _, err := NewFile(filepath.Join(dir, "endpoints.txt")); err == nil {
+		t.Fatal("missing file accepted")
+	}
+}
+
+func TestDNSSRVResolve(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		names []string
+		fail  bool
+	)
+	d := &DNSSRV{
+		Domain: "svc.local",
+		TTL:    time.Hour,
+		Lookup: func(_ context.Context, name string) ([]*net.SRV, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			names = append(names, name)
+			if fail {
+				return nil, errors.New("servfail")
+			}
+			return []*net.SRV{
+				{Target: "a.svc.local.", Port: 8001, Priority: 10, Weight: 3},
+				{Target: "b.svc.local.", Port: 8001, Priority: 10, Weight: 1},
+				{Target: "backup.svc.local.", Port: 8001, Priority: 20, Weight: 1},
+			}, nil
+		},
+	}
+
+	want := []Endpoint{{Addr: "a.svc.local:8001", Weight: 3}, {Addr: "b.svc.local:8001", Weight: 1}}
+	eps, err := d.Resolve(context.Background(), "UserService")
+	if err != nil || !slices.Equal(eps, want) {
+		t.Fatalf("Resolve = %v, %v; want %v", eps, err, want)
+	}
+	if _, err := d.Resolve(context.Background(), "UserService"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if !slices.Equal(names, []string{"_userservice._tcp.svc.local"}) {
+		t.Fatalf("lookups = %v, want one cached lookup", names)
+	}
+	fail = true
+	mu.Unlock()
+
+	// An expired answer is still served when the refresh fails.
+	expire(d, "UserService")
+	if eps, err := d.Resolve(context.Background(), "UserService"); err != nil || !slices.Equal(eps, want) {
+		t.Fatalf("stale Resolve = %v, %v", eps, err)
+	}
+	if _, err := d.Resolve(context.Background(), "OrderService"); err == nil {
+		t.Fatal("failed lookup without a cached answer succeeded")
+	}
+}
+
+// expire marks the cached answer for service as expired.
+func expire(d *DNSSRV, service string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e := d.cache[service]
+	e.expires = time.Now().Add(-time.Second)
+	d.cache[service] = e
+}
+
+func TestDNSSRVRefreshesInBackground(t *testing.T) {
+	var lookups atomic.Int32
+	release := make(chan struct{})
+	d := &DNSSRV{
+		Lookup: func(_ context.Context, name string) ([]*net.SRV, error) {
+			if lookups.Add(1) > 1 {
+				<-release
+			}
+			return []*net.SRV{{Target: fmt.Sprintf("v%d.", lookups.Load()), Port: 80}}, nil
+		},
+	}
+	if _, err := d.Resolve(context.Background(), "S"); err != nil {
+		t.Fatal(err)
+	}
+	expire(d, "S")
+
+	// While the refresh hangs every caller gets the stale answer at once.
+	for range 5 {
+		eps, err := d.Resolve(context.Background(), "S")
+		if err != nil || eps[0].Addr != "v1:80" {
+			t.Fatalf("Resolve during refresh = %v, %v", eps, err)
+		}
+	}
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		eps, _ := d.Resolve(context.Background(), "S")
+		if eps[0].Addr == "v2:80" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refreshed answer never served")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := lookups.Load(); n != 2 {
+		t.Fatalf("%d lookups, want one refresh", n)
+	}
+}
+
+func TestDNSSRVZeroWeights(t *testing.T) {
+	answers := map[string][]*net.SRV{
+		"_mixed._tcp": {
+			{Target: "a.", Port: 80, Weight: 2},
+			{Target: "b.", Port: 80, Weight: 0},
+		},
+		"_zero._tcp": {
+			{Target: "a.", Port: 80, Weight: 0},
+			{Target: "b.", Port: 80, Weight: 0},
+		},
+	}
+	d := &DNSSRV{Lookup: func(_ context.Context, name string) ([]*net.SRV, error) {
+		return answers[name], nil
+	}}
+	for service, want := range map[string][]int{
+		"Mixed": {2 * srvZeroWeightShare, 1},
+		"Zero":  {1, 1},
+	} {
+		eps, err := d.Resolve(context.Background(), service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, ep := range eps {
+			got = append(got, ep.Weight)
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("%s weights = %v, want %v", service, got, want)
+		}
+	}
+}
+
+func TestBalancerSmoothWeightedRoundRobin(t *testing.T) {
+	r := Static{"S": {{Addr: "a", Weight: 3}, {Addr: "b", Weight: 1}}}
+	b := NewBalancer(r, "S", BalancerConfig{})
+	var got []string
+	for range 8 {
+		ep, err := b.Pick(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ep.Addr)
+	}
+	want := []string{"a", "a", "b", "a", "a", "a", "b", "a"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("picks = %v, want %v", got, want)
+	}
+}
+
+func TestBalancerConsistentHash(t *testing.T) {
+	r := Static{"S": {{Addr: "a"}, {Addr: "b"}, {Addr: "c"}}}
+	b := NewBalancer(r, "S", BalancerConfig{
+		Policy: ConsistentHash,
+		// Key on the first 4 bytes, e.g. a user id prefix.
+		Key: func(p []byte) []byte { return p[:4] },
+	})
+	ctx := context.Background()
+
+	const keys = 3000
+	before := make([]string, keys)
+	counts := map[string]int{}
+	for i := range keys {
+		ep, err := b.Pick(ctx, []byte(fmt.Sprintf("%04d-payload", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[i] = ep.Addr
+		counts[ep.Addr]++
+		again, _ := b.Pick(ctx, []byte(fmt.Sprintf("%04d-other", i)))
+		if again != ep {
+			t.Fatalf("key %d moved between picks: %v then %v", i, ep, again)
+		}
+	}
+	for _, addr := range []string{"a", "b", "c"} {
+		if n := counts[addr]; n < keys/5 {
+			t.Fatalf("endpoint %s got %d of %d keys: %v", addr, n, keys, counts)
+		}
+	}
+
+	// Removing c moves only the keys c owned.
+	r["S"] = []Endpoint{{Addr: "a"}, {Addr: "b"}}
+	for i := range keys {
+		ep, _ := b.Pick(ctx, []byte(fmt.Sprintf("%04d-payload", i)))
+		if before[i] != "c" && ep.Addr != before[i] {
+			t.Fatalf("key %d moved from %s to %s", i, before[i], ep.Addr)
+		}
+	}
+}
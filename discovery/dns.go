@@ -0,0 +1,169 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDNSTTL is how long a DNSSRV resolver caches an answer.
+const DefaultDNSTTL = 30 * time.Second
+
+// DNSSRV is a Resolver over DNS SRV records. Service "UserService" in
+// Domain "svc.cluster.local" is looked up as
+// "_userservice._tcp.svc.cluster.local".
+//
+// Only the records of the lowest (most preferred) priority are used, and
+// their SRV weights become endpoint weights. As in RFC 2782, records of
+// weight 0 share the traffic equally when the whole priority has weight 0,
+// and otherwise only get a very small share of it.
+//
+// Answers are cached for TTL. An expired answer keeps being served while a
+// single background lookup refreshes it, and also when that refresh fails;
+// concurrent first lookups of a service share one query.
+type DNSSRV struct {
+	Domain string
+	// TTL defaults to DefaultDNSTTL.
+	TTL time.Duration
+	// Name overrides the record name of a service.
+	Name func(service string) string
+	// Lookup overrides net.DefaultResolver, mainly for tests.
+	Lookup func(ctx context.Context, name string) ([]*net.SRV, error)
+
+	mu       sync.Mutex
+	cache    map[string]srvEntry
+	inflight map[string]*srvLookup
+}
+
+type srvEntry struct {
+	endpoints []Endpoint
+	expires   time.Time
+}
+
+// srvLookup is a query shared by the callers waiting for it.
+type srvLookup struct {
+	done      chan struct{}
+	endpoints []Endpoint
+	err       error
+}
+
+// srvZeroWeightShare is how many times more traffic a weight 1 record gets
+// than a weight 0 record of the same priority.
+const srvZeroWeightShare = 100
+
+func (d *DNSSRV) Resolve(ctx context.Context, service string) ([]Endpoint, error) {
+	d.mu.Lock()
+	cached, ok := d.cache[service]
+	if ok && time.Now().Before(cached.expires) {
+		d.mu.Unlock()
+		return cached.endpoints, nil
+	}
+	l, running := d.inflight[service]
+	if !running {
+		l = &srvLookup{done: make(chan struct{})}
+		if d.inflight == nil {
+			d.inflight = make(map[string]*srvLookup)
+		}
+		d.inflight[service] = l
+		// The query outlives the caller starting it: others share it, and a
+		// refresh runs in the background.
+		go d.refresh(context.WithoutCancel(ctx), service, l)
+	}
+	d.mu.Unlock()
+	if ok {
+		return cached.endpoints, nil
+	}
+
+	select {
+	case <-l.done:
+		return l.endpoints, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// refresh looks service up, caches the answer and publishes it in l.
+func (d *DNSSRV) refresh(ctx context.Context, service string, l *srvLookup) {
+	eps, err := d.lookup(ctx, service)
+	ttl := d.TTL
+	if ttl <= 0 {
+		ttl = DefaultDNSTTL
+	}
+	d.mu.Lock()
+	delete(d.inflight, service)
+	if err == nil {
+		if d.cache == nil {
+			d.cache = make(map[string]srvEntry)
+		}
+		d.cache[service] = srvEntry{endpoints: eps, expires: time.Now().Add(ttl)}
+	} else if _, stale := d.cache[service]; stale {
+		log.Printf("discovery: serving stale endpoints of %q: %v", service, err)
+	}
+	d.mu.Unlock()
+	l.endpoints, l.err = eps, err
+	close(l.done)
+}
+
+func (d *DNSSRV) recordName(service string) string {
+	if d.Name != nil {
+		return d.Name(service)
+	}
+	name := "_" + strings.ToLower(service) + "._tcp"
+	if d.Domain != "" {
+		name += "." + strings.TrimSuffix(d.Domain, ".")
+	}
+	return name
+}
+
+func (d *DNSSRV) lookup(ctx context.Context, service string) ([]Endpoint, error) {
+	name := d.recordName(service)
+	lookup := d.Lookup
+	if lookup == nil {
+		lookup = func(ctx context.Context, name string) ([]*net.SRV, error) {
+			_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+			return srvs, err
+		}
+	}
+	srvs, err := lookup(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: lookup %s: %w", name, err)
+	}
+	if len(srvs) == 0 {
+		return nil, fmt.Errorf("%w for service %q (%s)", ErrNoEndpoints, service, name)
+	}
+
+	best := srvs[0].Priority
+	for _, s := range srvs[1:] {
+		best = min(best, s.Priority)
+	}
+	// Endpoint weights below 1 count as 1, so a priority mixing weight 0
+	// records with weighted ones is scaled to keep the former rare.
+	zero, weighted := false, false
+	for _, s := range srvs {
+		if s.Priority == best {
+			zero = zero || s.Weight == 0
+			weighted = weighted || s.Weight > 0
+		}
+	}
+	scale := 1
+	if zero && weighted {
+		scale = srvZeroWeightShare
+	}
+	var eps []Endpoint
+	for _, s := range srvs {
+		if s.Priority != best {
+			continue
+		}
+		host := strings.TrimSuffix(s.Target, ".")
+		eps = append(eps, Endpoint{
+			Addr:   net.JoinHostPort(host, strconv.Itoa(int(s.Port))),
+			Weight: max(int(s.Weight)*scale, 1),
+		})
+	}
+	return eps, nil
+}
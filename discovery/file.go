@@ -0,0 +1,115 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFilePollInterval is how often a File resolver checks its file.
+const DefaultFilePollInterval = 2 * time.Second
+
+// File is a Resolver backed by a JSON or YAML file (by extension) mapping
+// service names to endpoint lists:
+//
+//	UserService:
+//	  - addr: 10.0.0.1:8001
+//	    weight: 2
+//	  - addr: 10.0.0.2:8001
+//
+// The file is reloaded when its modification time or size changes. A file
+// that fails to load is logged and the previous table stays in use.
+type File struct {
+	path  string
+	table atomic.Pointer[Static]
+
+	mu   sync.Mutex // serializes reloads
+	stat fileStamp
+}
+
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+// NewFile loads path and returns its resolver. Call Watch to pick up changes.
+func NewFile(path string) (*File, error) {
+	f := &File{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) Resolve(ctx context.Context, service string) ([]Endpoint, error) {
+	return f.table.Load().Resolve(ctx, service)
+}
+
+// Watch polls the file every interval (DefaultFilePollInterval if <= 0)
+// until ctx is done.
+func (f *File) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultFilePollInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := f.reload(); err != nil {
+				log.Printf("discovery: keeping previous endpoints of %s: %v", f.path, err)
+			}
+		}
+	}
+}
+
+// reload reads the file if it changed since the last successful load.
+func (f *File) reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	stamp := fileStamp{fi.ModTime(), fi.Size()}
+	if f.table.Load() != nil && stamp == f.stat {
+		return nil
+	}
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	var table Static
+	switch ext := strings.ToLower(filepath.Ext(f.path)); ext {
+	case ".json":
+		err = json.Unmarshal(b, &table)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &table)
+	default:
+		return fmt.Errorf("unsupported endpoints file extension: %q", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("load %s: %w", f.path, err)
+	}
+	for service, eps := range table {
+		for _, ep := range eps {
+			if ep.Addr == "" {
+				return fmt.Errorf("load %s: service %q has an endpoint without addr", f.path, service)
+			}
+		}
+	}
+	f.table.Store(&table)
+	f.stat = stamp
+	return nil
+}
@@ -0,0 +1,252 @@
+package novagate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// FaultKind is a fault a FaultInjector can inject.
+type FaultKind string
+
+const (
+	// FaultLatency delays the request by FaultRule.Latency.
+	FaultLatency FaultKind = "latency"
+	// FaultError answers with a StatusError instead of calling the handler.
+	FaultError FaultKind = "error"
+	// FaultDrop serves the request but sends no response.
+	FaultDrop FaultKind = "drop"
+	// FaultReset serves the request, then resets the connection (TCP RST)
+	// instead of responding.
+	FaultReset FaultKind = "reset"
+	// FaultCorrupt serves the request and flips the last byte of the
+	// response frame, so the peer sees a checksum, decompression or payload
+	// error.
+	FaultCorrupt FaultKind = "corrupt"
+)
+
+func (k FaultKind) valid() bool {
+	switch k {
+	case FaultLatency, FaultError, FaultDrop, FaultReset, FaultCorrupt:
+		return true
+	}
+	return false
+}
+
+// FaultRule injects one kind of fault into a share of the requests. In JSON,
+// Latency is a Go duration string such as "200ms".
+type FaultRule struct {
+	// Command selects the command; 0 matches every command.
+	Command uint16    `yaml:"command"`
+	Kind    FaultKind `yaml:"kind"`
+	// Probability is the share of matching requests affected, in (0, 1].
+	Probability float64 `yaml:"probability"`
+	// Latency is the delay added by FaultLatency.
+	Latency time.Duration `yaml:"latency"`
+	// Code and Message make up the FaultError reply (default
+	// protocol.StatusUnavailable, "injected fault").
+	Code    uint16 `yaml:"code"`
+	Message string `yaml:"message"`
+}
+
+// faultRuleJSON is the JSON form of FaultRule.
+type faultRuleJSON struct {
+	Command     uint16    `json:"command"`
+	Kind        FaultKind `json:"kind"`
+	Probability float64   `json:"probability"`
+	Latency     string    `json:"latency,omitempty"`
+	Code        uint16    `json:"code,omitempty"`
+	Message     string    `json:"message,omitempty"`
+}
+
+func (r FaultRule) MarshalJSON() ([]byte, error) {
+	j := faultRuleJSON{Command: r.Command, Kind: r.Kind, Probability: r.Probability, Code: r.Code, Message: r.Message}
+	if r.Latency > 0 {
+		j.Latency = r.Latency.String()
+	}
+	return json.Marshal(j)
+}
+
+func (r *FaultRule) UnmarshalJSON(b []byte) error {
+	var j faultRuleJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	*r = FaultRule{Command: j.Command, Kind: j.Kind, Probability: j.Probability, Code: j.Code, Message: j.Message}
+	if j.Latency != "" {
+		d, err := time.ParseDuration(j.Latency)
+		if err != nil {
+			return fmt.Errorf("fault latency: %w", err)
+		}
+		r.Latency = d
+	}
+	return nil
+}
+
+// Validate reports whether the rule can be injected.
+func (r FaultRule) Validate() error {
+	if !r.Kind.valid() {
+		return fmt.Errorf("unknown fault kind %q", r.Kind)
+	}
+	if !(r.Probability > 0 && r.Probability <= 1) {
+		return fmt.Errorf("fault probability %v is not in (0, 1]", r.Probability)
+	}
+	if r.Kind == FaultLatency && r.Latency <= 0 {
+		return errors.New("latency fault needs a positive latency")
+	}
+	if r.Latency < 0 {
+		return errors.New("negative fault latency")
+	}
+	return nil
+}
+
+// FaultState is the configuration of a FaultInjector.
+type FaultState struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Rules are applied in order; several latency rules add up, and the
+	// first other fault that fires ends the request.
+	Rules []FaultRule `json:"rules" yaml:"rules"`
+}
+
+// faultStats counts injected faults by kind under "faults" in the novagate
+// expvar map.
+var faultStats = func() *expvar.Map {
+	m := new(expvar.Map)
+	metrics.Set("faults", m)
+	return m
+}()
+
+// FaultInjector injects latency, errors, dropped responses, connection
+// resets and corrupted frames into the requests of chosen commands, for
+// testing how clients cope. It starts disabled and costs one atomic load per
+// request until enabled, so it can stay compiled into production builds and
+// be switched on through the admin API (see NewAdminHandler).
+type FaultInjector struct {
+	state atomic.Pointer[FaultState]
+}
+
+// NewFaultInjector returns a disabled injector without rules; install it
+// with Router.InjectFaults.
+func NewFaultInjector() *FaultInjector {
+	f := &FaultInjector{}
+	f.state.Store(&FaultState{})
+	return f
+}
+
+// State returns the current configuration.
+func (f *FaultInjector) State() FaultState {
+	st := *f.state.Load()
+	st.Rules = slices.Clone(st.Rules)
+	if st.Rules == nil {
+		st.Rules = []FaultRule{}
+	}
+	return st
+}
+
+// Set validates st and makes it the current configuration.
+func (f *FaultInjector) Set(st FaultState) error {
+	for i, r := range st.Rules {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("fault rules[%d]: %w", i, err)
+		}
+	}
+	st.Rules = slices.Clone(st.Rules)
+	f.state.Store(&st)
+	return nil
+}
+
+// Middleware returns the middleware injecting the faults.
+func (f *FaultInjector) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			st := f.state.Load()
+			if !st.Enabled {
+				return next(ctx, m)
+			}
+			for _, r := range st.Rules {
+				if (r.Command != 0 && r.Command != m.Command) || rand.Float64() >= r.Probability {
+					continue
+				}
+				faultStats.Add(string(r.Kind), 1)
+				switch r.Kind {
+				case FaultLatency:
+					t := time.NewTimer(r.Latency)
+					select {
+					case <-t.C:
+					case <-ctx.Done():
+						t.Stop()
+						return nil, ctx.Err()
+					}
+				case FaultError:
+					return nil, r.statusError()
+				case FaultDrop:
+					_, err := next(ctx, m)
+					return nil, err
+				case FaultReset, FaultCorrupt:
+					resp, err := next(ctx, m)
+					if err != nil {
+						return nil, err
+					}
+					return nil, &faultError{kind: r.Kind, resp: resp}
+				}
+			}
+			return next(ctx, m)
+		}
+	}
+}
+
+func (r FaultRule) statusError() *StatusError {
+	se := &StatusError{Code: r.Code, Message: r.Message}
+	if se.Code == 0 {
+		se.Code = protocol.StatusUnavailable
+	}
+	if se.Message == "" {
+		se.Message = "injected fault"
+	}
+	return se
+}
+
+// faultError carries a fault the connection acts out: FaultReset or
+// FaultCorrupt with the response to corrupt. Anywhere else, such as on the
+// HTTP bridge, it is a plain handler error.
+type faultError struct {
+	kind FaultKind
+	resp *protocol.Message
+}
+
+func (e *faultError) Error() string {
+	return "injected fault: " + string(e.kind)
+}
+
+// resetConn makes closing conn send a TCP RST instead of a FIN. Other
+// connections, such as WebSockets, are just closed.
+func resetConn(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case interface{ SetLinger(int) error }:
+			_ = c.SetLinger(0)
+			return
+		case *proxyConn:
+			conn = c.Conn
+		default:
+			return
+		}
+	}
+}
+
+// corruptFrame flips the last byte of an encoded frame: the checksum trailer
+// if there is one, else the end of the (possibly compressed) body.
+func corruptFrame(frame []byte) {
+	if len(frame) > 0 {
+		frame[len(frame)-1] ^= 0xFF
+	}
+}
@@ -0,0 +1,183 @@
+package novagate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func TestFaultInjectorMiddleware(t *testing.T) {
+	f := NewFaultInjector()
+	calls := 0
+	h := f.Middleware()(func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		calls++
+		return &protocol.Message{Command: m.Command, Payload: []byte("ok")}, nil
+	})
+	call := func(cmd uint16) (*protocol.Message, error) {
+		return h(context.Background(), &protocol.Message{Command: cmd})
+	}
+
+	// Rules do nothing until enabled.
+	if err := f.Set(FaultState{Rules: []FaultRule{{Kind: FaultError, Probability: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := call(protocol.CmdPing); err != nil || string(resp.Payload) != "ok" {
+		t.Fatalf("disabled injector: %v, %v", resp, err)
+	}
+
+	if err := f.Set(FaultState{Enabled: true, Rules: []FaultRule{
+		{Command: protocol.CmdPing, Kind: FaultLatency, Probability: 1, Latency: 30 * time.Millisecond},
+		{Command: protocol.CmdUserLogin, Kind: FaultError, Probability: 1, Code: protocol.StatusRateLimited},
+		{Command: protocol.CmdOrderCreate, Kind: FaultDrop, Probability: 1},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if resp, err := call(protocol.CmdPing); err != nil || string(resp.Payload) != "ok" {
+		t.Fatalf("latency fault: %v, %v", resp, err)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("latency fault took %v, want >= 30ms", d)
+	}
+
+	calls = 0
+	var se *StatusError
+	if _, err := call(protocol.CmdUserLogin); !errors.As(err, &se) || se.Code != protocol.StatusRateLimited || se.Message != "injected fault" {
+		t.Fatalf("error fault: %v", err)
+	}
+	if calls != 0 {
+		t.Fatal("error fault called the handler")
+	}
+	if resp, err := call(protocol.CmdOrderCreate); resp != nil || err != nil || calls != 1 {
+		t.Fatalf("drop fault: %v, %v after %d calls", resp, err, calls)
+	}
+	if resp, err := call(0x0E05); err != nil || resp == nil {
+		t.Fatalf("unlisted command: %v, %v", resp, err)
+	}
+
+	for _, r := range []FaultRule{
+		{Kind: "slow", Probability: 1},
+		{Kind: FaultDrop},
+		{Kind: FaultDrop, Probability: 1.5},
+		{Kind: FaultLatency, Probability: 1},
+	} {
+		if err := f.Set(FaultState{Rules: []FaultRule{r}}); err == nil {
+			t.Errorf("invalid rule accepted: %+v", r)
+		}
+	}
+}
+
+func TestFaultResetAndCorruptFrames(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	f := NewFaultInjector()
+	setup := func(r *Router) error {
+		r.InjectFaults(f)
+		return echoSetup(r)
+	}
+	go func() { _ = ServeWithContext(ctx, ln, setup) }()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := f.Set(FaultState{Enabled: true, Rules: []FaultRule{{Kind: FaultCorrupt, Probability: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	writeFrame(t, c, protocol.FlagChecksum, &protocol.Message{Command: protocol.CmdPing, RequestID: 1, Payload: []byte("x")})
+	frame := readRawFrame(t, c)
+	var ce *protocol.ChecksumError
+	if _, err := protocol.DecodeFrameBody(frame); !errors.As(err, &ce) {
+		t.Fatalf("corrupted frame decoded with err = %v, want a checksum error", err)
+	}
+
+	if err := f.Set(FaultState{Enabled: true, Rules: []FaultRule{{Command: protocol.CmdPing, Kind: FaultReset, Probability: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	writeFrame(t, c, 0, &protocol.Message{Command: protocol.CmdPing, RequestID: 2})
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 64)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("read after reset fault: %v, want ECONNRESET", err)
+	}
+}
+
+// readRawFrame reads one frame from c without checking its body.
+func readRawFrame(t *testing.T, c net.Conn) *protocol.Frame {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var buf []byte
+	tmp := make([]byte, 4096)
+	for {
+		frame, _, err := protocol.Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame != nil {
+			return frame
+		}
+		n, err := c.Read(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = append(buf, tmp[:n]...)
+	}
+}
+
+func TestAdminAPIFaults(t *testing.T) {
+	r := NewRouter()
+	srv := httptest.NewServer(NewAdminHandler(r))
+	defer srv.Close()
+	do := func(method, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+"/admin/faults", strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	if code, _ := do(http.MethodGet, ""); code != http.StatusNotFound {
+		t.Fatalf("GET without injector = %d, want 404", code)
+	}
+
+	f := NewFaultInjector()
+	r.InjectFaults(f)
+	code, body := do(http.MethodPut, `{"enabled": true, "rules": [{"command": 1, "kind": "latency", "probability": 0.5, "latency": "200ms"}]}`)
+	if code != http.StatusOK || !strings.Contains(body, `"latency":"200ms"`) {
+		t.Fatalf("PUT = %d %s", code, body)
+	}
+	if st := f.State(); !st.Enabled || len(st.Rules) != 1 || st.Rules[0].Latency != 200*time.Millisecond {
+		t.Fatalf("state after PUT = %+v", st)
+	}
+
+	// Switching off keeps the rules.
+	if code, _ := do(http.MethodPut, `{"enabled": false}`); code != http.StatusOK {
+		t.Fatalf("PUT enabled=false = %d", code)
+	}
+	if st := f.State(); st.Enabled || len(st.Rules) != 1 {
+		t.Fatalf("state after disable = %+v", st)
+	}
+	if code, body := do(http.MethodPut, `{"rules": [{"kind": "explode", "probability": 1}]}`); code != http.StatusBadRequest {
+		t.Fatalf("PUT invalid rule = %d %s", code, body)
+	}
+	if code, body := do(http.MethodGet, ""); code != http.StatusOK || !strings.Contains(body, `"enabled":false`) || !strings.Contains(body, `"kind":"latency"`) {
+		t.Fatalf("GET = %d %s", code, body)
+	}
+}
@@ -0,0 +1,74 @@
+package novagate
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func TestChecksumNegotiatedPerConnection(t *testing.T) {
+	c := serveForTest(t)
+	fr := &frameReader{c: c}
+
+	// Plain requests get plain responses.
+	writeFrame(t, c, 0, &protocol.Message{Command: protocol.CmdPing, RequestID: 1, Payload: []byte("a")})
+	f, _, err := fr.next(time.Second)
+	if err != nil || f.Flags&protocol.FlagChecksum != 0 {
+		t.Fatalf("plain response = %+v, %v", f, err)
+	}
+
+	// Once the client sends a checksummed frame, every response carries one.
+	writeFrame(t, c, protocol.FlagChecksum, &protocol.Message{Command: protocol.CmdPing, RequestID: 2, Payload: []byte("b")})
+	writeFrame(t, c, 0, &protocol.Message{Command: protocol.CmdPing, RequestID: 3, Payload: []byte("c")})
+	for id := uint64(2); id <= 3; id++ {
+		f, m, err := fr.next(time.Second)
+		if err != nil {
+			t.Fatalf("response %d: %v", id, err)
+		}
+		if f.Flags&protocol.FlagChecksum == 0 || f.Checksum != protocol.Checksum(f.Body) {
+			t.Fatalf("response %d flags %#x checksum %#x", id, f.Flags, f.Checksum)
+		}
+		if m.RequestID != id {
+			t.Fatalf("response RequestID = %d, want %d", m.RequestID, id)
+		}
+	}
+}
+
+func TestCorruptFrameCountedSeparately(t *testing.T) {
+	c := serveForTest(t)
+	corrupt, malformed := metricFramesCorrupt.Value(), metricFramesMalformed.Value()
+
+	wire, err := protocol.EncodeMessageFrameTo(nil, protocol.FlagChecksum, &protocol.Message{Command: protocol.CmdPing, RequestID: 1, Payload: []byte("payload")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire[len(wire)-5] ^= 0xFF
+	if _, err := c.Write(wire); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server drops the connection without answering.
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := c.Read(make([]byte, 64)); err == nil {
+		t.Fatalf("read %d bytes after corrupt frame, want connection closed", n)
+	}
+	if got := metricFramesCorrupt.Value() - corrupt; got != 1 {
+		t.Fatalf("frames_corrupt delta = %d, want 1", got)
+	}
+	if got := metricFramesMalformed.Value() - malformed; got != 0 {
+		t.Fatalf("frames_malformed delta = %d, want 0", got)
+	}
+}
+
+func writeFrame(t *testing.T, c net.Conn, flags uint8, m *protocol.Message) {
+	t.Helper()
+	wire, err := protocol.EncodeMessageFrameTo(nil, flags, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(wire); err != nil {
+		t.Fatal(err)
+	}
+}
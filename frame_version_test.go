@@ -0,0 +1,41 @@
+package novagate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func TestVersion2FramesOnBothTransports(t *testing.T) {
+	for _, name := range []string{TransportNet, TransportNetpoll} {
+		c := serveForTest(t, WithTransport(name))
+		fr := &frameReader{c: c}
+
+		// v1 clients keep getting v1 responses.
+		if m := pingRoundTrip(t, c, 1, []byte("v1")); m.RequestID != 1 {
+			t.Fatalf("%s: v1 RequestID = %d", name, m.RequestID)
+		}
+
+		// An empty-payload v2 ping is a 7-byte frame, shorter than a v1 header.
+		for id := uint64(2); id <= 3; id++ {
+			wire, err := protocol.AppendFrame(nil, protocol.FrameVersion2, 0, &protocol.Message{Command: protocol.CmdPing, RequestID: id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(wire) != 7 {
+				t.Fatalf("v2 ping is %d bytes", len(wire))
+			}
+			if _, err := c.Write(wire); err != nil {
+				t.Fatal(err)
+			}
+			f, m, err := fr.next(2 * time.Second)
+			if err != nil {
+				t.Fatalf("%s: read: %v", name, err)
+			}
+			if f.Version != protocol.FrameVersion2 || m.RequestID != id {
+				t.Fatalf("%s: response version %d, %+v", name, f.Version, m)
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package novagate
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// minHeartbeatInterval bounds intervals advertised by clients.
+const minHeartbeatInterval = 100 * time.Millisecond
+
+// WithHeartbeat enables the liveness policy. The server sends a PING control
+// frame (protocol.FlagControl) after interval without inbound traffic and
+// closes the connection if the matching PONG does not arrive within timeout.
+// This detects half-open connections without closing quiet but healthy
+// clients. Any inbound bytes count as a PONG, and the policy is paused while
+// a request is being handled, since the peer's PONG is not read until the
+// handler returns. A client can ask for a different interval with a CtrlHeartbeat
+// frame. Use interval <= 0 to disable it (the default).
+//
+// Liveness is independent of WithIdleTimeout, which closes connections that
+// send nothing at all; PONGs count as traffic for the idle policy.
+func WithHeartbeat(interval, timeout time.Duration) ServeOption {
+	return func(o *serveOptions) {
+		o.heartbeatInterval = interval
+		o.heartbeatTimeout = timeout
+	}
+}
+
+// WithTCPKeepAlive configures OS-level TCP keepalive probes on accepted TCP
+// connections. Under the netpoll transport only cfg.Idle is applied.
+func WithTCPKeepAlive(cfg net.KeepAliveConfig) ServeOption {
+	return func(o *serveOptions) {
+		o.keepAlive = &cfg
+	}
+}
+
+func applyKeepAlive(c net.Conn, so serveOptions) {
+	if so.keepAlive == nil {
+		return
+	}
+	if pc, ok := c.(*proxyConn); ok {
+		c = pc.Conn
+	}
+	switch tc := c.(type) {
+	case *net.TCPConn:
+		_ = tc.SetKeepAliveConfig(*so.keepAlive)
+	case interface{ SetIdleTimeout(time.Duration) error }:
+		if so.keepAlive.Enable && so.keepAlive.Idle > 0 {
+			_ = tc.SetIdleTimeout(so.keepAlive.Idle)
+		}
+	}
+}
+
+// heartbeat drives the liveness policy of one connection with a single
+// runtime timer, so a quiet connection costs no goroutine.
+type heartbeat struct {
+	conn    net.Conn
+	out     *connWriter
+	timeout time.Duration
+
+	mu       sync.Mutex
+	interval time.Duration
+	timer    *time.Timer
+	seq      uint64
+	pending  uint64 // RequestID of the unanswered PING, 0 if none
+	busy     int    // requests being handled; PINGs wait while non-zero
+	stopped  bool
+}
+
+func startHeartbeat(conn net.Conn, out *connWriter, so serveOptions) *heartbeat {
+	if so.heartbeatInterval <= 0 {
+		return nil
+	}
+	timeout := so.heartbeatTimeout
+	if timeout <= 0 {
+		timeout = so.heartbeatInterval
+	}
+	h := &heartbeat{conn: conn, out: out, timeout: timeout, interval: so.heartbeatInterval}
+	h.mu.Lock()
+	h.timer = time.AfterFunc(h.interval, h.fire)
+	h.mu.Unlock()
+	return h
+}
+
+func (h *heartbeat) fire() {
+	h.mu.Lock()
+	if h.stopped || h.busy > 0 {
+		h.mu.Unlock()
+		return
+	}
+	if h.pending != 0 {
+		h.stopped = true
+		h.mu.Unlock()
+		metricHeartbeatTimeouts.Add(1)
+		_ = h.conn.Close()
+		return
+	}
+	h.seq++
+	h.pending = h.seq
+	seq := h.seq
+	h.timer.Reset(h.timeout)
+	h.mu.Unlock()
+
+	metricHeartbeatPings.Add(1)
+	err := queueControl(h.out, protocol.CtrlPing, seq, nil)
+	if err == nil {
+		err = h.out.flush()
+	}
+	if err != nil {
+		h.stop()
+		_ = h.conn.Close()
+	}
+}
+
+// activity records bytes read from the peer: they prove it alive as well as
+// a PONG would, and postpone the next PING.
+func (h *heartbeat) activity() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending = 0
+	if !h.stopped && h.busy == 0 {
+		h.timer.Reset(h.interval)
+	}
+}
+
+// begin pauses the policy while the read loop runs a request: a PONG cannot
+// be read until the handler returns, however healthy the peer.
+func (h *heartbeat) begin() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.busy++
+	h.timer.Stop()
+}
+
+// end resumes the policy after begin, with the full interval or timeout.
+func (h *heartbeat) end() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.busy--; h.busy > 0 || h.stopped {
+		return
+	}
+	if h.pending != 0 {
+		h.timer.Reset(h.timeout)
+	} else {
+		h.timer.Reset(h.interval)
+	}
+}
+
+func (h *heartbeat) pong(id uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopped || id == 0 || id != h.pending {
+		return
+	}
+	h.pending = 0
+	if h.busy == 0 {
+		h.timer.Reset(h.interval)
+	}
+}
+
+func (h *heartbeat) setInterval(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.interval = max(d, minHeartbeatInterval)
+	if !h.stopped && h.pending == 0 && h.busy == 0 {
+		h.timer.Reset(h.interval)
+	}
+}
+
+func (h *heartbeat) stop() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopped = true
+	h.timer.Stop()
+}
+
+// handleControl serves a FlagControl frame. PONG replies are queued with the
+// connection's other responses.
+func handleControl(state *connHandlerState, m *protocol.Message) error {
+	switch m.Command {
+	case protocol.CtrlPing:
+		return queueControl(state.out, protocol.CtrlPong, m.RequestID, m.Payload)
+	case protocol.CtrlPong:
+		if state.hb != nil {
+			state.hb.pong(m.RequestID)
+		}
+	case protocol.CtrlHeartbeat:
+		d, err := protocol.DecodeHeartbeatInterval(m.Payload)
+		if err != nil {
+			return err
+		}
+		if state.hb != nil {
+			state.hb.setInterval(d)
+		}
+	}
+	// Unknown opcodes are ignored so peers can add new ones.
+	return nil
+}
+
+func queueControl(w *connWriter, op uint16, id uint64, payload []byte) error {
+	frame, err := w.frame(protocol.FlagControl, &protocol.Message{Command: op, RequestID: id, Payload: payload})
+	if err != nil {
+		return err
+	}
+	return w.write(frame)
+}
@@ -0,0 +1,176 @@
+package novagate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// frameReader reads whole frames from a client connection.
+type frameReader struct {
+	c   net.Conn
+	buf []byte
+}
+
+func (r *frameReader) next(timeout time.Duration) (*protocol.Frame, *protocol.Message, error) {
+	_ = r.c.SetReadDeadline(time.Now().Add(timeout))
+	tmp := make([]byte, 4096)
+	for {
+		frame, n, err := protocol.Decode(r.buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		if frame != nil {
+			body := append([]byte(nil), frame.Body...)
+			r.buf = r.buf[n:]
+			m, err := frame.DecodeMessage(body)
+			return frame, m, err
+		}
+		m, err := r.c.Read(tmp)
+		if err != nil {
+			return nil, nil, err
+		}
+		r.buf = append(r.buf, tmp[:m]...)
+	}
+}
+
+func writeControl(t *testing.T, c net.Conn, op uint16, id uint64, payload []byte) {
+	t.Helper()
+	wire, err := protocol.EncodeMessageFrameTo(nil, protocol.FlagControl, &protocol.Message{Command: op, RequestID: id, Payload: payload})
+	if err != nil {
+		t.Fatalf("encode control: %v", err)
+	}
+	if _, err := c.Write(wire); err != nil {
+		t.Fatalf("write control: %v", err)
+	}
+}
+
+func serveForTest(t *testing.T, opts ...ServeOption) net.Conn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = ServeWithContext(ctx, ln, echoSetup, opts...) }()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestHeartbeatKeepsRespondingClientAlive(t *testing.T) {
+	for _, tr := range []string{TransportNet, TransportNetpoll} {
+		t.Run(tr, func(t *testing.T) {
+			c := serveForTest(t, WithTransport(tr), WithIdleTimeout(0), WithHeartbeat(50*time.Millisecond, 200*time.Millisecond))
+			r := &frameReader{c: c}
+			for i := 0; i < 4; i++ {
+				frame, m, err := r.next(2 * time.Second)
+				if err != nil {
+					t.Fatalf("ping %d: %v", i, err)
+				}
+				if !protocol.IsControl(frame.Flags) || m.Command != protocol.CtrlPing {
+					t.Fatalf("ping %d: got flags=%d cmd=0x%04X", i, frame.Flags, m.Command)
+				}
+				writeControl(t, c, protocol.CtrlPong, m.RequestID, nil)
+			}
+			if resp := pingRoundTrip(t, c, 42, []byte("still-alive")); resp.RequestID != 42 {
+				t.Fatalf("unexpected response %+v", resp)
+			}
+		})
+	}
+}
+
+func TestHeartbeatClosesSilentPeer(t *testing.T) {
+	for _, tr := range []string{TransportNet, TransportNetpoll} {
+		t.Run(tr, func(t *testing.T) {
+			c := serveForTest(t, WithTransport(tr), WithIdleTimeout(0), WithHeartbeat(50*time.Millisecond, 100*time.Millisecond))
+			r := &frameReader{c: c}
+			if _, m, err := r.next(2 * time.Second); err != nil || m.Command != protocol.CtrlPing {
+				t.Fatalf("expected PING, got %v %v", m, err)
+			}
+			// Never answer: the server must give up on us.
+			if _, _, err := r.next(2 * time.Second); !errors.Is(err, io.EOF) {
+				t.Fatalf("expected EOF after missed PONG, got %v", err)
+			}
+		})
+	}
+}
+
+func TestHeartbeatSurvivesSlowHandler(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	setup := func(r *Router) error {
+		r.Register(protocol.CmdPing, func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			time.Sleep(300 * time.Millisecond) // well past interval + timeout
+			return &protocol.Message{Command: m.Command, RequestID: m.RequestID, Payload: m.Payload}, nil
+		})
+		return nil
+	}
+	go func() {
+		_ = ServeWithContext(ctx, ln, setup, WithIdleTimeout(0), WithHeartbeat(50*time.Millisecond, 50*time.Millisecond))
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	writeFrame(t, c, 0, &protocol.Message{Command: protocol.CmdPing, RequestID: 9, Payload: []byte("slow")})
+	r := &frameReader{c: c}
+	for {
+		frame, m, err := r.next(2 * time.Second)
+		if err != nil {
+			t.Fatalf("connection closed during a slow request: %v", err)
+		}
+		if protocol.IsControl(frame.Flags) {
+			if m.Command == protocol.CtrlPing {
+				writeControl(t, c, protocol.CtrlPong, m.RequestID, nil)
+			}
+			continue
+		}
+		if m.RequestID != 9 {
+			t.Fatalf("unexpected response %+v", m)
+		}
+		return
+	}
+}
+
+func TestClientPingGetsPong(t *testing.T) {
+	c := serveForTest(t)
+	writeControl(t, c, protocol.CtrlPing, 77, []byte("hi"))
+	frame, m, err := (&frameReader{c: c}).next(2 * time.Second)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !protocol.IsControl(frame.Flags) || m.Command != protocol.CtrlPong || m.RequestID != 77 || string(m.Payload) != "hi" {
+		t.Fatalf("unexpected PONG flags=%d %+v", frame.Flags, m)
+	}
+}
+
+func TestClientAdvertisedHeartbeatInterval(t *testing.T) {
+	c := serveForTest(t, WithIdleTimeout(0), WithHeartbeat(50*time.Millisecond, time.Second))
+	writeControl(t, c, protocol.CtrlHeartbeat, 0, protocol.EncodeHeartbeatInterval(600*time.Millisecond))
+
+	start := time.Now()
+	_, m, err := (&frameReader{c: c}).next(3 * time.Second)
+	if err != nil || m.Command != protocol.CtrlPing {
+		t.Fatalf("expected PING, got %v %v", m, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("PING after %v, advertised interval ignored", elapsed)
+	}
+}
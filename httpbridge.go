@@ -0,0 +1,291 @@
+package novagate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gogogo1024/novagate/protocol"
+	"github.com/gogogo1024/novagate/schema"
+)
+
+// maxHTTPBatchCalls bounds the number of calls in one /v1/batch request.
+const maxHTTPBatchCalls = 100
+
+// HTTPMetadataPrefix marks the request headers the bridge copies into
+// Message.Metadata: "X-Novagate-Meta-Principal: alice" becomes the entry
+// "principal" = "alice". Keys are lowercased; of a repeated header the first
+// value wins.
+const HTTPMetadataPrefix = "X-Novagate-Meta-"
+
+// Timeouts of the HTTP servers (bridge and admin API). The write timeout
+// covers the dispatch, so it has to outlast the slowest route.
+const (
+	httpReadHeaderTimeout = 10 * time.Second
+	httpReadTimeout       = 30 * time.Second
+	httpWriteTimeout      = 60 * time.Second
+	httpIdleTimeout       = 120 * time.Second
+)
+
+// WithHTTPBridge starts an HTTP/JSON bridge on addr next to the binary listeners.
+//
+// The bridge dispatches through the same Router (and middlewares) as the
+// binary protocol. Use an empty addr to disable it (the default).
+func WithHTTPBridge(addr string) ServeOption {
+	return func(o *serveOptions) {
+		o.httpBridgeAddr = addr
+	}
+}
+
+// HTTPCallResult is the JSON body returned for a bridged call.
+type HTTPCallResult struct {
+	Command   uint16 `json:"command"`
+	RequestID uint64 `json:"request_id"`
+	// Payload is the raw response payload (base64 in JSON).
+	Payload []byte `json:"payload,omitempty"`
+	// PayloadText repeats Payload as a string when it is valid UTF-8.
+	PayloadText string  `json:"payload_text,omitempty"`
+	DurationMS  float64 `json:"duration_ms"`
+	Error       string  `json:"error,omitempty"`
+	// Code is the StatusError code when the call was declined (see
+	// protocol.CmdError); 0 for other errors.
+	Code uint16 `json:"code,omitempty"`
+	// Violations lists the failing fields of a protocol.StatusInvalidPayload
+	// reply (see ValidatePayloads).
+	Violations []schema.Violation `json:"violations,omitempty"`
+}
+
+// HTTPBatchCall is one entry of a /v1/batch request. Set either Method
+// ("Service.Method") or Command, and either Payload (base64) or PayloadText.
+// Metadata adds to, and overrides, the entries taken from the request
+// headers (see HTTPMetadataPrefix).
+type HTTPBatchCall struct {
+	Method      string            `json:"method,omitempty"`
+	Command     uint16            `json:"command,omitempty"`
+	RequestID   uint64            `json:"request_id,omitempty"`
+	Payload     []byte            `json:"payload,omitempty"`
+	PayloadText string            `json:"payload_text,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+type httpBridge struct {
+	router *Router
+	nextID atomic.Uint64
+}
+
+// NewHTTPBridge returns an http.Handler exposing the router over HTTP/JSON:
+//
+//	POST /v1/call/{Service}/{Method}  body = raw request payload
+//	POST /v1/call/cmd/{id}            id is decimal or 0x-prefixed hex
+//	POST /v1/batch                    body = JSON array of HTTPBatchCall
+//
+// Only registered methods are resolved (see protocol.LookupMethodCommand);
+// other names are answered with 404 rather than hashed. The request ID is
+// taken from the X-Request-Id header when it is a uint64, otherwise generated;
+// headers starting with HTTPMetadataPrefix become metadata. Errors other than
+// a *StatusError are logged and answered with a generic 502, so backend
+// details do not leak to clients.
+func NewHTTPBridge(router *Router) http.Handler {
+	b := &httpBridge{router: router}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/call/cmd/{id}", b.callCommand)
+	mux.HandleFunc("POST /v1/call/{service}/{method}", b.callMethod)
+	mux.HandleFunc("POST /v1/batch", b.batch)
+	return mux
+}
+
+func (b *httpBridge) callMethod(w http.ResponseWriter, r *http.Request) {
+	method := r.PathValue("service") + "." + r.PathValue("method")
+	cmd, ok := protocol.LookupMethodCommand(method)
+	if !ok {
+		writeHTTPError(w, http.StatusNotFound, fmt.Errorf("unknown method %q", method))
+		return
+	}
+	b.call(w, r, cmd)
+}
+
+func (b *httpBridge) callCommand(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 0, 16)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Errorf("invalid command id %q", r.PathValue("id")))
+		return
+	}
+	b.call(w, r, uint16(id))
+}
+
+func (b *httpBridge) call(w http.ResponseWriter, r *http.Request, cmd uint16) {
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, protocol.MaxFrameBody))
+	if err != nil {
+		writeHTTPError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	reqID := b.requestID(r.Header.Get("X-Request-Id"))
+
+	res := b.dispatch(r.Context(), &protocol.Message{Command: cmd, RequestID: reqID, Metadata: httpMetadata(r.Header), Payload: payload})
+	status := http.StatusOK
+	if res.Error != "" {
+		status = httpStatus(res.Code)
+		if !b.router.Has(cmd) {
+			status = http.StatusNotFound
+		}
+	}
+	w.Header().Set("X-Request-Id", strconv.FormatUint(res.RequestID, 10))
+	writeHTTPJSON(w, status, res)
+}
+
+func (b *httpBridge) batch(w http.ResponseWriter, r *http.Request) {
+	var calls []HTTPBatchCall
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*protocol.MaxFrameBody))
+	if err := dec.Decode(&calls); err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(calls) > maxHTTPBatchCalls {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Errorf("batch too large: %d calls (max %d)", len(calls), maxHTTPBatchCalls))
+		return
+	}
+
+	md := httpMetadata(r.Header)
+	results := make([]HTTPCallResult, len(calls))
+	for i, c := range calls {
+		cmd := c.Command
+		if c.Method != "" {
+			mapped, ok := protocol.LookupMethodCommand(c.Method)
+			if !ok {
+				results[i] = HTTPCallResult{RequestID: c.RequestID, Error: fmt.Sprintf("unknown method %q", c.Method)}
+				continue
+			}
+			cmd = mapped
+		}
+		payload := c.Payload
+		if payload == nil && c.PayloadText != "" {
+			payload = []byte(c.PayloadText)
+		}
+		reqID := c.RequestID
+		if reqID == 0 {
+			reqID = b.nextID.Add(1)
+		}
+		results[i] = b.dispatch(r.Context(), &protocol.Message{Command: cmd, RequestID: reqID, Metadata: mergeMetadata(md, c.Metadata), Payload: payload})
+	}
+	writeHTTPJSON(w, http.StatusOK, results)
+}
+
+func (b *httpBridge) dispatch(ctx context.Context, m *protocol.Message) HTTPCallResult {
+	start := time.Now()
+	resp, err := b.router.Dispatch(ctx, m)
+	res := HTTPCallResult{
+		Command:    m.Command,
+		RequestID:  m.RequestID,
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		var se *StatusError
+		switch {
+		case errors.As(err, &se):
+			res.Error = err.Error()
+			res.Code = se.Code
+			if se.Code == protocol.StatusInvalidPayload {
+				if vs, perr := schema.ParseViolations(se.Message); perr == nil {
+					res.Error = "invalid payload"
+					res.Violations = vs
+				}
+			}
+		case errors.Is(err, ErrUnknownCommand):
+			res.Error = err.Error()
+		default:
+			log.Printf("http bridge: command 0x%04X request %d: %v", m.Command, m.RequestID, err)
+			res.Error = http.StatusText(http.StatusBadGateway)
+		}
+		return res
+	}
+	if resp == nil {
+		return res
+	}
+	res.Command = resp.Command
+	res.Payload = resp.Payload
+	if utf8.Valid(resp.Payload) {
+		res.PayloadText = string(resp.Payload)
+	}
+	return res
+}
+
+// httpMetadata returns the metadata carried by the HTTPMetadataPrefix
+// headers of h, or nil if there is none.
+func httpMetadata(h http.Header) map[string]string {
+	var md map[string]string
+	for k, vs := range h {
+		if len(k) <= len(HTTPMetadataPrefix) || !strings.EqualFold(k[:len(HTTPMetadataPrefix)], HTTPMetadataPrefix) || len(vs) == 0 {
+			continue
+		}
+		if md == nil {
+			md = make(map[string]string)
+		}
+		md[strings.ToLower(k[len(HTTPMetadataPrefix):])] = vs[0]
+	}
+	return md
+}
+
+// mergeMetadata returns a copy of base with extra laid over it, so calls
+// of a batch do not share one map.
+func mergeMetadata(base, extra map[string]string) map[string]string {
+	if len(base)+len(extra) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(base)+len(extra))
+	maps.Copy(out, base)
+	maps.Copy(out, extra)
+	return out
+}
+
+func (b *httpBridge) requestID(header string) uint64 {
+	if header != "" {
+		if id, err := strconv.ParseUint(header, 10, 64); err == nil && id != 0 {
+			return id
+		}
+	}
+	return b.nextID.Add(1)
+}
+
+func writeHTTPJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, err error) {
+	writeHTTPJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// startHTTPServer binds addr synchronously (so bind errors surface at
+// startup) and serves h until ctx is canceled.
+func startHTTPServer(ctx context.Context, name, addr string, h http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	closeOnDone(ctx.Done(), srv)
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("%s error: %v", name, err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,166 @@
+package novagate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func newBridgeTestServer(t *testing.T) (*httptest.Server, *int) {
+	t.Helper()
+	protocol.RegisterFullMethodCommand("NovaService.Ping", protocol.CmdPing)
+
+	r := NewRouter()
+	_ = echoSetup(r)
+	calls := 0
+	r.Use(func(next Handler) Handler {
+		return func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			calls++
+			return next(ctx, m)
+		}
+	})
+	srv := httptest.NewServer(NewHTTPBridge(r))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestHTTPBridge_CallByMethodAndCommand(t *testing.T) {
+	srv, calls := newBridgeTestServer(t)
+
+	for _, path := range []string{"/v1/call/NovaService/Ping", "/v1/call/cmd/0x0001"} {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader("hello"))
+		req.Header.Set("X-Request-Id", "42")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		var res HTTPCallResult
+		_ = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status=%d error=%q", path, resp.StatusCode, res.Error)
+		}
+		if res.RequestID != 42 || res.Command != protocol.CmdPing || res.PayloadText != "hello" {
+			t.Fatalf("%s: unexpected result %+v", path, res)
+		}
+	}
+	if *calls != 2 {
+		t.Fatalf("middleware calls=%d, want 2", *calls)
+	}
+}
+
+func TestHTTPBridge_UnknownCommand(t *testing.T) {
+	srv, _ := newBridgeTestServer(t)
+	resp, err := http.Post(srv.URL+"/v1/call/cmd/0x7777", "application/octet-stream", nil)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status=%d, want 404", resp.StatusCode)
+	}
+
+	// Unregistered methods are not hashed, and metrics stay on the admin API.
+	for _, path := range []string{"/v1/call/NoSuch/Method", "/debug/vars"} {
+		method := http.MethodPost
+		if path == "/debug/vars" {
+			method = http.MethodGet
+		}
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: status=%d, want 404", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestHTTPBridge_Batch(t *testing.T) {
+	srv, _ := newBridgeTestServer(t)
+	body := `[{"method":"NovaService.Ping","payload_text":"a"},{"command":1,"request_id":9,"payload_text":"b"},{"command":30583}]`
+	resp, err := http.Post(srv.URL+"/v1/batch", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var results []HTTPCallResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("results=%d, want 3", len(results))
+	}
+	if results[0].PayloadText != "a" || results[1].PayloadText != "b" || results[1].RequestID != 9 {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if results[2].Error == "" {
+		t.Fatalf("expected error for unknown command, got %+v", results[2])
+	}
+}
+
+func TestHTTPBridge_MetadataAndBackendErrors(t *testing.T) {
+	protocol.RegisterFullMethodCommand("NovaService.Ping", protocol.CmdPing)
+	r := NewRouter()
+	r.Register(protocol.CmdPing, func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		if m.Metadata["fail"] != "" {
+			return nil, errors.New("dial tcp 10.0.0.7:9000: connection refused")
+		}
+		return &protocol.Message{Command: m.Command, Payload: []byte(m.Metadata["principal"] + "/" + m.Metadata["tenant"])}, nil
+	})
+	srv := httptest.NewServer(NewHTTPBridge(r))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/call/cmd/1", nil)
+	req.Header.Set("X-Novagate-Meta-Principal", "alice")
+	req.Header.Set("X-Novagate-Meta-Tenant", "t1")
+	req.Header.Set("X-Other", "ignored")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res HTTPCallResult
+	_ = json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || res.PayloadText != "alice/t1" {
+		t.Fatalf("status=%d result=%+v, want the metadata echoed", resp.StatusCode, res)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, srv.URL+"/v1/call/cmd/1", nil)
+	req.Header.Set("X-Novagate-Meta-Fail", "1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = HTTPCallResult{}
+	_ = json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || res.Error != "Bad Gateway" {
+		t.Fatalf("status=%d error=%q, want a generic 502", resp.StatusCode, res.Error)
+	}
+
+	body := `[{"command":1,"metadata":{"tenant":"t2"}}]`
+	req, _ = http.NewRequest(http.MethodPost, srv.URL+"/v1/batch", strings.NewReader(body))
+	req.Header.Set("X-Novagate-Meta-Principal", "bob")
+	req.Header.Set("X-Novagate-Meta-Tenant", "t1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []HTTPCallResult
+	_ = json.NewDecoder(resp.Body).Decode(&results)
+	resp.Body.Close()
+	if len(results) != 1 || results[0].PayloadText != "bob/t2" {
+		t.Fatalf("batch results = %+v, want call metadata over the headers", results)
+	}
+}
@@ -0,0 +1,285 @@
+package novagate
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gogogo1024/novagate/dedup"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// Default idempotency settings (see IdempotencyConfig).
+const (
+	DefaultIdempotencyTTL = 10 * time.Minute
+	// DefaultIdempotencyClaimTTL bounds how long a running request keeps
+	// duplicates on other gateways waiting.
+	DefaultIdempotencyClaimTTL = 30 * time.Second
+	// DefaultIdempotencyKey is the Message.Metadata key carrying an explicit
+	// idempotency key.
+	DefaultIdempotencyKey = "idempotency-key"
+)
+
+// dedupPollInterval is how often a duplicate polls the store while another
+// gateway runs the request.
+const dedupPollInterval = 20 * time.Millisecond
+
+// IdempotencyConfig configures an Idempotency layer. Zero values take the
+// defaults.
+type IdempotencyConfig struct {
+	// Store remembers completed responses (default a dedup.Memory of
+	// dedup.DefaultMemoryCapacity entries, private to this layer).
+	Store dedup.Store
+	// TTL is how long a response is replayed to retries (default 10m).
+	TTL time.Duration
+	// ClaimTTL is how long a running request holds its key in the store
+	// (default 30s). Set it above the command's timeout: once it lapses a
+	// duplicate may run again.
+	ClaimTTL time.Duration
+	// KeyMetadata names the metadata entry holding an explicit idempotency
+	// key (default DefaultIdempotencyKey).
+	KeyMetadata string
+	// Principal scopes keys by the caller it returns. Without it keys are
+	// scoped by the PrincipalKey metadata entry (default
+	// DefaultPrincipalKey), which clients set freely.
+	Principal    PrincipalFunc
+	PrincipalKey string
+	// SharedKeys lets requests without a principal use explicit keys, in one
+	// key space shared by every such client: any of them sending a key gets
+	// the response stored under it. Leave it off unless keys are
+	// unguessable and responses are not private.
+	SharedKeys bool
+}
+
+// Idempotency suppresses duplicate executions of one command. A request is
+// identified by its explicit idempotency key or, without one, by its
+// principal and RequestID, and keys are scoped by principal. Only a
+// principal from IdempotencyConfig.Principal keeps callers from reading each
+// other's responses: a metadata principal can be claimed by any client that
+// knows it, together with the key or RequestID. Requests without a
+// principal are served as usual, even with an explicit key, unless
+// IdempotencyConfig.SharedKeys is set.
+//
+// The first request with a given identity runs; its response (or the absence
+// of one) is stored for TTL and replayed, under the retry's RequestID, to
+// every duplicate. The request claims its key in the store before running,
+// so duplicates arriving while it runs wait for it, on this gateway or on any
+// other sharing the store (polling it). Failed requests release the claim and
+// are not stored, so a retry after an error runs again. If the store fails
+// the request runs unprotected.
+type Idempotency struct {
+	cmd uint16
+	cfg IdempotencyConfig
+
+	mu       sync.Mutex
+	inflight map[string]*dedupCall
+}
+
+// dedupCall is a request running under some identity.
+type dedupCall struct {
+	done chan struct{}
+	resp *protocol.Message
+	err  error
+}
+
+// NewIdempotency returns the idempotency layer of cmd; install its
+// Middleware in the command's RouteConfig.Middlewares, or with Router.Use.
+func NewIdempotency(cmd uint16, cfg IdempotencyConfig) (*Idempotency, error) {
+	if cfg.TTL < 0 || cfg.ClaimTTL < 0 {
+		return nil, fmt.Errorf("command 0x%04X: negative idempotency ttl", cmd)
+	}
+	if cfg.Store == nil {
+		cfg.Store = dedup.NewMemory(0)
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = DefaultIdempotencyTTL
+	}
+	if cfg.ClaimTTL == 0 {
+		cfg.ClaimTTL = DefaultIdempotencyClaimTTL
+	}
+	if cfg.KeyMetadata == "" {
+		cfg.KeyMetadata = DefaultIdempotencyKey
+	}
+	if cfg.PrincipalKey == "" {
+		cfg.PrincipalKey = DefaultPrincipalKey
+	}
+	return &Idempotency{cmd: cmd, cfg: cfg, inflight: make(map[string]*dedupCall)}, nil
+}
+
+// Middleware returns the middleware deduplicating the command; other
+// commands pass through untouched.
+func (d *Idempotency) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			if m.Command != d.cmd {
+				return next(ctx, m)
+			}
+			key, ok := d.key(ctx, m)
+			if !ok {
+				metricDedupUnkeyed.Add(1)
+				return next(ctx, m)
+			}
+			for {
+				d.mu.Lock()
+				c, running := d.inflight[key]
+				if !running {
+					c = &dedupCall{done: make(chan struct{})}
+					d.inflight[key] = c
+				}
+				d.mu.Unlock()
+				if !running {
+					return d.run(ctx, key, c, next, m)
+				}
+
+				select {
+				case <-c.done:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+				if c.err == nil {
+					metricDedupHits.Add(1)
+					return replay(c.resp, m), nil
+				}
+				// The first attempt failed: this one runs in its place.
+			}
+		}
+	}
+}
+
+// run serves m as the request running under key.
+func (d *Idempotency) run(ctx context.Context, key string, c *dedupCall, next Handler, m *protocol.Message) (*protocol.Message, error) {
+	defer func() {
+		d.mu.Lock()
+		delete(d.inflight, key)
+		d.mu.Unlock()
+		close(c.done)
+	}()
+
+	claimed, resp, done := d.claim(ctx, key, c, m)
+	if done {
+		return resp, c.err
+	}
+	release := func() {
+		if claimed {
+			if err := d.cfg.Store.Release(context.WithoutCancel(ctx), key); err != nil {
+				metricDedupStoreErrors.Add(1)
+			}
+		}
+	}
+
+	resp, err := next(ctx, m)
+	if err != nil {
+		c.err = err
+		release()
+		return resp, err
+	}
+	// The response may alias the request buffer; waiters need their own copy.
+	var stored []byte
+	if resp != nil {
+		c.resp = resp.Clone()
+		if stored, err = encodeStoredResponse(c.resp); err != nil {
+			metricDedupStoreErrors.Add(1)
+			release()
+			return resp, nil
+		}
+	}
+	if err := d.cfg.Store.Set(context.WithoutCancel(ctx), key, stored, d.cfg.TTL); err != nil {
+		metricDedupStoreErrors.Add(1)
+	}
+	return resp, nil
+}
+
+// claim looks key up in the store and claims it, waiting while another
+// gateway holds the claim. done is set when m has been answered (resp, or
+// c.err) without running; claimed when m runs holding the claim. After a
+// store failure m runs unclaimed.
+func (d *Idempotency) claim(ctx context.Context, key string, c *dedupCall, m *protocol.Message) (claimed bool, resp *protocol.Message, done bool) {
+	for {
+		v, ok, err := d.cfg.Store.Get(ctx, key)
+		if err != nil {
+			metricDedupStoreErrors.Add(1)
+			return false, nil, false
+		}
+		if ok {
+			stored, err := decodeStoredResponse(v)
+			if err != nil {
+				metricDedupStoreErrors.Add(1)
+				return false, nil, false
+			}
+			metricDedupHits.Add(1)
+			c.resp = stored
+			return false, replay(stored, m), true
+		}
+		claimed, err := d.cfg.Store.Claim(ctx, key, d.cfg.ClaimTTL)
+		if err != nil {
+			metricDedupStoreErrors.Add(1)
+			return false, nil, false
+		}
+		if claimed {
+			return true, nil, false
+		}
+		// Another gateway runs the request: wait for its response, or for
+		// its claim to be released or to lapse.
+		t := time.NewTimer(dedupPollInterval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			c.err = ctx.Err()
+			return false, nil, true
+		}
+	}
+}
+
+// key returns the store key identifying m.
+func (d *Idempotency) key(ctx context.Context, m *protocol.Message) (string, bool) {
+	var principal string
+	if d.cfg.Principal != nil {
+		principal = d.cfg.Principal(ctx, m)
+	} else {
+		principal = m.Metadata[d.cfg.PrincipalKey]
+	}
+	if principal == "" && !d.cfg.SharedKeys {
+		return "", false
+	}
+	prefix := fmt.Sprintf("%04x:", d.cmd)
+	if k := m.Metadata[d.cfg.KeyMetadata]; k != "" {
+		return prefix + "k:" + strconv.Quote(principal) + ":" + k, true
+	}
+	if principal == "" {
+		return "", false
+	}
+	return prefix + "r:" + strconv.Quote(principal) + ":" + strconv.FormatUint(m.RequestID, 10), true
+}
+
+// encodeStoredResponse encodes resp as a version 2 frame, which keeps its
+// Metadata (such as the content type).
+func encodeStoredResponse(resp *protocol.Message) ([]byte, error) {
+	return protocol.AppendFrame(nil, protocol.FrameVersion2, 0, resp)
+}
+
+// decodeStoredResponse decodes a stored response; an empty value stands for
+// a request that had no response. Values that are not a frame are bare
+// version 1 messages, as stored by earlier releases.
+func decodeStoredResponse(v []byte) (*protocol.Message, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	f, n, err := protocol.Decode(v)
+	if err != nil || f == nil || n != len(v) {
+		return protocol.DecodeMessage(v)
+	}
+	return f.DecodeMessage(f.Body)
+}
+
+// replay returns a copy of the stored response resp for the request m.
+func replay(resp *protocol.Message, m *protocol.Message) *protocol.Message {
+	if resp == nil {
+		return nil
+	}
+	out := *resp
+	out.RequestID = m.RequestID
+	return &out
+}
@@ -0,0 +1,384 @@
+package novagate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/dedup"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func TestIdempotencyReplaysCompletedResponses(t *testing.T) {
+	var calls atomic.Int64
+	fail := atomic.Bool{}
+	order := func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		n := calls.Add(1)
+		if fail.Load() {
+			return nil, ErrOverloaded
+		}
+		return &protocol.Message{Command: m.Command, RequestID: m.RequestID, Payload: []byte(fmt.Sprintf("order-%d", n))}, nil
+	}
+	d, err := NewIdempotency(protocol.CmdOrderCreate, IdempotencyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter()
+	if err := r.Route(protocol.CmdOrderCreate, order, RouteConfig{Middlewares: []Middleware{d.Middleware()}}); err != nil {
+		t.Fatal(err)
+	}
+	call := func(id uint64, md map[string]string) (*protocol.Message, error) {
+		return r.Dispatch(context.Background(), &protocol.Message{Command: protocol.CmdOrderCreate, RequestID: id, Metadata: md})
+	}
+	expect := func(id uint64, md map[string]string, payload string) {
+		t.Helper()
+		resp, err := call(id, md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Payload) != payload || resp.RequestID != id {
+			t.Fatalf("request %d %v: got %q for request %d, want %q", id, md, resp.Payload, resp.RequestID, payload)
+		}
+	}
+	alice := map[string]string{"principal": "alice"}
+	bob := map[string]string{"principal": "bob"}
+
+	expect(7, alice, "order-1")
+	expect(7, alice, "order-1") // retry
+	expect(8, alice, "order-2")
+	expect(7, bob, "order-3")
+
+	// An explicit key spans RequestIDs, within one principal.
+	expect(20, map[string]string{"principal": "alice", "idempotency-key": "cart-9"}, "order-4")
+	expect(21, map[string]string{"principal": "alice", "idempotency-key": "cart-9"}, "order-4")
+	expect(22, map[string]string{"principal": "bob", "idempotency-key": "cart-9"}, "order-5")
+
+	// Without a key or principal nothing is suppressed.
+	unkeyed := metricDedupUnkeyed.Value()
+	expect(30, nil, "order-6")
+	expect(30, nil, "order-7")
+	if got := metricDedupUnkeyed.Value() - unkeyed; got != 2 {
+		t.Fatalf("dedup_unkeyed delta = %d, want 2", got)
+	}
+
+	// Failures are not remembered.
+	fail.Store(true)
+	if _, err := call(40, alice); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("failing request: %v", err)
+	}
+	fail.Store(false)
+	expect(40, alice, "order-9")
+	if n := calls.Load(); n != 9 {
+		t.Fatalf("handler ran %d times, want 9", n)
+	}
+}
+
+func TestIdempotencyAuthenticatedPrincipal(t *testing.T) {
+	var calls atomic.Int64
+	d, err := NewIdempotency(protocol.CmdOrderCreate, IdempotencyConfig{Principal: testPrincipal})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := d.Middleware()(func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		return &protocol.Message{Command: m.Command, RequestID: m.RequestID, Payload: []byte(fmt.Sprintf("order-%d", calls.Add(1)))}, nil
+	})
+	call := func(as string) string {
+		ctx := context.WithValue(context.Background(), testPrincipalKey{}, as)
+		resp, err := h(ctx, &protocol.Message{Command: protocol.CmdOrderCreate, RequestID: 7, Metadata: map[string]string{"principal": "alice"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(resp.Payload)
+	}
+	if call("alice") != "order-1" || call("alice") != "order-1" {
+		t.Fatal("retry of alice not replayed")
+	}
+	if got := call("mallory"); got != "order-2" {
+		t.Fatalf("mallory claiming alice got %q", got)
+	}
+}
+
+func TestIdempotencyKeysNeedPrincipal(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		var calls atomic.Int64
+		d, err := NewIdempotency(protocol.CmdOrderCreate, IdempotencyConfig{SharedKeys: shared})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, _ := backendForTest(t, func(r *Router) error {
+			return r.Route(protocol.CmdOrderCreate, func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+				n := calls.Add(1)
+				return &protocol.Message{Command: m.Command, RequestID: m.RequestID, Payload: []byte(fmt.Sprintf("%s#%d", m.Payload, n))}, nil
+			}, RouteConfig{Middlewares: []Middleware{d.Middleware()}})
+		})
+		// Two clients without a principal happen to pick the same key.
+		order := func(client string) string {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			wire, err := protocol.AppendFrame(nil, protocol.FrameVersion2, 0, &protocol.Message{
+				Command: protocol.CmdOrderCreate, RequestID: 1, Payload: []byte(client),
+				Metadata: map[string]string{DefaultIdempotencyKey: "1"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.Write(wire); err != nil {
+				t.Fatal(err)
+			}
+			_, m, err := (&frameReader{c: c}).next(2 * time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(m.Payload)
+		}
+		a, b := order("a"), order("b")
+		if a != "a#1" {
+			t.Fatalf("shared=%v: first client got %q", shared, a)
+		}
+		if want := map[bool]string{false: "b#2", true: "a#1"}[shared]; b != want {
+			t.Fatalf("shared=%v: second client got %q, want %q", shared, b, want)
+		}
+	}
+}
+
+func TestIdempotencyWaitsForRunningDuplicate(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int64
+	h := func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		calls.Add(1)
+		<-release
+		// Alias the request payload, as zero-copy handlers may.
+		return &protocol.Message{Command: m.Command, Payload: m.Payload}, nil
+	}
+	d, err := NewIdempotency(protocol.CmdOrderCreate, IdempotencyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw := d.Middleware()(h)
+
+	md := map[string]string{"principal": "alice", "idempotency-key": "k"}
+	var wg sync.WaitGroup
+	resps := make([]*protocol.Message, 3)
+	for i := range resps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := []byte("payload")
+			resp, err := mw(context.Background(), &protocol.Message{Command: protocol.CmdOrderCreate, RequestID: uint64(i + 1), Metadata: md, Payload: buf})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resps[i] = resp
+			copy(buf, "xxxxxxx")
+		}()
+	}
+	// Duplicates arriving after the first completes are replayed from the
+	// store, so the handler runs once whatever the timing.
+	deadline := time.Now().Add(2 * time.Second)
+	for calls.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("request did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("handler ran %d times for concurrent duplicates", n)
+	}
+	// The first response is the handler's own, aliasing its request buffer;
+	// the replays are copies taken before that buffer was reused, under the
+	// RequestID of the duplicate.
+	replayed := 0
+	for i, resp := range resps {
+		if resp == nil {
+			t.Fatalf("response %d missing", i)
+		}
+		if resp.RequestID == uint64(i+1) && string(resp.Payload) == "payload" {
+			replayed++
+		}
+	}
+	if replayed < 2 {
+		t.Fatalf("%d replayed responses kept their payload, want 2", replayed)
+	}
+}
+
+func TestIdempotencySharedStore(t *testing.T) {
+	store := dedup.NewMemory(0)
+	var calls atomic.Int64
+	h := func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		calls.Add(1)
+		if len(m.Payload) == 0 {
+			return nil, nil // one-way style: no response
+		}
+		return &protocol.Message{Command: m.Command, Payload: []byte("created"), Metadata: map[string]string{"content-type": "json"}}, nil
+	}
+	// Two gateways sharing one store.
+	var gateways []Handler
+	for range 2 {
+		d, err := NewIdempotency(protocol.CmdOrderCreate, IdempotencyConfig{Store: store, TTL: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gateways = append(gateways, d.Middleware()(h))
+	}
+	md := map[string]string{"principal": "alice"}
+	m := func(id uint64, payload string) *protocol.Message {
+		return &protocol.Message{Command: protocol.CmdOrderCreate, RequestID: id, Metadata: md, Payload: []byte(payload)}
+	}
+
+	hits := metricDedupHits.Value()
+	if _, err := gateways[0](context.Background(), m(1, "p")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := gateways[1](context.Background(), m(1, "p"))
+	if err != nil || string(resp.Payload) != "created" || resp.RequestID != 1 || resp.Metadata["content-type"] != "json" {
+		t.Fatalf("replay on the other gateway = %+v, %v", resp, err)
+	}
+	if _, err := gateways[0](context.Background(), m(2, "")); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := gateways[1](context.Background(), m(2, "")); resp != nil || err != nil {
+		t.Fatalf("replayed empty response = %+v, %v", resp, err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("handler ran %d times, want 2", n)
+	}
+	if got := metricDedupHits.Value() - hits; got != 2 {
+		t.Fatalf("dedup_hits delta = %d, want 2", got)
+	}
+}
+
+func TestDecodeLegacyStoredResponse(t *testing.T) {
+	legacy := protocol.EncodeMessageTo(nil, &protocol.Message{Command: protocol.CmdOrderCreate, RequestID: 3, Payload: []byte("v1")})
+	resp, err := decodeStoredResponse(legacy)
+	if err != nil || string(resp.Payload) != "v1" || resp.Command != protocol.CmdOrderCreate {
+		t.Fatalf("legacy value = %+v, %v", resp, err)
+	}
+}
+
+func TestIdempotencyClaimsAcrossGateways(t *testing.T) {
+	store := dedup.NewMemory(0)
+	var calls atomic.Int64
+	release := make(chan struct{})
+	fail := atomic.Bool{}
+	h := func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		calls.Add(1)
+		<-release
+		if fail.Load() {
+			return nil, ErrOverloaded
+		}
+		return &protocol.Message{Command: m.Command, RequestID: m.RequestID, Payload: []byte("created")}, nil
+	}
+	var gateways []Handler
+	for range 2 {
+		d, err := NewIdempotency(protocol.CmdOrderCreate, IdempotencyConfig{Store: store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gateways = append(gateways, d.Middleware()(h))
+	}
+	m := &protocol.Message{Command: protocol.CmdOrderCreate, RequestID: 1, Metadata: map[string]string{"principal": "alice"}}
+
+	// A failed first attempt releases its claim: the waiting duplicate runs.
+	fail.Store(true)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := gateways[0](context.Background(), m)
+		errs <- err
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	var resp *protocol.Message
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		resp, err = gateways[1](context.Background(), m.Clone())
+		done <- err
+	}()
+	time.Sleep(3 * dedupPollInterval)
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("duplicate ran on the other gateway while the first was running (%d calls)", n)
+	}
+	close(release)
+	if err := <-errs; !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("first attempt: %v", err)
+	}
+	fail.Store(false)
+	if err := <-done; err != nil || string(resp.Payload) != "created" {
+		t.Fatalf("duplicate = %+v, %v", resp, err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("handler ran %d times, want 2", n)
+	}
+
+	// The stored response now answers both gateways.
+	for _, g := range gateways {
+		if resp, err := g(context.Background(), m.Clone()); err != nil || string(resp.Payload) != "created" {
+			t.Fatalf("replay = %+v, %v", resp, err)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("handler ran %d times after replays, want 2", n)
+	}
+}
+
+func TestIdempotencyWaitsForClaimOnOtherGateway(t *testing.T) {
+	store := dedup.NewMemory(0)
+	var calls atomic.Int64
+	release := make(chan struct{})
+	h := func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		calls.Add(1)
+		<-release
+		return &protocol.Message{Command: m.Command, RequestID: m.RequestID, Payload: []byte("created")}, nil
+	}
+	var gateways []Handler
+	for range 2 {
+		d, err := NewIdempotency(protocol.CmdOrderCreate, IdempotencyConfig{Store: store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gateways = append(gateways, d.Middleware()(h))
+	}
+	md := map[string]string{"principal": "alice", "idempotency-key": "k"}
+	go func() {
+		_, _ = gateways[0](context.Background(), &protocol.Message{Command: protocol.CmdOrderCreate, RequestID: 1, Metadata: md})
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		time.Sleep(3 * dedupPollInterval)
+		close(release)
+	}()
+	resp, err := gateways[1](context.Background(), &protocol.Message{Command: protocol.CmdOrderCreate, RequestID: 2, Metadata: md})
+	if err != nil || string(resp.Payload) != "created" || resp.RequestID != 2 {
+		t.Fatalf("duplicate = %+v, %v", resp, err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("handler ran %d times, want 1", n)
+	}
+
+	// A waiting duplicate gives up with its caller.
+	store2 := dedup.NewMemory(0)
+	d, _ := NewIdempotency(protocol.CmdOrderCreate, IdempotencyConfig{Store: store2})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*dedupPollInterval)
+	defer cancel()
+	key, _ := d.key(ctx, &protocol.Message{Command: protocol.CmdOrderCreate, Metadata: md})
+	_, _ = store2.Claim(context.Background(), key, time.Minute)
+	if _, err := d.Middleware()(h)(ctx, &protocol.Message{Command: protocol.CmdOrderCreate, Metadata: md}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waiting duplicate = %v", err)
+	}
+}
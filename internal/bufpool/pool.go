@@ -0,0 +1,54 @@
+// Package bufpool provides size-classed byte slice pools for the frame pipeline.
+package bufpool
+
+import "sync"
+
+// Size classes grow by 4x from 512B up to a class that fits the largest frame
+// (1MB body + headers). Larger requests are allocated and never pooled.
+var classes = [...]int{
+	512,
+	2 << 10,
+	8 << 10,
+	32 << 10,
+	128 << 10,
+	512 << 10,
+	2 << 20,
+}
+
+var pools [len(classes)]sync.Pool
+
+// Get returns a slice with len n and cap of the smallest class >= n.
+// The contents are not zeroed.
+func Get(n int) []byte {
+	idx := classIndex(n)
+	if idx < 0 {
+		return make([]byte, n)
+	}
+	if p, ok := pools[idx].Get().(*[]byte); ok {
+		return (*p)[:n]
+	}
+	return make([]byte, n, classes[idx])
+}
+
+// Put returns b to its pool. Slices whose cap is not exactly a class size
+// (for example ones that were grown by append) are dropped.
+//
+// The caller must not use b after Put.
+func Put(b []byte) {
+	c := cap(b)
+	idx := classIndex(c)
+	if idx < 0 || classes[idx] != c {
+		return
+	}
+	b = b[:0]
+	pools[idx].Put(&b)
+}
+
+func classIndex(n int) int {
+	for i, c := range classes {
+		if n <= c {
+			return i
+		}
+	}
+	return -1
+}
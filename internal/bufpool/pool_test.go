@@ -0,0 +1,28 @@
+package bufpool
+
+import "testing"
+
+func TestGetRoundsUpToClass(t *testing.T) {
+	for _, tc := range []struct{ n, wantCap int }{
+		{0, 512},
+		{512, 512},
+		{513, 2 << 10},
+		{1 << 20, 2 << 20},
+	} {
+		b := Get(tc.n)
+		if len(b) != tc.n || cap(b) != tc.wantCap {
+			t.Fatalf("Get(%d): len=%d cap=%d, want len=%d cap=%d", tc.n, len(b), cap(b), tc.n, tc.wantCap)
+		}
+		Put(b)
+	}
+}
+
+func TestGetOversizedIsNotPooled(t *testing.T) {
+	b := Get(3 << 20)
+	if len(b) != 3<<20 {
+		t.Fatalf("len=%d", len(b))
+	}
+	// Must not panic or pollute pools.
+	Put(b)
+	Put(make([]byte, 100))
+}
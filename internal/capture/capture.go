@@ -0,0 +1,258 @@
+// Package capture records decoded gateway frames to rotating JSON Lines files
+// and reads them back for replay. The format is documented in
+// docs/traffic-capture.md.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QueueSize bounds the records waiting for the background writer (see
+// Writer.Enqueue).
+const QueueSize = 4096
+
+// Direction of a captured message relative to the gateway.
+const (
+	DirIn  = "in"
+	DirOut = "out"
+)
+
+// Record is one captured message. One Record is written per line.
+type Record struct {
+	Time      time.Time `json:"ts"`
+	ConnID    uint64    `json:"conn"`
+	Dir       string    `json:"dir"`
+	Flags     uint8     `json:"flags"`
+	Command   uint16    `json:"cmd"`
+	RequestID uint64    `json:"req"`
+	// Payload is base64 in JSON.
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// Writer appends Records to path and rotates it once it grows past maxBytes,
+// keeping at most maxFiles rotated files (path.1 is the newest). If the file
+// cannot be rotated or reopened, each later write tries to reopen it.
+// It is safe for concurrent use.
+type Writer struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+	f        *os.File
+	size     int64
+	closed   bool
+
+	// Records queued by Enqueue, written by run.
+	qmu      sync.Mutex
+	queue    chan *Record
+	stopping bool
+	done     chan struct{}
+	dropped  atomic.Uint64
+}
+
+// NewWriter opens (or appends to) path. maxBytes <= 0 disables rotation.
+func NewWriter(path string, maxBytes int64, maxFiles int) (*Writer, error) {
+	w := &Writer{
+		path:     path,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+		queue:    make(chan *Record, QueueSize),
+		done:     make(chan struct{}),
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	w.f = f
+	w.size = fi.Size()
+	return nil
+}
+
+// Write appends one record.
+func (w *Writer) Write(r *Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	if w.f == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	if w.maxBytes > 0 && w.size > 0 && w.size+int64(len(line)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.f.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+func (w *Writer) rotate() error {
+	err := w.f.Close()
+	w.f = nil
+	if err != nil {
+		return err
+	}
+	if w.maxFiles > 0 {
+		for i := w.maxFiles - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(w.path); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// Enqueue hands r to a background goroutine that writes it, without
+// blocking. If QueueSize records are already waiting, r is dropped and
+// counted (see Dropped); r must not be modified afterwards. It returns false
+// if r will not be written.
+func (w *Writer) Enqueue(r *Record) bool {
+	w.qmu.Lock()
+	defer w.qmu.Unlock()
+	if w.stopping {
+		return false
+	}
+	select {
+	case w.queue <- r:
+		return true
+	default:
+		w.dropped.Add(1)
+		return false
+	}
+}
+
+// Dropped returns the number of records lost because the queue was full or
+// the background write failed.
+func (w *Writer) Dropped() uint64 { return w.dropped.Load() }
+
+// run writes queued records until Close. A failure is logged once, with the
+// recovery, rather than for every record it drops.
+func (w *Writer) run() {
+	defer close(w.done)
+	var failed uint64
+	for r := range w.queue {
+		if err := w.Write(r); err != nil {
+			if failed == 0 {
+				log.Printf("capture %s: %v; dropping records until writes succeed", w.path, err)
+			}
+			failed++
+			w.dropped.Add(1)
+			continue
+		}
+		if failed > 0 {
+			log.Printf("capture %s: writing again after %d dropped records", w.path, failed)
+			failed = 0
+		}
+	}
+}
+
+// Close writes the queued records, then closes the current file.
+func (w *Writer) Close() error {
+	w.qmu.Lock()
+	if !w.stopping {
+		w.stopping = true
+		close(w.queue)
+	}
+	w.qmu.Unlock()
+	<-w.done
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// Reader decodes Records from a JSON Lines stream.
+type Reader struct {
+	sc   *bufio.Scanner
+	line int
+}
+
+// NewReader returns a Reader over r.
+func NewReader(r io.Reader) *Reader {
+	sc := bufio.NewScanner(r)
+	// Payloads are bounded by the 1MB frame limit; base64 adds a third.
+	sc.Buffer(make([]byte, 64*1024), 2*1024*1024)
+	return &Reader{sc: sc}
+}
+
+// Next returns the next record, or io.EOF at the end of the stream.
+func (r *Reader) Next() (*Record, error) {
+	for r.sc.Scan() {
+		r.line++
+		b := r.sc.Bytes()
+		if len(b) == 0 {
+			continue
+		}
+		rec := &Record{}
+		if err := json.Unmarshal(b, rec); err != nil {
+			return nil, fmt.Errorf("capture line %d: %w", r.line, err)
+		}
+		return rec, nil
+	}
+	if err := r.sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// ReadFile reads every record in path.
+func ReadFile(path string) ([]*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []*Record
+	rd := NewReader(f)
+	for {
+		rec, err := rd.Next()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		out = append(out, rec)
+	}
+}
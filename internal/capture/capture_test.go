@@ -0,0 +1,127 @@
+package capture
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriterReadFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cap.jsonl")
+	w, err := NewWriter(path, 0, 0)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	in := &Record{Time: time.Now().UTC(), ConnID: 3, Dir: DirIn, Flags: 1, Command: 0x0101, RequestID: 9, Payload: []byte{0, 1, 2}}
+	if err := w.Write(in); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	recs, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if len(recs) != 1 {
+		t.Fatalf("records=%d, want 1", len(recs))
+	}
+	got := recs[0]
+	if !got.Time.Equal(in.Time) || got.ConnID != 3 || got.Dir != DirIn || got.Flags != 1 ||
+		got.Command != 0x0101 || got.RequestID != 9 || !bytes.Equal(got.Payload, in.Payload) {
+		t.Fatalf("record mismatch: got %+v, want %+v", got, in)
+	}
+}
+
+func TestWriterRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cap.jsonl")
+	w, err := NewWriter(path, 200, 2)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := w.Write(&Record{Time: time.Now(), ConnID: 1, Dir: DirOut, RequestID: uint64(i), Payload: []byte("0123456789")}); err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+	}
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("expected %s: %v", p, err)
+		}
+		if fi.Size() > 200 {
+			t.Fatalf("%s size=%d exceeds limit", p, fi.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected at most 2 rotated files, stat .3: %v", err)
+	}
+}
+
+func TestWriterReopensAfterFailedRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cap.jsonl")
+	w, err := NewWriter(path, 100, 1)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	defer w.Close()
+	rec := &Record{Time: time.Now(), Dir: DirIn, Payload: []byte("0123456789")}
+	if err := w.Write(rec); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// A non-empty directory in the way makes the rotation fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 2 {
+		if err := w.Write(rec); err == nil {
+			t.Fatalf("Write %d succeeded with the rotation blocked", i)
+		}
+	}
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(rec); err != nil {
+		t.Fatalf("Write after clearing the way: %v", err)
+	}
+	recs, err := ReadFile(path)
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("current file holds %d records, %v; want 1", len(recs), err)
+	}
+}
+
+func TestWriterEnqueueDropsWhenFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cap.jsonl")
+	w, err := NewWriter(path, 0, 0)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	// Holding the file lock stalls the background writer.
+	w.mu.Lock()
+	queued := 0
+	for i := range QueueSize + 10 {
+		if w.Enqueue(&Record{Time: time.Now(), Dir: DirIn, RequestID: uint64(i)}) {
+			queued++
+		}
+	}
+	w.mu.Unlock()
+	if w.Dropped() == 0 || queued+int(w.Dropped()) != QueueSize+10 {
+		t.Fatalf("queued=%d dropped=%d", queued, w.Dropped())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if w.Enqueue(&Record{}) {
+		t.Fatal("Enqueue after Close accepted a record")
+	}
+	recs, err := ReadFile(path)
+	if err != nil || len(recs) != queued {
+		t.Fatalf("file holds %d records, %v; want %d", len(recs), err, queued)
+	}
+}
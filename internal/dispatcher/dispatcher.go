@@ -20,3 +20,9 @@ func Dispatch(ctx context.Context, cmd uint16, payload []byte) ([]byte, error) {
 	}
 	return h(ctx, payload)
 }
+
+// Has reports whether a handler is registered for cmd.
+func Has(cmd uint16) bool {
+	_, ok := handlers[cmd]
+	return ok
+}
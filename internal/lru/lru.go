@@ -0,0 +1,98 @@
+// Package lru provides a least-recently-used map whose entries expire.
+package lru
+
+import (
+	"container/list"
+	"time"
+)
+
+// Cache holds at most a fixed number of entries, evicting the least recently
+// used, and drops each entry once its TTL has passed. It is not safe for
+// concurrent use: callers guard it with their own lock.
+type Cache[K comparable, V any] struct {
+	capacity int
+	ll       *list.List // front is the most recently used
+	entries  map[K]*list.Element
+}
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// New returns a cache of at most capacity entries; capacity must be positive.
+func New[K comparable, V any](capacity int) *Cache[K, V] {
+	return &Cache[K, V]{capacity: capacity, ll: list.New(), entries: make(map[K]*list.Element)}
+}
+
+// Get returns the live value of key and marks it as recently used. An
+// expired entry is dropped.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	e := el.Value.(*entry[K, V])
+	if !time.Now().Before(e.expires) {
+		c.remove(el)
+		var zero V
+		return zero, false
+	}
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+// Set adds or replaces the value of key, live for ttl, and returns how many
+// entries were evicted to make room.
+func (c *Cache[K, V]) Set(key K, value V, ttl time.Duration) int {
+	e := &entry[K, V]{key: key, value: value, expires: time.Now().Add(ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return 0
+	}
+	c.entries[key] = c.ll.PushFront(e)
+	n := 0
+	for c.ll.Len() > c.capacity {
+		c.remove(c.ll.Back())
+		n++
+	}
+	return n
+}
+
+// Remove drops the entry of key and reports whether there was one.
+func (c *Cache[K, V]) Remove(key K) bool {
+	el, ok := c.entries[key]
+	if ok {
+		c.remove(el)
+	}
+	return ok
+}
+
+// RemoveFunc drops every entry match reports true for, expired ones
+// included, and returns how many there were.
+func (c *Cache[K, V]) RemoveFunc(match func(K, V) bool) int {
+	n := 0
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*entry[K, V]); match(e.key, e.value) {
+			c.remove(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// Len returns the number of entries held, expired ones included until they
+// are looked up or evicted.
+func (c *Cache[K, V]) Len() int {
+	return c.ll.Len()
+}
+
+func (c *Cache[K, V]) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.entries, el.Value.(*entry[K, V]).key)
+}
@@ -0,0 +1,48 @@
+package lru
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New[string, int](2)
+	c.Set("a", 1, time.Hour)
+	c.Set("b", 2, time.Hour)
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatalf("Get(a) = %d, %v", v, ok)
+	}
+	if n := c.Set("c", 3, time.Hour); n != 1 {
+		t.Fatalf("Set(c) evicted %d, want 1", n)
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b survived although least recently used")
+	}
+	if n := c.Set("a", 10, time.Hour); n != 0 || c.Len() != 2 {
+		t.Fatalf("replacing a evicted %d, len %d", n, c.Len())
+	}
+	if v, _ := c.Get("a"); v != 10 {
+		t.Fatalf("Get(a) = %d after replace", v)
+	}
+}
+
+func TestCacheExpiresAndRemoves(t *testing.T) {
+	c := New[int, string](8)
+	c.Set(1, "short", 10*time.Millisecond)
+	c.Set(2, "long", time.Hour)
+	c.Set(3, "long", time.Hour)
+	time.Sleep(20 * time.Millisecond)
+	if c.Len() != 3 {
+		t.Fatalf("len = %d before lookup, want 3", c.Len())
+	}
+	if _, ok := c.Get(1); ok || c.Len() != 2 {
+		t.Fatalf("expired entry served or kept (len %d)", c.Len())
+	}
+	if !c.Remove(2) || c.Remove(2) {
+		t.Fatal("Remove did not report the entry once")
+	}
+	c.Set(4, "other", time.Hour)
+	if n := c.RemoveFunc(func(_ int, v string) bool { return v == "long" }); n != 1 || c.Len() != 1 {
+		t.Fatalf("RemoveFunc removed %d, left %d", n, c.Len())
+	}
+}
@@ -0,0 +1,170 @@
+// Package proxyproto parses HAProxy PROXY protocol v1 (text) and v2 (binary)
+// headers as specified in
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// v2Signature starts every v2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLen    = 107
+	v2HeaderLen = 16
+	v2MaxBody   = 4096
+)
+
+// ErrInvalidHeader is wrapped by every parse error.
+var ErrInvalidHeader = errors.New("proxyproto: invalid header")
+
+// Header is a parsed PROXY header.
+type Header struct {
+	Version int
+	// Local is set for v2 LOCAL commands (health checks from the balancer
+	// itself) and v1 UNKNOWN; Source and Destination are nil then.
+	Local       bool
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// Read consumes a PROXY header from r. It returns (nil, nil) without
+// consuming anything if the stream does not start with one.
+func Read(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case v1Prefix[0]:
+		if p, err := r.Peek(len(v1Prefix)); err == nil && string(p) == v1Prefix {
+			return readV1(r)
+		}
+	case v2Signature[0]:
+		if p, err := r.Peek(len(v2Signature)); err == nil && bytes.Equal(p, v2Signature) {
+			return readV2(r)
+		}
+	}
+	return nil, nil
+}
+
+func invalid(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidHeader, fmt.Sprintf(format, args...))
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, invalid("v1 line not terminated by CRLF within %d bytes", v1MaxLen)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: 1, Local: true}, nil
+	}
+	if len(fields) != 6 {
+		return nil, invalid("v1 has %d fields, want 6", len(fields))
+	}
+	switch fields[1] {
+	case "TCP4", "TCP6":
+	default:
+		return nil, invalid("v1 unknown protocol %q", fields[1])
+	}
+	src, err := v1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	dst, err := v1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	return &Header{Version: 1, Source: src, Destination: dst}, nil
+}
+
+func v1Addr(ipStr, portStr string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return nil, invalid("v1 bad address %q", ipStr)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, invalid("v1 bad port %q", portStr)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	var hdr [v2HeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	if verCmd>>4 != 2 {
+		return nil, invalid("v2 version %d", verCmd>>4)
+	}
+	n := int(binary.BigEndian.Uint16(hdr[14:16]))
+	if n > v2MaxBody {
+		return nil, invalid("v2 body of %d bytes", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+	switch verCmd & 0x0F {
+	case 0x0: // LOCAL
+		h.Local = true
+		return h, nil
+	case 0x1: // PROXY
+	default:
+		return nil, invalid("v2 command %d", verCmd&0x0F)
+	}
+
+	switch fam >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, invalid("v2 short IPv4 block")
+		}
+		h.Source = v2Addr(fam, body[0:4], body[8:10])
+		h.Destination = v2Addr(fam, body[4:8], body[10:12])
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, invalid("v2 short IPv6 block")
+		}
+		h.Source = v2Addr(fam, body[0:16], body[32:34])
+		h.Destination = v2Addr(fam, body[16:32], body[34:36])
+	default:
+		// AF_UNSPEC / AF_UNIX: keep the transport's addresses.
+		h.Local = true
+	}
+	return h, nil
+}
+
+func v2Addr(fam byte, ip, port []byte) net.Addr {
+	p := int(binary.BigEndian.Uint16(port))
+	ipc := net.IP(append([]byte(nil), ip...))
+	if fam&0x0F == 0x2 { // DGRAM
+		return &net.UDPAddr{IP: ipc, Port: p}
+	}
+	return &net.TCPAddr{IP: ipc, Port: p}
+}
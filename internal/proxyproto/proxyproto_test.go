@@ -0,0 +1,92 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func v2Header(cmd, fam byte, body []byte) []byte {
+	h := append([]byte(nil), v2Signature...)
+	h = append(h, 0x20|cmd, fam)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(body)))
+	return append(h, body...)
+}
+
+func TestReadV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 203.0.113.7 10.0.0.1 4444 9000\r\nrest"))
+	h, err := Read(r)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if h.Version != 1 || h.Source.String() != "203.0.113.7:4444" || h.Destination.String() != "10.0.0.1:9000" {
+		t.Fatalf("header = %+v", h)
+	}
+	if rest, _ := r.ReadString(0); rest != "rest" {
+		t.Fatalf("rest = %q", rest)
+	}
+
+	h, err = Read(bufio.NewReader(strings.NewReader("PROXY TCP6 2001:db8::1 2001:db8::2 1 2\r\n")))
+	if err != nil || h.Source.String() != "[2001:db8::1]:1" {
+		t.Fatalf("TCP6: %+v %v", h, err)
+	}
+	h, err = Read(bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n")))
+	if err != nil || !h.Local || h.Source != nil {
+		t.Fatalf("UNKNOWN: %+v %v", h, err)
+	}
+}
+
+func TestReadV2(t *testing.T) {
+	body := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x11, 0x5C, 0x23, 0x28}
+	body = append(body, 0x03, 0x00, 0x01, 0xFF) // a TLV, ignored
+	r := bufio.NewReader(strings.NewReader(string(v2Header(0x1, 0x11, body)) + "rest"))
+	h, err := Read(r)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if h.Version != 2 || h.Local || h.Source.String() != "203.0.113.7:4444" || h.Destination.String() != "10.0.0.1:9000" {
+		t.Fatalf("header = %+v", h)
+	}
+	if rest, _ := r.ReadString(0); rest != "rest" {
+		t.Fatalf("rest = %q", rest)
+	}
+
+	ip6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0, 1, 0, 2)
+	h, err = Read(bufio.NewReader(strings.NewReader(string(v2Header(0x1, 0x21, ip6)))))
+	if err != nil || h.Source.String() != "[2001:db8::1]:1" {
+		t.Fatalf("IPv6: %+v %v", h, err)
+	}
+
+	h, err = Read(bufio.NewReader(strings.NewReader(string(v2Header(0x0, 0x00, nil)))))
+	if err != nil || !h.Local {
+		t.Fatalf("LOCAL: %+v %v", h, err)
+	}
+}
+
+func TestReadNoHeaderConsumesNothing(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("\xCA\xFE\x01\x00"))
+	h, err := Read(r)
+	if h != nil || err != nil {
+		t.Fatalf("Read = %+v, %v", h, err)
+	}
+	if r.Buffered() != 4 {
+		t.Fatalf("consumed input: buffered=%d", r.Buffered())
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	for name, in := range map[string]string{
+		"v1 fields":   "PROXY TCP4 1.2.3.4\r\n",
+		"v1 family":   "PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n",
+		"v1 no crlf":  "PROXY " + strings.Repeat("x", 120),
+		"v2 version":  string(append(append([]byte(nil), v2Signature...), 0x11, 0x11, 0, 0)),
+		"v2 short v4": string(v2Header(0x1, 0x11, []byte{1, 2, 3})),
+	} {
+		if _, err := Read(bufio.NewReader(strings.NewReader(in))); !errors.Is(err, ErrInvalidHeader) {
+			t.Fatalf("%s: err = %v, want ErrInvalidHeader", name, err)
+		}
+	}
+}
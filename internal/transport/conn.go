@@ -1 +1,53 @@
+// Package transport defines how the gateway drives accepted connections.
+//
+// The default transport (in package novagate) runs one goroutine with its own
+// read buffer per connection. Netpoll multiplexes connections on
+// cloudwego/netpoll event loops instead, so an idle connection holds neither
+// a goroutine nor a buffer.
 package transport
+
+import (
+	"context"
+	"net"
+
+	"github.com/cloudwego/netpoll"
+)
+
+// Transport serves connections accepted from ln until ctx is canceled or the
+// listener fails.
+type Transport interface {
+	Serve(ctx context.Context, ln net.Listener, h Handler) error
+}
+
+// Handler is the gateway side of a Transport.
+type Handler interface {
+	// ServeConn serves c until it is closed. Blocking transports call it on
+	// a goroutine of their own; it closes c before returning.
+	ServeConn(ctx context.Context, c net.Conn)
+	// NewSession creates the per-connection state used by event-driven
+	// transports, which deliver complete frames to it as they arrive.
+	NewSession(ctx context.Context, c net.Conn) Session
+}
+
+// Session serves the frames of one connection.
+type Session interface {
+	// HandleFrame serves one complete wire frame (header included). frame is
+	// only valid during the call. A non-nil error closes the connection.
+	HandleFrame(frame []byte) error
+	// Flush writes responses queued by HandleFrame. The transport calls it
+	// once no complete frame is left in the connection's input.
+	Flush() error
+	// Close releases the session after the connection has closed.
+	Close()
+}
+
+// WriteBuffers writes bufs to c as one batch. Netpoll connections stage them
+// in their output buffer and flush once; other connections use net.Buffers,
+// which is a single writev on TCP and Unix sockets.
+func WriteBuffers(c net.Conn, bufs [][]byte) (int64, error) {
+	if nc, ok := c.(netpoll.Connection); ok {
+		return writeNetpoll(nc, bufs)
+	}
+	nb := net.Buffers(bufs)
+	return nb.WriteTo(c)
+}
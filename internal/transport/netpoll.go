@@ -0,0 +1,184 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudwego/netpoll"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// Netpoll serves TCP and Unix listeners on netpoll event loops.
+//
+// Bytes are read by the poller into netpoll's linked buffers; a pooled
+// goroutine runs only while a connection has unread data, and frames are
+// handed to the Session without being copied.
+type Netpoll struct {
+	// IdleTimeout closes connections that receive nothing for this long.
+	// A single sweeper per listener enforces it. 0 disables it.
+	IdleTimeout time.Duration
+	// ReadTimeout bounds the wait for the rest of a partially received frame.
+	ReadTimeout time.Duration
+	// ShutdownTimeout bounds the graceful close of active connections once
+	// ctx is canceled. Defaults to 5s.
+	ShutdownTimeout time.Duration
+}
+
+// NetpollSupported reports whether ln can be served by Netpoll, which needs
+// the listener's file descriptor.
+func NetpollSupported(ln net.Listener) bool {
+	switch ln.(type) {
+	case *net.TCPListener, *net.UnixListener:
+		return true
+	default:
+		return false
+	}
+}
+
+type netpollConn struct {
+	conn     netpoll.Connection
+	sess     Session
+	lastSeen atomic.Int64
+}
+
+type netpollConnKey struct{}
+
+// Serve implements Transport. It returns nil once ctx is canceled.
+func (t Netpoll) Serve(ctx context.Context, ln net.Listener, h Handler) error {
+	var conns sync.Map // *netpollConn -> struct{}
+
+	onConnect := func(_ context.Context, c netpoll.Connection) context.Context {
+		nc := &netpollConn{conn: c, sess: h.NewSession(ctx, c)}
+		nc.lastSeen.Store(time.Now().UnixNano())
+		conns.Store(nc, struct{}{})
+		_ = c.AddCloseCallback(func(netpoll.Connection) error {
+			conns.Delete(nc)
+			nc.sess.Close()
+			return nil
+		})
+		return context.WithValue(ctx, netpollConnKey{}, nc)
+	}
+	onRequest := func(cctx context.Context, c netpoll.Connection) error {
+		nc, ok := cctx.Value(netpollConnKey{}).(*netpollConn)
+		if !ok {
+			return c.Close()
+		}
+		nc.lastSeen.Store(time.Now().UnixNano())
+		err := serveFrames(c, nc.sess)
+		nc.lastSeen.Store(time.Now().UnixNano())
+		if err != nil {
+			_ = c.Close()
+		}
+		return err
+	}
+
+	opts := []netpoll.Option{netpoll.WithOnConnect(onConnect)}
+	if t.ReadTimeout > 0 {
+		opts = append(opts, netpoll.WithReadTimeout(t.ReadTimeout))
+	}
+	evl, err := netpoll.NewEventLoop(onRequest, opts...)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		timeout := t.ShutdownTimeout
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		sctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_ = evl.Shutdown(sctx)
+	}()
+	if t.IdleTimeout > 0 {
+		go sweepIdle(&conns, t.IdleTimeout, done)
+	}
+
+	return evl.Serve(ln)
+}
+
+// serveFrames hands every complete frame in the connection's input to sess.
+// netpoll keeps calling OnRequest while input is pending, so a partial frame
+// is waited for here (bounded by ReadTimeout) rather than left unread.
+func serveFrames(c netpoll.Connection, sess Session) (err error) {
+	defer func() {
+		if ferr := sess.Flush(); err == nil {
+			err = ferr
+		}
+	}()
+	r := c.Reader()
+	for r.Len() > 0 {
+		n, err := peekFrameLen(r)
+		if err != nil {
+			return err
+		}
+		frame, err := r.Next(n)
+		if err != nil {
+			return err
+		}
+		err = sess.HandleFrame(frame)
+		_ = r.Release()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// peekFrameLen returns the length of the next frame, waiting for as much of
+// its variable-length header as needed.
+func peekFrameLen(r netpoll.Reader) (int, error) {
+	for want := min(r.Len(), protocol.FrameHeaderLen); ; want++ {
+		hdr, err := r.Peek(want)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := protocol.FrameLen(hdr); err != nil || n > 0 {
+			return n, err
+		}
+	}
+}
+
+func sweepIdle(conns *sync.Map, idle time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(max(idle/2, 10*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			cutoff := now.Add(-idle).UnixNano()
+			conns.Range(func(k, _ any) bool {
+				nc := k.(*netpollConn)
+				if nc.lastSeen.Load() < cutoff {
+					_ = nc.conn.Close()
+				}
+				return true
+			})
+		}
+	}
+}
+
+func writeNetpoll(c netpoll.Connection, bufs [][]byte) (int64, error) {
+	w := c.Writer()
+	var n int64
+	for _, b := range bufs {
+		m, err := w.WriteBinary(b)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, w.Flush()
+}
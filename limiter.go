@@ -0,0 +1,209 @@
+package novagate
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// Priority is the load-shedding class of a command. Every class has its own
+// adaptive limit, so a flood of normal traffic against a slow backend cannot
+// starve health checks or logins.
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	// PriorityCritical is for commands that must survive overload, such as
+	// health checks and logins.
+	PriorityCritical
+	// PriorityLow is for commands that are the first to go, such as bulk or
+	// background requests.
+	PriorityLow
+
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityCritical:
+		return "critical"
+	case PriorityLow:
+		return "low"
+	}
+	return "normal"
+}
+
+// Default limiter settings (see LimiterConfig).
+const (
+	defaultInitialLimit = 20
+	defaultMinLimit     = 1
+	defaultMaxLimit     = 1000
+	defaultTolerance    = 1.5
+)
+
+// Windows of the latency averages, in samples, and the share of each new
+// limit estimate blended into the current limit.
+const (
+	limiterLongWindow  = 600
+	limiterShortWindow = 10
+	limiterSmoothing   = 0.2
+)
+
+// LimiterConfig configures an AdaptiveLimiter. Zero values take the defaults.
+type LimiterConfig struct {
+	// InitialLimit is the concurrency limit of each class before any latency
+	// has been observed (default 20).
+	InitialLimit int
+	// MinLimit and MaxLimit bound the adaptive limit (defaults 1 and 1000).
+	MinLimit int
+	MaxLimit int
+	// Tolerance is how far the recent handler latency may rise above its
+	// long-term average before the limit shrinks (default 1.5, i.e. +50%).
+	Tolerance float64
+	// Priorities assigns commands to classes; unlisted commands are
+	// PriorityNormal.
+	Priorities map[uint16]Priority
+}
+
+// AdaptiveLimiter caps the number of requests in flight through the router
+// and sheds the excess with ErrOverloaded.
+//
+// The limit of each priority class follows the gradient algorithm: it keeps
+// a long-term and a short-term average of handler latency and, whenever the
+// class is busy, sets the new limit to
+//
+//	limit × clamp(Tolerance × long / short, 0.5, 1) + √limit
+//
+// so the limit grows by about √limit per sample while latency holds steady
+// and shrinks as soon as requests start queueing in a slow backend.
+type AdaptiveLimiter struct {
+	priorities map[uint16]Priority
+	classes    [numPriorities]limitClass
+}
+
+type limitClass struct {
+	mu        sync.Mutex
+	limit     float64
+	min, max  float64
+	tolerance float64
+	inflight  int
+	long      float64 // long-term average latency, ns
+	short     float64 // recent average latency, ns
+}
+
+// NewAdaptiveLimiter returns a limiter; install it with Router.Use(l.Middleware()).
+func NewAdaptiveLimiter(cfg LimiterConfig) *AdaptiveLimiter {
+	if cfg.MinLimit <= 0 {
+		cfg.MinLimit = defaultMinLimit
+	}
+	if cfg.MaxLimit <= 0 {
+		cfg.MaxLimit = defaultMaxLimit
+	}
+	cfg.MaxLimit = max(cfg.MaxLimit, cfg.MinLimit)
+	if cfg.InitialLimit <= 0 {
+		cfg.InitialLimit = defaultInitialLimit
+	}
+	cfg.InitialLimit = min(max(cfg.InitialLimit, cfg.MinLimit), cfg.MaxLimit)
+	if cfg.Tolerance < 1 {
+		cfg.Tolerance = defaultTolerance
+	}
+
+	l := &AdaptiveLimiter{priorities: cfg.Priorities}
+	for i := range l.classes {
+		c := &l.classes[i]
+		c.limit = float64(cfg.InitialLimit)
+		c.min = float64(cfg.MinLimit)
+		c.max = float64(cfg.MaxLimit)
+		c.tolerance = cfg.Tolerance
+	}
+	return l
+}
+
+// Middleware returns the router middleware enforcing the limits. The
+// latency it measures covers the middlewares registered after it, so install
+// it ahead of everything that does real work; only cheap rejections such as
+// ValidatePayloads belong before it, so that requests they refuse never take
+// a slot (cmd/server installs them in that order).
+func (l *AdaptiveLimiter) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			c := &l.classes[l.priority(m.Command)]
+			if !c.acquire() {
+				metricLimiterShed.Add(1)
+				return nil, ErrOverloaded
+			}
+			start := time.Now()
+			resp, err := next(ctx, m)
+			c.release(time.Since(start))
+			return resp, err
+		}
+	}
+}
+
+// Limit returns the current concurrency limit of class p.
+func (l *AdaptiveLimiter) Limit(p Priority) int {
+	c := &l.classes[p]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int(c.limit)
+}
+
+// Inflight returns the number of class p requests being handled.
+func (l *AdaptiveLimiter) Inflight(p Priority) int {
+	c := &l.classes[p]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inflight
+}
+
+func (l *AdaptiveLimiter) priority(cmd uint16) Priority {
+	if p, ok := l.priorities[cmd]; ok && p >= 0 && p < numPriorities {
+		return p
+	}
+	return PriorityNormal
+}
+
+func (c *limitClass) acquire() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inflight >= int(c.limit) {
+		return false
+	}
+	c.inflight++
+	return true
+}
+
+func (c *limitClass) release(latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.observe(float64(max(latency, time.Microsecond)), c.inflight)
+	c.inflight--
+}
+
+// observe feeds one latency sample, taken with inflight requests running.
+// Callers hold c.mu.
+func (c *limitClass) observe(sample float64, inflight int) {
+	if c.long == 0 {
+		c.long, c.short = sample, sample
+	} else {
+		c.long += (sample - c.long) / limiterLongWindow
+		c.short += (sample - c.short) / limiterShortWindow
+	}
+	// After a latency drop, pull the long-term average down quickly instead
+	// of waiting out its window, so that the next rise is noticed.
+	if c.long > 2*c.short {
+		c.long *= 0.95
+	}
+	// A mostly idle class tells nothing about the backend's capacity.
+	if float64(inflight) < c.limit/2 {
+		return
+	}
+
+	gradient := max(0.5, min(1, c.tolerance*c.long/c.short))
+	next := c.limit*gradient + math.Sqrt(c.limit)
+	c.limit = c.limit*(1-limiterSmoothing) + next*limiterSmoothing
+	c.limit = min(max(c.limit, c.min), c.max)
+}
@@ -0,0 +1,131 @@
+package novagate
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func TestAdaptiveLimiterShedsPerPriorityClass(t *testing.T) {
+	l := NewAdaptiveLimiter(LimiterConfig{
+		InitialLimit: 2,
+		MaxLimit:     2,
+		Priorities:   map[uint16]Priority{protocol.CmdPing: PriorityCritical},
+	})
+	release := make(chan struct{})
+	h := l.Middleware()(func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		if m.Command == protocol.CmdOrderCreate {
+			<-release
+		}
+		return m, nil
+	})
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = h(context.Background(), &protocol.Message{Command: protocol.CmdOrderCreate})
+		}()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for l.Inflight(PriorityNormal) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("requests did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	shed := metricLimiterShed.Value()
+	if _, err := h(context.Background(), &protocol.Message{Command: protocol.CmdOrderCreate}); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("normal request over the limit: err = %v, want ErrOverloaded", err)
+	}
+	if got := metricLimiterShed.Value() - shed; got != 1 {
+		t.Fatalf("limiter_shed delta = %d, want 1", got)
+	}
+	if _, err := h(context.Background(), &protocol.Message{Command: protocol.CmdPing}); err != nil {
+		t.Fatalf("critical request during overload: %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+	if n := l.Inflight(PriorityNormal); n != 0 {
+		t.Fatalf("inflight after completion = %d", n)
+	}
+}
+
+func TestAdaptiveLimitFollowsLatency(t *testing.T) {
+	l := NewAdaptiveLimiter(LimiterConfig{InitialLimit: 10, MaxLimit: 200})
+	c := &l.classes[PriorityNormal]
+	busy := func(latency time.Duration, n int) {
+		for range n {
+			c.mu.Lock()
+			c.observe(float64(latency), int(c.limit))
+			c.mu.Unlock()
+		}
+	}
+
+	busy(time.Millisecond, 200)
+	grown := l.Limit(PriorityNormal)
+	if grown <= 10 {
+		t.Fatalf("limit = %d after steady latency, want growth above 10", grown)
+	}
+
+	busy(20*time.Millisecond, 50)
+	if got := l.Limit(PriorityNormal); got >= grown/2 {
+		t.Fatalf("limit = %d after latency rise, want well below %d", got, grown)
+	}
+
+	// An idle class does not move its limit.
+	before := l.Limit(PriorityLow)
+	lc := &l.classes[PriorityLow]
+	lc.mu.Lock()
+	lc.observe(float64(time.Millisecond), 0)
+	lc.mu.Unlock()
+	if got := l.Limit(PriorityLow); got != before {
+		t.Fatalf("idle class limit moved from %d to %d", before, got)
+	}
+}
+
+func TestOverloadedReplyKeepsConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	setup := func(r *Router) error {
+		r.Use(func(next Handler) Handler {
+			return func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+				if m.RequestID == 1 {
+					return nil, ErrOverloaded
+				}
+				return next(ctx, m)
+			}
+		})
+		return echoSetup(r)
+	}
+	go func() { _ = ServeWithContext(ctx, ln, setup) }()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	resp := pingRoundTrip(t, c, 1, []byte("x"))
+	if resp.Command != protocol.CmdError || resp.RequestID != 1 {
+		t.Fatalf("shed response = %+v, want CmdError for request 1", resp)
+	}
+	code, msg, err := protocol.DecodeErrorReply(resp.Payload)
+	if err != nil || code != protocol.StatusOverloaded || msg != "overloaded" {
+		t.Fatalf("error reply = %d %q %v", code, msg, err)
+	}
+	if resp := pingRoundTrip(t, c, 2, []byte("y")); resp.Command != protocol.CmdPing || resp.RequestID != 2 {
+		t.Fatalf("follow-up response = %+v", resp)
+	}
+}
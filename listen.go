@@ -0,0 +1,164 @@
+package novagate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// WithListenURLs adds extra listeners to the ListenAndServe*WithContext variants.
+//
+// Each URL selects the listener kind by scheme:
+//   - tcp://host:port
+//   - unix:///path/to/socket
+//   - ws://host:port/path (WebSocket, one binary WS message per write)
+//
+// All listeners share the same Router. This option has no effect when you
+// call Serve/ServeWithContext with an existing listener.
+func WithListenURLs(urls ...string) ServeOption {
+	return func(o *serveOptions) {
+		o.listenURLs = append(o.listenURLs, urls...)
+	}
+}
+
+// ListenURL opens a listener described by a URL (see WithListenURLs).
+func ListenURL(raw string) (net.Listener, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("novagate: invalid listen url %q: %w", raw, err)
+	}
+	switch u.Scheme {
+	case "tcp", "tcp4", "tcp6":
+		return net.Listen(u.Scheme, u.Host)
+	case "unix":
+		return listenUnix(u.Path)
+	case "ws":
+		return ListenWebSocket(u.Host, u.Path)
+	default:
+		return nil, fmt.Errorf("novagate: unsupported listen scheme %q", u.Scheme)
+	}
+}
+
+// listenUnix removes a stale socket file left behind by a previous process
+// before binding. Regular files are never removed.
+func listenUnix(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("novagate: empty unix socket path")
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if _, derr := net.Dial("unix", path); derr != nil {
+			_ = os.Remove(path)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func openListeners(addr string, urls []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	primary, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listeners = append(listeners, primary)
+	for _, raw := range urls {
+		ln, err := ListenURL(raw)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, ln := range listeners {
+		_ = ln.Close()
+	}
+}
+
+// ServeListeners serves the protocol on several listeners that share one Router.
+//
+// setup runs once. ServeListeners returns nil after ctx is canceled, or the
+// first accept error from any listener; in both cases every listener is closed.
+func ServeListeners(ctx context.Context, listeners []net.Listener, setup SetupFunc, opts ...ServeOption) error {
+	if setup == nil {
+		return ErrNoSetup
+	}
+	if len(listeners) == 0 {
+		return errors.New("novagate: no listeners")
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	so := applyServeOptions(opts)
+	if err := validTransport(so.transport); err != nil {
+		return err
+	}
+	if so.proxyProtocol != nil {
+		var err error
+		if listeners, err = wrapProxyListeners(listeners, *so.proxyProtocol); err != nil {
+			return err
+		}
+	}
+
+	router := NewRouter()
+	if err := setup(router); err != nil {
+		return err
+	}
+
+	closeCapture, err := openCapture(&so)
+	if err != nil {
+		return err
+	}
+	defer closeCapture()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if so.httpBridgeAddr != "" {
+		if err := startHTTPServer(ctx, "http bridge", so.httpBridgeAddr, NewHTTPBridge(router)); err != nil {
+			return err
+		}
+	}
+	if so.adminAddr != "" {
+		if err := startHTTPServer(ctx, "admin api", so.adminAddr, NewAdminHandler(router)); err != nil {
+			return err
+		}
+	}
+	return serveListeners(ctx, listeners, router, so)
+}
+
+func serveListeners(ctx context.Context, listeners []net.Listener, router *Router, so serveOptions) error {
+	h := &connServer{router: router, so: so}
+	if len(listeners) == 1 {
+		return transportFor(listeners[0], so).Serve(ctx, listeners[0], h)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			err := transportFor(ln, so).Serve(ctx, ln, h)
+			if err != nil {
+				once.Do(func() { firstErr = err })
+			}
+			// One listener stopping (error or close) stops the whole server.
+			cancel()
+		}(ln)
+	}
+	wg.Wait()
+	return firstErr
+}
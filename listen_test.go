@@ -0,0 +1,100 @@
+package novagate
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func echoSetup(r *Router) error {
+	r.Register(protocol.CmdPing, func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		return &protocol.Message{Command: m.Command, RequestID: m.RequestID, Payload: m.Payload}, nil
+	})
+	return nil
+}
+
+// pingRoundTrip writes one CmdPing frame to c and returns the decoded response.
+func pingRoundTrip(t *testing.T, c net.Conn, requestID uint64, payload []byte) *protocol.Message {
+	t.Helper()
+	msgBytes, _ := protocol.EncodeMessage(&protocol.Message{Command: protocol.CmdPing, RequestID: requestID, Payload: payload})
+	if _, err := c.Write(protocol.Encode(&protocol.Frame{Body: msgBytes})); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var buf []byte
+	tmp := make([]byte, 512)
+	for {
+		n, err := c.Read(tmp)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		buf = append(buf, tmp[:n]...)
+		frame, _, err := protocol.Decode(buf)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if frame == nil {
+			continue
+		}
+		resp, err := protocol.DecodeMessage(frame.Body)
+		if err != nil {
+			t.Fatalf("decode message: %v", err)
+		}
+		return resp
+	}
+}
+
+func TestServeListeners_TCPAndUnixShareRouter(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp: %v", err)
+	}
+	sock := filepath.Join(t.TempDir(), "novagate.sock")
+	unixLn, err := ListenURL("unix://" + sock)
+	if err != nil {
+		t.Fatalf("listen unix: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeListeners(ctx, []net.Listener{tcpLn, unixLn}, echoSetup)
+	}()
+
+	for _, target := range []struct{ network, addr string }{
+		{"tcp", tcpLn.Addr().String()},
+		{"unix", sock},
+	} {
+		c, err := net.Dial(target.network, target.addr)
+		if err != nil {
+			t.Fatalf("dial %s: %v", target.network, err)
+		}
+		resp := pingRoundTrip(t, c, 7, []byte(target.network))
+		c.Close()
+		if resp.RequestID != 7 || !bytes.Equal(resp.Payload, []byte(target.network)) {
+			t.Fatalf("%s: unexpected response %+v", target.network, resp)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ServeListeners returned error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for ServeListeners to stop")
+	}
+}
+
+func TestListenURLRejectsUnknownScheme(t *testing.T) {
+	if _, err := ListenURL("udp://127.0.0.1:0"); err == nil {
+		t.Fatalf("expected error for unsupported scheme")
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/gogogo1024/novagate/internal/capture"
+	"github.com/gogogo1024/novagate/internal/transport"
 	"github.com/gogogo1024/novagate/protocol"
 )
 
@@ -21,12 +23,38 @@ type serveOptions struct {
 	addr         string
 	idleTimeout  time.Duration
 	writeTimeout time.Duration
+	listenURLs   []string
+	transport    string
+
+	writeBatchBytes int
+	writeBatchDelay time.Duration
+
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	keepAlive         *net.KeepAliveConfig
+
+	admission     *Admission
+	proxyProtocol *ProxyProtocolConfig
+
+	httpBridgeAddr string
+	adminAddr      string
+
+	capturePath     string
+	captureMaxBytes int64
+	captureMaxFiles int
+	capture         *capture.Writer
 }
 
 type ServeOption func(*serveOptions)
 
 func defaultServeOptions() serveOptions {
-	return serveOptions{addr: ":9000", idleTimeout: 5 * time.Minute, writeTimeout: 10 * time.Second}
+	return serveOptions{
+		addr:            ":9000",
+		idleTimeout:     5 * time.Minute,
+		writeTimeout:    10 * time.Second,
+		writeBatchBytes: defaultWriteBatchBytes,
+		writeBatchDelay: defaultWriteBatchDelay,
+	}
 }
 
 func applyServeOptions(opts []ServeOption) serveOptions {
@@ -112,13 +140,14 @@ func ListenAndServeWithOptionsOptions(setup SetupFunc, opts ...ServeOption) erro
 // ListenAndServeWithContext is like ListenAndServeWithOptions but can be stopped via ctx cancellation.
 //
 // When ctx is canceled, the listener will be closed and Serve will return.
+// Extra listeners configured with WithListenURLs are served alongside addr.
 func ListenAndServeWithContext(ctx context.Context, addr string, setup SetupFunc, opts ...ServeOption) error {
-	listener, err := net.Listen("tcp", normalizeAddr(addr, opts))
+	listeners, err := openListeners(normalizeAddr(addr, opts), applyServeOptions(opts).listenURLs)
 	if err != nil {
 		return err
 	}
-	defer listener.Close()
-	return ServeWithContext(ctx, listener, setup, opts...)
+	defer closeListeners(listeners)
+	return ServeListeners(ctx, listeners, setup, opts...)
 }
 
 // ListenAndServeWithContextOptions is like ListenAndServeWithContext but takes the addr from options.
@@ -142,21 +171,7 @@ func ServeWithOptions(listener net.Listener, setup SetupFunc, opts ...ServeOptio
 //
 // When ctx is canceled, the listener will be closed and Serve will return.
 func ServeWithContext(ctx context.Context, listener net.Listener, setup SetupFunc, opts ...ServeOption) error {
-	if setup == nil {
-		return ErrNoSetup
-	}
-	if ctx == nil {
-		ctx = context.Background()
-	}
-
-	so := applyServeOptions(opts)
-
-	router := NewRouter()
-	if err := setup(router); err != nil {
-		return err
-	}
-	closeOnDone(ctx.Done(), listener)
-	return acceptLoop(ctx, listener, router, so)
+	return ServeListeners(ctx, []net.Listener{listener}, setup, opts...)
 }
 
 type closer interface {
@@ -189,7 +204,7 @@ func closeConnOnDone(ctx context.Context, c net.Conn) func() {
 	return func() { close(stop) }
 }
 
-func acceptLoop(ctx context.Context, listener net.Listener, router *Router, so serveOptions) error {
+func acceptLoop(ctx context.Context, listener net.Listener, h transport.Handler) error {
 	acceptBackoff := 5 * time.Millisecond
 	for {
 		conn, err := listener.Accept()
@@ -206,7 +221,7 @@ func acceptLoop(ctx context.Context, listener net.Listener, router *Router, so s
 			return err
 		}
 		acceptBackoff = 5 * time.Millisecond
-		go serveConn(ctx, conn, router, so)
+		go h.ServeConn(ctx, conn)
 	}
 }
 
@@ -252,7 +267,7 @@ func serveConn(ctx context.Context, c net.Conn, router *Router, so serveOptions)
 	if stop != nil {
 		defer stop()
 	}
-	if err := handleConn(ctx, c, router, so.idleTimeout, so.writeTimeout); err != nil && !isBenignConnError(err) {
+	if err := handleConnWithOptions(ctx, c, router, so); err != nil && !isBenignConnError(err) {
 		log.Printf("conn error: %v", err)
 	}
 }
@@ -273,7 +288,8 @@ func isBenignConnError(err error) bool {
 	if errors.Is(err, syscall.ECONNRESET) {
 		return true
 	}
-	return false
+	var fe *faultError
+	return errors.As(err, &fe)
 }
 
 // BridgeProtocolHandler returns a protocol.Handler that forwards the payload to fn.
@@ -0,0 +1,82 @@
+package novagate
+
+import "expvar"
+
+// Gateway counters are published with expvar under "novagate" and served at
+// GET /debug/vars on the admin API (and on http.DefaultServeMux, if used).
+var (
+	metrics = expvar.NewMap("novagate")
+
+	// Response write path (see connWriter).
+	metricWriteFlushes      = newMetric("write_flushes")
+	metricWriteFrames       = newMetric("write_frames")
+	metricWriteBytes        = newMetric("write_bytes")
+	metricWriteErrors       = newMetric("write_errors")
+	metricWriteFlushBatch   = newMetric("write_flush_batch_end")
+	metricWriteFlushSize    = newMetric("write_flush_size")
+	metricWriteFlushLatency = newMetric("write_flush_latency")
+
+	// Inbound frames that could not be decoded: corrupt ones failed their
+	// FlagChecksum trailer, malformed ones are invalid in any other way.
+	metricFramesCorrupt   = newMetric("frames_corrupt")
+	metricFramesMalformed = newMetric("frames_malformed")
+
+	// Connections currently served, and admission rejections (see WithAdmission).
+	metricConnsOpen         = newMetric("conns_open")
+	metricAdmissionRejected = newMetric("admission_rejected")
+	metricAdmissionDenied   = newMetric("admission_rejected_denied")
+	metricAdmissionMaxConns = newMetric("admission_rejected_max_conns")
+	metricAdmissionMaxPerIP = newMetric("admission_rejected_max_conns_per_ip")
+
+	// PROXY protocol headers (see WithProxyProtocol).
+	metricProxyHeadersV1    = newMetric("proxy_headers_v1")
+	metricProxyHeadersV2    = newMetric("proxy_headers_v2")
+	metricProxyHeaderErrors = newMetric("proxy_header_errors")
+
+	// Requests shed by an AdaptiveLimiter.
+	metricLimiterShed = newMetric("limiter_shed")
+
+	// Backend resilience policies (see ResiliencePolicy); breaker states are
+	// published under "breakers".
+	metricBreakerOpens    = newMetric("breaker_opens")
+	metricBreakerRejected = newMetric("breaker_rejected")
+	metricRetries         = newMetric("retries")
+	metricHedges          = newMetric("hedges")
+
+	// Requests refused by a route policy (see Router.Route) and calls
+	// forwarded to upstream backends (see Upstream).
+	metricRouteRateLimited = newMetric("route_rate_limited")
+	metricRouteTimeouts    = newMetric("route_timeouts")
+	metricRouteRejected    = newMetric("route_rejected")
+	metricUpstreamDials    = newMetric("upstream_dials")
+	metricUpstreamErrors   = newMetric("upstream_errors")
+
+	// Shadow traffic (see Mirror): calls made, calls dropped at the
+	// concurrency cap, shadow errors and responses that differed.
+	metricMirrorRequests   = newMetric("mirror_requests")
+	metricMirrorDropped    = newMetric("mirror_dropped")
+	metricMirrorErrors     = newMetric("mirror_errors")
+	metricMirrorMismatches = newMetric("mirror_mismatches")
+
+	// Duplicate suppression (see Idempotency): responses replayed to
+	// duplicates, requests without a key or principal, and store failures.
+	metricDedupHits        = newMetric("dedup_hits")
+	metricDedupUnkeyed     = newMetric("dedup_unkeyed")
+	metricDedupStoreErrors = newMetric("dedup_store_errors")
+
+	// Requests answered with protocol.StatusBadPayload: undecodable payloads
+	// and unaccepted content types (see Typed, RouteConfig.ContentTypes).
+	metricBadPayloads = newMetric("bad_payloads")
+	// Requests refused by ValidatePayloads.
+	metricInvalidPayloads = newMetric("invalid_payloads")
+
+	// Liveness policy (see WithHeartbeat).
+	metricHeartbeatPings    = newMetric("heartbeat_pings")
+	metricHeartbeatTimeouts = newMetric("heartbeat_timeouts")
+)
+
+func newMetric(name string) *expvar.Int {
+	v := new(expvar.Int)
+	metrics.Set(name, v)
+	return v
+}
@@ -0,0 +1,161 @@
+package novagate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// Default mirror settings (see MirrorConfig).
+const (
+	DefaultMirrorMaxInflight = 64
+	DefaultMirrorTimeout     = time.Second
+)
+
+// MirrorConfig configures a Mirror. Zero MaxInflight and Timeout take the
+// defaults.
+type MirrorConfig struct {
+	// Shadow is the secondary handler, e.g. the rewritten service. Its
+	// responses are compared and then discarded.
+	Shadow Handler
+	// Sample is the share of requests mirrored, in (0, 1].
+	Sample float64
+	// MaxInflight caps the shadow calls in flight; requests sampled beyond it
+	// are not mirrored (default 64).
+	MaxInflight int
+	// Timeout bounds each shadow call (default 1s).
+	Timeout time.Duration
+	// Compare reports whether two successful response payloads agree
+	// (default bytes.Equal). Use it to ignore fields such as timestamps.
+	Compare func(primary, shadow []byte) bool
+}
+
+// Mirror copies a sample of one command's requests to a shadow handler in
+// the background and logs the RequestID of every request whose shadow
+// response differs from the primary one. The primary path only pays for
+// copying the sampled messages: shadow calls never block it, inherit none of
+// its cancellation, and are dropped once MaxInflight are running.
+type Mirror struct {
+	cmd      uint16
+	cfg      MirrorConfig
+	inflight atomic.Int64
+	wg       sync.WaitGroup
+}
+
+// NewMirror validates cfg and returns the mirror of cmd; install its
+// Middleware in the command's RouteConfig.Middlewares, or with Router.Use.
+func NewMirror(cmd uint16, cfg MirrorConfig) (*Mirror, error) {
+	if cfg.Shadow == nil {
+		return nil, fmt.Errorf("command 0x%04X: mirror without a shadow handler", cmd)
+	}
+	if !(cfg.Sample > 0 && cfg.Sample <= 1) {
+		return nil, fmt.Errorf("command 0x%04X: mirror sample %v is not in (0, 1]", cmd, cfg.Sample)
+	}
+	if cfg.MaxInflight <= 0 {
+		cfg.MaxInflight = DefaultMirrorMaxInflight
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultMirrorTimeout
+	}
+	if cfg.Compare == nil {
+		cfg.Compare = bytes.Equal
+	}
+	return &Mirror{cmd: cmd, cfg: cfg}, nil
+}
+
+// Middleware returns the middleware mirroring the command; other commands
+// pass through untouched.
+func (mr *Mirror) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			if m.Command != mr.cmd || !mr.sample() {
+				return next(ctx, m)
+			}
+			if mr.inflight.Add(1) > int64(mr.cfg.MaxInflight) {
+				mr.inflight.Add(-1)
+				metricMirrorDropped.Add(1)
+				return next(ctx, m)
+			}
+			// The request payload may alias the connection buffer and the
+			// response may alias the request, so both are copied before the
+			// handler returns.
+			req := m.Clone()
+			resp, err := next(ctx, m)
+			var primary *protocol.Message
+			if resp != nil {
+				primary = resp.Clone()
+			}
+			mr.wg.Add(1)
+			go mr.shadow(context.WithoutCancel(ctx), req, primary, err)
+			return resp, err
+		}
+	}
+}
+
+// Wait blocks until the shadow calls in flight have finished.
+func (mr *Mirror) Wait() {
+	mr.wg.Wait()
+}
+
+func (mr *Mirror) sample() bool {
+	return mr.cfg.Sample >= 1 || rand.Float64() < mr.cfg.Sample
+}
+
+func (mr *Mirror) shadow(ctx context.Context, req, primary *protocol.Message, primaryErr error) {
+	defer mr.wg.Done()
+	defer mr.inflight.Add(-1)
+
+	ctx, cancel := context.WithTimeout(ctx, mr.cfg.Timeout)
+	defer cancel()
+	metricMirrorRequests.Add(1)
+	resp, err := mr.cfg.Shadow(ctx, req)
+	if err != nil {
+		metricMirrorErrors.Add(1)
+	}
+	if diff := mr.diff(primary, primaryErr, resp, err); diff != "" {
+		metricMirrorMismatches.Add(1)
+		log.Printf("mirror mismatch: command 0x%04X request %d: %s", mr.cmd, req.RequestID, diff)
+	}
+}
+
+// diff describes how the shadow outcome differs from the primary one, or
+// returns "" when they agree. Errors agree when they carry the same status
+// code, or are both plain errors.
+func (mr *Mirror) diff(primary *protocol.Message, primaryErr error, shadow *protocol.Message, shadowErr error) string {
+	if primaryErr != nil || shadowErr != nil {
+		if outcome(primaryErr) != outcome(shadowErr) {
+			return fmt.Sprintf("primary %s, shadow %s", outcome(primaryErr), outcome(shadowErr))
+		}
+		return ""
+	}
+	var p, s []byte
+	if primary != nil {
+		p = primary.Payload
+	}
+	if shadow != nil {
+		s = shadow.Payload
+	}
+	if (primary == nil) != (shadow == nil) || !mr.cfg.Compare(p, s) {
+		return fmt.Sprintf("primary %d bytes, shadow %d bytes", len(p), len(s))
+	}
+	return ""
+}
+
+func outcome(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return fmt.Sprintf("status %d", se.Code)
+	}
+	return "error"
+}
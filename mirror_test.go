@@ -0,0 +1,159 @@
+package novagate
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+const cmdMirrorTest uint16 = 0x0E02
+
+func TestMirrorComparesShadowResponses(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	release := make(chan struct{})
+	shadow := func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		<-release
+		switch string(m.Payload) {
+		case "differ":
+			return &protocol.Message{Command: m.Command, Payload: []byte("v2")}, nil
+		case "fail":
+			return nil, ErrOverloaded
+		}
+		return &protocol.Message{Command: m.Command, Payload: m.Payload}, nil
+	}
+	mr, err := NewMirror(cmdMirrorTest, MirrorConfig{Shadow: shadow, Sample: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter()
+	primary := func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		// Echo by aliasing the request, as zero-copy handlers may.
+		return &protocol.Message{Command: m.Command, RequestID: m.RequestID, Payload: m.Payload}, nil
+	}
+	if err := r.Route(cmdMirrorTest, primary, RouteConfig{Middlewares: []Middleware{mr.Middleware()}}); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, mismatches, errs := metricMirrorRequests.Value(), metricMirrorMismatches.Value(), metricMirrorErrors.Value()
+	for id, payload := range []string{"same", "differ", "fail"} {
+		buf := []byte(payload)
+		resp, err := r.Dispatch(context.Background(), &protocol.Message{Command: cmdMirrorTest, RequestID: uint64(id + 1), Payload: buf})
+		if err != nil || string(resp.Payload) != payload {
+			t.Fatalf("primary response = %v, %v", resp, err)
+		}
+		// The connection buffer is reused once the handler returns.
+		copy(buf, "xxxxxx")
+	}
+	close(release)
+	mr.Wait()
+
+	if got := metricMirrorRequests.Value() - sent; got != 3 {
+		t.Fatalf("mirror_requests delta = %d, want 3", got)
+	}
+	if got := metricMirrorErrors.Value() - errs; got != 1 {
+		t.Fatalf("mirror_errors delta = %d, want 1", got)
+	}
+	if got := metricMirrorMismatches.Value() - mismatches; got != 2 {
+		t.Fatalf("mirror_mismatches delta = %d, want 2; log:\n%s", got, logs.String())
+	}
+	out := logs.String()
+	if strings.Contains(out, "request 1:") || !strings.Contains(out, "request 2: primary 6 bytes, shadow 2 bytes") ||
+		!strings.Contains(out, "request 3: primary ok, shadow status 1") {
+		t.Fatalf("mismatch log:\n%s", out)
+	}
+}
+
+func TestMirrorNeverBlocksPrimary(t *testing.T) {
+	release := make(chan struct{})
+	shadow := func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return m, nil
+	}
+	mr, err := NewMirror(cmdMirrorTest, MirrorConfig{Shadow: shadow, Sample: 1, MaxInflight: 1, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mr.Middleware()(func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		return m, nil
+	})
+
+	dropped := metricMirrorDropped.Value()
+	ctx, cancel := context.WithCancel(context.Background())
+	start := time.Now()
+	for range 5 {
+		if _, err := h(ctx, &protocol.Message{Command: cmdMirrorTest}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := h(ctx, &protocol.Message{Command: protocol.CmdPing}); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("primary path took %v with a stuck shadow", d)
+	}
+	if got := metricMirrorDropped.Value() - dropped; got != 4 {
+		t.Fatalf("mirror_dropped delta = %d, want 4", got)
+	}
+
+	// Cancelling the request does not cancel its shadow call.
+	cancel()
+	done := make(chan struct{})
+	go func() { mr.Wait(); close(done) }()
+	select {
+	case <-done:
+		t.Fatal("shadow call ended with the request context")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-done
+
+	for _, sample := range []float64{0, -0.5, 1.5} {
+		if _, err := NewMirror(cmdMirrorTest, MirrorConfig{Shadow: shadow, Sample: sample}); err == nil {
+			t.Errorf("sample %v accepted", sample)
+		}
+	}
+}
+
+func TestValidateCommandSpecsMirror(t *testing.T) {
+	half, bad := 0.5, 2.0
+	ok := CommandSpec{ID: cmdMirrorTest, Method: "OrderService.Create", Backend: BackendUpstream,
+		Mirror: &MirrorSpec{Service: "OrderServiceV2", Sample: &half}}
+	if err := ValidateCommandSpecs([]CommandSpec{ok}); err != nil {
+		t.Fatal(err)
+	}
+	if tgt := ok.Mirror.Target(ok); tgt.Backend != BackendUpstream || tgt.Service != "OrderServiceV2" {
+		t.Fatalf("mirror target = %+v", tgt)
+	}
+	if cfg := (MirrorSpec{}).MirrorConfig(); cfg.Sample != 1 {
+		t.Fatalf("default sample = %v, want 1", cfg.Sample)
+	}
+
+	err := ValidateCommandSpecs([]CommandSpec{
+		{ID: 0x0E03, Method: "OrderService.Pay", Mirror: &MirrorSpec{}},
+		{ID: 0x0E04, Method: "OrderService.Cancel", Mirror: &MirrorSpec{Service: "OrderServiceV2", Sample: &bad}},
+	})
+	if err == nil {
+		t.Fatal("invalid mirrors accepted")
+	}
+	for _, want := range []string{
+		"commands[0] (OrderService.Pay): mirror: needs a backend or service of its own",
+		"commands[1] (OrderService.Cancel): mirror: service is only used by upstream backends",
+		"commands[1] (OrderService.Cancel): mirror: sample 2 is not in (0, 1]",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// FlagBatch marks a frame whose body carries several messages instead of
+// one. The (decompressed) body is a sequence of entries, each a big-endian
+// uint32 length (a uvarint in version 2) followed by that many bytes of
+// Message encoding. Every message
+// keeps its own RequestID and is dispatched independently; with
+// FlagCompressed the whole body is compressed at once, so gzip sees across
+// messages. Batch and control frames are mutually exclusive.
+const FlagBatch uint8 = 1 << 5
+
+// BatchEntryPrefixLen is the size of the length prefix before each message.
+const BatchEntryPrefixLen = 4
+
+// BatchEntryLen returns the encoded size of m inside a batch body.
+func BatchEntryLen(m *Message) int {
+	return BatchEntryPrefixLen + MessageHeaderLen + len(m.Payload)
+}
+
+// AppendBatchMessage appends m to the batch body in dst.
+func AppendBatchMessage(dst []byte, m *Message) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(MessageHeaderLen+len(m.Payload)))
+	return EncodeMessageTo(dst, m)
+}
+
+// EncodeBatch returns the batch body carrying msgs, for use with
+// EncodeFrameBody and Encode.
+func EncodeBatch(msgs []*Message) []byte {
+	n := 0
+	for _, m := range msgs {
+		n += BatchEntryLen(m)
+	}
+	dst := make([]byte, 0, n)
+	for _, m := range msgs {
+		dst = AppendBatchMessage(dst, m)
+	}
+	return dst
+}
+
+// EncodeBatchFrameTo appends a complete version 1 FlagBatch frame carrying
+// msgs to dst; see AppendFrame. FlagBatch is implied.
+func EncodeBatchFrameTo(dst []byte, flags uint8, msgs []*Message) ([]byte, error) {
+	if len(msgs) == 0 {
+		return dst, errors.New("empty batch")
+	}
+	return AppendFrame(dst, FrameVersion, flags|FlagBatch, msgs...)
+}
+
+// DecodeBatch splits a decoded batch body into its messages. Like
+// DecodeMessage it does not copy: every Payload aliases body.
+func DecodeBatch(body []byte) ([]*Message, error) {
+	if len(body) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	var msgs []*Message
+	for len(body) > 0 {
+		if len(body) < BatchEntryPrefixLen {
+			return nil, errors.New("truncated batch entry")
+		}
+		n := binary.BigEndian.Uint32(body)
+		body = body[BatchEntryPrefixLen:]
+		if uint64(n) > uint64(len(body)) {
+			return nil, errors.New("batch entry exceeds body")
+		}
+		m, err := DecodeMessage(body[:n])
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+		body = body[n:]
+	}
+	return msgs, nil
+}
@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func batchMessages(n int) []*Message {
+	msgs := make([]*Message, n)
+	for i := range msgs {
+		msgs[i] = &Message{Command: CmdPing, RequestID: uint64(i + 1), Payload: []byte(fmt.Sprintf("payload-%d", i))}
+	}
+	return msgs
+}
+
+func TestBatchBodyRoundTrip(t *testing.T) {
+	msgs := append(batchMessages(3), &Message{Command: 2, RequestID: 9})
+	got, err := DecodeBatch(EncodeBatch(msgs))
+	if err != nil {
+		t.Fatalf("DecodeBatch: %v", err)
+	}
+	if len(got) != len(msgs) {
+		t.Fatalf("got %d messages, want %d", len(got), len(msgs))
+	}
+	for i, m := range msgs {
+		if got[i].Command != m.Command || got[i].RequestID != m.RequestID || !bytes.Equal(got[i].Payload, m.Payload) {
+			t.Fatalf("message %d = %+v, want %+v", i, got[i], m)
+		}
+	}
+}
+
+func TestBatchFrameRoundTrip(t *testing.T) {
+	msgs := batchMessages(5)
+	for _, flags := range []uint8{0, FlagCompressed, FlagCompressed | FlagChecksum, FlagOneWay} {
+		wire, err := EncodeBatchFrameTo(nil, flags, msgs)
+		if err != nil {
+			t.Fatalf("flags=%#x: EncodeBatchFrameTo: %v", flags, err)
+		}
+		f, n, err := Decode(wire)
+		if err != nil || n != len(wire) || f.Flags != flags|FlagBatch {
+			t.Fatalf("flags=%#x: Decode f=%+v n=%d err=%v", flags, f, n, err)
+		}
+		body, err := DecodeFrameBody(f)
+		if err != nil {
+			t.Fatalf("flags=%#x: DecodeFrameBody: %v", flags, err)
+		}
+		if want := EncodeBatch(msgs); !bytes.Equal(body, want) {
+			t.Fatalf("flags=%#x: body = %x, want %x", flags, body, want)
+		}
+	}
+
+	// The client-side path (EncodeFrameBody + Encode) produces the same frame.
+	flags, body, err := EncodeFrameBody(FlagBatch, EncodeBatch(msgs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := EncodeBatchFrameTo(nil, 0, msgs)
+	if got := Encode(&Frame{Flags: flags, Body: body}); !bytes.Equal(got, want) {
+		t.Fatalf("Encode = %x, want %x", got, want)
+	}
+}
+
+func TestBatchErrors(t *testing.T) {
+	if _, err := EncodeBatchFrameTo(nil, 0, nil); err == nil {
+		t.Fatal("expected error for empty batch")
+	}
+	if _, err := EncodeBatchFrameTo(nil, FlagControl, batchMessages(1)); err != ErrUnsupportedFrameFlags {
+		t.Fatalf("control batch err = %v, want ErrUnsupportedFrameFlags", err)
+	}
+
+	body := EncodeBatch(batchMessages(2))
+	for name, bad := range map[string][]byte{
+		"empty":          nil,
+		"short prefix":   body[:2],
+		"entry overflow": body[:len(body)-1],
+		"short message":  {0, 0, 0, 3, 1, 2, 3},
+	} {
+		if _, err := DecodeBatch(bad); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
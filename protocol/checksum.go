@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// FlagChecksum marks a frame whose body is followed by a ChecksumLen-byte
+// CRC32C (Castagnoli) trailer computed over the body as sent, i.e. after
+// compression. The header Length includes the trailer.
+//
+// Encode and EncodeMessageFrameTo append the trailer when the flag is set;
+// Decode strips it into Frame.Checksum and DecodeFrameBody verifies it.
+const FlagChecksum uint8 = 1 << 4
+
+// ChecksumLen is the size of the FlagChecksum trailer in bytes.
+const ChecksumLen = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError reports a frame whose body does not match its CRC32C trailer.
+// It is kept distinct from malformed-frame errors so callers can tell
+// corruption in transit apart from a peer speaking the protocol wrong.
+type ChecksumError struct {
+	Want uint32 // trailer value
+	Got  uint32 // computed over the received body
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("frame checksum mismatch: trailer 0x%08X, body 0x%08X", e.Want, e.Got)
+}
+
+// Checksum returns the CRC32C of body as carried in a FlagChecksum trailer.
+func Checksum(body []byte) uint32 {
+	return crc32.Checksum(body, castagnoli)
+}
+
+// VerifyChecksum returns a *ChecksumError unless f carries no FlagChecksum or
+// its body matches f.Checksum.
+func VerifyChecksum(f *Frame) error {
+	if f.Flags&FlagChecksum == 0 {
+		return nil
+	}
+	if got := Checksum(f.Body); got != f.Checksum {
+		return &ChecksumError{Want: f.Checksum, Got: got}
+	}
+	return nil
+}
+
+func appendChecksum(dst, body []byte) []byte {
+	return binary.BigEndian.AppendUint32(dst, Checksum(body))
+}
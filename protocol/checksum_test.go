@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestChecksumFrameRoundTrip(t *testing.T) {
+	m := &Message{Command: 0x0101, RequestID: 7, Payload: []byte("checked payload")}
+	for _, flags := range []uint8{FlagChecksum, FlagChecksum | FlagCompressed} {
+		wire, err := EncodeMessageFrameTo(nil, flags, m)
+		if err != nil {
+			t.Fatalf("flags %#x: EncodeMessageFrameTo: %v", flags, err)
+		}
+		f, n, err := Decode(wire)
+		if err != nil || n != len(wire) {
+			t.Fatalf("flags %#x: Decode = %d, %v", flags, n, err)
+		}
+		body, err := DecodeFrameBody(f)
+		if err != nil {
+			t.Fatalf("flags %#x: DecodeFrameBody: %v", flags, err)
+		}
+		got, err := DecodeMessage(body)
+		if err != nil || !bytes.Equal(got.Payload, m.Payload) {
+			t.Fatalf("flags %#x: DecodeMessage = %+v, %v", flags, got, err)
+		}
+	}
+
+	// Encode appends the same trailer as EncodeMessageFrameTo.
+	plain, err := EncodeMessage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := EncodeMessageFrameTo(nil, FlagChecksum, m)
+	if got := Encode(&Frame{Flags: FlagChecksum, Body: plain}); !bytes.Equal(got, want) {
+		t.Fatalf("Encode = %x, want %x", got, want)
+	}
+}
+
+func TestChecksumMismatchIsDistinct(t *testing.T) {
+	wire := Encode(&Frame{Flags: FlagChecksum, Body: []byte("0123456789")})
+	wire[FrameHeaderLen+3] ^= 0x40
+
+	f, _, err := Decode(wire)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	_, err = DecodeFrameBody(f)
+	var ce *ChecksumError
+	if !errors.As(err, &ce) {
+		t.Fatalf("DecodeFrameBody error = %v, want *ChecksumError", err)
+	}
+
+	short := Encode(&Frame{Body: []byte{1, 2}})
+	short[3] = FlagChecksum
+	if _, _, err := Decode(short); err == nil || errors.As(err, &ce) {
+		t.Fatalf("short trailer error = %v, want a malformed-frame error", err)
+	}
+}
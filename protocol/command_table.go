@@ -0,0 +1,246 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CommandTableVersion is the schema version of exported command table files.
+const CommandTableVersion = 1
+
+// ErrCommandTableChecksum is returned when a command table file does not match its checksum.
+var ErrCommandTableChecksum = errors.New("command table checksum mismatch")
+
+// CommandTable is a portable snapshot of the method → command mapping.
+//
+// It is meant to be exported once (JSON or YAML) and loaded by clients in
+// other languages so both sides resolve methods to the exact same IDs.
+type CommandTable struct {
+	Version  int            `json:"version" yaml:"version"`
+	Strict   bool           `json:"strict" yaml:"strict"`
+	Commands []CommandEntry `json:"commands" yaml:"commands"`
+	// Checksum is "sha256:<hex>" over the canonical form (see Canonical).
+	Checksum string `json:"checksum" yaml:"checksum"`
+}
+
+// CommandEntry is one row of a CommandTable.
+type CommandEntry struct {
+	Method  string `json:"method" yaml:"method"`
+	Command uint16 `json:"command" yaml:"command"`
+	// Hashed marks IDs that were assigned by the non-strict FNV fallback
+	// (see MapMethodToCommand and AddHashed).
+	Hashed bool `json:"hashed,omitempty" yaml:"hashed,omitempty"`
+}
+
+// ExportCommandTable returns a checksummed snapshot of the explicit mappings
+// and of the FNV fallbacks handed out so far, sorted by command ID. Add
+// unregistered methods that have not been resolved yet with AddHashed.
+func ExportCommandTable() *CommandTable {
+	methodCommandMu.RLock()
+	t := &CommandTable{Version: CommandTableVersion, Strict: strictMapping}
+	for cmd, method := range commandMethod {
+		t.Commands = append(t.Commands, CommandEntry{Method: method, Command: cmd})
+	}
+	for cmd, method := range hashedCommand {
+		t.Commands = append(t.Commands, CommandEntry{Method: method, Command: cmd, Hashed: true})
+	}
+	methodCommandMu.RUnlock()
+
+	sortCommandEntries(t.Commands)
+	t.Checksum = t.ComputeChecksum()
+	return t
+}
+
+// AddHashed appends the FNV fallback IDs of methods that have no entry yet
+// and refreshes the checksum. It returns a *CommandCollisionError, leaving t
+// unchanged, if a fallback ID is already taken by another entry.
+func (t *CommandTable) AddHashed(methods ...string) error {
+	byCmd := make(map[uint16]CommandEntry, len(t.Commands))
+	byMethod := make(map[string]bool, len(t.Commands))
+	for _, e := range t.Commands {
+		byCmd[e.Command] = e
+		byMethod[e.Method] = true
+	}
+	var added []CommandEntry
+	for _, m := range methods {
+		service, method, err := splitFullMethod(strings.TrimSpace(m))
+		if err != nil {
+			return err
+		}
+		normalized := service + "." + method
+		if byMethod[normalized] {
+			continue
+		}
+		cmd := hashMethod(service, method)
+		if existing, ok := byCmd[cmd]; ok {
+			return &CommandCollisionError{Command: cmd, Existing: existing.Method, Attempted: normalized, Hashed: existing.Hashed}
+		}
+		e := CommandEntry{Method: normalized, Command: cmd, Hashed: true}
+		byCmd[cmd] = e
+		byMethod[normalized] = true
+		added = append(added, e)
+	}
+	t.Commands = append(t.Commands, added...)
+	sortCommandEntries(t.Commands)
+	t.Checksum = t.ComputeChecksum()
+	return nil
+}
+
+// Canonical returns the byte form the checksum is computed over:
+//
+//	novagate-commands v<version> strict=<bool>\n
+//	0x<CMD> <method> <explicit|hashed>\n   (one line per entry, sorted by command)
+func (t *CommandTable) Canonical() []byte {
+	entries := append([]CommandEntry(nil), t.Commands...)
+	sortCommandEntries(entries)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "novagate-commands v%d strict=%t\n", t.Version, t.Strict)
+	for _, e := range entries {
+		kind := "explicit"
+		if e.Hashed {
+			kind = "hashed"
+		}
+		fmt.Fprintf(&b, "0x%04X %s %s\n", e.Command, e.Method, kind)
+	}
+	return b.Bytes()
+}
+
+// ComputeChecksum returns "sha256:<hex>" for the table's canonical form.
+func (t *CommandTable) ComputeChecksum() string {
+	sum := sha256.Sum256(t.Canonical())
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Validate checks the schema version, checksum and that no method or command
+// ID appears twice.
+func (t *CommandTable) Validate() error {
+	if t.Version != CommandTableVersion {
+		return fmt.Errorf("unsupported command table version: %d", t.Version)
+	}
+	if t.Checksum != t.ComputeChecksum() {
+		return ErrCommandTableChecksum
+	}
+	byCmd := map[uint16]string{}
+	byMethod := map[string]uint16{}
+	for _, e := range t.Commands {
+		if _, _, err := splitFullMethod(e.Method); err != nil {
+			return err
+		}
+		if existing, ok := byCmd[e.Command]; ok {
+			return &CommandCollisionError{Command: e.Command, Existing: existing, Attempted: e.Method}
+		}
+		if _, ok := byMethod[e.Method]; ok {
+			return fmt.Errorf("duplicate method %q in command table", e.Method)
+		}
+		byCmd[e.Command] = e.Method
+		byMethod[e.Method] = e.Command
+	}
+	return nil
+}
+
+// Apply registers every entry explicitly and adopts the table's strict mode.
+// Hash-assigned entries are pinned so they no longer depend on the hash.
+func (t *CommandTable) Apply() error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	for _, e := range t.Commands {
+		RegisterFullMethodCommand(e.Method, e.Command)
+	}
+	SetStrictCommandMapping(t.Strict)
+	return nil
+}
+
+// MarshalCommandTable encodes t as "json" or "yaml".
+func MarshalCommandTable(t *CommandTable, format string) ([]byte, error) {
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(t, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	case "yaml":
+		return yaml.Marshal(t)
+	default:
+		return nil, fmt.Errorf("unsupported command table format: %q", format)
+	}
+}
+
+// UnmarshalCommandTable decodes a "json" or "yaml" command table and validates it.
+func UnmarshalCommandTable(data []byte, format string) (*CommandTable, error) {
+	t := &CommandTable{}
+	var err error
+	switch format {
+	case "json":
+		err = json.Unmarshal(data, t)
+	case "yaml":
+		err = yaml.Unmarshal(data, t)
+	default:
+		return nil, fmt.Errorf("unsupported command table format: %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// SaveCommandTable writes t to path; the format is chosen from the extension
+// (.json, .yaml or .yml).
+func SaveCommandTable(path string, t *CommandTable) error {
+	format, err := commandTableFormat(path)
+	if err != nil {
+		return err
+	}
+	b, err := MarshalCommandTable(t, format)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
+// LoadCommandTable reads and validates a command table file written by SaveCommandTable.
+func LoadCommandTable(path string) (*CommandTable, error) {
+	format, err := commandTableFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := UnmarshalCommandTable(b, format)
+	if err != nil {
+		return nil, fmt.Errorf("load %s: %w", path, err)
+	}
+	return t, nil
+}
+
+func commandTableFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json", nil
+	case ".yaml", ".yml":
+		return "yaml", nil
+	default:
+		return "", fmt.Errorf("unsupported command table extension: %q", filepath.Ext(path))
+	}
+}
+
+func sortCommandEntries(entries []CommandEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Command < entries[j].Command })
+}
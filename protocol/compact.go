@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"maps"
+	"slices"
+)
+
+// FlagMetadata marks a FrameVersion2 frame whose messages carry a metadata
+// section (Message.Metadata) between RequestID and Payload. Version 1 has no
+// room for it and rejects the flag.
+const FlagMetadata uint8 = 1 << 6
+
+// Version 2 message layout, after the frame header:
+//
+//	uvarint Command | uvarint RequestID | [metadata] | Payload
+//
+// where metadata, present only with FlagMetadata, is a uvarint entry count
+// followed by uvarint-length-prefixed key and value strings. Batch entries are
+// prefixed with a uvarint length instead of v1's uint32.
+
+func validateVersionFlags(version, flags uint8) error {
+	if flags&FlagMetadata != 0 && version != FrameVersion2 {
+		return errors.New("metadata requires frame version 2")
+	}
+	return nil
+}
+
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// messageHeadLen returns the encoded length of m without its payload.
+func messageHeadLen(version, flags uint8, m *Message) int {
+	if version != FrameVersion2 {
+		return MessageHeaderLen
+	}
+	n := uvarintLen(uint64(m.Command)) + uvarintLen(m.RequestID)
+	if flags&FlagMetadata != 0 {
+		n += uvarintLen(uint64(len(m.Metadata)))
+		for k, v := range m.Metadata {
+			n += uvarintLen(uint64(len(k))) + len(k) + uvarintLen(uint64(len(v))) + len(v)
+		}
+	}
+	return n
+}
+
+func batchPrefixLen(version uint8, entryLen int) int {
+	if version == FrameVersion2 {
+		return uvarintLen(uint64(entryLen))
+	}
+	return BatchEntryPrefixLen
+}
+
+// appendMessageHead appends everything of m but its payload: the batch
+// entry prefix if batch is set, then the message header for version.
+func appendMessageHead(dst []byte, version, flags uint8, batch bool, m *Message) []byte {
+	if version != FrameVersion2 {
+		if batch {
+			dst = binary.BigEndian.AppendUint32(dst, uint32(MessageHeaderLen+len(m.Payload)))
+		}
+		return EncodeMessageTo(dst, &Message{Command: m.Command, RequestID: m.RequestID})
+	}
+	if batch {
+		dst = binary.AppendUvarint(dst, uint64(messageHeadLen(version, flags, m)+len(m.Payload)))
+	}
+	dst = binary.AppendUvarint(dst, uint64(m.Command))
+	dst = binary.AppendUvarint(dst, m.RequestID)
+	if flags&FlagMetadata != 0 {
+		dst = binary.AppendUvarint(dst, uint64(len(m.Metadata)))
+		for _, k := range slices.Sorted(maps.Keys(m.Metadata)) {
+			v := m.Metadata[k]
+			dst = binary.AppendUvarint(dst, uint64(len(k)))
+			dst = append(dst, k...)
+			dst = binary.AppendUvarint(dst, uint64(len(v)))
+			dst = append(dst, v...)
+		}
+	}
+	return dst
+}
+
+func decodeMessageV2(data []byte, flags uint8) (*Message, error) {
+	cmd, n := binary.Uvarint(data)
+	if n <= 0 || cmd > 0xFFFF {
+		return nil, errors.New("invalid message command")
+	}
+	data = data[n:]
+	id, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errors.New("invalid message request id")
+	}
+	data = data[n:]
+	m := &Message{Command: uint16(cmd), RequestID: id}
+
+	if flags&FlagMetadata != 0 {
+		count, n := binary.Uvarint(data)
+		if n <= 0 || count > uint64(len(data)) {
+			return nil, errors.New("invalid message metadata")
+		}
+		data = data[n:]
+		m.Metadata = make(map[string]string, count)
+		for range count {
+			var k, v []byte
+			if k, data = uvarintBytes(data); k == nil {
+				return nil, errors.New("invalid message metadata")
+			}
+			if v, data = uvarintBytes(data); v == nil {
+				return nil, errors.New("invalid message metadata")
+			}
+			m.Metadata[string(k)] = string(v)
+		}
+	}
+	m.Payload = data
+	return m, nil
+}
+
+// uvarintBytes splits a uvarint-length-prefixed field off data. It returns a
+// nil field if data is malformed.
+func uvarintBytes(data []byte) (field, rest []byte) {
+	n, l := binary.Uvarint(data)
+	if l <= 0 || n > uint64(len(data)-l) {
+		return nil, data
+	}
+	data = data[l:]
+	return data[:n:n], data[n:]
+}
+
+func decodeBatchV2(body []byte, flags uint8) ([]*Message, error) {
+	if len(body) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	var msgs []*Message
+	for len(body) > 0 {
+		entry, rest := uvarintBytes(body)
+		if entry == nil {
+			return nil, errors.New("truncated batch entry")
+		}
+		m, err := decodeMessageV2(entry, flags)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+		body = rest
+	}
+	return msgs, nil
+}
+
+// DecodeMessage parses a non-batch body of f, as returned by DecodeFrameBody,
+// according to the frame's version and flags. See Message for ownership rules.
+func (f *Frame) DecodeMessage(body []byte) (*Message, error) {
+	if f.Version == FrameVersion2 {
+		return decodeMessageV2(body, f.Flags)
+	}
+	return DecodeMessage(body)
+}
+
+// DecodeBatch splits a FlagBatch body of f, as returned by DecodeFrameBody,
+// according to the frame's version and flags.
+func (f *Frame) DecodeBatch(body []byte) ([]*Message, error) {
+	if f.Version == FrameVersion2 {
+		return decodeBatchV2(body, f.Flags)
+	}
+	return DecodeBatch(body)
+}
@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"bytes"
+	"maps"
+	"testing"
+)
+
+func TestVersion2FrameRoundTrip(t *testing.T) {
+	cases := []struct {
+		name  string
+		flags uint8
+		msgs  []*Message
+	}{
+		{"plain", 0, []*Message{{Command: CmdPing, RequestID: 1, Payload: []byte("hi")}}},
+		{"metadata", FlagChecksum, []*Message{{Command: 0x0203, RequestID: 1 << 40, Payload: []byte("x"), Metadata: map[string]string{"trace": "abc", "tenant": "", "z": "1"}}}},
+		{"compressed batch", FlagCompressed | FlagBatch, []*Message{
+			{Command: CmdPing, RequestID: 1, Payload: bytes.Repeat([]byte("ab"), 100)},
+			{Command: CmdPing, RequestID: 2, Metadata: map[string]string{"k": "v"}},
+		}},
+	}
+	for _, tc := range cases {
+		wire, err := AppendFrame(nil, FrameVersion2, tc.flags, tc.msgs...)
+		if err != nil {
+			t.Fatalf("%s: AppendFrame: %v", tc.name, err)
+		}
+		if tc.flags&FlagCompressed == 0 {
+			if size := FrameSize(FrameVersion2, tc.flags, tc.msgs...); size != len(wire) {
+				t.Fatalf("%s: FrameSize = %d, encoded %d", tc.name, size, len(wire))
+			}
+		}
+		f, n, err := Decode(wire)
+		if err != nil || n != len(wire) || f.Version != FrameVersion2 {
+			t.Fatalf("%s: Decode f=%+v n=%d err=%v", tc.name, f, n, err)
+		}
+		body, err := DecodeFrameBody(f)
+		if err != nil {
+			t.Fatalf("%s: DecodeFrameBody: %v", tc.name, err)
+		}
+		var got []*Message
+		if f.Flags&FlagBatch != 0 {
+			got, err = f.DecodeBatch(body)
+		} else {
+			var m *Message
+			m, err = f.DecodeMessage(body)
+			got = []*Message{m}
+		}
+		if err != nil || len(got) != len(tc.msgs) {
+			t.Fatalf("%s: decoded %d messages, err %v", tc.name, len(got), err)
+		}
+		for i, want := range tc.msgs {
+			m := got[i]
+			if m.Command != want.Command || m.RequestID != want.RequestID || !bytes.Equal(m.Payload, want.Payload) {
+				t.Fatalf("%s: message %d = %+v, want %+v", tc.name, i, m, want)
+			}
+			if len(want.Metadata) > 0 && !maps.Equal(m.Metadata, want.Metadata) {
+				t.Fatalf("%s: metadata %v, want %v", tc.name, m.Metadata, want.Metadata)
+			}
+		}
+	}
+}
+
+func TestVersion2IsSmaller(t *testing.T) {
+	m := &Message{Command: CmdPing, RequestID: 7, Payload: []byte("ok")}
+	v1, _ := AppendFrame(nil, FrameVersion1, 0, m)
+	v2, _ := AppendFrame(nil, FrameVersion2, 0, m)
+	// 5-byte header + 1-byte command + 1-byte request ID + payload.
+	if len(v2) != 9 || len(v1) != 20 {
+		t.Fatalf("v1 %d bytes, v2 %d bytes", len(v1), len(v2))
+	}
+}
+
+func TestVersion2PartialFrames(t *testing.T) {
+	m := &Message{Command: CmdPing, RequestID: 300, Payload: bytes.Repeat([]byte("p"), 200)}
+	wire, err := AppendFrame(nil, FrameVersion2, 0, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range len(wire) {
+		f, n, err := Decode(wire[:i])
+		if f != nil || n != 0 || err != nil {
+			t.Fatalf("Decode(%d bytes) = %v, %d, %v; want incomplete", i, f, n, err)
+		}
+		if i < 6 {
+			if n, err := FrameLen(wire[:i]); n != 0 || err != nil {
+				t.Fatalf("FrameLen(%d bytes) = %d, %v", i, n, err)
+			}
+		}
+	}
+	if n, err := FrameLen(wire[:6]); n != len(wire) || err != nil {
+		t.Fatalf("FrameLen = %d, %v; want %d", n, err, len(wire))
+	}
+}
+
+func TestVersion2Errors(t *testing.T) {
+	if _, err := AppendFrame(nil, FrameVersion1, FlagMetadata, &Message{}); err == nil {
+		t.Fatal("expected error for metadata in a v1 frame")
+	}
+	v1 := Encode(&Frame{Flags: FlagMetadata, Body: make([]byte, MessageHeaderLen)})
+	if _, _, err := Decode(v1); err == nil {
+		t.Fatal("expected Decode error for metadata in a v1 frame")
+	}
+
+	// Five continuation bytes cannot be a valid length.
+	if _, err := FrameLen([]byte{0xCA, 0xFE, 2, 0, 0xFF, 0xFF, 0xFF, 0xFF}); err == nil {
+		t.Fatal("expected error for overlong length varint")
+	}
+
+	f := &Frame{Version: FrameVersion2, Flags: FlagMetadata}
+	for name, body := range map[string][]byte{
+		"empty":           nil,
+		"command too big": {0xFF, 0xFF, 0x04, 0},
+		"missing id":      {0x01},
+		"short metadata":  {0x01, 0x01, 0x01, 0x05, 'a'},
+	} {
+		if _, err := f.DecodeMessage(body); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
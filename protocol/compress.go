@@ -13,10 +13,15 @@ func ValidateFlags(flags uint8) error {
 	if flags&FlagEncrypted != 0 {
 		return ErrUnsupportedFrameFlags
 	}
+	if flags&FlagBatch != 0 && flags&FlagControl != 0 {
+		return ErrUnsupportedFrameFlags
+	}
 	return nil
 }
 
 // DecodeFrameBody validates flags and returns a decoded body for Message decoding.
+// If FlagChecksum is set, the body is verified against f.Checksum first and a
+// mismatch is reported as *ChecksumError.
 // If FlagCompressed is set, it will gzip-decompress the body.
 func DecodeFrameBody(f *Frame) ([]byte, error) {
 	if f == nil {
@@ -25,6 +30,9 @@ func DecodeFrameBody(f *Frame) ([]byte, error) {
 	if err := ValidateFlags(f.Flags); err != nil {
 		return nil, err
 	}
+	if err := VerifyChecksum(f); err != nil {
+		return nil, err
+	}
 	if f.Flags&FlagCompressed == 0 {
 		return f.Body, nil
 	}
@@ -32,7 +40,8 @@ func DecodeFrameBody(f *Frame) ([]byte, error) {
 }
 
 // EncodeFrameBody validates flags and returns an encoded body for Frame writing.
-// If FlagCompressed is set, it will gzip-compress the body.
+// If FlagCompressed is set, it will gzip-compress the body. A FlagChecksum
+// trailer is added later, by Encode.
 func EncodeFrameBody(flags uint8, body []byte) (uint8, []byte, error) {
 	if err := ValidateFlags(flags); err != nil {
 		return 0, nil, err
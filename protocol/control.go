@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// FlagControl marks a connection-level control frame. Its body is a Message
+// whose Command is one of the Ctrl* opcodes below; control frames are handled
+// by the connection itself and never reach the command router.
+const FlagControl uint8 = 1 << 3
+
+// Control opcodes (Message.Command of a FlagControl frame).
+const (
+	// CtrlPing asks the peer to answer with CtrlPong carrying the same
+	// RequestID and Payload. Either side may send it.
+	CtrlPing uint16 = 0x0001
+	// CtrlPong answers CtrlPing.
+	CtrlPong uint16 = 0x0002
+	// CtrlHeartbeat advertises the interval at which the sender wants to be
+	// pinged; the payload is EncodeHeartbeatInterval.
+	CtrlHeartbeat uint16 = 0x0003
+	// CtrlClose tells the peer why the sender is about to close the
+	// connection; the payload is EncodeCloseReason.
+	CtrlClose uint16 = 0x0004
+)
+
+// Close codes carried by CtrlClose.
+const (
+	CloseNormal uint16 = 0
+	// CloseTooManyConnections: the server is at its global connection cap.
+	CloseTooManyConnections uint16 = 1
+	// CloseTooManyConnectionsPerIP: the client's address is at its cap.
+	CloseTooManyConnectionsPerIP uint16 = 2
+	// CloseAccessDenied: the client's address is not allowed.
+	CloseAccessDenied uint16 = 3
+)
+
+// IsControl reports whether flags mark a control frame.
+func IsControl(flags uint8) bool {
+	return flags&FlagControl != 0
+}
+
+// EncodeHeartbeatInterval encodes d as the CtrlHeartbeat payload:
+// a big-endian uint32 of milliseconds.
+func EncodeHeartbeatInterval(d time.Duration) []byte {
+	ms := d.Milliseconds()
+	if ms < 0 {
+		ms = 0
+	}
+	if ms > 0xFFFFFFFF {
+		ms = 0xFFFFFFFF
+	}
+	return binary.BigEndian.AppendUint32(nil, uint32(ms))
+}
+
+// DecodeHeartbeatInterval parses a CtrlHeartbeat payload.
+func DecodeHeartbeatInterval(p []byte) (time.Duration, error) {
+	if len(p) != 4 {
+		return 0, errors.New("invalid heartbeat payload")
+	}
+	return time.Duration(binary.BigEndian.Uint32(p)) * time.Millisecond, nil
+}
+
+// EncodeCloseReason encodes the CtrlClose payload: a big-endian uint16 code
+// followed by a UTF-8 reason.
+func EncodeCloseReason(code uint16, reason string) []byte {
+	p := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(reason)), code)
+	return append(p, reason...)
+}
+
+// DecodeCloseReason parses a CtrlClose payload.
+func DecodeCloseReason(p []byte) (uint16, string, error) {
+	if len(p) < 2 {
+		return 0, "", errors.New("invalid close payload")
+	}
+	return binary.BigEndian.Uint16(p), string(p[2:]), nil
+}
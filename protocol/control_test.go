@@ -0,0 +1,35 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatIntervalPayload(t *testing.T) {
+	d, err := DecodeHeartbeatInterval(EncodeHeartbeatInterval(1500 * time.Millisecond))
+	if err != nil || d != 1500*time.Millisecond {
+		t.Fatalf("round trip = %v, %v", d, err)
+	}
+	if _, err := DecodeHeartbeatInterval([]byte{1}); err == nil {
+		t.Fatal("expected error for short payload")
+	}
+}
+
+func TestControlFlagIsValid(t *testing.T) {
+	if err := ValidateFlags(FlagControl | FlagCompressed); err != nil {
+		t.Fatalf("ValidateFlags: %v", err)
+	}
+	if !IsControl(FlagControl|FlagOneWay) || IsControl(FlagOneWay) {
+		t.Fatal("IsControl mismatch")
+	}
+}
+
+func TestCloseReasonPayload(t *testing.T) {
+	code, reason, err := DecodeCloseReason(EncodeCloseReason(CloseAccessDenied, "denied"))
+	if err != nil || code != CloseAccessDenied || reason != "denied" {
+		t.Fatalf("round trip = %d %q %v", code, reason, err)
+	}
+	if _, _, err := DecodeCloseReason(nil); err == nil {
+		t.Fatal("expected error for empty payload")
+	}
+}
@@ -0,0 +1,140 @@
+package protocol
+
+import (
+	"compress/gzip"
+	"errors"
+	"sync"
+)
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// appendWriter is an io.Writer that appends to a byte slice in place.
+type appendWriter struct {
+	buf []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+// EncodeMessageFrameTo appends a complete version 1 frame carrying m to dst;
+// see AppendFrame.
+func EncodeMessageFrameTo(dst []byte, flags uint8, m *Message) ([]byte, error) {
+	return AppendFrame(dst, FrameVersion, flags, m)
+}
+
+// AppendFrame appends a complete frame of the given version carrying msgs to
+// dst: exactly one message, or with FlagBatch any number of them.
+//
+// The frame header is reserved up front and patched once the body length is
+// known, and the messages are written (or gzip-compressed when FlagCompressed
+// is set) directly after it, so neither the messages nor the body are
+// materialized in a separate buffer. With FlagChecksum set the CRC32C trailer
+// is appended after the (possibly compressed) body. Version 2 frames get
+// FlagMetadata whenever a message has Metadata; version 1 cannot carry it and
+// drops it. On error dst is returned truncated to its original length.
+func AppendFrame(dst []byte, version, flags uint8, msgs ...*Message) ([]byte, error) {
+	if version == 0 {
+		version = FrameVersion
+	}
+	flags = frameFlagsFor(version, flags, msgs)
+	if err := ValidateFlags(flags); err != nil {
+		return dst, err
+	}
+	if err := validateVersionFlags(version, flags); err != nil {
+		return dst, err
+	}
+	batch := flags&FlagBatch != 0
+	if !batch && len(msgs) != 1 {
+		return dst, errors.New("multiple messages require FlagBatch")
+	}
+	start := len(dst)
+	dst = appendFrameHeader(dst, version, flags, MaxFrameBody)
+	bodyStart := len(dst)
+
+	if flags&FlagCompressed == 0 {
+		for _, m := range msgs {
+			dst = appendMessageHead(dst, version, flags, batch, m)
+			dst = append(dst, m.Payload...)
+		}
+	} else {
+		var err error
+		if dst, err = gzipMessagesTo(dst, version, flags, msgs); err != nil {
+			return dst[:start], err
+		}
+	}
+
+	if flags&FlagChecksum != 0 {
+		dst = appendChecksum(dst, dst[bodyStart:])
+	}
+
+	bodyLen := len(dst) - bodyStart
+	if bodyLen > MaxFrameBody {
+		return dst[:start], errors.New("frame body too large")
+	}
+	// A varint length may need fewer bytes than reserved: close the gap.
+	if gap := bodyStart - start - frameHeaderLen(version, bodyLen); gap > 0 {
+		copy(dst[bodyStart-gap:], dst[bodyStart:])
+		dst = dst[:len(dst)-gap]
+	}
+	appendFrameHeader(dst[start:start], version, flags, bodyLen)
+	return dst, nil
+}
+
+// FrameSize returns the length of the frame AppendFrame produces for msgs
+// without compression, for sizing the destination buffer.
+func FrameSize(version, flags uint8, msgs ...*Message) int {
+	if version == 0 {
+		version = FrameVersion
+	}
+	flags = frameFlagsFor(version, flags, msgs)
+	n := 0
+	for _, m := range msgs {
+		entry := messageHeadLen(version, flags, m) + len(m.Payload)
+		if flags&FlagBatch != 0 {
+			entry += batchPrefixLen(version, entry)
+		}
+		n += entry
+	}
+	if flags&FlagChecksum != 0 {
+		n += ChecksumLen
+	}
+	return frameHeaderLen(version, n) + n
+}
+
+func frameFlagsFor(version, flags uint8, msgs []*Message) uint8 {
+	if version != FrameVersion2 {
+		return flags
+	}
+	for _, m := range msgs {
+		if len(m.Metadata) > 0 {
+			return flags | FlagMetadata
+		}
+	}
+	return flags
+}
+
+func gzipMessagesTo(dst []byte, version, flags uint8, msgs []*Message) ([]byte, error) {
+	w := &appendWriter{buf: dst}
+	zw := gzipWriters.Get().(*gzip.Writer)
+	zw.Reset(w)
+	defer gzipWriters.Put(zw)
+
+	batch := flags&FlagBatch != 0
+	var scratch [BatchEntryPrefixLen + MessageHeaderLen + 8]byte
+	for _, m := range msgs {
+		if _, err := zw.Write(appendMessageHead(scratch[:0], version, flags, batch, m)); err != nil {
+			return dst, err
+		}
+		if _, err := zw.Write(m.Payload); err != nil {
+			return dst, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return dst, err
+	}
+	return w.buf, nil
+}
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeToMatchesEncode(t *testing.T) {
+	f := &Frame{Flags: FlagOneWay, Body: []byte("hello")}
+	prefix := []byte("prefix")
+	got := EncodeTo(append([]byte(nil), prefix...), f)
+	if !bytes.Equal(got[:len(prefix)], prefix) {
+		t.Fatalf("prefix overwritten: %q", got[:len(prefix)])
+	}
+	if want := Encode(f); !bytes.Equal(got[len(prefix):], want) {
+		t.Fatalf("EncodeTo = %x, want %x", got[len(prefix):], want)
+	}
+}
+
+func TestEncodeMessageFrameToRoundTrip(t *testing.T) {
+	m := &Message{Command: CmdPing, RequestID: 7, Payload: bytes.Repeat([]byte("abc"), 1000)}
+	for _, flags := range []uint8{0, FlagCompressed, FlagCompressed | FlagOneWay} {
+		wire, err := EncodeMessageFrameTo(make([]byte, 0, 64), flags, m)
+		if err != nil {
+			t.Fatalf("flags=%d: %v", flags, err)
+		}
+		f, n, err := Decode(wire)
+		if err != nil || f == nil || n != len(wire) {
+			t.Fatalf("flags=%d: Decode f=%v n=%d err=%v", flags, f, n, err)
+		}
+		if f.Flags != flags {
+			t.Fatalf("flags=%d: got flags %d", flags, f.Flags)
+		}
+		body, err := DecodeFrameBody(f)
+		if err != nil {
+			t.Fatalf("flags=%d: DecodeFrameBody: %v", flags, err)
+		}
+		got, err := DecodeMessage(body)
+		if err != nil {
+			t.Fatalf("flags=%d: DecodeMessage: %v", flags, err)
+		}
+		if got.Command != m.Command || got.RequestID != m.RequestID || !bytes.Equal(got.Payload, m.Payload) {
+			t.Fatalf("flags=%d: message mismatch", flags)
+		}
+	}
+}
+
+func TestEncodeMessageFrameToErrors(t *testing.T) {
+	dst := []byte("keep")
+	out, err := EncodeMessageFrameTo(dst, FlagEncrypted, &Message{})
+	if err != ErrUnsupportedFrameFlags {
+		t.Fatalf("err = %v, want ErrUnsupportedFrameFlags", err)
+	}
+	if string(out) != "keep" {
+		t.Fatalf("dst modified: %q", out)
+	}
+
+	big := &Message{Payload: make([]byte, MaxFrameBody)}
+	out, err = EncodeMessageFrameTo(dst, 0, big)
+	if err == nil {
+		t.Fatal("expected oversized body error")
+	}
+	if string(out) != "keep" {
+		t.Fatalf("dst not truncated: len=%d", len(out))
+	}
+}
+
+func TestMessageClone(t *testing.T) {
+	m := &Message{Command: 1, RequestID: 2, Payload: []byte("abc")}
+	c := m.Clone()
+	m.Payload[0] = 'x'
+	if string(c.Payload) != "abc" || c.Command != 1 || c.RequestID != 2 {
+		t.Fatalf("clone = %+v", c)
+	}
+}
+
+func BenchmarkEncodeMessageFrameTo(b *testing.B) {
+	m := &Message{Command: CmdPing, RequestID: 1, Payload: make([]byte, 256)}
+	buf := make([]byte, 0, 512)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := EncodeMessageFrameTo(buf, 0, m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// CmdError is the Command of an error reply. A server that declines to serve
+// a request answers with a message carrying CmdError, the request's
+// RequestID, and an EncodeErrorReply payload, instead of closing the
+// connection. The ID is reserved: do not register a handler for it.
+const CmdError uint16 = 0xFFFF
+
+// Status codes carried by error replies.
+const (
+	// StatusOverloaded: the request was shed by the gateway's concurrency
+	// limiter; it did not reach a handler and may be retried after a backoff.
+	StatusOverloaded uint16 = 1
+	// StatusUnavailable: the backend of the command is failing and the
+	// gateway's circuit breaker is rejecting calls to it for now.
+	StatusUnavailable uint16 = 2
+	// StatusRateLimited: the command's rate limit is exhausted; retry later.
+	StatusRateLimited uint16 = 3
+	// StatusTimeout: the command did not complete within its timeout.
+	StatusTimeout uint16 = 4
+	// StatusRejected: the command does not accept the request as sent, e.g.
+	// one-way or compressed when its route forbids that.
+	StatusRejected uint16 = 5
+	// StatusBadPayload: the payload could not be decoded, or is in a content
+	// type the command does not accept.
+	StatusBadPayload uint16 = 6
+	// StatusInvalidPayload: the payload decoded but breaks the command's
+	// schema. The message is JSON listing the failing fields:
+	// {"violations":[{"field":"items[0].sku","reason":"is required"}]}.
+	StatusInvalidPayload uint16 = 7
+	// StatusTooLarge: the response does not fit in a frame (MaxFrameBody).
+	StatusTooLarge uint16 = 8
+)
+
+// EncodeErrorReply encodes an error reply payload: a big-endian uint16
+// status code followed by a UTF-8 message.
+func EncodeErrorReply(code uint16, msg string) []byte {
+	p := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), code)
+	return append(p, msg...)
+}
+
+// DecodeErrorReply parses an error reply payload.
+func DecodeErrorReply(p []byte) (uint16, string, error) {
+	if len(p) < 2 {
+		return 0, "", errors.New("invalid error reply payload")
+	}
+	return binary.BigEndian.Uint16(p), string(p[2:]), nil
+}
@@ -0,0 +1,13 @@
+package protocol
+
+import "testing"
+
+func TestErrorReplyPayload(t *testing.T) {
+	code, msg, err := DecodeErrorReply(EncodeErrorReply(StatusOverloaded, "overloaded"))
+	if err != nil || code != StatusOverloaded || msg != "overloaded" {
+		t.Fatalf("round trip = %d %q %v", code, msg, err)
+	}
+	if _, _, err := DecodeErrorReply([]byte{1}); err == nil {
+		t.Fatal("expected error for short payload")
+	}
+}
@@ -9,11 +9,21 @@ import (
 const (
 	// FrameMagic is the 2-byte magic number at the start of every frame.
 	FrameMagic uint16 = 0xCAFE
-	// FrameVersion is the current supported protocol frame version.
-	FrameVersion uint8 = 1
+	// FrameVersion1 is the original encoding: a fixed 8-byte frame header and
+	// a fixed 10-byte message header.
+	FrameVersion1 uint8 = 1
+	// FrameVersion2 is the compact encoding: varint body length, varint
+	// Command and RequestID, and optional message fields gated by flags.
+	FrameVersion2 uint8 = 2
+	// FrameVersion is the version Encode uses when Frame.Version is unset.
+	// Decode accepts both versions.
+	FrameVersion = FrameVersion1
 
-	// FrameHeaderLen is the fixed header length in bytes.
+	// FrameHeaderLen is the v1 header length in bytes, which is also the
+	// longest header of any version.
 	FrameHeaderLen = 8
+	// frameHeaderPrefixLen covers magic, version and flags, common to all versions.
+	frameHeaderPrefixLen = 4
 	// MaxFrameBody is the maximum allowed frame body size in bytes.
 	MaxFrameBody = 1024 * 1024 // 1MB
 )
@@ -28,58 +38,136 @@ type Frame struct {
 	Version uint8
 	Flags   uint8
 	Body    []byte
+	// Checksum is the CRC32C trailer of a FlagChecksum frame, as read by
+	// Decode. Encode computes the trailer itself and ignores this field.
+	Checksum uint32
 }
 
+// Decode parses the frame at the start of buf. It returns a nil frame and
+// no error while buf holds only part of the frame.
 func Decode(buf []byte) (*Frame, int, error) {
-	if len(buf) < FrameHeaderLen {
+	hdrLen, bodyLen, err := parseFrameHeader(buf)
+	if err != nil || hdrLen == 0 {
+		return nil, 0, err
+	}
+	totalLen := hdrLen + bodyLen
+	if len(buf) < totalLen {
 		return nil, 0, nil
 	}
 
-	magic := binary.BigEndian.Uint16(buf[0:2])
-	if magic != FrameMagic {
-		return nil, 0, fmt.Errorf("invalid frame magic: 0x%04X", magic)
+	f := &Frame{
+		Version: buf[2],
+		Flags:   buf[3],
+		Body:    buf[hdrLen:totalLen],
+	}
+	if err := validateVersionFlags(f.Version, f.Flags); err != nil {
+		return nil, 0, err
+	}
+	if f.Flags&FlagChecksum != 0 {
+		if len(f.Body) < ChecksumLen {
+			return nil, 0, errors.New("frame too short for checksum trailer")
+		}
+		end := len(f.Body) - ChecksumLen
+		f.Checksum = binary.BigEndian.Uint32(f.Body[end:])
+		f.Body = f.Body[:end]
 	}
 
-	version := buf[2]
-	if version != FrameVersion {
-		return nil, 0, fmt.Errorf("unsupported frame version: %d", version)
+	return f, totalLen, nil
+}
+
+// FrameLen validates the frame header at the start of buf and returns the
+// total frame length (header + body), or 0 if buf does not hold the whole
+// header yet. Headers are at most FrameHeaderLen bytes long.
+// Event-driven transports use it to wait for a whole frame before decoding.
+func FrameLen(buf []byte) (int, error) {
+	hdrLen, bodyLen, err := parseFrameHeader(buf)
+	if err != nil || hdrLen == 0 {
+		return 0, err
 	}
+	return hdrLen + bodyLen, nil
+}
 
-	flags := buf[3]
-	length := binary.BigEndian.Uint32(buf[4:8])
-	if length > MaxFrameBody {
-		return nil, 0, errors.New("frame too large")
+// parseFrameHeader returns the header and body lengths of the frame at the
+// start of buf; hdrLen is 0 if more bytes are needed.
+func parseFrameHeader(buf []byte) (hdrLen, bodyLen int, err error) {
+	if len(buf) < frameHeaderPrefixLen {
+		return 0, 0, nil
 	}
 
-	totalLen := int(length) + FrameHeaderLen
-	if len(buf) < totalLen {
-		return nil, 0, nil
+	magic := binary.BigEndian.Uint16(buf[0:2])
+	if magic != FrameMagic {
+		return 0, 0, fmt.Errorf("invalid frame magic: 0x%04X", magic)
 	}
 
-	f := &Frame{
-		Version: version,
-		Flags:   flags,
-		Body:    buf[FrameHeaderLen:totalLen],
+	var length uint64
+	switch version := buf[2]; version {
+	case FrameVersion1:
+		if len(buf) < FrameHeaderLen {
+			return 0, 0, nil
+		}
+		length = uint64(binary.BigEndian.Uint32(buf[4:8]))
+		hdrLen = FrameHeaderLen
+	case FrameVersion2:
+		var n int
+		length, n = binary.Uvarint(buf[frameHeaderPrefixLen:])
+		if n == 0 {
+			if len(buf) < FrameHeaderLen {
+				return 0, 0, nil
+			}
+			n = -1
+		}
+		if n < 0 {
+			return 0, 0, errors.New("invalid frame length varint")
+		}
+		hdrLen = frameHeaderPrefixLen + n
+	default:
+		return 0, 0, fmt.Errorf("unsupported frame version: %d", version)
 	}
 
-	return f, totalLen, nil
+	if length > MaxFrameBody {
+		return 0, 0, errors.New("frame too large")
+	}
+	return hdrLen, int(length), nil
 }
 
 func Encode(f *Frame) []byte {
+	return EncodeTo(make([]byte, 0, FrameHeaderLen+len(f.Body)+ChecksumLen), f)
+}
+
+// EncodeTo appends the wire form of f to dst and returns the extended slice.
+// Pass a pooled buffer with enough capacity to encode without allocating.
+// With FlagChecksum set the CRC32C trailer of f.Body is appended as well.
+func EncodeTo(dst []byte, f *Frame) []byte {
 	bodyLen := len(f.Body)
+	if f.Flags&FlagChecksum != 0 {
+		bodyLen += ChecksumLen
+	}
 	if bodyLen > int(MaxFrameBody) {
 		panic("frame body too large")
 	}
+	dst = appendFrameHeader(dst, f.Version, f.Flags, bodyLen)
+	dst = append(dst, f.Body...)
+	if f.Flags&FlagChecksum != 0 {
+		dst = appendChecksum(dst, f.Body)
+	}
+	return dst
+}
 
-	buf := make([]byte, FrameHeaderLen+bodyLen)
-	binary.BigEndian.PutUint16(buf[0:2], FrameMagic)
-	version := f.Version
+func appendFrameHeader(dst []byte, version, flags uint8, bodyLen int) []byte {
 	if version == 0 {
 		version = FrameVersion
 	}
-	buf[2] = version
-	buf[3] = f.Flags
-	binary.BigEndian.PutUint32(buf[4:8], uint32(bodyLen))
-	copy(buf[FrameHeaderLen:], f.Body[:bodyLen])
-	return buf
+	dst = binary.BigEndian.AppendUint16(dst, FrameMagic)
+	dst = append(dst, version, flags)
+	if version == FrameVersion2 {
+		return binary.AppendUvarint(dst, uint64(bodyLen))
+	}
+	return binary.BigEndian.AppendUint32(dst, uint32(bodyLen))
+}
+
+func frameHeaderLen(version uint8, bodyLen int) int {
+	if version == FrameVersion2 {
+		return frameHeaderPrefixLen + uvarintLen(uint64(bodyLen))
+	}
+	return FrameHeaderLen
 }
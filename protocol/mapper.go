@@ -11,9 +11,32 @@ var (
 	methodCommandMu sync.RWMutex
 	methodCommand   = map[string]uint16{}
 	commandMethod   = map[uint16]string{}
-	strictMapping   bool
+	// hashedCommand records the method each FNV fallback ID was handed to,
+	// so a second method hashing to it is caught. Keyed by the 16-bit ID, it
+	// holds at most 65536 entries.
+	hashedCommand = map[uint16]string{}
+	strictMapping bool
 )
 
+// CommandCollisionError reports that two different methods resolve to the
+// same command ID.
+type CommandCollisionError struct {
+	Command   uint16
+	Existing  string
+	Attempted string
+	// Hashed is true when Existing is an FNV fallback rather than an explicit
+	// registration.
+	Hashed bool
+}
+
+func (e *CommandCollisionError) Error() string {
+	kind := "explicitly registered"
+	if e.Hashed {
+		kind = "hash-assigned"
+	}
+	return fmt.Sprintf("command 0x%04X for %q collides with %s %q", e.Command, e.Attempted, kind, e.Existing)
+}
+
 // SetStrictCommandMapping makes MapMethodToCommand return an error when
 // the method is not explicitly registered.
 func SetStrictCommandMapping(strict bool) {
@@ -29,6 +52,9 @@ func RegisterMethodCommand(service, method string, cmd uint16) {
 }
 
 // RegisterFullMethodCommand binds a full method name ("Service.Method") to a stable protocol command ID.
+//
+// It panics if cmd is already bound to another method, explicitly or as the
+// hash fallback of one. Registering a method at its own fallback ID pins it.
 func RegisterFullMethodCommand(fullMethod string, cmd uint16) {
 	fullMethod = strings.TrimSpace(fullMethod)
 	if fullMethod == "" {
@@ -39,14 +65,28 @@ func RegisterFullMethodCommand(fullMethod string, cmd uint16) {
 	}
 
 	methodCommandMu.Lock()
+	defer methodCommandMu.Unlock()
 	if existing, ok := commandMethod[cmd]; ok && existing != fullMethod {
 		panic(fmt.Sprintf("command 0x%04X already bound to %q (attempted %q)", cmd, existing, fullMethod))
 	}
+	if existing, ok := hashedCommand[cmd]; ok && existing != fullMethod {
+		panic(fmt.Sprintf("command 0x%04X already hash-assigned to %q (attempted %q)", cmd, existing, fullMethod))
+	}
+	service, method, _ := splitFullMethod(fullMethod)
+	if h := hashMethod(service, method); hashedCommand[h] == fullMethod {
+		delete(hashedCommand, h)
+	}
 	methodCommand[fullMethod] = cmd
 	commandMethod[cmd] = fullMethod
-	methodCommandMu.Unlock()
 }
 
+// MapMethodToCommand resolves "Service.Method" to a command ID.
+//
+// Explicit registrations always win. In non-strict mode unregistered methods
+// fall back to an FNV-32a hash truncated to 16 bits. The first method to
+// take a fallback ID keeps it (ExportCommandTable lists it as hashed); a
+// *CommandCollisionError is returned for a method whose fallback clashes
+// with an explicit registration or with another method's fallback.
 func MapMethodToCommand(fullMethod string) (uint16, error) {
 	fullMethod = strings.TrimSpace(fullMethod)
 	service, method, err := splitFullMethod(fullMethod)
@@ -66,11 +106,56 @@ func MapMethodToCommand(fullMethod string) (uint16, error) {
 		return 0, fmt.Errorf("unregistered command mapping for %q", normalized)
 	}
 
+	cmd = hashMethod(service, method)
+
+	methodCommandMu.Lock()
+	defer methodCommandMu.Unlock()
+	if existing, ok := commandMethod[cmd]; ok {
+		return 0, &CommandCollisionError{Command: cmd, Existing: existing, Attempted: normalized}
+	}
+	if existing, ok := hashedCommand[cmd]; ok && existing != normalized {
+		return 0, &CommandCollisionError{Command: cmd, Existing: existing, Attempted: normalized, Hashed: true}
+	}
+	hashedCommand[cmd] = normalized
+	return cmd, nil
+}
+
+// LookupMethodCommand returns the command explicitly registered for
+// "Service.Method", ignoring the hash fallback whatever the strict mode. Use
+// it to resolve untrusted names.
+func LookupMethodCommand(fullMethod string) (uint16, bool) {
+	service, method, err := splitFullMethod(strings.TrimSpace(fullMethod))
+	if err != nil {
+		return 0, false
+	}
+	methodCommandMu.RLock()
+	defer methodCommandMu.RUnlock()
+	cmd, ok := methodCommand[service+"."+method]
+	return cmd, ok
+}
+
+// MethodForCommand returns the "Service.Method" explicitly bound to cmd;
+// hash fallbacks are not included.
+func MethodForCommand(cmd uint16) (string, bool) {
+	methodCommandMu.RLock()
+	defer methodCommandMu.RUnlock()
+	m, ok := commandMethod[cmd]
+	return m, ok
+}
+
+// ServiceName returns the service part of "Service.Method", the name backends
+// are discovered by.
+func ServiceName(fullMethod string) (string, error) {
+	service, _, err := splitFullMethod(strings.TrimSpace(fullMethod))
+	return service, err
+}
+
+func hashMethod(service, method string) uint16 {
 	h := fnv.New32a()
 	_, _ = h.Write([]byte(service))
 	_, _ = h.Write([]byte{0})
 	_, _ = h.Write([]byte(method))
-	return uint16(h.Sum32()), nil
+	return uint16(h.Sum32())
 }
 
 func splitFullMethod(fullMethod string) (service string, method string, err error) {
@@ -0,0 +1,200 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func resetCommandMapping(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		methodCommandMu.Lock()
+		methodCommand = map[string]uint16{}
+		commandMethod = map[uint16]string{}
+		hashedCommand = map[uint16]string{}
+		strictMapping = false
+		methodCommandMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// findHashCollision returns two distinct methods of service "Svc" whose
+// fallback IDs are identical.
+func findHashCollision(t *testing.T) (string, string, uint16) {
+	t.Helper()
+	seen := map[uint16]string{}
+	for i := 0; i < 1<<17; i++ {
+		method := fmt.Sprintf("M%d", i)
+		cmd := hashMethod("Svc", method)
+		if prev, ok := seen[cmd]; ok {
+			return "Svc." + prev, "Svc." + method, cmd
+		}
+		seen[cmd] = method
+	}
+	t.Fatalf("no hash collision found")
+	return "", "", 0
+}
+
+func TestMapMethodToCommand_HashFallbackCollision(t *testing.T) {
+	resetCommandMapping(t)
+	first, second, cmd := findHashCollision(t)
+
+	for range 2 {
+		if got, err := MapMethodToCommand(first); err != nil || got != cmd {
+			t.Fatalf("MapMethodToCommand(%q) = 0x%04X, %v", first, got, err)
+		}
+	}
+	_, err := MapMethodToCommand(second)
+	var ce *CommandCollisionError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected CommandCollisionError, got %v", err)
+	}
+	if !ce.Hashed || ce.Command != cmd || ce.Existing != first || ce.Attempted != second {
+		t.Fatalf("unexpected collision detail: %+v", ce)
+	}
+
+	table := ExportCommandTable()
+	if len(table.Commands) != 1 || table.Commands[0] != (CommandEntry{Method: first, Command: cmd, Hashed: true}) {
+		t.Fatalf("exported table = %+v", table.Commands)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering over a hash-assigned ID did not panic")
+		}
+	}()
+	RegisterFullMethodCommand("Other.Explicit", cmd)
+}
+
+func TestRegisterPinsHashedCommand(t *testing.T) {
+	resetCommandMapping(t)
+	cmd, err := MapMethodToCommand("Svc.Hashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterFullMethodCommand("Svc.Hashed", cmd)
+	table := ExportCommandTable()
+	if len(table.Commands) != 1 || table.Commands[0].Hashed {
+		t.Fatalf("exported table = %+v, want one explicit entry", table.Commands)
+	}
+}
+
+func TestCommandTableAddHashed(t *testing.T) {
+	resetCommandMapping(t)
+	first, second, cmd := findHashCollision(t)
+	RegisterFullMethodCommand("NovaService.Ping", CmdPing)
+
+	table := ExportCommandTable()
+	if err := table.AddHashed(first, "NovaService.Ping"); err != nil {
+		t.Fatalf("AddHashed: %v", err)
+	}
+	if len(table.Commands) != 2 || table.Validate() != nil {
+		t.Fatalf("table = %+v", table)
+	}
+	err := table.AddHashed(second)
+	var ce *CommandCollisionError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected CommandCollisionError, got %v", err)
+	}
+	if !ce.Hashed || ce.Command != cmd || ce.Existing != first || ce.Attempted != second {
+		t.Fatalf("unexpected collision detail: %+v", ce)
+	}
+	if len(table.Commands) != 2 {
+		t.Fatalf("failed AddHashed changed the table: %+v", table.Commands)
+	}
+}
+
+func TestMapMethodToCommand_HashCollidesWithExplicit(t *testing.T) {
+	resetCommandMapping(t)
+	cmd := hashMethod("Svc", "Hashed")
+	RegisterFullMethodCommand("Other.Explicit", cmd)
+
+	_, err := MapMethodToCommand("Svc.Hashed")
+	var ce *CommandCollisionError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected CommandCollisionError, got %v", err)
+	}
+	if ce.Hashed || ce.Existing != "Other.Explicit" {
+		t.Fatalf("unexpected collision detail: %+v", ce)
+	}
+}
+
+func TestCommandTableRoundTrip(t *testing.T) {
+	for _, ext := range []string{".json", ".yaml"} {
+		t.Run(ext, func(t *testing.T) {
+			resetCommandMapping(t)
+			RegisterFullMethodCommand("NovaService.Ping", CmdPing)
+			RegisterFullMethodCommand("UserService.Login", CmdUserLogin)
+			hashed, err := MapMethodToCommand("Svc.Hashed")
+			if err != nil {
+				t.Fatalf("MapMethodToCommand: %v", err)
+			}
+			table := ExportCommandTable()
+
+			path := filepath.Join(t.TempDir(), "commands"+ext)
+			if err := SaveCommandTable(path, table); err != nil {
+				t.Fatalf("SaveCommandTable: %v", err)
+			}
+
+			resetCommandMapping(t)
+			table, err = LoadCommandTable(path)
+			if err != nil {
+				t.Fatalf("LoadCommandTable: %v", err)
+			}
+			if len(table.Commands) != 3 {
+				t.Fatalf("entries=%d, want 3", len(table.Commands))
+			}
+			if err := table.Apply(); err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			SetStrictCommandMapping(true)
+			if got, err := MapMethodToCommand("Svc.Hashed"); err != nil || got != hashed {
+				t.Fatalf("hashed entry not pinned: cmd=0x%04X err=%v", got, err)
+			}
+			if got, err := MapMethodToCommand("UserService.Login"); err != nil || got != CmdUserLogin {
+				t.Fatalf("explicit entry lost: cmd=0x%04X err=%v", got, err)
+			}
+		})
+	}
+}
+
+func TestCommandTableChecksumMismatch(t *testing.T) {
+	resetCommandMapping(t)
+	RegisterFullMethodCommand("NovaService.Ping", CmdPing)
+	table := ExportCommandTable()
+	table.Commands[0].Command = 0x0002
+
+	data, err := MarshalCommandTable(table, "json")
+	if err != nil {
+		t.Fatalf("MarshalCommandTable: %v", err)
+	}
+	if _, err := UnmarshalCommandTable(data, "json"); !errors.Is(err, ErrCommandTableChecksum) {
+		t.Fatalf("expected ErrCommandTableChecksum, got %v", err)
+	}
+}
+
+func TestMethodForCommandAndServiceName(t *testing.T) {
+	resetCommandMapping(t)
+	RegisterFullMethodCommand("UserService.Login", 0x0101)
+	if m, ok := MethodForCommand(0x0101); !ok || m != "UserService.Login" {
+		t.Fatalf("MethodForCommand = %q, %v", m, ok)
+	}
+	hashed, err := MapMethodToCommand("Svc.Hashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := MethodForCommand(hashed); ok {
+		t.Fatalf("MethodForCommand(hashed) = %q, want no mapping", m)
+	}
+	if _, ok := MethodForCommand(0x7777); ok {
+		t.Fatal("unexpected mapping for 0x7777")
+	}
+	if s, err := ServiceName("pkg.UserService.Login"); err != nil || s != "pkg.UserService" {
+		t.Fatalf("ServiceName = %q, %v", s, err)
+	}
+	if _, err := ServiceName("nodot"); err == nil {
+		t.Fatal("expected error for a name without method")
+	}
+}
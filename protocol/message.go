@@ -3,26 +3,55 @@ package protocol
 import (
 	"encoding/binary"
 	"errors"
+	"maps"
 )
 
 // MessageHeaderLen is the fixed header length in bytes:
 // Command(uint16) + RequestID(uint64).
 const MessageHeaderLen = 2 + 8
 
+// Message is the semantic unit carried by a frame body.
+//
+// Payload ownership: DecodeMessage does not copy, so Payload aliases the
+// decoded bytes. On the server those bytes live in the connection read buffer
+// (unless the frame was compressed), which is reused as soon as the handler
+// returns. A handler that keeps the message or its payload after returning,
+// for example by handing it to another goroutine, must Clone it first.
 type Message struct {
 	Command   uint16
 	RequestID uint64
 	Payload   []byte
+	// Metadata holds optional key/value pairs such as tracing or routing
+	// hints. Only FrameVersion2 frames carry it (see FlagMetadata).
+	Metadata map[string]string
+}
+
+// Clone returns a deep copy of m whose Payload and Metadata do not alias m's.
+func (m *Message) Clone() *Message {
+	c := *m
+	if m.Payload != nil {
+		c.Payload = append(make([]byte, 0, len(m.Payload)), m.Payload...)
+	}
+	if m.Metadata != nil {
+		c.Metadata = maps.Clone(m.Metadata)
+	}
+	return &c
 }
 
 func EncodeMessage(m *Message) ([]byte, error) {
-	buf := make([]byte, MessageHeaderLen+len(m.Payload))
-	binary.BigEndian.PutUint16(buf[0:2], m.Command)
-	binary.BigEndian.PutUint64(buf[2:10], m.RequestID)
-	copy(buf[10:], m.Payload)
-	return buf, nil
+	return EncodeMessageTo(make([]byte, 0, MessageHeaderLen+len(m.Payload)), m), nil
+}
+
+// EncodeMessageTo appends the version 1 binary form of m to dst and returns
+// the extended slice. Metadata is not part of it.
+func EncodeMessageTo(dst []byte, m *Message) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, m.Command)
+	dst = binary.BigEndian.AppendUint64(dst, m.RequestID)
+	return append(dst, m.Payload...)
 }
 
+// DecodeMessage parses version 1 data without copying; see Message for
+// ownership rules. Frame.DecodeMessage handles every version.
 func DecodeMessage(data []byte) (*Message, error) {
 	if len(data) < MessageHeaderLen {
 		return nil, errors.New("message too short")
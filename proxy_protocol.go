@@ -0,0 +1,177 @@
+package novagate
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/gogogo1024/novagate/internal/proxyproto"
+)
+
+// ProxyProtocolConfig configures PROXY protocol (v1 and v2) parsing.
+type ProxyProtocolConfig struct {
+	// Trusted lists the CIDRs of the load balancers allowed to send a PROXY
+	// header. Headers are never parsed from other peers, whose bytes go
+	// straight to the frame decoder (which rejects a spoofed header).
+	// It must not be empty unless TrustAll is set.
+	Trusted []string
+	// TrustAll parses headers from every peer, letting any client choose
+	// its own source address. Only set it when the listener is reachable
+	// exclusively through the load balancers.
+	TrustAll bool
+	// Required rejects trusted peers that do not send a header.
+	Required bool
+	// HeaderTimeout bounds the wait for the header. Defaults to 5s.
+	HeaderTimeout time.Duration
+}
+
+var (
+	errProxyHeaderRequired = errors.New("novagate: PROXY protocol header required")
+	errProxyNoTrusted      = errors.New("novagate: PROXY protocol needs trusted CIDRs (or TrustAll)")
+)
+
+// WithProxyProtocol wraps every TCP and Unix listener with NewProxyListener,
+// so ConnInfo.RemoteAddr, admission control and capture see the real client.
+// WebSocket listeners are not wrapped. Wrapped listeners are served by the
+// goroutine transport even when netpoll is selected.
+func WithProxyProtocol(cfg ProxyProtocolConfig) ServeOption {
+	return func(o *serveOptions) {
+		o.proxyProtocol = &cfg
+	}
+}
+
+func wrapProxyListeners(listeners []net.Listener, cfg ProxyProtocolConfig) ([]net.Listener, error) {
+	out := make([]net.Listener, len(listeners))
+	for i, ln := range listeners {
+		if _, ok := ln.(*WebSocketListener); ok {
+			out[i] = ln
+			continue
+		}
+		pl, err := NewProxyListener(ln, cfg)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = pl
+	}
+	return out, nil
+}
+
+// ProxyListener parses a PROXY header at the start of each accepted
+// connection. Parsing is lazy: it happens on the connection's first Read or
+// RemoteAddr call, so a slow client never blocks Accept.
+type ProxyListener struct {
+	net.Listener
+	cfg     ProxyProtocolConfig
+	trusted []netip.Prefix
+}
+
+// NewProxyListener wraps ln. It fails if cfg trusts no peer.
+func NewProxyListener(ln net.Listener, cfg ProxyProtocolConfig) (*ProxyListener, error) {
+	trusted, err := parsePrefixes(cfg.Trusted)
+	if err != nil {
+		return nil, err
+	}
+	if len(trusted) == 0 && !cfg.TrustAll {
+		return nil, errProxyNoTrusted
+	}
+	if cfg.HeaderTimeout <= 0 {
+		cfg.HeaderTimeout = 5 * time.Second
+	}
+	return &ProxyListener{Listener: ln, cfg: cfg, trusted: trusted}, nil
+}
+
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusts(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, cfg: l.cfg}, nil
+}
+
+func (l *ProxyListener) trusts(addr net.Addr) bool {
+	if l.cfg.TrustAll {
+		return true
+	}
+	ip, ok := remoteIP(addr)
+	return ok && containsIP(l.trusted, ip)
+}
+
+// proxyConn reports the addresses from the PROXY header once it is parsed.
+type proxyConn struct {
+	net.Conn
+	cfg ProxyProtocolConfig
+
+	once   sync.Once
+	br     *bufio.Reader
+	header *proxyproto.Header
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.cfg.HeaderTimeout))
+		c.br = bufio.NewReaderSize(c.Conn, 256)
+		c.header, c.err = proxyproto.Read(c.br)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		switch {
+		case c.err != nil:
+			metricProxyHeaderErrors.Add(1)
+		case c.header == nil && c.cfg.Required:
+			c.err = errProxyHeaderRequired
+			metricProxyHeaderErrors.Add(1)
+		case c.header != nil && c.header.Version == 1:
+			metricProxyHeadersV1.Add(1)
+		case c.header != nil:
+			metricProxyHeadersV2.Add(1)
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.br != nil {
+		if c.br.Buffered() > 0 {
+			return c.br.Read(p)
+		}
+		// Header and look-ahead consumed: read directly from now on.
+		c.br = nil
+	}
+	return c.Conn.Read(p)
+}
+
+// RemoteAddr returns the client address from the header, or the peer's.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to, or the local one.
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ProxyAddr returns the load balancer's address when a header supplied the
+// client address, else nil.
+func (c *proxyConn) ProxyAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.Source != nil {
+		return c.Conn.RemoteAddr()
+	}
+	return nil
+}
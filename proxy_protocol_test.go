@@ -0,0 +1,129 @@
+package novagate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// remoteAddrSetup answers CmdPing with the handler's view of the client address.
+func remoteAddrSetup(r *Router) error {
+	r.Register(protocol.CmdPing, func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		info, _ := ConnInfoFromContext(ctx)
+		payload := info.RemoteAddr.String()
+		if info.ProxyAddr != nil {
+			payload += " via proxy"
+		}
+		return &protocol.Message{Command: m.Command, RequestID: m.RequestID, Payload: []byte(payload)}, nil
+	})
+	return nil
+}
+
+func serveProxyForTest(t *testing.T, cfg ProxyProtocolConfig, opts ...ServeOption) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	opts = append(opts, WithProxyProtocol(cfg))
+	go func() { _ = ServeWithContext(ctx, ln, remoteAddrSetup, opts...) }()
+	return ln.Addr().String()
+}
+
+func TestProxyProtocolExposesClientAddress(t *testing.T) {
+	addr := serveProxyForTest(t, ProxyProtocolConfig{Trusted: []string{"127.0.0.0/8"}})
+	for name, header := range map[string]string{
+		"v1": "PROXY TCP4 203.0.113.7 10.0.0.1 4444 9000\r\n",
+		"v2": string(append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0C"), 203, 0, 113, 7, 10, 0, 0, 1, 0x11, 0x5C, 0x23, 0x28)),
+	} {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("%s: dial: %v", name, err)
+		}
+		if _, err := c.Write([]byte(header)); err != nil {
+			t.Fatalf("%s: write header: %v", name, err)
+		}
+		resp := pingRoundTrip(t, c, 1, nil)
+		c.Close()
+		if got := string(resp.Payload); got != "203.0.113.7:4444 via proxy" {
+			t.Fatalf("%s: handler saw %q", name, got)
+		}
+	}
+
+	// A trusted peer may still connect directly unless Required is set.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	if got := string(pingRoundTrip(t, c, 2, nil).Payload); got != c.LocalAddr().String() {
+		t.Fatalf("direct connection: handler saw %q, want %q", got, c.LocalAddr())
+	}
+}
+
+func TestProxyProtocolIgnoresUntrustedPeers(t *testing.T) {
+	addr := serveProxyForTest(t, ProxyProtocolConfig{Trusted: []string{"10.0.0.0/8"}})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	// The spoofed header reaches the frame decoder, which rejects it.
+	if _, err := c.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 4444 9000\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected close, got %v", err)
+	}
+}
+
+func TestProxyProtocolRequiredAndAdmission(t *testing.T) {
+	a, _ := NewAdmission(AdmissionConfig{Deny: []string{"203.0.113.0/24"}})
+	addr := serveProxyForTest(t, ProxyProtocolConfig{TrustAll: true, Required: true}, WithAdmission(a))
+
+	// No header: rejected.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	msgBytes, _ := protocol.EncodeMessage(&protocol.Message{Command: protocol.CmdPing, RequestID: 1})
+	_, _ = c.Write(protocol.Encode(&protocol.Frame{Body: msgBytes}))
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected close for missing header")
+	}
+
+	// Admission sees the proxied client, not the balancer.
+	d, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 4444 9000\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	expectCloseReason(t, d, protocol.CloseAccessDenied)
+}
+
+func TestProxyProtocolNeedsTrustedPeers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	if _, err := NewProxyListener(ln, ProxyProtocolConfig{}); err == nil {
+		t.Fatal("empty trusted list accepted")
+	}
+	if _, err := NewProxyListener(ln, ProxyProtocolConfig{TrustAll: true}); err != nil {
+		t.Fatalf("TrustAll: %v", err)
+	}
+}
@@ -0,0 +1,388 @@
+package novagate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// BackendFunc is the backend call a bridged handler forwards payloads to
+// (see BridgeProtocolHandler).
+type BackendFunc func(ctx context.Context, payload []byte) ([]byte, error)
+
+// ResiliencePolicy is the per-command protection applied to backend calls.
+// Nil sections are disabled.
+type ResiliencePolicy struct {
+	// Idempotent marks a command that is safe to send more than once;
+	// Retry and Hedge require it.
+	Idempotent bool
+	Breaker    *BreakerConfig
+	Retry      *RetryConfig
+	Hedge      *HedgeConfig
+}
+
+// BreakerConfig configures a circuit breaker. Zero values take the defaults.
+type BreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures that opens the
+	// breaker (default 5).
+	FailureThreshold int
+	// OpenTimeout is how long the breaker rejects calls before letting
+	// probes through (default 10s).
+	OpenTimeout time.Duration
+	// HalfOpenProbes is the number of concurrent probe calls allowed while
+	// half-open (default 1). A successful probe closes the breaker, a failed
+	// one opens it again.
+	HalfOpenProbes int
+}
+
+// RetryConfig configures bounded retries with exponential backoff and full
+// jitter. Zero values take the defaults.
+type RetryConfig struct {
+	// MaxAttempts counts the first call too (default 3).
+	MaxAttempts int
+	// Backoff is the upper bound of the first wait (default 50ms); it doubles
+	// per attempt up to MaxBackoff (default 1s).
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// HedgeConfig configures hedged requests: when a call has not answered after
+// Delay, another one is sent and the first successful answer wins.
+type HedgeConfig struct {
+	Delay time.Duration
+	// MaxHedges is the number of extra calls per attempt (default 1).
+	MaxHedges int
+}
+
+// Default resilience settings.
+const (
+	defaultBreakerFailures  = 5
+	defaultBreakerOpen      = 10 * time.Second
+	defaultBreakerProbes    = 1
+	defaultRetryAttempts    = 3
+	defaultRetryBackoff     = 50 * time.Millisecond
+	defaultRetryMaxBackoff  = time.Second
+	defaultHedgeMaxRequests = 1
+)
+
+// ErrCircuitOpen is returned, and sent to the client as a protocol.CmdError
+// reply, for calls rejected by an open circuit breaker.
+var ErrCircuitOpen = &StatusError{Code: protocol.StatusUnavailable, Message: "circuit open"}
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breakerStates publishes the state of every breaker, keyed by command (and
+// split target, see NewTargetResilience), under "breakers" in the novagate
+// expvar map.
+var breakerStates = func() *expvar.Map {
+	m := new(expvar.Map)
+	metrics.Set("breakers", m)
+	return m
+}()
+
+// Resilience applies a ResiliencePolicy to the backend calls of one command.
+type Resilience struct {
+	policy  ResiliencePolicy
+	breaker *breaker
+}
+
+// NewResilience validates p and returns the resilience layer for cmd. Its
+// breaker state is published as novagate.breakers["0x<cmd>"].
+func NewResilience(cmd uint16, p ResiliencePolicy) (*Resilience, error) {
+	return NewTargetResilience(cmd, "", p)
+}
+
+// NewTargetResilience is NewResilience for one target of a split command
+// (see Splitter), each of which has its own breaker. Its breaker state is
+// published as novagate.breakers["0x<cmd>/<target>"].
+func NewTargetResilience(cmd uint16, target string, p ResiliencePolicy) (*Resilience, error) {
+	if !p.Idempotent && (p.Retry != nil || p.Hedge != nil) {
+		return nil, fmt.Errorf("command 0x%04X: retry and hedge require an idempotent command", cmd)
+	}
+	if p.Retry != nil {
+		r := *p.Retry
+		if r.MaxAttempts <= 0 {
+			r.MaxAttempts = defaultRetryAttempts
+		}
+		if r.Backoff <= 0 {
+			r.Backoff = defaultRetryBackoff
+		}
+		if r.MaxBackoff <= 0 {
+			r.MaxBackoff = defaultRetryMaxBackoff
+		}
+		p.Retry = &r
+	}
+	if p.Hedge != nil {
+		h := *p.Hedge
+		if h.Delay <= 0 {
+			return nil, fmt.Errorf("command 0x%04X: hedge delay must be positive", cmd)
+		}
+		if h.MaxHedges <= 0 {
+			h.MaxHedges = defaultHedgeMaxRequests
+		}
+		p.Hedge = &h
+	}
+
+	r := &Resilience{policy: p}
+	if p.Breaker != nil {
+		r.breaker = newBreaker(*p.Breaker)
+		key := fmt.Sprintf("0x%04X", cmd)
+		if target != "" {
+			key += "/" + target
+		}
+		breakerStates.Set(key, r.breaker.stateVar)
+	}
+	return r, nil
+}
+
+// BreakerState returns the current breaker state; always BreakerClosed
+// without a breaker.
+func (r *Resilience) BreakerState() BreakerState {
+	if r.breaker == nil {
+		return BreakerClosed
+	}
+	return r.breaker.currentState()
+}
+
+// Wrap returns fn guarded by the policy. From the outside in: retries around
+// an attempt, an attempt hedges calls, and every call passes the breaker, so
+// an open breaker also cuts retries and hedges short.
+func (r *Resilience) Wrap(fn BackendFunc) BackendFunc {
+	call := fn
+	if r.breaker != nil {
+		call = r.breaker.wrap(fn)
+	}
+	attempt := call
+	if h := r.policy.Hedge; h != nil {
+		attempt = hedge(*h, call)
+	}
+	if rc := r.policy.Retry; rc != nil {
+		return retry(*rc, attempt)
+	}
+	return attempt
+}
+
+type breaker struct {
+	failureThreshold int
+	openTimeout      time.Duration
+	probes           int
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	inflight int // probes in flight while half-open
+	stateVar *expvar.String
+}
+
+func newBreaker(cfg BreakerConfig) *breaker {
+	b := &breaker{
+		failureThreshold: cfg.FailureThreshold,
+		openTimeout:      cfg.OpenTimeout,
+		probes:           cfg.HalfOpenProbes,
+		stateVar:         new(expvar.String),
+	}
+	if b.failureThreshold <= 0 {
+		b.failureThreshold = defaultBreakerFailures
+	}
+	if b.openTimeout <= 0 {
+		b.openTimeout = defaultBreakerOpen
+	}
+	if b.probes <= 0 {
+		b.probes = defaultBreakerProbes
+	}
+	b.stateVar.Set(BreakerClosed.String())
+	return b
+}
+
+func (b *breaker) wrap(fn BackendFunc) BackendFunc {
+	return func(ctx context.Context, payload []byte) ([]byte, error) {
+		probe, ok := b.allow()
+		if !ok {
+			metricBreakerRejected.Add(1)
+			return nil, ErrCircuitOpen
+		}
+		out, err := fn(ctx, payload)
+		if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+			// A call abandoned by its caller says nothing about the
+			// backend: free its probe slot without judging it. A call
+			// that ran out its deadline is a failure like any other.
+			b.release(probe)
+			return out, err
+		}
+		b.record(probe, err == nil)
+		return out, err
+	}
+}
+
+func (b *breaker) currentState() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow reports whether a call may proceed, and whether it is a half-open probe.
+func (b *breaker) allow() (probe, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return false, false
+		}
+		b.setState(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.inflight >= b.probes {
+			return false, false
+		}
+		b.inflight++
+		return true, true
+	}
+	return false, true
+}
+
+// release ends a call that is neither a success nor a failure.
+func (b *breaker) release(probe bool) {
+	if probe {
+		b.mu.Lock()
+		b.inflight--
+		b.mu.Unlock()
+	}
+}
+
+func (b *breaker) record(probe, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.inflight--
+	}
+	switch {
+	case success:
+		b.failures = 0
+		if b.state == BreakerHalfOpen {
+			b.setState(BreakerClosed)
+		}
+	case b.state == BreakerHalfOpen:
+		b.trip()
+	case b.state == BreakerClosed:
+		b.failures++
+		if b.failures >= b.failureThreshold {
+			b.trip()
+		}
+	}
+}
+
+// trip opens the breaker. Callers hold b.mu.
+func (b *breaker) trip() {
+	b.failures = 0
+	b.openedAt = time.Now()
+	b.setState(BreakerOpen)
+	metricBreakerOpens.Add(1)
+}
+
+// setState records a transition. Callers hold b.mu.
+func (b *breaker) setState(s BreakerState) {
+	b.state = s
+	b.stateVar.Set(s.String())
+}
+
+func retry(cfg RetryConfig, fn BackendFunc) BackendFunc {
+	return func(ctx context.Context, payload []byte) ([]byte, error) {
+		backoff := cfg.Backoff
+		for attempt := 1; ; attempt++ {
+			out, err := fn(ctx, payload)
+			if err == nil || attempt >= cfg.MaxAttempts || errors.Is(err, ErrCircuitOpen) {
+				return out, err
+			}
+			t := time.NewTimer(rand.N(backoff) + 1)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return nil, err
+			case <-t.C:
+			}
+			metricRetries.Add(1)
+			backoff = min(2*backoff, cfg.MaxBackoff)
+		}
+	}
+}
+
+func hedge(cfg HedgeConfig, fn BackendFunc) BackendFunc {
+	type result struct {
+		out []byte
+		err error
+	}
+	return func(ctx context.Context, payload []byte) ([]byte, error) {
+		// Hedged calls may outlive this one, and with it the caller's
+		// payload (see protocol.Message).
+		payload = bytes.Clone(payload)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		results := make(chan result, 1+cfg.MaxHedges)
+		launch := func() {
+			go func() {
+				out, err := fn(ctx, payload)
+				results <- result{out, err}
+			}()
+		}
+		launch()
+		pending, hedges := 1, 0
+		timer := time.NewTimer(cfg.Delay)
+		defer timer.Stop()
+
+		var lastErr error
+		for {
+			select {
+			case <-timer.C:
+				if hedges < cfg.MaxHedges {
+					hedges++
+					pending++
+					metricHedges.Add(1)
+					launch()
+					timer.Reset(cfg.Delay)
+				}
+			case r := <-results:
+				pending--
+				if r.err == nil {
+					return r.out, nil
+				}
+				lastErr = r.err
+				if pending == 0 && (hedges >= cfg.MaxHedges || errors.Is(r.err, ErrCircuitOpen)) {
+					return nil, lastErr
+				}
+				// A failed call is replaced right away instead of after Delay.
+				if pending == 0 {
+					timer.Reset(0)
+				}
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
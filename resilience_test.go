@@ -0,0 +1,197 @@
+package novagate
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+var errBackend = errors.New("backend failed")
+
+func TestBreakerOpensAndRecovers(t *testing.T) {
+	r, err := NewResilience(0x7001, ResiliencePolicy{Breaker: &BreakerConfig{FailureThreshold: 2, OpenTimeout: 50 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls atomic.Int32
+	var fail atomic.Bool
+	fail.Store(true)
+	fn := r.Wrap(func(ctx context.Context, p []byte) ([]byte, error) {
+		calls.Add(1)
+		if fail.Load() {
+			return nil, errBackend
+		}
+		return p, nil
+	})
+
+	for range 2 {
+		if _, err := fn(context.Background(), nil); !errors.Is(err, errBackend) {
+			t.Fatalf("err = %v, want backend error", err)
+		}
+	}
+	if s := r.BreakerState(); s != BreakerOpen {
+		t.Fatalf("state = %v, want open", s)
+	}
+	if got := breakerStates.Get("0x7001").String(); got != `"open"` {
+		t.Fatalf("published state = %s", got)
+	}
+	if _, err := fn(context.Background(), nil); err != ErrCircuitOpen || calls.Load() != 2 {
+		t.Fatalf("open breaker: err = %v after %d calls", err, calls.Load())
+	}
+
+	// After OpenTimeout a failed probe re-opens, a successful one closes.
+	time.Sleep(60 * time.Millisecond)
+	if _, err := fn(context.Background(), nil); !errors.Is(err, errBackend) || r.BreakerState() != BreakerOpen {
+		t.Fatalf("failed probe: err = %v, state %v", err, r.BreakerState())
+	}
+	time.Sleep(60 * time.Millisecond)
+	fail.Store(false)
+	if _, err := fn(context.Background(), []byte("ok")); err != nil || r.BreakerState() != BreakerClosed {
+		t.Fatalf("successful probe: err = %v, state %v", err, r.BreakerState())
+	}
+}
+
+func TestBreakerIgnoresCancelledCalls(t *testing.T) {
+	r, err := NewResilience(0x7002, ResiliencePolicy{Breaker: &BreakerConfig{FailureThreshold: 2, OpenTimeout: 20 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := r.Wrap(func(ctx context.Context, p []byte) ([]byte, error) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errBackend
+	})
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A cancellation between two failures does not reset the count.
+	_, _ = fn(context.Background(), nil)
+	_, _ = fn(cancelled, nil)
+	_, _ = fn(context.Background(), nil)
+	if s := r.BreakerState(); s != BreakerOpen {
+		t.Fatalf("state = %v, want open", s)
+	}
+
+	// A cancelled probe neither closes the breaker nor holds its slot.
+	time.Sleep(30 * time.Millisecond)
+	if _, err := fn(cancelled, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled probe: %v", err)
+	}
+	if s := r.BreakerState(); s != BreakerHalfOpen {
+		t.Fatalf("state after cancelled probe = %v, want half-open", s)
+	}
+	if _, err := fn(context.Background(), nil); !errors.Is(err, errBackend) || r.BreakerState() != BreakerOpen {
+		t.Fatalf("next probe: err = %v, state %v", err, r.BreakerState())
+	}
+}
+
+func TestRouteTimeoutsOpenBreaker(t *testing.T) {
+	res, err := NewResilience(0x7004, ResiliencePolicy{Breaker: &BreakerConfig{FailureThreshold: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls atomic.Int32
+	stalled := res.Wrap(func(ctx context.Context, p []byte) ([]byte, error) {
+		calls.Add(1)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	r := NewRouter()
+	err = r.Route(0x7004, func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		out, err := stalled(ctx, m.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return &protocol.Message{Command: m.Command, Payload: out}, nil
+	}, RouteConfig{Timeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		if _, err := r.Dispatch(context.Background(), &protocol.Message{Command: 0x7004}); err != ErrTimeout {
+			t.Fatalf("err = %v, want ErrTimeout", err)
+		}
+	}
+	if s := res.BreakerState(); s != BreakerOpen {
+		t.Fatalf("state after timeouts = %v, want open", s)
+	}
+	if _, err := r.Dispatch(context.Background(), &protocol.Message{Command: 0x7004}); !errors.Is(err, ErrCircuitOpen) || calls.Load() != 2 {
+		t.Fatalf("open breaker: err = %v after %d calls", err, calls.Load())
+	}
+}
+
+func TestTargetBreakersPublishedSeparately(t *testing.T) {
+	p := ResiliencePolicy{Breaker: &BreakerConfig{FailureThreshold: 1}}
+	stable, _ := NewTargetResilience(0x7003, "stable", p)
+	canary, _ := NewTargetResilience(0x7003, "canary", p)
+	_, _ = canary.Wrap(func(ctx context.Context, p []byte) ([]byte, error) { return nil, errBackend })(context.Background(), nil)
+	if stable.BreakerState() != BreakerClosed || canary.BreakerState() != BreakerOpen {
+		t.Fatalf("states = %v, %v", stable.BreakerState(), canary.BreakerState())
+	}
+	for key, want := range map[string]string{"0x7003/stable": `"closed"`, "0x7003/canary": `"open"`} {
+		if v := breakerStates.Get(key); v == nil || v.String() != want {
+			t.Fatalf("breakers[%s] = %v, want %s", key, v, want)
+		}
+	}
+}
+
+func TestRetryIdempotentOnly(t *testing.T) {
+	if _, err := NewResilience(0x7002, ResiliencePolicy{Retry: &RetryConfig{}}); err == nil {
+		t.Fatal("expected error for retry on a non-idempotent command")
+	}
+
+	r, err := NewResilience(0x7002, ResiliencePolicy{Idempotent: true, Retry: &RetryConfig{MaxAttempts: 3, Backoff: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls atomic.Int32
+	fn := r.Wrap(func(ctx context.Context, p []byte) ([]byte, error) {
+		if calls.Add(1) < 3 {
+			return nil, errBackend
+		}
+		return p, nil
+	})
+	out, err := fn(context.Background(), []byte("ok"))
+	if err != nil || string(out) != "ok" || calls.Load() != 3 {
+		t.Fatalf("got %q, %v after %d calls", out, err, calls.Load())
+	}
+
+	calls.Store(-10)
+	if _, err := fn(context.Background(), nil); !errors.Is(err, errBackend) || calls.Load() != -7 {
+		t.Fatalf("exhausted retries: err = %v after %d calls", err, calls.Load()+10)
+	}
+}
+
+func TestHedgeWinsOverSlowCall(t *testing.T) {
+	r, err := NewResilience(0x7003, ResiliencePolicy{Idempotent: true, Hedge: &HedgeConfig{Delay: 10 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls atomic.Int32
+	cancelled := make(chan struct{})
+	fn := r.Wrap(func(ctx context.Context, p []byte) ([]byte, error) {
+		if calls.Add(1) == 1 {
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		}
+		return []byte("hedged"), nil
+	})
+
+	payload := []byte("req")
+	out, err := fn(context.Background(), payload)
+	if err != nil || string(out) != "hedged" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("slow call was not cancelled")
+	}
+}
@@ -0,0 +1,267 @@
+package novagate
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// CompressionPolicy is how a route treats FlagCompressed.
+type CompressionPolicy string
+
+const (
+	// CompressionMirror (the default) accepts compressed requests and
+	// compresses the response when the request was compressed.
+	CompressionMirror CompressionPolicy = "mirror"
+	// CompressionNever rejects compressed requests and answers uncompressed.
+	CompressionNever CompressionPolicy = "never"
+	// CompressionAlways accepts either and always compresses the response.
+	CompressionAlways CompressionPolicy = "always"
+)
+
+func (p CompressionPolicy) valid() bool {
+	switch p {
+	case "", CompressionMirror, CompressionNever, CompressionAlways:
+		return true
+	}
+	return false
+}
+
+// Errors returned for requests refused by a route (see Router.Route).
+var (
+	ErrRateLimited = &StatusError{Code: protocol.StatusRateLimited, Message: "rate limited"}
+	ErrTimeout     = &StatusError{Code: protocol.StatusTimeout, Message: "timeout"}
+)
+
+// RouteConfig is the per-command policy of a route. Zero values disable
+// each limit.
+type RouteConfig struct {
+	// Timeout bounds the handler; a request exceeding it is answered with
+	// ErrTimeout.
+	Timeout time.Duration
+	// RateLimit caps the requests per second to the command across all
+	// connections, with bursts of up to Burst (default: RateLimit rounded
+	// up). Requests over the limit are answered with ErrRateLimited.
+	RateLimit float64
+	Burst     int
+	// RejectOneWay refuses FlagOneWay requests; they are dropped unserved.
+	RejectOneWay bool
+	Compression  CompressionPolicy
+	// Middlewares wrap the handler inside the route policy, so they only
+	// see requests the rate limit let through. The first is the outermost.
+	Middlewares []Middleware
+	// Cache serves repeated requests from memory (see ResponseCache). It
+	// sits outside the rate limit and timeout: hits cost no token.
+	Cache *ResponseCache
+	// ContentTypes restricts the payload codecs of the command, by name (see
+	// codec.MetadataKey); the first is the default. Requests naming another
+	// are answered with protocol.StatusBadPayload. Empty accepts any.
+	ContentTypes []string
+}
+
+// route is a registered RouteConfig with its rate limiter state.
+type route struct {
+	cfg    RouteConfig
+	bucket *tokenBucket
+}
+
+// Route registers h for cmd like Register, under the policy rc. The timeout
+// and rate limit also apply to requests from the HTTP bridge; the one-way
+// and compression policies concern the frame the request arrived in.
+func (r *Router) Route(cmd uint16, h Handler, rc RouteConfig) error {
+	if !rc.Compression.valid() {
+		return fmt.Errorf("command 0x%04X: unknown compression policy %q", cmd, rc.Compression)
+	}
+	if rc.Timeout < 0 || rc.RateLimit < 0 || rc.Burst < 0 {
+		return fmt.Errorf("command 0x%04X: negative route limit", cmd)
+	}
+	if err := checkContentTypes(rc.ContentTypes); err != nil {
+		return fmt.Errorf("command 0x%04X: %w", cmd, err)
+	}
+	rt := &route{cfg: rc}
+	if rc.RateLimit > 0 {
+		burst := rc.Burst
+		if burst == 0 {
+			burst = int(math.Ceil(rc.RateLimit))
+		}
+		rt.bucket = newTokenBucket(rc.RateLimit, burst)
+	}
+
+	r.mu.Lock()
+	r.routes[cmd] = rt
+	delete(r.splits, cmd)
+	r.handlers[cmd] = rt.wrap(h)
+	r.chained[cmd] = r.chain(r.handlers[cmd])
+	r.mu.Unlock()
+	return nil
+}
+
+// Split routes cmd to the targets of s under the policy rc, and exposes s
+// to the admin API (see NewAdminHandler).
+func (r *Router) Split(s *Splitter, rc RouteConfig) error {
+	if err := r.Route(s.cmd, s.Handler(), rc); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.splits[s.cmd] = s
+	r.mu.Unlock()
+	return nil
+}
+
+// Splitters returns the splitters registered with Split, by command.
+func (r *Router) Splitters() []*Splitter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]*Splitter, 0, len(r.splits))
+	for _, s := range r.splits {
+		out = append(out, s)
+	}
+	slices.SortFunc(out, func(a, b *Splitter) int { return cmp.Compare(a.cmd, b.cmd) })
+	return out
+}
+
+func (r *Router) splitter(cmd uint16) *Splitter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.splits[cmd]
+}
+
+// Cache returns the response cache of the route registered for cmd, or nil.
+func (r *Router) Cache(cmd uint16) *ResponseCache {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if rt := r.routes[cmd]; rt != nil {
+		return rt.cfg.Cache
+	}
+	return nil
+}
+
+// Caches returns the response caches of the registered routes, by command.
+func (r *Router) Caches() []*ResponseCache {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []*ResponseCache
+	for _, rt := range r.routes {
+		if rt.cfg.Cache != nil {
+			out = append(out, rt.cfg.Cache)
+		}
+	}
+	slices.SortFunc(out, func(a, b *ResponseCache) int { return cmp.Compare(a.cmd, b.cmd) })
+	return out
+}
+
+// route returns the policy registered for cmd, or nil.
+func (r *Router) route(cmd uint16) *route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.routes[cmd]
+}
+
+func (rt *route) wrap(h Handler) Handler {
+	for i := len(rt.cfg.Middlewares) - 1; i >= 0; i-- {
+		if mw := rt.cfg.Middlewares[i]; mw != nil {
+			h = mw(h)
+		}
+	}
+	if rt.bucket != nil || rt.cfg.Timeout > 0 {
+		h = rt.limit(h)
+	}
+	if rt.cfg.Cache != nil {
+		h = rt.cfg.Cache.Middleware()(h)
+	}
+	if len(rt.cfg.ContentTypes) > 0 {
+		next := h
+		h = func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			if _, err := payloadCodec(m, rt.cfg.ContentTypes); err != nil {
+				return nil, err
+			}
+			return next(ctx, m)
+		}
+	}
+	return h
+}
+
+// limit applies the rate limit and timeout of the route to h.
+func (rt *route) limit(h Handler) Handler {
+	return func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		if rt.bucket != nil && !rt.bucket.allow() {
+			metricRouteRateLimited.Add(1)
+			return nil, ErrRateLimited
+		}
+		if rt.cfg.Timeout <= 0 {
+			return h(ctx, m)
+		}
+		tctx, cancel := context.WithTimeout(ctx, rt.cfg.Timeout)
+		defer cancel()
+		resp, err := h(tctx, m)
+		// The route's own deadline, not the caller giving up.
+		if err != nil && errors.Is(tctx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			metricRouteTimeouts.Add(1)
+			return nil, ErrTimeout
+		}
+		return resp, err
+	}
+}
+
+// admit checks the frame flags of a request against the route.
+func (rt *route) admit(flags uint8) error {
+	if rt == nil {
+		return nil
+	}
+	if rt.cfg.RejectOneWay && flags&protocol.FlagOneWay != 0 {
+		metricRouteRejected.Add(1)
+		return &StatusError{Code: protocol.StatusRejected, Message: "one-way not allowed"}
+	}
+	if rt.cfg.Compression == CompressionNever && flags&protocol.FlagCompressed != 0 {
+		metricRouteRejected.Add(1)
+		return &StatusError{Code: protocol.StatusRejected, Message: "compression not allowed"}
+	}
+	return nil
+}
+
+// responseFlags returns the compression flag of the response to a request
+// that arrived with flags.
+func (rt *route) responseFlags(flags uint8) uint8 {
+	if rt != nil {
+		switch rt.cfg.Compression {
+		case CompressionNever:
+			return 0
+		case CompressionAlways:
+			return protocol.FlagCompressed
+		}
+	}
+	return flags & protocol.FlagCompressed
+}
+
+// tokenBucket is a mutex-guarded token bucket shared by all connections.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,425 @@
+package novagate
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gogogo1024/novagate/codec"
+	"github.com/gogogo1024/novagate/protocol"
+	"github.com/gogogo1024/novagate/schema"
+)
+
+// Backends of a CommandSpec.
+const (
+	// BackendLocal serves the command in process (cmd/server: the
+	// dispatcher handler registered for the command).
+	BackendLocal = "local"
+	// BackendUpstream forwards the command to the discovered endpoints of
+	// its service (see Upstream).
+	BackendUpstream = "upstream"
+)
+
+// CommandSpec declares one command of a routing table, as listed under
+// commands in novagate.yaml:
+//
+//	commands:
+//	  - id: 0x0201
+//	    method: "OrderService.Create"
+//	    backend: "upstream"
+//	    timeout: "2s"
+//	    rate_limit: 500
+//	    one_way: false
+//	    compression: "mirror"
+//	    content_types: ["protobuf", "json"]
+//	    split:
+//	      sticky: "principal"
+//	      targets:
+//	        - { name: "stable", weight: 90 }
+//	        - { name: "canary", weight: 10, service: "OrderServiceV2" }
+//	      rules:
+//	        - { metadata: { x-canary: "1" }, target: "canary" }
+//	    mirror:
+//	      service: "OrderServiceV3"
+//	      sample: 0.1
+//	    idempotency:
+//	      ttl: "10m"
+//	    cache:
+//	      ttl: "30s"
+//	      capacity: 10000
+//	    schema:
+//	      max_bytes: 65536
+//	      proto: "./schemas/order.pb"
+//	      message: "order.v1.CreateRequest"
+type CommandSpec struct {
+	ID     uint16 `yaml:"id"`
+	Method string `yaml:"method"`
+	// Backend is BackendLocal (the default) or BackendUpstream.
+	Backend string `yaml:"backend"`
+	// Service overrides the upstream service name, by default the Service
+	// part of Method.
+	Service   string        `yaml:"service"`
+	Timeout   time.Duration `yaml:"timeout"`
+	RateLimit float64       `yaml:"rate_limit"`
+	Burst     int           `yaml:"burst"`
+	// OneWay allows one-way requests; unset means allowed.
+	OneWay      *bool             `yaml:"one_way"`
+	Compression CompressionPolicy `yaml:"compression"`
+	// ContentTypes lists the accepted payload codecs, the default first
+	// (see RouteConfig.ContentTypes).
+	ContentTypes []string `yaml:"content_types"`
+	// Split spreads the command over several targets (see Splitter).
+	Split *SplitSpec `yaml:"split"`
+	// Mirror shadows the command to a secondary backend (see Mirror).
+	Mirror *MirrorSpec `yaml:"mirror"`
+	// Idempotency replays completed responses to retries (see Idempotency).
+	Idempotency *IdempotencySpec `yaml:"idempotency"`
+	// Cache serves repeated lookups from memory (see ResponseCache); only
+	// for read-only commands.
+	Cache *CacheSpec `yaml:"cache"`
+	// Schema validates payloads before dispatch (see ValidatePayloads).
+	Schema *SchemaSpec `yaml:"schema"`
+}
+
+// SchemaSpec declares the payload contract of a command: a size limit and
+// either a JSON Schema or a protobuf message.
+type SchemaSpec struct {
+	MaxBytes int `yaml:"max_bytes"`
+	// JSON is the path of a JSON Schema file (see schema.CompileJSON).
+	JSON string `yaml:"json"`
+	// Proto is the path of a FileDescriptorSet (protoc --descriptor_set_out
+	// --include_imports) and Message the full name of the request message.
+	Proto   string `yaml:"proto"`
+	Message string `yaml:"message"`
+}
+
+// DefaultContentType returns the codec of payloads that name none: the first
+// of ContentTypes, or "" when the command accepts any.
+func (s CommandSpec) DefaultContentType() string {
+	if len(s.ContentTypes) > 0 {
+		return s.ContentTypes[0]
+	}
+	return ""
+}
+
+// CommandSchema loads the schema files of the command.
+func (s CommandSpec) CommandSchema() (CommandSchema, error) {
+	cs := CommandSchema{MaxBytes: s.Schema.MaxBytes, ContentType: s.DefaultContentType()}
+	var err error
+	switch {
+	case s.Schema.JSON != "":
+		cs.Validator, err = schema.LoadJSON(s.Schema.JSON)
+	case s.Schema.Proto != "":
+		cs.Validator, err = schema.LoadProto(s.Schema.Proto, s.Schema.Message)
+	}
+	if err != nil {
+		return CommandSchema{}, fmt.Errorf("command 0x%04X schema: %w", s.ID, err)
+	}
+	return cs, nil
+}
+
+// CacheSpec declares the response cache of a command.
+type CacheSpec struct {
+	TTL          time.Duration `yaml:"ttl"`
+	Capacity     int           `yaml:"capacity"`
+	PrincipalKey string        `yaml:"principal_key"`
+}
+
+// CacheConfig returns the settings of the spec; contentType is the default
+// codec of the command (see CacheConfig.ContentType).
+func (s CacheSpec) CacheConfig(contentType string) CacheConfig {
+	return CacheConfig{TTL: s.TTL, Capacity: s.Capacity, PrincipalKey: s.PrincipalKey, ContentType: contentType}
+}
+
+// IdempotencySpec declares the duplicate suppression of a command. The
+// store is configured for the whole gateway.
+type IdempotencySpec struct {
+	TTL time.Duration `yaml:"ttl"`
+	// Key names the metadata entry holding an explicit idempotency key.
+	Key          string        `yaml:"key"`
+	PrincipalKey string        `yaml:"principal_key"`
+	ClaimTTL     time.Duration `yaml:"claim_ttl"`
+	// SharedKeys lets clients without a principal share explicit keys
+	// (see IdempotencyConfig.SharedKeys).
+	SharedKeys bool `yaml:"shared_keys"`
+}
+
+// IdempotencyConfig returns the settings of the spec, without the store.
+func (s IdempotencySpec) IdempotencyConfig() IdempotencyConfig {
+	return IdempotencyConfig{TTL: s.TTL, KeyMetadata: s.Key, PrincipalKey: s.PrincipalKey, ClaimTTL: s.ClaimTTL, SharedKeys: s.SharedKeys}
+}
+
+// SplitSpec declares the traffic split of a command.
+type SplitSpec struct {
+	Sticky       Stickiness        `yaml:"sticky"`
+	PrincipalKey string            `yaml:"principal_key"`
+	Targets      []SplitTargetSpec `yaml:"targets"`
+	Rules        []SplitRule       `yaml:"rules"`
+}
+
+// SplitConfig returns the settings of the spec over targets; principal, if
+// not nil, identifies callers in place of the PrincipalKey metadata entry.
+func (s SplitSpec) SplitConfig(targets []SplitTarget, principal PrincipalFunc) SplitConfig {
+	return SplitConfig{Targets: targets, Rules: s.Rules, Sticky: s.Sticky, Principal: principal, PrincipalKey: s.PrincipalKey}
+}
+
+// SplitTargetSpec declares one target of a split. Backend and Service
+// default to those of the command.
+type SplitTargetSpec struct {
+	Name    string `yaml:"name"`
+	Weight  int    `yaml:"weight"`
+	Backend string `yaml:"backend"`
+	Service string `yaml:"service"`
+}
+
+// MirrorSpec declares the shadow backend of a command. Backend and Service
+// default to those of the command, so at least one of them must be set.
+type MirrorSpec struct {
+	Backend string `yaml:"backend"`
+	Service string `yaml:"service"`
+	// Sample is the share of requests mirrored; unset means all of them.
+	Sample      *float64      `yaml:"sample"`
+	MaxInflight int           `yaml:"max_inflight"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// Target returns the shadow backend with its defaults filled in.
+func (m MirrorSpec) Target(s CommandSpec) SplitTargetSpec {
+	return s.target(SplitTargetSpec{Name: "mirror", Backend: m.Backend, Service: m.Service})
+}
+
+// MirrorConfig returns the mirror settings of the spec, without the shadow
+// handler.
+func (m MirrorSpec) MirrorConfig() MirrorConfig {
+	cfg := MirrorConfig{Sample: 1, MaxInflight: m.MaxInflight, Timeout: m.Timeout}
+	if m.Sample != nil {
+		cfg.Sample = *m.Sample
+	}
+	return cfg
+}
+
+// Targets returns the targets of the command with their defaults filled
+// in: the split targets, or a single target named "default".
+func (s CommandSpec) Targets() []SplitTargetSpec {
+	if s.Split == nil {
+		return []SplitTargetSpec{s.target(SplitTargetSpec{Name: "default", Weight: 1})}
+	}
+	out := make([]SplitTargetSpec, 0, len(s.Split.Targets))
+	for _, t := range s.Split.Targets {
+		out = append(out, s.target(t))
+	}
+	return out
+}
+
+func (s CommandSpec) target(t SplitTargetSpec) SplitTargetSpec {
+	if t.Backend == "" {
+		t.Backend = s.Backend
+	}
+	if t.Backend == "" {
+		t.Backend = BackendLocal
+	}
+	if t.Backend == BackendUpstream && t.Service == "" {
+		t.Service = s.ServiceName()
+	}
+	return t
+}
+
+// ServiceName returns the service the command is forwarded to.
+func (s CommandSpec) ServiceName() string {
+	if s.Service != "" {
+		return s.Service
+	}
+	service, _ := protocol.ServiceName(s.Method)
+	return service
+}
+
+// RouteConfig returns the route policy of the command.
+func (s CommandSpec) RouteConfig() RouteConfig {
+	return RouteConfig{
+		Timeout:      s.Timeout,
+		RateLimit:    s.RateLimit,
+		Burst:        s.Burst,
+		RejectOneWay: s.OneWay != nil && !*s.OneWay,
+		Compression:  s.Compression,
+		ContentTypes: s.ContentTypes,
+	}
+}
+
+// ValidateCommandSpecs checks a routing table and reports every problem
+// found, not just the first.
+func ValidateCommandSpecs(specs []CommandSpec) error {
+	var errs []error
+	ids := make(map[uint16]int, len(specs))
+	methods := make(map[string]int, len(specs))
+	for i, s := range specs {
+		fail := func(format string, args ...any) {
+			errs = append(errs, fmt.Errorf("commands[%d] (%s): %s", i, s.Method, fmt.Sprintf(format, args...)))
+		}
+		if _, err := protocol.ServiceName(s.Method); err != nil {
+			fail("invalid method: %v", err)
+		}
+		switch {
+		case s.ID == 0:
+			fail("id is required")
+		case s.ID == protocol.CmdError:
+			fail("id 0x%04X is reserved for error replies", s.ID)
+		}
+		if j, dup := ids[s.ID]; dup && s.ID != 0 {
+			fail("id 0x%04X already used by commands[%d]", s.ID, j)
+		} else {
+			ids[s.ID] = i
+		}
+		if j, dup := methods[s.Method]; dup {
+			fail("method already declared by commands[%d]", j)
+		} else {
+			methods[s.Method] = i
+		}
+		if err := checkBackend(s.Backend, s.Service); err != nil {
+			fail("%v", err)
+		}
+		if s.Timeout < 0 || s.RateLimit < 0 || s.Burst < 0 {
+			fail("timeout, rate_limit and burst must not be negative")
+		}
+		if !s.Compression.valid() {
+			fail("unknown compression policy %q", s.Compression)
+		}
+		if err := checkContentTypes(s.ContentTypes); err != nil {
+			fail("content_types: %v", err)
+		}
+		if s.Split != nil {
+			for _, err := range checkSplit(s) {
+				fail("split: %v", err)
+			}
+		}
+		if s.Mirror != nil {
+			for _, err := range checkMirror(s) {
+				fail("mirror: %v", err)
+			}
+		}
+		if s.Idempotency != nil && (s.Idempotency.TTL < 0 || s.Idempotency.ClaimTTL < 0) {
+			fail("idempotency: negative ttl")
+		}
+		if s.Schema != nil {
+			for _, err := range checkSchema(s) {
+				fail("schema: %v", err)
+			}
+		}
+		if s.Cache != nil {
+			switch {
+			case s.Cache.TTL < 0 || s.Cache.Capacity < 0:
+				fail("cache: ttl and capacity must not be negative")
+			case s.Idempotency != nil:
+				fail("cache: a cached command is read-only and needs no idempotency")
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func checkBackend(backend, service string) error {
+	switch backend {
+	case "", BackendLocal:
+		if service != "" {
+			return errors.New("service is only used by upstream backends")
+		}
+	case BackendUpstream:
+	default:
+		return fmt.Errorf("unknown backend %q (want %q or %q)", backend, BackendLocal, BackendUpstream)
+	}
+	return nil
+}
+
+func checkSchema(s CommandSpec) []error {
+	var errs []error
+	sc := s.Schema
+	if sc.MaxBytes < 0 {
+		errs = append(errs, errors.New("negative max_bytes"))
+	}
+	// The codecs each kind of schema can decode.
+	var codecs []string
+	switch {
+	case sc.JSON != "" && sc.Proto != "":
+		errs = append(errs, errors.New("json and proto are exclusive"))
+	case sc.JSON != "":
+		codecs = []string{codec.JSONName, codec.MsgPackName}
+	case sc.Proto != "":
+		codecs = []string{codec.ProtobufName, codec.JSONName}
+		if sc.Message == "" {
+			errs = append(errs, errors.New("proto needs the message name"))
+		}
+	case sc.MaxBytes == 0:
+		errs = append(errs, errors.New("declares neither max_bytes, json nor proto"))
+	}
+	if sc.Message != "" && sc.Proto == "" {
+		errs = append(errs, errors.New("message is only used with proto"))
+	}
+	for _, ct := range s.ContentTypes {
+		if codecs != nil && !slices.Contains(codecs, ct) {
+			errs = append(errs, fmt.Errorf("content type %q cannot be checked against the schema", ct))
+		}
+	}
+	return errs
+}
+
+func checkMirror(s CommandSpec) []error {
+	var errs []error
+	m := s.Mirror
+	backend := m.Backend
+	if backend == "" {
+		backend = s.Backend
+	}
+	if m.Backend == "" && m.Service == "" {
+		errs = append(errs, errors.New("needs a backend or service of its own"))
+	} else if err := checkBackend(backend, m.Service); err != nil {
+		errs = append(errs, err)
+	}
+	if m.Sample != nil && !(*m.Sample > 0 && *m.Sample <= 1) {
+		errs = append(errs, fmt.Errorf("sample %v is not in (0, 1]", *m.Sample))
+	}
+	if m.MaxInflight < 0 || m.Timeout < 0 {
+		errs = append(errs, errors.New("max_inflight and timeout must not be negative"))
+	}
+	return errs
+}
+
+func checkSplit(s CommandSpec) []error {
+	var errs []error
+	switch s.Split.Sticky {
+	case "", StickyNone, StickyConnection, StickyPrincipal:
+	default:
+		errs = append(errs, fmt.Errorf("unknown stickiness %q", s.Split.Sticky))
+	}
+	names := map[string]bool{}
+	weights := make([]int, 0, len(s.Split.Targets))
+	for i, t := range s.Split.Targets {
+		if t.Name == "" {
+			errs = append(errs, fmt.Errorf("targets[%d] needs a name", i))
+		} else if names[t.Name] {
+			errs = append(errs, fmt.Errorf("duplicate target %q", t.Name))
+		}
+		names[t.Name] = true
+		backend := t.Backend
+		if backend == "" {
+			backend = s.Backend
+		}
+		if err := checkBackend(backend, t.Service); err != nil {
+			errs = append(errs, fmt.Errorf("target %q: %w", t.Name, err))
+		}
+		weights = append(weights, t.Weight)
+	}
+	if len(weights) == 0 {
+		errs = append(errs, errors.New("no targets"))
+	} else if err := checkWeights(weights); err != nil {
+		errs = append(errs, err)
+	}
+	for i, r := range s.Split.Rules {
+		if !names[r.Target] {
+			errs = append(errs, fmt.Errorf("rules[%d] names unknown target %q", i, r.Target))
+		}
+		if len(r.Metadata) == 0 && len(r.Principals) == 0 {
+			errs = append(errs, fmt.Errorf("rules[%d] needs metadata or principals", i))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,174 @@
+package novagate
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func TestRouteTimeoutAndRateLimit(t *testing.T) {
+	r := NewRouter()
+	slow := func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if err := r.Route(protocol.CmdUserLogin, slow, RouteConfig{Timeout: 20 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	timeouts := metricRouteTimeouts.Value()
+	if _, err := r.Dispatch(context.Background(), &protocol.Message{Command: protocol.CmdUserLogin}); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("slow handler: err = %v, want ErrTimeout", err)
+	}
+	if got := metricRouteTimeouts.Value() - timeouts; got != 1 {
+		t.Fatalf("route_timeouts delta = %d, want 1", got)
+	}
+	// A caller giving up is not the route's timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.Dispatch(ctx, &protocol.Message{Command: protocol.CmdUserLogin}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled caller: err = %v, want context.Canceled", err)
+	}
+
+	echo := func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) { return m, nil }
+	if err := r.Route(protocol.CmdPing, echo, RouteConfig{RateLimit: 0.001, Burst: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 2 {
+		if _, err := r.Dispatch(context.Background(), &protocol.Message{Command: protocol.CmdPing}); err != nil {
+			t.Fatalf("request %d within burst: %v", i, err)
+		}
+	}
+	if _, err := r.Dispatch(context.Background(), &protocol.Message{Command: protocol.CmdPing}); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("request over the limit: err = %v, want ErrRateLimited", err)
+	}
+
+	// Register replaces the route and its policy.
+	r.Register(protocol.CmdPing, echo)
+	if _, err := r.Dispatch(context.Background(), &protocol.Message{Command: protocol.CmdPing}); err != nil {
+		t.Fatalf("after Register: %v", err)
+	}
+
+	if err := r.Route(protocol.CmdPing, echo, RouteConfig{Compression: "zstd"}); err == nil {
+		t.Fatal("unknown compression policy accepted")
+	}
+}
+
+func TestRouteFramePolicies(t *testing.T) {
+	const cmdAlways uint16 = 0x0F01
+	var pings atomic.Int32
+	setup := func(r *Router) error {
+		echo := func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			if m.Command == protocol.CmdPing {
+				pings.Add(1)
+			}
+			return &protocol.Message{Command: m.Command, RequestID: m.RequestID, Payload: m.Payload}, nil
+		}
+		if err := r.Route(protocol.CmdPing, echo, RouteConfig{RejectOneWay: true, Compression: CompressionNever}); err != nil {
+			return err
+		}
+		return r.Route(cmdAlways, echo, RouteConfig{Compression: CompressionAlways})
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = ServeWithContext(ctx, ln, setup) }()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fr := &frameReader{c: c}
+
+	rejected := metricRouteRejected.Value()
+	writeFrame(t, c, protocol.FlagOneWay, &protocol.Message{Command: protocol.CmdPing, RequestID: 1})
+	writeFrame(t, c, protocol.FlagCompressed, &protocol.Message{Command: protocol.CmdPing, RequestID: 2, Payload: []byte("zip")})
+	_, resp, err := fr.next(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, msg, err := protocol.DecodeErrorReply(resp.Payload)
+	if resp.Command != protocol.CmdError || resp.RequestID != 2 || err != nil || code != protocol.StatusRejected {
+		t.Fatalf("compressed request: %+v (%d %q %v), want StatusRejected for request 2", resp, code, msg, err)
+	}
+	if got := metricRouteRejected.Value() - rejected; got != 2 {
+		t.Fatalf("route_rejected delta = %d, want 2", got)
+	}
+	if n := pings.Load(); n != 0 {
+		t.Fatalf("rejected requests reached the handler %d times", n)
+	}
+
+	writeFrame(t, c, 0, &protocol.Message{Command: cmdAlways, RequestID: 3, Payload: []byte("plain")})
+	frame, _, _ := fr.next(2 * time.Second)
+	if frame == nil || frame.Flags&protocol.FlagCompressed == 0 {
+		t.Fatalf("response frame = %+v, want FlagCompressed", frame)
+	}
+	body, err := protocol.DecodeFrameBody(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := frame.DecodeMessage(body); err != nil || resp.RequestID != 3 || string(resp.Payload) != "plain" {
+		t.Fatalf("compressed response = %+v, %v", resp, err)
+	}
+}
+
+func TestValidateCommandSpecs(t *testing.T) {
+	good := []CommandSpec{
+		{ID: protocol.CmdPing, Method: "NovaService.Ping"},
+		{ID: protocol.CmdOrderCreate, Method: "OrderService.Create", Backend: BackendUpstream, Timeout: time.Second, RateLimit: 100},
+	}
+	if err := ValidateCommandSpecs(good); err != nil {
+		t.Fatalf("valid table: %v", err)
+	}
+	if got := good[1].ServiceName(); got != "OrderService" {
+		t.Fatalf("ServiceName = %q", got)
+	}
+	no := false
+	if rc := (CommandSpec{OneWay: &no}).RouteConfig(); !rc.RejectOneWay {
+		t.Fatal("one_way: false did not reject one-way requests")
+	}
+
+	bad := []CommandSpec{
+		{ID: protocol.CmdPing, Method: "NovaService.Ping"},
+		{ID: protocol.CmdPing, Method: "NovaService.Ping"},
+		{ID: protocol.CmdError, Method: "Broken"},
+		{Method: "UserService.Login", Backend: "grpc", Compression: "zstd", Service: "X"},
+		{ID: 0x0102, Method: "UserService.GetProfile", Cache: &CacheSpec{Capacity: -1}},
+		{ID: 0x0103, Method: "UserService.Update", Cache: &CacheSpec{}, Idempotency: &IdempotencySpec{}},
+		{ID: 0x0104, Method: "UserService.Export", ContentTypes: []string{"json", "xml"}},
+		{ID: 0x0105, Method: "UserService.Import", Schema: &SchemaSpec{JSON: "a.json", Proto: "a.pb"}},
+		{ID: 0x0106, Method: "UserService.Search", ContentTypes: []string{"protobuf"}, Schema: &SchemaSpec{JSON: "a.json"}},
+		{ID: 0x0107, Method: "UserService.Delete", Schema: &SchemaSpec{Proto: "a.pb"}},
+	}
+	err := ValidateCommandSpecs(bad)
+	if err == nil {
+		t.Fatal("invalid table accepted")
+	}
+	for _, want := range []string{
+		"already used by commands[0]",
+		"already declared by commands[0]",
+		"reserved for error replies",
+		"invalid method",
+		"id is required",
+		`unknown backend "grpc"`,
+		`unknown compression policy "zstd"`,
+		"cache: ttl and capacity must not be negative",
+		"needs no idempotency",
+		`content_types: unknown content type "xml"`,
+		"schema: json and proto are exclusive",
+		`schema: content type "protobuf" cannot be checked`,
+		"schema: proto needs the message name",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
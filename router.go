@@ -2,39 +2,111 @@ package novagate
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 
 	"github.com/gogogo1024/novagate/protocol"
 )
 
+// ErrUnknownCommand is returned by Router.Dispatch when no handler is registered.
+var ErrUnknownCommand = errors.New("unknown command")
+
 // Handler handles a decoded protocol message.
 // Returning (nil, nil) means no response.
+// The request payload is only valid until the handler returns (see
+// protocol.Message); use Clone to retain it.
 type Handler func(context.Context, *protocol.Message) (*protocol.Message, error)
 
+// Middleware wraps a Handler. Middlewares registered with Router.Use apply to
+// every command, whichever transport (TCP, WebSocket, HTTP bridge) delivered it.
+type Middleware func(Handler) Handler
+
 // Router is the default in-process command router.
 // It is safe for concurrent use.
 type Router struct {
-	mu       sync.RWMutex
-	handlers map[uint16]Handler
+	mu          sync.RWMutex
+	handlers    map[uint16]Handler
+	middlewares []Middleware
+	// chained caches handlers wrapped by middlewares; rebuilt on Register/Use.
+	chained map[uint16]Handler
+	// routes holds the policies of commands registered with Route.
+	routes map[uint16]*route
+	// splits holds the splitters registered with Split.
+	splits map[uint16]*Splitter
+	// faults is the injector installed with InjectFaults.
+	faults *FaultInjector
 }
 
 func NewRouter() *Router {
-	return &Router{handlers: make(map[uint16]Handler)}
+	return &Router{
+		handlers: make(map[uint16]Handler),
+		chained:  make(map[uint16]Handler),
+		routes:   make(map[uint16]*route),
+		splits:   make(map[uint16]*Splitter),
+	}
 }
 
 func (r *Router) Register(cmd uint16, h Handler) {
 	r.mu.Lock()
+	delete(r.routes, cmd)
+	delete(r.splits, cmd)
 	r.handlers[cmd] = h
+	r.chained[cmd] = r.chain(h)
+	r.mu.Unlock()
+}
+
+// Use appends middlewares. The first middleware registered is the outermost.
+func (r *Router) Use(mws ...Middleware) {
+	r.mu.Lock()
+	for _, mw := range mws {
+		if mw != nil {
+			r.middlewares = append(r.middlewares, mw)
+		}
+	}
+	for cmd, h := range r.handlers {
+		r.chained[cmd] = r.chain(h)
+	}
 	r.mu.Unlock()
 }
 
+func (r *Router) chain(h Handler) Handler {
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		h = r.middlewares[i](h)
+	}
+	return h
+}
+
+// InjectFaults installs f as a middleware, at this point of the chain, and
+// exposes it to the admin API (see NewAdminHandler).
+func (r *Router) InjectFaults(f *FaultInjector) {
+	r.Use(f.Middleware())
+	r.mu.Lock()
+	r.faults = f
+	r.mu.Unlock()
+}
+
+// FaultInjector returns the injector installed with InjectFaults, or nil.
+func (r *Router) FaultInjector() *FaultInjector {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.faults
+}
+
+// Has reports whether a handler is registered for cmd.
+func (r *Router) Has(cmd uint16) bool {
+	r.mu.RLock()
+	_, ok := r.handlers[cmd]
+	r.mu.RUnlock()
+	return ok
+}
+
 func (r *Router) Dispatch(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
 	r.mu.RLock()
-	h := r.handlers[m.Command]
+	h := r.chained[m.Command]
 	r.mu.RUnlock()
 	if h == nil {
-		return nil, fmt.Errorf("unknown command: 0x%04X", m.Command)
+		return nil, fmt.Errorf("%w: 0x%04X", ErrUnknownCommand, m.Command)
 	}
 	return h(ctx, m)
 }
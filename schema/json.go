@@ -0,0 +1,329 @@
+package schema
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gogogo1024/novagate/codec"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// JSONSchema is a compiled JSON Schema, checked by
+// github.com/santhosh-tekuri/jsonschema/v5. Documents without $schema follow
+// draft 2020-12; format is asserted, pattern uses Go regexp syntax, and
+// $ref resolves only within the document.
+//
+// Keywords the drafts do not define are rejected by CompileJSON, so that a
+// misspelled constraint fails at startup instead of silently passing
+// everything; vendor extensions may use an "x-" prefix.
+//
+// JSON payloads are checked as is, MessagePack payloads after decoding them
+// to the same values.
+type JSONSchema struct {
+	schema *jsonschema.Schema
+	doc    any // the decoded document, to look up failed keywords
+}
+
+// jsonKeywords are the keywords of drafts 7 to 2020-12, annotations
+// included.
+var jsonKeywords = map[string]bool{
+	"$schema": true, "$id": true, "$anchor": true, "$dynamicAnchor": true, "$recursiveAnchor": true,
+	"$ref": true, "$dynamicRef": true, "$recursiveRef": true, "$defs": true, "definitions": true,
+	"$vocabulary": true, "$comment": true,
+	"allOf": true, "anyOf": true, "oneOf": true, "not": true, "if": true, "then": true, "else": true,
+	"dependentSchemas": true, "dependencies": true, "prefixItems": true, "items": true,
+	"additionalItems": true, "contains": true, "properties": true, "patternProperties": true,
+	"additionalProperties": true, "propertyNames": true,
+	"unevaluatedItems": true, "unevaluatedProperties": true,
+	"type": true, "enum": true, "const": true, "multipleOf": true, "maximum": true,
+	"exclusiveMaximum": true, "minimum": true, "exclusiveMinimum": true, "maxLength": true,
+	"minLength": true, "pattern": true, "maxItems": true, "minItems": true, "uniqueItems": true,
+	"maxContains": true, "minContains": true, "maxProperties": true, "minProperties": true,
+	"required": true, "dependentRequired": true, "format": true,
+	"contentEncoding": true, "contentMediaType": true, "contentSchema": true,
+	"title": true, "description": true, "default": true, "deprecated": true, "readOnly": true,
+	"writeOnly": true, "examples": true,
+}
+
+// Keywords whose value is a schema, a map of schemas or a list of schemas.
+var (
+	jsonSchemaKeywords = []string{
+		"not", "if", "then", "else", "items", "additionalItems", "contains",
+		"additionalProperties", "propertyNames", "unevaluatedItems",
+		"unevaluatedProperties", "contentSchema",
+	}
+	jsonSchemaMapKeywords  = []string{"$defs", "definitions", "properties", "patternProperties", "dependentSchemas", "dependencies"}
+	jsonSchemaListKeywords = []string{"allOf", "anyOf", "oneOf", "prefixItems", "items"}
+)
+
+// LoadJSON compiles the JSON Schema in the file at path.
+func LoadJSON(path string) (*JSONSchema, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := CompileJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// jsonSchemaURL names the document being compiled; $ref outside it fails.
+const jsonSchemaURL = "mem:///schema.json"
+
+// CompileJSON compiles a JSON Schema document.
+func CompileJSON(doc []byte) (*JSONSchema, error) {
+	var v any
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return nil, fmt.Errorf("json schema: %w", err)
+	}
+	if err := checkJSONKeywords(v, ""); err != nil {
+		return nil, fmt.Errorf("json schema: %w", err)
+	}
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft2020
+	c.AssertFormat = true
+	c.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("cannot load %s: only references within the schema are supported", url)
+	}
+	if err := c.AddResource(jsonSchemaURL, bytes.NewReader(doc)); err != nil {
+		return nil, fmt.Errorf("json schema: %w", err)
+	}
+	s, err := c.Compile(jsonSchemaURL)
+	if err != nil {
+		return nil, fmt.Errorf("json schema: %w", err)
+	}
+	return &JSONSchema{schema: s, doc: v}, nil
+}
+
+// checkJSONKeywords rejects keywords that no draft defines in the schema v
+// at path and in its subschemas.
+func checkJSONKeywords(v any, path string) error {
+	s, ok := v.(map[string]any)
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if !jsonKeywords[name] && !strings.HasPrefix(name, "x-") {
+			if path == "" {
+				return fmt.Errorf("unknown keyword %q", name)
+			}
+			return fmt.Errorf("%s: unknown keyword %q", path, name)
+		}
+	}
+	for _, kw := range jsonSchemaKeywords {
+		if err := checkJSONKeywords(s[kw], child(path, kw)); err != nil {
+			return err
+		}
+	}
+	for _, kw := range jsonSchemaMapKeywords {
+		m, _ := s[kw].(map[string]any)
+		for name, sub := range m {
+			if err := checkJSONKeywords(sub, child(path, kw+"."+name)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, kw := range jsonSchemaListKeywords {
+		list, _ := s[kw].([]any)
+		for i, sub := range list {
+			if err := checkJSONKeywords(sub, index(child(path, kw), i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate implements Validator for JSON ("" or "json") and MessagePack
+// payloads.
+func (s *JSONSchema) Validate(contentType string, payload []byte) []Violation {
+	var v any
+	switch contentType {
+	case "", codec.JSONName:
+		dec := json.NewDecoder(bytes.NewReader(payload))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return []Violation{{Reason: "malformed json: " + err.Error()}}
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return []Violation{{Reason: "malformed json: trailing data"}}
+		}
+	case codec.MsgPackName:
+		if err := (codec.MsgPack{}).Unmarshal(payload, &v); err != nil {
+			return []Violation{{Reason: err.Error()}}
+		}
+	default:
+		return []Violation{{Reason: fmt.Sprintf("content type %q cannot be checked against a JSON schema", contentType)}}
+	}
+	v = normalize(v)
+	err := s.schema.Validate(v)
+	if err == nil {
+		return nil
+	}
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return []Violation{{Reason: err.Error()}}
+	}
+	var vs []Violation
+	s.collect(ve, v, &vs)
+	slices.SortStableFunc(vs, func(a, b Violation) int {
+		return cmp.Or(strings.Compare(a.Field, b.Field), strings.Compare(a.Reason, b.Reason))
+	})
+	return vs
+}
+
+// collect adds the leaves of the error tree ve, the failures that caused the
+// others, to vs. Missing and unexpected properties are reported one by one
+// under their own names, like the other violations.
+func (s *JSONSchema) collect(ve *jsonschema.ValidationError, v any, vs *[]Violation) {
+	for _, c := range ve.Causes {
+		s.collect(c, v, vs)
+	}
+	if len(ve.Causes) > 0 {
+		return
+	}
+	path, at := locate(v, ve.InstanceLocation)
+	obj, _ := at.(map[string]any)
+	kw, parent := s.keyword(ve.AbsoluteKeywordLocation)
+	n := len(*vs)
+	switch {
+	case obj == nil:
+	case strings.HasSuffix(ve.KeywordLocation, "/required"):
+		names, _ := kw.([]any)
+		for _, name := range names {
+			if name, ok := name.(string); ok {
+				if _, ok := obj[name]; !ok {
+					*vs = append(*vs, Violation{Field: child(path, name), Reason: "is required"})
+				}
+			}
+		}
+	case strings.HasSuffix(ve.KeywordLocation, "/additionalProperties") && kw == false:
+		props, _ := parent["properties"].(map[string]any)
+		patterns, _ := parent["patternProperties"].(map[string]any)
+		for name := range obj {
+			if _, ok := props[name]; !ok && !matchesAny(patterns, name) {
+				*vs = append(*vs, Violation{Field: child(path, name), Reason: "is not allowed"})
+			}
+		}
+	}
+	if len(*vs) == n {
+		*vs = append(*vs, Violation{Field: path, Reason: ve.Message})
+	}
+}
+
+// keyword returns the value of the keyword at loc, an absolute keyword
+// location within the document, and the schema holding it.
+func (s *JSONSchema) keyword(loc string) (v any, parent map[string]any) {
+	ptr, ok := strings.CutPrefix(loc, jsonSchemaURL+"#")
+	if !ok {
+		return nil, nil
+	}
+	v = s.doc
+	for _, tok := range pointerTokens(ptr) {
+		parent = nil
+		switch cur := v.(type) {
+		case map[string]any:
+			parent, v = cur, cur[tok]
+		case []any:
+			i, err := strconv.Atoi(tok)
+			if err != nil || i < 0 || i >= len(cur) {
+				return nil, nil
+			}
+			v = cur[i]
+		default:
+			return nil, nil
+		}
+	}
+	return v, parent
+}
+
+func matchesAny(patterns map[string]any, name string) bool {
+	for p := range patterns {
+		if ok, _ := regexp.MatchString(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// locate follows the JSON pointer ptr into v and returns the value found and
+// its field path, such as "items[2].sku".
+func locate(v any, ptr string) (path string, at any) {
+	for _, tok := range pointerTokens(ptr) {
+		switch cur := v.(type) {
+		case []any:
+			if i, err := strconv.Atoi(tok); err == nil && i >= 0 && i < len(cur) {
+				path, v = index(path, i), cur[i]
+				continue
+			}
+			v = nil
+		case map[string]any:
+			v = cur[tok]
+		default:
+			v = nil
+		}
+		path = child(path, tok)
+	}
+	return path, v
+}
+
+// pointerTokens splits a JSON pointer into its unescaped reference tokens.
+func pointerTokens(ptr string) []string {
+	if ptr == "" {
+		return nil
+	}
+	toks := strings.Split(strings.TrimPrefix(ptr, "/"), "/")
+	for i, tok := range toks {
+		toks[i] = strings.ReplaceAll(strings.ReplaceAll(tok, "~1", "/"), "~0", "~")
+	}
+	return toks
+}
+
+// normalize converts decoded values to the JSON data model: numbers become
+// float64 and maps map[string]any (keys that are not strings are printed).
+func normalize(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case []byte:
+		return string(v)
+	case []any:
+		for i := range v {
+			v[i] = normalize(v[i])
+		}
+		return v
+	case map[string]any:
+		for k, e := range v {
+			v[k] = normalize(e)
+		}
+		return v
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normalize(e)
+		}
+		return m
+	}
+	return v
+}
@@ -0,0 +1,141 @@
+package schema
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gogogo1024/novagate/codec"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// ProtoSchema checks payloads against a protobuf message descriptor: the
+// payload must decode as the message, proto2 required fields must be set,
+// and enum fields must hold values the enum declares, at any depth.
+//
+// Protobuf payloads ("" or "protobuf") are decoded from the binary format,
+// JSON payloads with the protobuf JSON mapping.
+type ProtoSchema struct {
+	md protoreflect.MessageDescriptor
+}
+
+// NewProtoSchema returns the schema of messages described by md.
+func NewProtoSchema(md protoreflect.MessageDescriptor) *ProtoSchema {
+	return &ProtoSchema{md: md}
+}
+
+// LoadProto returns the schema of the message named message (fully
+// qualified, such as "order.v1.CreateRequest") in the FileDescriptorSet at
+// path, as written by protoc --descriptor_set_out --include_imports.
+func LoadProto(path, message string) (*ProtoSchema, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(message))
+	if err != nil {
+		return nil, fmt.Errorf("%s: message %q: %w", path, message, err)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s: %q is not a message", path, message)
+	}
+	return NewProtoSchema(md), nil
+}
+
+// Validate implements Validator for protobuf and JSON payloads.
+func (s *ProtoSchema) Validate(contentType string, payload []byte) []Violation {
+	m := dynamicpb.NewMessage(s.md)
+	switch contentType {
+	case "", codec.ProtobufName:
+		if err := (proto.UnmarshalOptions{AllowPartial: true}).Unmarshal(payload, m); err != nil {
+			return []Violation{{Reason: "malformed protobuf: " + err.Error()}}
+		}
+	case codec.JSONName:
+		if err := (protojson.UnmarshalOptions{AllowPartial: true}).Unmarshal(payload, m); err != nil {
+			return []Violation{{Reason: "malformed json: " + err.Error()}}
+		}
+	default:
+		return []Violation{{Reason: fmt.Sprintf("content type %q cannot be checked against a protobuf descriptor", contentType)}}
+	}
+	var vs []Violation
+	validateProto(m, "", &vs)
+	return vs
+}
+
+func validateProto(m protoreflect.Message, path string, vs *[]Violation) {
+	fields := m.Descriptor().Fields()
+	for i := range fields.Len() {
+		fd := fields.Get(i)
+		name := child(path, string(fd.Name()))
+		if fd.Cardinality() == protoreflect.Required && !m.Has(fd) {
+			*vs = append(*vs, Violation{Field: name, Reason: "is required"})
+			continue
+		}
+		if !m.Has(fd) {
+			continue
+		}
+		v := m.Get(fd)
+		switch {
+		case fd.IsList():
+			list := v.List()
+			for j := range list.Len() {
+				validateProtoValue(fd, list.Get(j), index(name, j), vs)
+			}
+		case fd.IsMap():
+			v.Map().Range(func(k protoreflect.MapKey, e protoreflect.Value) bool {
+				validateProtoValue(fd.MapValue(), e, name+"["+k.String()+"]", vs)
+				return true
+			})
+		default:
+			validateProtoValue(fd, v, name, vs)
+		}
+	}
+
+	// Messages with closed (proto2) enums may keep undeclared values as
+	// unknown fields.
+	for b := m.GetUnknown(); len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return
+		}
+		value := b[:n]
+		b = b[n:]
+		if fd := fields.ByNumber(num); fd != nil && fd.Enum() != nil {
+			reason := fmt.Sprintf("is not a %s value", fd.Enum().FullName())
+			if x, n := protowire.ConsumeVarint(value); typ == protowire.VarintType && n > 0 {
+				reason = fmt.Sprintf("%d %s", int32(x), reason)
+			}
+			*vs = append(*vs, Violation{Field: child(path, string(fd.Name())), Reason: reason})
+		}
+	}
+}
+
+func validateProtoValue(fd protoreflect.FieldDescriptor, v protoreflect.Value, path string, vs *[]Violation) {
+	switch fd.Kind() {
+	case protoreflect.EnumKind:
+		if fd.Enum().Values().ByNumber(v.Enum()) == nil {
+			*vs = append(*vs, Violation{Field: path, Reason: fmt.Sprintf("%d is not a %s value", v.Enum(), fd.Enum().FullName())})
+		}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		validateProto(v.Message(), path, vs)
+	}
+}
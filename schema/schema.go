@@ -0,0 +1,58 @@
+// Package schema validates request payloads against declared contracts: a
+// JSON Schema (see CompileJSON) or a protobuf message descriptor (see
+// LoadProto). The gateway checks payloads with them before dispatch (see
+// novagate.ValidatePayloads) so that backends only see well-formed requests.
+package schema
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Validator checks a payload. contentType is the codec name the request
+// carries (see codec.MetadataKey); empty means the validator's own encoding.
+// A nil or empty result means the payload is valid.
+type Validator interface {
+	Validate(contentType string, payload []byte) []Violation
+}
+
+// Violation is one reason a payload is invalid.
+type Violation struct {
+	// Field is the path of the offending field, such as "items[2].sku";
+	// empty for the payload as a whole.
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// FormatViolations encodes violations as the message of an
+// INVALID_PAYLOAD error reply: {"violations":[{"field":...,"reason":...}]}.
+func FormatViolations(vs []Violation) string {
+	b, _ := json.Marshal(struct {
+		Violations []Violation `json:"violations"`
+	}{vs})
+	return string(b)
+}
+
+// ParseViolations decodes the message of an INVALID_PAYLOAD error reply.
+func ParseViolations(msg string) ([]Violation, error) {
+	var v struct {
+		Violations []Violation `json:"violations"`
+	}
+	if err := json.Unmarshal([]byte(msg), &v); err != nil {
+		return nil, err
+	}
+	return v.Violations, nil
+}
+
+// child returns the path of field name under path.
+func child(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// index returns the path of element i under path.
+func index(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
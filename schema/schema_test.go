@@ -0,0 +1,235 @@
+package schema
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gogogo1024/novagate/codec"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const orderSchema = `{
+  "type": "object",
+  "required": ["id", "items"],
+  "additionalProperties": false,
+  "properties": {
+    "id":     {"type": "string", "pattern": "^o-[0-9]+$"},
+    "status": {"enum": ["new", "paid"]},
+    "note":   {"type": ["string", "null"], "maxLength": 5},
+    "items": {
+      "type": "array", "minItems": 1, "maxItems": 3,
+      "items": {
+        "type": "object", "required": ["sku"],
+        "properties": {
+          "sku": {"type": "string", "minLength": 1},
+          "qty": {"type": "integer", "minimum": 1, "exclusiveMaximum": 100}
+        }
+      }
+    }
+  }
+}`
+
+func TestJSONSchema(t *testing.T) {
+	s, err := CompileJSON([]byte(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vs := s.Validate("", []byte(`{"id":"o-1","status":"paid","note":null,"items":[{"sku":"a","qty":2}]}`)); len(vs) != 0 {
+		t.Fatalf("valid order: %v", vs)
+	}
+	got := s.Validate(codec.JSONName, []byte(`{"id":"x","status":"lost","note":"too long","extra":1,"items":[{"qty":1.5},{"sku":"","qty":100}]}`))
+	want := []Violation{
+		{"id", "does not match pattern '^o-[0-9]+$'"},
+		{"status", `value must be one of "new", "paid"`},
+		{"note", "length must be <= 5, but got 8"},
+		{"extra", "is not allowed"},
+		{"items[0].sku", "is required"},
+		{"items[0].qty", "expected integer, but got number"},
+		{"items[1].sku", "length must be >= 1, but got 0"},
+		{"items[1].qty", "must be < 100 but found 100"},
+	}
+	if !sameViolations(got, want) {
+		t.Fatalf("violations:\n got %v\nwant %v", got, want)
+	}
+	if vs := s.Validate("", []byte(`[]`)); len(vs) != 1 || vs[0].Reason != "expected object, but got array" {
+		t.Fatalf("array payload: %v", vs)
+	}
+	if vs := s.Validate("", []byte(`{"id":`)); len(vs) != 1 || !strings.HasPrefix(vs[0].Reason, "malformed json") {
+		t.Fatalf("malformed payload: %v", vs)
+	}
+
+	// MessagePack payloads are checked against the same schema.
+	mp, _ := codec.MsgPack{}.Marshal(map[string]any{"id": "o-2", "items": []any{map[string]any{"sku": "b", "qty": 0}}})
+	if vs := s.Validate(codec.MsgPackName, mp); !sameViolations(vs, []Violation{{"items[0].qty", "must be >= 1 but found 0"}}) {
+		t.Fatalf("msgpack payload: %v", vs)
+	}
+	if vs := s.Validate(codec.ProtobufName, nil); len(vs) != 1 {
+		t.Fatalf("protobuf payload: %v", vs)
+	}
+
+	for _, doc := range []string{
+		`{"$ref": "#/$defs/x"}`,
+		`{"type": "text"}`,
+		`{"properties": {"a": {"anyOf": []}}}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+		`[]`,
+		`{"propertys": {"a": {}}}`,
+		`{"properties": {"a": {"minLenght": 1}}}`,
+		`{"items": [{"type": "string"}, {"maxlength": 1}]}`,
+		`{"$ref": "https://example.com/order.json"}`,
+	} {
+		if _, err := CompileJSON([]byte(doc)); err == nil {
+			t.Errorf("CompileJSON(%s) succeeded", doc)
+		}
+	}
+
+	// Formats are asserted, references resolve within the document and
+	// "x-" keywords are left alone.
+	s, err = CompileJSON([]byte(`{"x-owner": "orders", "$defs": {"mail": {"format": "email"}}, "properties": {"to": {"$ref": "#/$defs/mail"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vs := s.Validate("", []byte(`{"to":"ann"}`)); len(vs) != 1 || vs[0].Field != "to" {
+		t.Fatalf("format: %v", vs)
+	}
+}
+
+// orderDescriptor builds:
+//
+//	syntax = "proto2"; package test;
+//	enum Status { NEW = 1; PAID = 2; }
+//	message Item { required string sku = 1; optional Status status = 2; }
+//	message Order { required string id = 1; repeated Item items = 2; optional Status status = 3; }
+func orderDescriptor(t *testing.T) *descriptorpb.FileDescriptorProto {
+	t.Helper()
+	field := func(name string, num int32, label descriptorpb.FieldDescriptorProto_Label, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(num), Label: label.Enum(), Type: typ.Enum()}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	const (
+		required = descriptorpb.FieldDescriptorProto_LABEL_REQUIRED
+		optional = descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		repeated = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	)
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test/order.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto2"),
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Status"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("NEW"), Number: proto.Int32(1)},
+				{Name: proto.String("PAID"), Number: proto.Int32(2)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("Item"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("sku", 1, required, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("status", 2, optional, descriptorpb.FieldDescriptorProto_TYPE_ENUM, ".test.Status"),
+			}},
+			{Name: proto.String("Order"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("id", 1, required, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("items", 2, repeated, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Item"),
+				field("status", 3, optional, descriptorpb.FieldDescriptorProto_TYPE_ENUM, ".test.Status"),
+			}},
+		},
+	}
+}
+
+func TestProtoSchema(t *testing.T) {
+	fdp := orderDescriptor(t)
+	set, _ := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fdp}})
+	path := filepath.Join(t.TempDir(), "order.pb")
+	if err := os.WriteFile(path, set, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadProto(path, "test.Order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadProto(path, "test.Missing"); err == nil {
+		t.Fatal("LoadProto found a missing message")
+	}
+	fd, err := protodesc.NewFile(fdp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := fd.Messages().ByName("Order")
+	item := fd.Messages().ByName("Item")
+
+	m := dynamicpb.NewMessage(order)
+	m.Set(order.Fields().ByName("id"), protoreflect.ValueOfString("o-1"))
+	it := dynamicpb.NewMessage(item)
+	it.Set(item.Fields().ByName("sku"), protoreflect.ValueOfString("a"))
+	m.Mutable(order.Fields().ByName("items")).List().Append(protoreflect.ValueOfMessage(it))
+	valid, _ := proto.Marshal(m)
+	if vs := s.Validate("", valid); len(vs) != 0 {
+		t.Fatalf("valid order: %v", vs)
+	}
+
+	// An item without its sku, and status 7 on the order and on an item.
+	bad := protowire.AppendTag(nil, 2, protowire.BytesType)
+	bad = protowire.AppendBytes(bad, protowire.AppendVarint(protowire.AppendTag(nil, 2, protowire.VarintType), 7))
+	bad = protowire.AppendVarint(protowire.AppendTag(bad, 3, protowire.VarintType), 7)
+	got := s.Validate(codec.ProtobufName, bad)
+	want := []Violation{
+		{"id", "is required"},
+		{"items[0].sku", "is required"},
+		{"items[0].status", "7 is not a test.Status value"},
+		{"status", "7 is not a test.Status value"},
+	}
+	if !sameViolations(got, want) {
+		t.Fatalf("violations:\n got %v\nwant %v", got, want)
+	}
+
+	if vs := s.Validate(codec.JSONName, []byte(`{"id":"o-1","status":"PAID"}`)); len(vs) != 0 {
+		t.Fatalf("json order: %v", vs)
+	}
+	if vs := s.Validate(codec.JSONName, []byte(`{"id":"o-1","status":"LOST"}`)); len(vs) != 1 || !strings.HasPrefix(vs[0].Reason, "malformed json") {
+		t.Fatalf("json order with unknown enum name: %v", vs)
+	}
+	if vs := s.Validate("", []byte{0xff}); len(vs) != 1 || !strings.HasPrefix(vs[0].Reason, "malformed protobuf") {
+		t.Fatalf("malformed payload: %v", vs)
+	}
+}
+
+func TestViolationsMessage(t *testing.T) {
+	vs := []Violation{{"id", "is required"}, {"", "too large"}}
+	msg := FormatViolations(vs)
+	if msg != `{"violations":[{"field":"id","reason":"is required"},{"field":"","reason":"too large"}]}` {
+		t.Fatalf("FormatViolations = %s", msg)
+	}
+	got, err := ParseViolations(msg)
+	if err != nil || !reflect.DeepEqual(got, vs) {
+		t.Fatalf("ParseViolations = %v, %v", got, err)
+	}
+}
+
+func sameViolations(got, want []Violation) bool {
+	key := func(v Violation) string { return v.Field + "\x00" + v.Reason }
+	g := map[string]int{}
+	for _, v := range got {
+		g[key(v)]++
+	}
+	for _, v := range want {
+		g[key(v)]--
+	}
+	for _, n := range g {
+		if n != 0 {
+			return false
+		}
+	}
+	return len(got) == len(want)
+}
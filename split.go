@@ -0,0 +1,297 @@
+package novagate
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogogo1024/novagate/discovery"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// Stickiness selects what keeps a client on the same target of a split.
+type Stickiness string
+
+const (
+	// StickyNone picks a target per request.
+	StickyNone Stickiness = "none"
+	// StickyConnection keeps every request of a connection on one target.
+	StickyConnection Stickiness = "connection"
+	// StickyPrincipal keeps every request of a principal (see
+	// SplitConfig.Principal) on one target, across connections and
+	// gateway instances. Requests without a principal stick to their
+	// connection.
+	StickyPrincipal Stickiness = "principal"
+)
+
+// splitScale is the resolution of sticky positions.
+const splitScale = 10000
+
+// DefaultPrincipalKey is the Message.Metadata key naming the caller. Clients
+// set metadata freely: a principal read from it is a claim, not an identity.
+const DefaultPrincipalKey = "principal"
+
+// PrincipalFunc returns the authenticated caller of m, or "" if there is
+// none. Derive it from state the gateway has verified, such as the connection
+// (see ConnInfoFromContext), never from metadata alone.
+type PrincipalFunc func(ctx context.Context, m *protocol.Message) string
+
+// SplitTarget is one destination of a traffic split, e.g. "stable" or
+// "canary".
+type SplitTarget struct {
+	Name string
+	// Weight is the target's share of the requests no rule matched.
+	Weight  int
+	Handler Handler
+}
+
+// SplitRule sends matching requests to Target whatever the weights. A rule
+// matches when the request carries every Metadata entry and, if Principals
+// is set, comes from one of them.
+type SplitRule struct {
+	Metadata   map[string]string `yaml:"metadata"`
+	Principals []string          `yaml:"principals"`
+	Target     string            `yaml:"target"`
+}
+
+// SplitConfig configures a Splitter.
+type SplitConfig struct {
+	Targets []SplitTarget
+	// Rules are tried in order before the weights.
+	Rules  []SplitRule
+	Sticky Stickiness
+	// Principal returns the caller that Principals rules and StickyPrincipal
+	// go by. Without it the caller is the PrincipalKey metadata entry
+	// (default DefaultPrincipalKey), which clients set freely: any client
+	// can then claim a principal's target.
+	Principal    PrincipalFunc
+	PrincipalKey string
+}
+
+// splitStats publishes per-target counters under "splits" in the novagate
+// expvar map: splits["0x<cmd>"]["<target>"] = {requests, errors, latency_us}.
+var splitStats = func() *expvar.Map {
+	m := new(expvar.Map)
+	metrics.Set("splits", m)
+	return m
+}()
+
+// Splitter spreads the requests of one command over several targets by
+// weight, with match rules and stickiness; weights can change at runtime.
+// Register it with Router.Split.
+type Splitter struct {
+	cmd          uint16
+	targets      []splitTarget
+	rules        []splitRule
+	sticky       Stickiness
+	principal    PrincipalFunc
+	principalKey string
+	weights      atomic.Pointer[[]int]
+}
+
+type splitTarget struct {
+	name      string
+	handler   Handler
+	requests  *expvar.Int
+	errors    *expvar.Int
+	latencyUS *expvar.Int
+}
+
+type splitRule struct {
+	SplitRule
+	target int
+}
+
+// NewSplitter validates cfg and returns the splitter for cmd. Its counters
+// are published as novagate.splits["0x<cmd>"].
+func NewSplitter(cmd uint16, cfg SplitConfig) (*Splitter, error) {
+	if len(cfg.Targets) == 0 {
+		return nil, fmt.Errorf("command 0x%04X: split without targets", cmd)
+	}
+	switch cfg.Sticky {
+	case "":
+		cfg.Sticky = StickyNone
+	case StickyNone, StickyConnection, StickyPrincipal:
+	default:
+		return nil, fmt.Errorf("command 0x%04X: unknown stickiness %q", cmd, cfg.Sticky)
+	}
+	if cfg.PrincipalKey == "" {
+		cfg.PrincipalKey = DefaultPrincipalKey
+	}
+
+	s := &Splitter{cmd: cmd, sticky: cfg.Sticky, principal: cfg.Principal, principalKey: cfg.PrincipalKey}
+	stats := new(expvar.Map)
+	weights := make([]int, len(cfg.Targets))
+	for i, t := range cfg.Targets {
+		if t.Name == "" || t.Handler == nil {
+			return nil, fmt.Errorf("command 0x%04X: split target %d needs a name and a handler", cmd, i)
+		}
+		if s.index(t.Name) >= 0 {
+			return nil, fmt.Errorf("command 0x%04X: duplicate split target %q", cmd, t.Name)
+		}
+		st := splitTarget{name: t.Name, handler: t.Handler, requests: new(expvar.Int), errors: new(expvar.Int), latencyUS: new(expvar.Int)}
+		m := new(expvar.Map)
+		m.Set("requests", st.requests)
+		m.Set("errors", st.errors)
+		m.Set("latency_us", st.latencyUS)
+		stats.Set(t.Name, m)
+		s.targets = append(s.targets, st)
+		weights[i] = t.Weight
+	}
+	if err := checkWeights(weights); err != nil {
+		return nil, fmt.Errorf("command 0x%04X: %w", cmd, err)
+	}
+	for _, r := range cfg.Rules {
+		if len(r.Metadata) == 0 && len(r.Principals) == 0 {
+			return nil, fmt.Errorf("command 0x%04X: split rule for %q matches nothing specific", cmd, r.Target)
+		}
+		i := s.index(r.Target)
+		if i < 0 {
+			return nil, fmt.Errorf("command 0x%04X: split rule names unknown target %q", cmd, r.Target)
+		}
+		s.rules = append(s.rules, splitRule{SplitRule: r, target: i})
+	}
+	s.weights.Store(&weights)
+	splitStats.Set(fmt.Sprintf("0x%04X", cmd), stats)
+	return s, nil
+}
+
+func checkWeights(weights []int) error {
+	total := 0
+	for _, w := range weights {
+		if w < 0 {
+			return errors.New("negative split weight")
+		}
+		total += w
+	}
+	if total == 0 {
+		return errors.New("split weights sum to zero")
+	}
+	return nil
+}
+
+func (s *Splitter) index(name string) int {
+	for i, t := range s.targets {
+		if t.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Command returns the command the splitter serves.
+func (s *Splitter) Command() uint16 { return s.cmd }
+
+// Weights returns the current weight of every target.
+func (s *Splitter) Weights() map[string]int {
+	weights := *s.weights.Load()
+	out := make(map[string]int, len(weights))
+	for i, t := range s.targets {
+		out[t.name] = weights[i]
+	}
+	return out
+}
+
+// SetWeights changes the weights of the named targets; the others keep
+// theirs. A sticky client keeps its position on a fixed scale, so moving
+// share between two adjacent targets only moves clients between those two.
+func (s *Splitter) SetWeights(w map[string]int) error {
+	weights := append([]int(nil), *s.weights.Load()...)
+	for name, weight := range w {
+		i := s.index(name)
+		if i < 0 {
+			return fmt.Errorf("unknown split target %q", name)
+		}
+		weights[i] = weight
+	}
+	if err := checkWeights(weights); err != nil {
+		return err
+	}
+	s.weights.Store(&weights)
+	return nil
+}
+
+// Handler returns the handler dispatching to the targets.
+func (s *Splitter) Handler() Handler {
+	return func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		t := &s.targets[s.pick(ctx, m)]
+		start := time.Now()
+		resp, err := t.handler(ctx, m)
+		t.requests.Add(1)
+		t.latencyUS.Add(time.Since(start).Microseconds())
+		if err != nil {
+			t.errors.Add(1)
+		}
+		return resp, err
+	}
+}
+
+func (s *Splitter) pick(ctx context.Context, m *protocol.Message) int {
+	principal := s.principalOf(ctx, m)
+	for _, r := range s.rules {
+		if r.matches(m, principal) {
+			return r.target
+		}
+	}
+
+	weights := *s.weights.Load()
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	var n int
+	if key, ok := s.stickyKey(ctx, principal); ok {
+		n = int(discovery.HashKey([]byte(key))%splitScale) * total / splitScale
+	} else {
+		n = rand.N(total)
+	}
+	for i, w := range weights {
+		if n < w {
+			return i
+		}
+		n -= w
+	}
+	return len(weights) - 1
+}
+
+func (s *Splitter) principalOf(ctx context.Context, m *protocol.Message) string {
+	if s.principal != nil {
+		return s.principal(ctx, m)
+	}
+	return m.Metadata[s.principalKey]
+}
+
+func (s *Splitter) stickyKey(ctx context.Context, principal string) (string, bool) {
+	if s.sticky == StickyNone {
+		return "", false
+	}
+	if s.sticky == StickyPrincipal && principal != "" {
+		return "p:" + principal, true
+	}
+	if info, ok := ConnInfoFromContext(ctx); ok {
+		return "c:" + strconv.FormatUint(info.ID, 10), true
+	}
+	return "", false
+}
+
+func (r *splitRule) matches(m *protocol.Message, principal string) bool {
+	for k, v := range r.Metadata {
+		if got, ok := m.Metadata[k]; !ok || got != v {
+			return false
+		}
+	}
+	if len(r.Principals) == 0 {
+		return true
+	}
+	for _, p := range r.Principals {
+		if p == principal {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+package novagate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+const cmdSplitTest uint16 = 0x0E01
+
+func namedTarget(name string, weight int) SplitTarget {
+	return SplitTarget{Name: name, Weight: weight, Handler: func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		return &protocol.Message{Command: m.Command, Payload: []byte(name)}, nil
+	}}
+}
+
+func splitCall(t *testing.T, h Handler, ctx context.Context, md map[string]string) string {
+	t.Helper()
+	resp, err := h(ctx, &protocol.Message{Command: cmdSplitTest, Metadata: md})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(resp.Payload)
+}
+
+func TestSplitterWeightsAndRules(t *testing.T) {
+	s, err := NewSplitter(cmdSplitTest, SplitConfig{
+		Targets: []SplitTarget{namedTarget("stable", 100), namedTarget("canary", 0)},
+		Rules: []SplitRule{
+			{Metadata: map[string]string{"x-canary": "1"}, Target: "canary"},
+			{Principals: []string{"alice"}, Target: "canary"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.Handler()
+	ctx := context.Background()
+	for range 20 {
+		if got := splitCall(t, h, ctx, nil); got != "stable" {
+			t.Fatalf("weight 100/0 picked %s", got)
+		}
+	}
+	if got := splitCall(t, h, ctx, map[string]string{"x-canary": "1"}); got != "canary" {
+		t.Fatalf("metadata rule picked %s", got)
+	}
+	if got := splitCall(t, h, ctx, map[string]string{"principal": "alice"}); got != "canary" {
+		t.Fatalf("principal rule picked %s", got)
+	}
+	if got := splitCall(t, h, ctx, map[string]string{"principal": "bob"}); got != "stable" {
+		t.Fatalf("unmatched principal picked %s", got)
+	}
+
+	if err := s.SetWeights(map[string]int{"stable": 0, "canary": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := splitCall(t, h, ctx, nil); got != "canary" {
+		t.Fatalf("after SetWeights picked %s", got)
+	}
+	if err := s.SetWeights(map[string]int{"canary": 0}); err == nil {
+		t.Fatal("all-zero weights accepted")
+	}
+	if err := s.SetWeights(map[string]int{"blue": 1}); err == nil {
+		t.Fatal("unknown target accepted")
+	}
+
+	stats := splitStats.Get(fmt.Sprintf("0x%04X", cmdSplitTest)).String()
+	if !strings.Contains(stats, `"requests": 3`) || !strings.Contains(stats, `"canary"`) {
+		t.Fatalf("split stats = %s", stats)
+	}
+
+	for _, cfg := range []SplitConfig{
+		{},
+		{Targets: []SplitTarget{namedTarget("a", 1), namedTarget("a", 1)}},
+		{Targets: []SplitTarget{namedTarget("a", 1)}, Rules: []SplitRule{{Target: "a"}}},
+		{Targets: []SplitTarget{namedTarget("a", 1)}, Sticky: "session"},
+	} {
+		if _, err := NewSplitter(cmdSplitTest, cfg); err == nil {
+			t.Errorf("invalid config accepted: %+v", cfg)
+		}
+	}
+}
+
+func TestSplitterAuthenticatedPrincipal(t *testing.T) {
+	s, err := NewSplitter(cmdSplitTest, SplitSpec{
+		Rules: []SplitRule{{Principals: []string{"alice"}, Target: "canary"}},
+	}.SplitConfig([]SplitTarget{namedTarget("stable", 1), namedTarget("canary", 0)}, testPrincipal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.Handler()
+	as := func(p string) context.Context { return context.WithValue(context.Background(), testPrincipalKey{}, p) }
+	if got := splitCall(t, h, as("alice"), nil); got != "canary" {
+		t.Fatalf("alice picked %s", got)
+	}
+	// Claiming alice in metadata does not reach her target.
+	if got := splitCall(t, h, as("mallory"), map[string]string{"principal": "alice"}); got != "stable" {
+		t.Fatalf("mallory claiming alice picked %s", got)
+	}
+}
+
+func TestSplitterStickiness(t *testing.T) {
+	s, err := NewSplitter(cmdSplitTest, SplitConfig{
+		Targets:      []SplitTarget{namedTarget("stable", 90), namedTarget("canary", 10)},
+		Sticky:       StickyPrincipal,
+		PrincipalKey: "user",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.Handler()
+
+	const users = 2000
+	before := make([]string, users)
+	canary := 0
+	for i := range users {
+		md := map[string]string{"user": fmt.Sprintf("user-%d", i)}
+		// Different connections, same principal.
+		before[i] = splitCall(t, h, withConnInfo(context.Background(), &ConnInfo{ID: uint64(i)}), md)
+		if again := splitCall(t, h, withConnInfo(context.Background(), &ConnInfo{ID: uint64(users + i)}), md); again != before[i] {
+			t.Fatalf("user %d flipped from %s to %s", i, before[i], again)
+		}
+		if before[i] == "canary" {
+			canary++
+		}
+	}
+	if canary < users/20 || canary > users/5 {
+		t.Fatalf("canary got %d of %d users at weight 10%%", canary, users)
+	}
+
+	// Growing the canary only moves stable users onto it.
+	if err := s.SetWeights(map[string]int{"stable": 80, "canary": 20}); err != nil {
+		t.Fatal(err)
+	}
+	for i := range users {
+		got := splitCall(t, h, context.Background(), map[string]string{"user": fmt.Sprintf("user-%d", i)})
+		if before[i] == "canary" && got != "canary" {
+			t.Fatalf("canary user %d moved to %s", i, got)
+		}
+	}
+
+	// Without a principal the connection decides.
+	conn := withConnInfo(context.Background(), &ConnInfo{ID: 42})
+	first := splitCall(t, h, conn, nil)
+	for range 20 {
+		if got := splitCall(t, h, conn, nil); got != first {
+			t.Fatalf("connection flipped from %s to %s", first, got)
+		}
+	}
+}
+
+func TestAdminAPISplitWeights(t *testing.T) {
+	r := NewRouter()
+	s, err := NewSplitter(cmdSplitTest, SplitConfig{
+		Targets: []SplitTarget{namedTarget("stable", 100), namedTarget("canary", 0)},
+		Sticky:  StickyConnection,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Split(s, RouteConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewAdminHandler(r))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/admin/splits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states []SplitState
+	if err := json.NewDecoder(res.Body).Decode(&states); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if len(states) != 1 || states[0].Command != cmdSplitTest || states[0].Sticky != StickyConnection || states[0].Weights["stable"] != 100 {
+		t.Fatalf("GET /admin/splits = %+v", states)
+	}
+
+	put := func(path, body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if code := put(fmt.Sprintf("/admin/splits/0x%04X", cmdSplitTest), `{"stable": 50, "canary": 50}`); code != http.StatusOK {
+		t.Fatalf("PUT weights = %d", code)
+	}
+	if w := s.Weights(); w["stable"] != 50 || w["canary"] != 50 {
+		t.Fatalf("weights after PUT = %v", w)
+	}
+	if code := put("/admin/splits/0x0001", `{"stable": 1}`); code != http.StatusNotFound {
+		t.Fatalf("PUT unknown split = %d, want 404", code)
+	}
+	if code := put(fmt.Sprintf("/admin/splits/%d", cmdSplitTest), `{"blue": 1}`); code != http.StatusBadRequest {
+		t.Fatalf("PUT unknown target = %d, want 400", code)
+	}
+
+	if _, err := r.Dispatch(context.Background(), &protocol.Message{Command: cmdSplitTest}); err != nil {
+		t.Fatal(err)
+	}
+	r.Register(cmdSplitTest, namedTarget("plain", 1).Handler)
+	if n := len(r.Splitters()); n != 0 {
+		t.Fatalf("Register kept %d splitters", n)
+	}
+}
+
+func TestValidateCommandSpecsSplit(t *testing.T) {
+	specs := []CommandSpec{{
+		ID:     cmdSplitTest,
+		Method: "OrderService.Create",
+		Split: &SplitSpec{
+			Sticky: "session",
+			Targets: []SplitTargetSpec{
+				{Name: "stable", Weight: 90},
+				{Name: "stable", Weight: 10, Backend: "upstream", Service: "OrderServiceV2"},
+				{Name: "v3", Weight: -1, Service: "OrderServiceV3"},
+			},
+			Rules: []SplitRule{{Target: "blue"}},
+		},
+	}}
+	err := ValidateCommandSpecs(specs)
+	if err == nil {
+		t.Fatal("invalid split accepted")
+	}
+	for _, want := range []string{
+		`unknown stickiness "session"`,
+		`duplicate target "stable"`,
+		"service is only used by upstream backends",
+		"negative split weight",
+		`unknown target "blue"`,
+		"needs metadata or principals",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+
+	spec := CommandSpec{ID: cmdSplitTest, Method: "OrderService.Create", Backend: BackendUpstream, Split: &SplitSpec{
+		Targets: []SplitTargetSpec{{Name: "stable", Weight: 9}, {Name: "canary", Weight: 1, Service: "OrderServiceV2"}, {Name: "local", Backend: BackendLocal}},
+	}}
+	targets := spec.Targets()
+	if targets[0].Service != "OrderService" || targets[1].Service != "OrderServiceV2" || targets[2].Service != "" || targets[2].Backend != BackendLocal {
+		t.Fatalf("Targets = %+v", targets)
+	}
+}
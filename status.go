@@ -0,0 +1,54 @@
+package novagate
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// StatusError is a handler error the client is told about. Instead of closing
+// the connection, the server answers the request with a protocol.CmdError
+// message carrying Code and Message (nothing is sent for one-way requests).
+// Any other handler error still closes the connection.
+type StatusError struct {
+	Code    uint16
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+// ErrOverloaded is returned for requests shed by an AdaptiveLimiter.
+var ErrOverloaded = &StatusError{Code: protocol.StatusOverloaded, Message: "overloaded"}
+
+// errorReply turns a StatusError from the handler chain into the reply for m.
+func errorReply(m *protocol.Message, err error) (*protocol.Message, bool) {
+	var se *StatusError
+	if !errors.As(err, &se) {
+		return nil, false
+	}
+	return &protocol.Message{
+		Command:   protocol.CmdError,
+		RequestID: m.RequestID,
+		Payload:   protocol.EncodeErrorReply(se.Code, se.Message),
+	}, true
+}
+
+// httpStatus maps a StatusError code to the HTTP bridge response status.
+func httpStatus(code uint16) int {
+	switch code {
+	case protocol.StatusOverloaded, protocol.StatusUnavailable:
+		return http.StatusServiceUnavailable
+	case protocol.StatusRateLimited:
+		return http.StatusTooManyRequests
+	case protocol.StatusTimeout:
+		return http.StatusGatewayTimeout
+	case protocol.StatusRejected, protocol.StatusBadPayload:
+		return http.StatusBadRequest
+	case protocol.StatusInvalidPayload:
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadGateway
+}
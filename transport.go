@@ -0,0 +1,127 @@
+package novagate
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/gogogo1024/novagate/internal/transport"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// Transport names accepted by WithTransport.
+const (
+	// TransportNet runs one goroutine and read buffer per connection (default).
+	TransportNet = "net"
+	// TransportNetpoll serves TCP and Unix listeners on cloudwego/netpoll
+	// event loops, so idle connections cost no goroutine or buffer.
+	TransportNetpoll = "netpoll"
+)
+
+// WithTransport selects how connections are driven; see TransportNet and
+// TransportNetpoll. Listeners the chosen transport cannot serve (for example
+// WebSocket listeners under netpoll) fall back to TransportNet.
+func WithTransport(name string) ServeOption {
+	return func(o *serveOptions) {
+		o.transport = name
+	}
+}
+
+func validTransport(name string) error {
+	switch name {
+	case "", TransportNet, TransportNetpoll:
+		return nil
+	default:
+		return fmt.Errorf("novagate: unknown transport %q", name)
+	}
+}
+
+func transportFor(ln net.Listener, so serveOptions) transport.Transport {
+	if so.transport == TransportNetpoll && transport.NetpollSupported(ln) {
+		return transport.Netpoll{IdleTimeout: so.idleTimeout, ReadTimeout: so.idleTimeout}
+	}
+	return netTransport{}
+}
+
+// netTransport is the goroutine-per-connection accept loop.
+type netTransport struct{}
+
+func (netTransport) Serve(ctx context.Context, ln net.Listener, h transport.Handler) error {
+	closeOnDone(ctx.Done(), ln)
+	return acceptLoop(ctx, ln, h)
+}
+
+// connServer adapts the frame pipeline to transport.Handler.
+type connServer struct {
+	router *Router
+	so     serveOptions
+}
+
+func (s *connServer) ServeConn(ctx context.Context, c net.Conn) {
+	release, ok := admitConn(c, s.so)
+	if !ok {
+		return
+	}
+	defer release()
+	serveConn(ctx, c, s.router, s.so)
+}
+
+func (s *connServer) NewSession(ctx context.Context, c net.Conn) transport.Session {
+	release, ok := admitConn(c, s.so)
+	if !ok {
+		return rejectedSession{}
+	}
+	info := newConnInfo(c)
+	return &frameSession{
+		ctx:     withConnInfo(ctx, info),
+		router:  s.router,
+		state:   newConnHandlerState(c, info, s.so),
+		release: release,
+	}
+}
+
+// frameSession serves frames delivered by an event-driven transport. Reads
+// are buffered by the transport, so state.rb stays unused.
+type frameSession struct {
+	ctx     context.Context
+	router  *Router
+	state   *connHandlerState
+	release func()
+}
+
+func (s *frameSession) HandleFrame(data []byte) error {
+	frame, _, err := protocol.Decode(data)
+	if err != nil {
+		err = frameError(err)
+	} else if frame == nil {
+		err = fmt.Errorf("novagate: incomplete frame of %d bytes", len(data))
+	}
+	if err == nil {
+		err = handleFrame(s.ctx, s.state, s.router, frame)
+	}
+	if err != nil && !isBenignConnError(err) {
+		log.Printf("conn error: %v", err)
+	}
+	return err
+}
+
+func (s *frameSession) Flush() error {
+	return s.state.out.flush()
+}
+
+func (s *frameSession) Close() {
+	s.state.release()
+	s.release()
+}
+
+// rejectedSession stands in for a connection admission already closed.
+type rejectedSession struct{}
+
+func (rejectedSession) HandleFrame([]byte) error {
+	return net.ErrClosed
+}
+
+func (rejectedSession) Flush() error { return nil }
+
+func (rejectedSession) Close() {}
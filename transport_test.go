@@ -0,0 +1,154 @@
+package novagate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+func TestNetpollTransportServesTCPAndUnix(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp: %v", err)
+	}
+	sock := filepath.Join(t.TempDir(), "novagate.sock")
+	unixLn, err := ListenURL("unix://" + sock)
+	if err != nil {
+		t.Fatalf("listen unix: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeListeners(ctx, []net.Listener{tcpLn, unixLn}, echoSetup, WithTransport(TransportNetpoll))
+	}()
+
+	for _, target := range []struct{ network, addr string }{
+		{"tcp", tcpLn.Addr().String()},
+		{"unix", sock},
+	} {
+		c, err := net.Dial(target.network, target.addr)
+		if err != nil {
+			t.Fatalf("dial %s: %v", target.network, err)
+		}
+		for id := uint64(1); id <= 3; id++ {
+			resp := pingRoundTrip(t, c, id, []byte(target.network))
+			if resp.RequestID != id || !bytes.Equal(resp.Payload, []byte(target.network)) {
+				t.Fatalf("%s: unexpected response %+v", target.network, resp)
+			}
+		}
+		c.Close()
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ServeListeners: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeListeners did not return after cancel")
+	}
+}
+
+func TestNetpollTransportSplitAndCompressedFrames(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = ServeWithContext(ctx, ln, echoSetup, WithTransport(TransportNetpoll)) }()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+
+	payload := bytes.Repeat([]byte("netpoll"), 4096)
+	wire, err := protocol.EncodeMessageFrameTo(nil, protocol.FlagCompressed, &protocol.Message{Command: protocol.CmdPing, RequestID: 9, Payload: payload})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	for _, part := range [][]byte{wire[:3], wire[3:20], wire[20:]} {
+		if _, err := c.Write(part); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var buf []byte
+	tmp := make([]byte, 4096)
+	for {
+		n, err := c.Read(tmp)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		buf = append(buf, tmp[:n]...)
+		frame, _, err := protocol.Decode(buf)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if frame == nil {
+			continue
+		}
+		if frame.Flags&protocol.FlagCompressed == 0 {
+			t.Fatalf("response not compressed: flags=%d", frame.Flags)
+		}
+		body, err := protocol.DecodeFrameBody(frame)
+		if err != nil {
+			t.Fatalf("DecodeFrameBody: %v", err)
+		}
+		resp, err := protocol.DecodeMessage(body)
+		if err != nil {
+			t.Fatalf("DecodeMessage: %v", err)
+		}
+		if resp.RequestID != 9 || !bytes.Equal(resp.Payload, payload) {
+			t.Fatalf("unexpected response req=%d len=%d", resp.RequestID, len(resp.Payload))
+		}
+		return
+	}
+}
+
+func TestNetpollTransportIdleTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = ServeWithContext(ctx, ln, echoSetup, WithTransport(TransportNetpoll), WithIdleTimeout(100*time.Millisecond))
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF after idle timeout, got %v", err)
+	}
+}
+
+func TestServeRejectsUnknownTransport(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	if err := ServeWithOptions(ln, echoSetup, WithTransport("epoll")); err == nil {
+		t.Fatal("expected error for unknown transport")
+	}
+}
@@ -0,0 +1,109 @@
+package novagate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/gogogo1024/novagate/codec"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// TypedOption configures a typed handler (see Typed).
+type TypedOption func(*typedConfig)
+
+type typedConfig struct {
+	// contentTypes lists the accepted codecs, the default first; empty
+	// accepts every registered codec with JSON as the default.
+	contentTypes []string
+}
+
+// WithContentTypes restricts a typed handler to the named codecs. The first
+// is the default, used for requests that do not name one.
+func WithContentTypes(names ...string) TypedOption {
+	return func(c *typedConfig) {
+		c.contentTypes = names
+	}
+}
+
+// Typed adapts fn to a Handler: the request payload is decoded into a new
+// Req with the codec named by its content type (see codec.MetadataKey), and
+// the Resp returned is encoded with the same codec, which the response names
+// in its metadata. A nil Resp means no response.
+//
+// Payloads that cannot be decoded, and content types the handler does not
+// accept, are answered with a protocol.StatusBadPayload error reply. For
+// protobuf, *Req and *Resp must be generated messages.
+func Typed[Req, Resp any](fn func(context.Context, *Req) (*Resp, error), opts ...TypedOption) (Handler, error) {
+	var cfg typedConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := checkContentTypes(cfg.contentTypes); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		c, err := payloadCodec(m, cfg.contentTypes)
+		if err != nil {
+			return nil, err
+		}
+		req := new(Req)
+		if err := c.Unmarshal(m.Payload, req); err != nil {
+			metricBadPayloads.Add(1)
+			return nil, &StatusError{Code: protocol.StatusBadPayload, Message: fmt.Sprintf("malformed %s payload: %v", c.Name(), err)}
+		}
+		resp, err := fn(ctx, req)
+		if err != nil || resp == nil {
+			return nil, err
+		}
+		payload, err := c.Marshal(resp)
+		if err != nil {
+			return nil, fmt.Errorf("command 0x%04X: encode %s response: %w", m.Command, c.Name(), err)
+		}
+		return &protocol.Message{
+			Command:   m.Command,
+			RequestID: m.RequestID,
+			Payload:   payload,
+			Metadata:  map[string]string{codec.MetadataKey: c.Name()},
+		}, nil
+	}, nil
+}
+
+// RegisterTyped registers Typed(fn, opts...) for cmd.
+func RegisterTyped[Req, Resp any](r *Router, cmd uint16, fn func(context.Context, *Req) (*Resp, error), opts ...TypedOption) error {
+	h, err := Typed(fn, opts...)
+	if err != nil {
+		return fmt.Errorf("command 0x%04X: %w", cmd, err)
+	}
+	r.Register(cmd, h)
+	return nil
+}
+
+// payloadCodec returns the codec of m's payload: the one its metadata names,
+// else the first of accept (JSON if accept is empty). A codec that is not
+// registered or not in accept is a StatusBadPayload error.
+func payloadCodec(m *protocol.Message, accept []string) (codec.Codec, error) {
+	name := m.Metadata[codec.MetadataKey]
+	if name == "" {
+		name = codec.JSONName
+		if len(accept) > 0 {
+			name = accept[0]
+		}
+	}
+	c, ok := codec.Lookup(name)
+	if !ok || (len(accept) > 0 && !slices.Contains(accept, name)) {
+		metricBadPayloads.Add(1)
+		return nil, &StatusError{Code: protocol.StatusBadPayload, Message: fmt.Sprintf("unsupported content type %q", name)}
+	}
+	return c, nil
+}
+
+// checkContentTypes reports names that are not registered codecs.
+func checkContentTypes(names []string) error {
+	for _, name := range names {
+		if _, ok := codec.Lookup(name); !ok {
+			return fmt.Errorf("unknown content type %q (registered: %v)", name, codec.Names())
+		}
+	}
+	return nil
+}
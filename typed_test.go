@@ -0,0 +1,142 @@
+package novagate
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/codec"
+	"github.com/gogogo1024/novagate/protocol"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type loginReq struct {
+	User string `json:"user" msgpack:"user"`
+}
+
+type loginResp struct {
+	Token string `json:"token" msgpack:"token"`
+}
+
+func login(ctx context.Context, req *loginReq) (*loginResp, error) {
+	if req.User == "" {
+		return nil, &StatusError{Code: protocol.StatusRejected, Message: "user required"}
+	}
+	return &loginResp{Token: "t-" + req.User}, nil
+}
+
+func TestTypedHandlerCodecs(t *testing.T) {
+	r := NewRouter()
+	if err := RegisterTyped(r, protocol.CmdUserLogin, login); err != nil {
+		t.Fatal(err)
+	}
+	call := func(contentType string, payload []byte) (*protocol.Message, error) {
+		m := &protocol.Message{Command: protocol.CmdUserLogin, RequestID: 3, Payload: payload}
+		if contentType != "" {
+			m.Metadata = map[string]string{codec.MetadataKey: contentType}
+		}
+		return r.Dispatch(context.Background(), m)
+	}
+
+	resp, err := call("", []byte(`{"user":"alice"}`))
+	if err != nil || string(resp.Payload) != `{"token":"t-alice"}` || resp.Metadata[codec.MetadataKey] != "json" || resp.RequestID != 3 {
+		t.Fatalf("json call = %+v, %v", resp, err)
+	}
+
+	mp, _ := codec.MsgPack{}.Marshal(loginReq{User: "bob"})
+	resp, err = call("msgpack", mp)
+	if err != nil || resp.Metadata[codec.MetadataKey] != "msgpack" {
+		t.Fatalf("msgpack call = %+v, %v", resp, err)
+	}
+	var out loginResp
+	if err := (codec.MsgPack{}).Unmarshal(resp.Payload, &out); err != nil || out.Token != "t-bob" {
+		t.Fatalf("msgpack response %x: %+v, %v", resp.Payload, out, err)
+	}
+
+	// Handler errors pass through; decoding problems are BAD_PAYLOAD.
+	var se *StatusError
+	if _, err := call("json", []byte(`{}`)); !errors.As(err, &se) || se.Code != protocol.StatusRejected {
+		t.Fatalf("handler error: %v", err)
+	}
+	bad := metricBadPayloads.Value()
+	for _, tc := range []struct{ contentType, payload string }{
+		{"json", `{"user":`},
+		{"msgpack", "\xc1"},
+		{"xml", "<user/>"},
+	} {
+		if _, err := call(tc.contentType, []byte(tc.payload)); !errors.As(err, &se) || se.Code != protocol.StatusBadPayload {
+			t.Errorf("%s payload %q: %v, want BAD_PAYLOAD", tc.contentType, tc.payload, err)
+		}
+	}
+	if got := metricBadPayloads.Value() - bad; got != 3 {
+		t.Fatalf("bad_payloads delta = %d, want 3", got)
+	}
+	// Protobuf needs generated messages: here the request type is not one.
+	if _, err := call("protobuf", nil); !errors.As(err, &se) || se.Code != protocol.StatusBadPayload {
+		t.Fatalf("protobuf into a plain struct: %v", err)
+	}
+
+	if err := RegisterTyped(r, protocol.CmdUserLogin, login, WithContentTypes("json", "yaml")); err == nil {
+		t.Fatal("unknown content type accepted")
+	}
+}
+
+func TestTypedProtobufOverTCP(t *testing.T) {
+	echo := func(ctx context.Context, s *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+		return wrapperspb.String("echo " + s.GetValue()), nil
+	}
+	setup := func(r *Router) error {
+		h, err := Typed(echo, WithContentTypes(codec.ProtobufName))
+		if err != nil {
+			return err
+		}
+		return r.Route(protocol.CmdPing, h, RouteConfig{})
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = ServeWithContext(ctx, ln, setup) }()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fr := &frameReader{c: c}
+
+	// A v1 frame carries no content type: the handler's default applies.
+	payload, _ := codec.Protobuf{}.Marshal(wrapperspb.String("v1"))
+	writeFrame(t, c, 0, &protocol.Message{Command: protocol.CmdPing, RequestID: 1, Payload: payload})
+	_, resp, err := fr.next(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s wrapperspb.StringValue
+	if err := (codec.Protobuf{}).Unmarshal(resp.Payload, &s); err != nil || s.GetValue() != "echo v1" {
+		t.Fatalf("v1 response %+v: %q, %v", resp, s.GetValue(), err)
+	}
+
+	// A v2 request naming a content type the command refuses.
+	wire, err := protocol.AppendFrame(nil, protocol.FrameVersion2, 0, &protocol.Message{
+		Command: protocol.CmdPing, RequestID: 2, Payload: []byte(`"v2"`),
+		Metadata: map[string]string{codec.MetadataKey: codec.JSONName},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(wire); err != nil {
+		t.Fatal(err)
+	}
+	_, resp, err = fr.next(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, msg, err := protocol.DecodeErrorReply(resp.Payload)
+	if resp.Command != protocol.CmdError || resp.RequestID != 2 || err != nil || code != protocol.StatusBadPayload {
+		t.Fatalf("json to a protobuf command = %+v (%d %q)", resp, code, msg)
+	}
+}
@@ -0,0 +1,342 @@
+package novagate
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gogogo1024/novagate/discovery"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// DefaultUpstreamDialTimeout bounds connecting to an upstream endpoint.
+const DefaultUpstreamDialTimeout = 3 * time.Second
+
+// UpstreamWriteTimeout bounds writing one request to an upstream connection
+// when the call's context has no earlier deadline.
+const UpstreamWriteTimeout = 5 * time.Second
+
+// errUpstreamClosed is returned for calls on a closed Upstream.
+var errUpstreamClosed = errors.New("upstream closed")
+
+// Upstream forwards requests to backends that speak the novagate protocol.
+// Each call picks an endpoint from a discovery.Balancer. Connections are
+// dialed on first use, shared by concurrent calls (responses are matched by
+// RequestID) and redialed after a failure.
+type Upstream struct {
+	balancer    *discovery.Balancer
+	dialTimeout time.Duration
+	dialer      func(ctx context.Context, addr string) (net.Conn, error)
+
+	mu     sync.Mutex
+	conns  map[string]*upstreamConn
+	dials  map[string]*upstreamDial
+	closed bool
+}
+
+// upstreamDial is a connection attempt shared by the calls waiting for it.
+type upstreamDial struct {
+	done chan struct{}
+	c    *upstreamConn
+	err  error
+}
+
+// NewUpstream returns an Upstream over b; dialTimeout <= 0 means
+// DefaultUpstreamDialTimeout.
+func NewUpstream(b *discovery.Balancer, dialTimeout time.Duration) *Upstream {
+	if dialTimeout <= 0 {
+		dialTimeout = DefaultUpstreamDialTimeout
+	}
+	u := &Upstream{
+		balancer:    b,
+		dialTimeout: dialTimeout,
+		conns:       make(map[string]*upstreamConn),
+		dials:       make(map[string]*upstreamDial),
+	}
+	d := net.Dialer{Timeout: dialTimeout}
+	u.dialer = func(ctx context.Context, addr string) (net.Conn, error) {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	return u
+}
+
+// Backend returns the BackendFunc forwarding cmd. Error replies from the
+// backend come back as *StatusError, so the client sees the backend's code.
+func (u *Upstream) Backend(cmd uint16) BackendFunc {
+	return func(ctx context.Context, payload []byte) ([]byte, error) {
+		ep, err := u.balancer.Pick(ctx, payload)
+		if err != nil {
+			metricUpstreamErrors.Add(1)
+			return nil, fmt.Errorf("upstream %s: %w", u.balancer.Service(), err)
+		}
+		c, err := u.conn(ctx, ep.Addr)
+		if err != nil {
+			metricUpstreamErrors.Add(1)
+			return nil, fmt.Errorf("upstream %s: %w", ep.Addr, err)
+		}
+		out, err := c.call(ctx, cmd, payload)
+		if err != nil {
+			var se *StatusError
+			if !errors.As(err, &se) {
+				metricUpstreamErrors.Add(1)
+			}
+			return nil, err
+		}
+		return out, nil
+	}
+}
+
+// Close closes every upstream connection; later calls fail.
+func (u *Upstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	for addr, c := range u.conns {
+		c.fail(errUpstreamClosed)
+		delete(u.conns, addr)
+	}
+	return nil
+}
+
+// conn returns a live connection to addr, dialing one if needed. Concurrent
+// callers share one dial per address, run outside u.mu so that a slow
+// endpoint does not hold up calls to the others.
+func (u *Upstream) conn(ctx context.Context, addr string) (*upstreamConn, error) {
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		return nil, errUpstreamClosed
+	}
+	if c := u.conns[addr]; c != nil && !c.broken() {
+		u.mu.Unlock()
+		return c, nil
+	}
+	d, dialing := u.dials[addr]
+	if !dialing {
+		d = &upstreamDial{done: make(chan struct{})}
+		u.dials[addr] = d
+		// The dial outlives a caller giving up: others may be waiting.
+		go u.dial(addr, d)
+	}
+	u.mu.Unlock()
+
+	select {
+	case <-d.done:
+		return d.c, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dial connects to addr and publishes the outcome in d.
+func (u *Upstream) dial(addr string, d *upstreamDial) {
+	nc, err := u.dialer(context.Background(), addr)
+
+	u.mu.Lock()
+	delete(u.dials, addr)
+	switch {
+	case err != nil:
+		d.err = err
+	case u.closed:
+		_ = nc.Close()
+		d.err = errUpstreamClosed
+	default:
+		metricUpstreamDials.Add(1)
+		d.c = newUpstreamConn(nc)
+		u.conns[addr] = d.c
+	}
+	u.mu.Unlock()
+	close(d.done)
+}
+
+// upstreamConn multiplexes calls over one backend connection.
+type upstreamConn struct {
+	nc  net.Conn
+	wmu sync.Mutex // serializes frame writes
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *protocol.Message
+	err     error
+	done    chan struct{}
+}
+
+func newUpstreamConn(nc net.Conn) *upstreamConn {
+	c := &upstreamConn{
+		nc:      nc,
+		pending: make(map[uint64]chan *protocol.Message),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *upstreamConn) broken() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// fail closes the connection and fails the calls waiting on it; the first
+// error wins.
+func (c *upstreamConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	_ = c.nc.Close()
+}
+
+func (c *upstreamConn) call(ctx context.Context, cmd uint16, payload []byte) ([]byte, error) {
+	ch := make(chan *protocol.Message, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(ctx, 0, &protocol.Message{Command: cmd, RequestID: id, Payload: payload}); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-ch:
+		if resp.Command == protocol.CmdError {
+			code, msg, err := protocol.DecodeErrorReply(resp.Payload)
+			if err != nil {
+				return nil, err
+			}
+			return nil, &StatusError{Code: code, Message: msg}
+		}
+		return resp.Payload, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// write sends one frame, giving up when ctx ends or after
+// UpstreamWriteTimeout. A failed write may have sent part of the frame, so it
+// fails the connection.
+func (c *upstreamConn) write(ctx context.Context, flags uint8, m *protocol.Message) error {
+	frame, err := protocol.AppendFrame(nil, protocol.FrameVersion, flags, m)
+	if err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(UpstreamWriteTimeout)
+	d, ctxDeadline := ctx.Deadline()
+	if ctxDeadline = ctxDeadline && d.Before(deadline); ctxDeadline {
+		deadline = d
+	}
+	_ = c.nc.SetWriteDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { _ = c.nc.SetWriteDeadline(time.Unix(1, 0)) })
+	_, err = c.nc.Write(frame)
+	stop()
+	if err == nil {
+		return nil
+	}
+	c.fail(err)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	// The write deadline may fire just before ctx notices its own.
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && ctxDeadline {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+func (c *upstreamConn) readLoop() {
+	r := bufio.NewReader(c.nc)
+	for {
+		m, flags, err := readUpstreamMessage(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if protocol.IsControl(flags) {
+			switch m.Command {
+			case protocol.CtrlPing:
+				err = c.write(context.Background(), protocol.FlagControl, &protocol.Message{Command: protocol.CtrlPong, RequestID: m.RequestID, Payload: m.Payload})
+			case protocol.CtrlClose:
+				_, reason, _ := protocol.DecodeCloseReason(m.Payload)
+				err = fmt.Errorf("closed by backend: %s", reason)
+			}
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			continue
+		}
+		c.mu.Lock()
+		ch := c.pending[m.RequestID]
+		c.mu.Unlock()
+		// Responses to calls that gave up, or repeated ones, are dropped.
+		if ch != nil {
+			select {
+			case ch <- m:
+			default:
+			}
+		}
+	}
+}
+
+// readUpstreamMessage reads one non-batch frame and decodes its message.
+func readUpstreamMessage(r *bufio.Reader) (*protocol.Message, uint8, error) {
+	var n int
+	for size := 1; n == 0; size++ {
+		hdr, err := r.Peek(min(size, protocol.FrameHeaderLen))
+		if err != nil {
+			return nil, 0, err
+		}
+		if n, err = protocol.FrameLen(hdr); err != nil {
+			return nil, 0, err
+		}
+		if n == 0 && len(hdr) == protocol.FrameHeaderLen {
+			return nil, 0, errors.New("invalid frame header")
+		}
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, 0, err
+	}
+	frame, _, err := protocol.Decode(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	if frame.Flags&protocol.FlagBatch != 0 {
+		return nil, 0, errors.New("unexpected batch frame from backend")
+	}
+	body, err := protocol.DecodeFrameBody(frame)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, err := frame.DecodeMessage(body)
+	return m, frame.Flags, err
+}
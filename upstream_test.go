@@ -0,0 +1,189 @@
+package novagate
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogogo1024/novagate/discovery"
+	"github.com/gogogo1024/novagate/protocol"
+)
+
+// backendForTest serves setup on a loopback listener and returns its address.
+func backendForTest(t *testing.T, setup func(*Router) error) (string, context.CancelFunc) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = ServeWithContext(ctx, ln, setup) }()
+	return ln.Addr().String(), cancel
+}
+
+func TestUpstreamForwardsAndMultiplexes(t *testing.T) {
+	addr, _ := backendForTest(t, func(r *Router) error {
+		r.Register(protocol.CmdUserLogin, func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			if string(m.Payload) == "busy" {
+				return nil, ErrOverloaded
+			}
+			return &protocol.Message{Command: m.Command, Payload: append([]byte("hello "), m.Payload...)}, nil
+		})
+		return nil
+	})
+	b := discovery.NewBalancer(discovery.Static{"UserService": {{Addr: addr}}}, "UserService", discovery.BalancerConfig{})
+	u := NewUpstream(b, 0)
+	defer u.Close()
+	call := u.Backend(protocol.CmdUserLogin)
+
+	dials := metricUpstreamDials.Value()
+	errs := make(chan error, 20)
+	for range 20 {
+		go func() {
+			out, err := call(context.Background(), []byte("alice"))
+			if err == nil && string(out) != "hello alice" {
+				err = errors.New("unexpected response " + string(out))
+			}
+			errs <- err
+		}()
+	}
+	for range 20 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := metricUpstreamDials.Value() - dials; got != 1 {
+		t.Fatalf("upstream_dials delta = %d, want 1 shared connection", got)
+	}
+
+	_, err := call(context.Background(), []byte("busy"))
+	var se *StatusError
+	if !errors.As(err, &se) || se.Code != protocol.StatusOverloaded {
+		t.Fatalf("backend error reply: err = %v, want StatusOverloaded", err)
+	}
+
+	u.Close()
+	if _, err := call(context.Background(), []byte("alice")); err == nil {
+		t.Fatal("call after Close succeeded")
+	}
+}
+
+func TestUpstreamRedialsAfterBackendRestart(t *testing.T) {
+	setup := func(r *Router) error {
+		r.Register(protocol.CmdPing, func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			return &protocol.Message{Command: m.Command, Payload: m.Payload}, nil
+		})
+		return nil
+	}
+	addr, stop := backendForTest(t, setup)
+	b := discovery.NewBalancer(discovery.Static{"NovaService": {{Addr: addr}}}, "NovaService", discovery.BalancerConfig{})
+	u := NewUpstream(b, 0)
+	defer u.Close()
+	call := u.Backend(protocol.CmdPing)
+	if _, err := call(context.Background(), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	stop()
+	// Calls fail until the backend is back on the same address.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := call(context.Background(), []byte("2")); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("calls still succeed after the backend stopped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot rebind %s: %v", addr, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = ServeWithContext(ctx, ln, setup) }()
+	if out, err := call(context.Background(), []byte("3")); err != nil || string(out) != "3" {
+		t.Fatalf("after restart: %q, %v", out, err)
+	}
+}
+
+func TestUpstreamSlowDialDoesNotBlockOtherEndpoints(t *testing.T) {
+	addr, _ := backendForTest(t, func(r *Router) error {
+		r.Register(protocol.CmdUserLogin, func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			return &protocol.Message{Command: m.Command, Payload: m.Payload}, nil
+		})
+		return nil
+	})
+	const slow = "192.0.2.1:9000"
+	b := discovery.NewBalancer(discovery.Static{"UserService": {{Addr: addr}}}, "UserService", discovery.BalancerConfig{})
+	u := NewUpstream(b, 0)
+	defer u.Close()
+	release := make(chan struct{})
+	var slowDials atomic.Int32
+	dial := u.dialer
+	u.dialer = func(ctx context.Context, a string) (net.Conn, error) {
+		if a == slow {
+			slowDials.Add(1)
+			<-release
+			return nil, errors.New("unreachable")
+		}
+		return dial(ctx, a)
+	}
+
+	errs := make(chan error, 3)
+	for range 3 {
+		go func() {
+			_, err := u.conn(context.Background(), slow)
+			errs <- err
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if out, err := u.Backend(protocol.CmdUserLogin)(ctx, []byte("hi")); err != nil || string(out) != "hi" {
+		t.Fatalf("call to the healthy endpoint = %q, %v", out, err)
+	}
+	close(release)
+	for range 3 {
+		if err := <-errs; err == nil {
+			t.Fatal("dial to the unreachable endpoint succeeded")
+		}
+	}
+	if n := slowDials.Load(); n != 1 {
+		t.Fatalf("%d dials to the unreachable endpoint, want 1 shared", n)
+	}
+}
+
+func TestUpstreamWriteGivesUpAndFailsConn(t *testing.T) {
+	b := discovery.NewBalancer(discovery.Static{"UserService": {{Addr: "stalled"}}}, "UserService", discovery.BalancerConfig{})
+	u := NewUpstream(b, 0)
+	defer u.Close()
+	// The backend end of the pipe is never read, so every write blocks.
+	u.dialer = func(ctx context.Context, addr string) (net.Conn, error) {
+		client, backend := net.Pipe()
+		t.Cleanup(func() { _ = backend.Close() })
+		return client, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := u.Backend(protocol.CmdUserLogin)(ctx, []byte("hi"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("write blocked for %v", d)
+	}
+	u.mu.Lock()
+	c := u.conns["stalled"]
+	u.mu.Unlock()
+	if c == nil || !c.broken() {
+		t.Fatal("a timed-out write left the connection in use")
+	}
+}
@@ -0,0 +1,67 @@
+package novagate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gogogo1024/novagate/codec"
+	"github.com/gogogo1024/novagate/protocol"
+	"github.com/gogogo1024/novagate/schema"
+)
+
+// maxReportedViolations bounds the violations listed in one reply.
+const maxReportedViolations = 16
+
+// CommandSchema is the payload contract of a command (see ValidatePayloads).
+type CommandSchema struct {
+	// MaxBytes bounds the payload size; 0 means no limit beyond the frame's.
+	MaxBytes int
+	// Validator checks the payload; nil checks the size only.
+	Validator schema.Validator
+	// ContentType is the codec of payloads that name none (see
+	// codec.MetadataKey); empty leaves the choice to the Validator.
+	ContentType string
+}
+
+// ValidatePayloads returns a middleware checking request payloads against
+// the schemas of their commands before dispatch; commands without a schema
+// pass through. Invalid requests are answered with a
+// protocol.StatusInvalidPayload error reply whose message lists the failing
+// fields (see schema.FormatViolations). Install it with Router.Use so that it
+// runs before route policies: refused requests cost no rate limit token.
+func ValidatePayloads(schemas map[uint16]CommandSchema) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+			s, ok := schemas[m.Command]
+			if !ok {
+				return next(ctx, m)
+			}
+			if err := s.check(m); err != nil {
+				metricInvalidPayloads.Add(1)
+				return nil, err
+			}
+			return next(ctx, m)
+		}
+	}
+}
+
+// check returns the StatusError refusing m, or nil if m is valid.
+func (s CommandSchema) check(m *protocol.Message) error {
+	var vs []schema.Violation
+	if s.MaxBytes > 0 && len(m.Payload) > s.MaxBytes {
+		vs = append(vs, schema.Violation{Reason: fmt.Sprintf("payload is %d bytes, limit %d", len(m.Payload), s.MaxBytes)})
+	} else if s.Validator != nil {
+		ct := m.Metadata[codec.MetadataKey]
+		if ct == "" {
+			ct = s.ContentType
+		}
+		vs = s.Validator.Validate(ct, m.Payload)
+	}
+	if len(vs) == 0 {
+		return nil
+	}
+	if n := len(vs) - maxReportedViolations; n > 0 {
+		vs = append(vs[:maxReportedViolations], schema.Violation{Reason: fmt.Sprintf("and %d more", n)})
+	}
+	return &StatusError{Code: protocol.StatusInvalidPayload, Message: schema.FormatViolations(vs)}
+}
@@ -0,0 +1,155 @@
+package novagate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gogogo1024/novagate/codec"
+	"github.com/gogogo1024/novagate/protocol"
+	"github.com/gogogo1024/novagate/schema"
+)
+
+const loginSchema = `{
+  "type": "object",
+  "required": ["user"],
+  "properties": {
+    "user":     {"type": "string", "minLength": 1},
+    "attempts": {"type": "integer", "maximum": 3}
+  }
+}`
+
+// loginSchemaSpec writes loginSchema to a file and returns the spec loading it.
+func loginSchemaSpec(t *testing.T) CommandSpec {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "login.json")
+	if err := os.WriteFile(path, []byte(loginSchema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return CommandSpec{
+		ID:           protocol.CmdUserLogin,
+		Method:       "UserService.Login",
+		ContentTypes: []string{codec.JSONName, codec.MsgPackName},
+		Schema:       &SchemaSpec{MaxBytes: 64, JSON: path},
+	}
+}
+
+func TestValidatePayloads(t *testing.T) {
+	spec := loginSchemaSpec(t)
+	if err := ValidateCommandSpecs([]CommandSpec{spec}); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := spec.CommandSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	h := ValidatePayloads(map[uint16]CommandSchema{spec.ID: cs})(func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		calls++
+		return &protocol.Message{Command: m.Command, RequestID: m.RequestID}, nil
+	})
+	call := func(cmd uint16, payload []byte, md map[string]string) ([]schema.Violation, error) {
+		_, err := h(context.Background(), &protocol.Message{Command: cmd, Payload: payload, Metadata: md})
+		var se *StatusError
+		if !errors.As(err, &se) {
+			return nil, err
+		}
+		if se.Code != protocol.StatusInvalidPayload {
+			t.Fatalf("code = %d, want %d", se.Code, protocol.StatusInvalidPayload)
+		}
+		return schema.ParseViolations(se.Message)
+	}
+
+	if vs, err := call(spec.ID, []byte(`{"user":"ann","attempts":1}`), nil); vs != nil || err != nil {
+		t.Fatalf("valid payload: %v, %v", vs, err)
+	}
+	vs, err := call(spec.ID, []byte(`{"user":"","attempts":4}`), nil)
+	if err != nil || len(vs) != 2 || vs[0] != (schema.Violation{Field: "attempts", Reason: "must be <= 3 but found 4"}) || vs[1].Field != "user" {
+		t.Fatalf("invalid payload: %v, %v", vs, err)
+	}
+	vs, err = call(spec.ID, []byte(`{"user":"`+strings.Repeat("a", 64)+`"}`), nil)
+	if err != nil || len(vs) != 1 || vs[0].Field != "" || !strings.Contains(vs[0].Reason, "limit 64") {
+		t.Fatalf("oversized payload: %v, %v", vs, err)
+	}
+
+	// The content type of the request selects the decoding.
+	mp, _ := codec.MsgPack{}.Marshal(map[string]any{"attempts": 2})
+	md := map[string]string{codec.MetadataKey: codec.MsgPackName}
+	if vs, err := call(spec.ID, mp, md); err != nil || len(vs) != 1 || vs[0] != (schema.Violation{Field: "user", Reason: "is required"}) {
+		t.Fatalf("msgpack payload: %v, %v", vs, err)
+	}
+
+	// Commands without a schema pass through.
+	if vs, err := call(protocol.CmdPing, []byte("anything"), nil); vs != nil || err != nil {
+		t.Fatalf("unvalidated command: %v, %v", vs, err)
+	}
+	if calls != 2 {
+		t.Fatalf("handler calls = %d, want 2", calls)
+	}
+}
+
+func TestValidatePayloadsLimitsViolations(t *testing.T) {
+	props := map[string]any{}
+	for _, c := range "abcdefghijklmnopqrst" {
+		props[string(c)] = 1
+	}
+	payload, _ := json.Marshal(props)
+	s, err := schema.CompileJSON([]byte(`{"additionalProperties": false}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CommandSchema{Validator: s}.check(&protocol.Message{Payload: payload})
+	var se *StatusError
+	if !errors.As(err, &se) {
+		t.Fatalf("err = %v", err)
+	}
+	vs, _ := schema.ParseViolations(se.Message)
+	if len(vs) != maxReportedViolations+1 || vs[maxReportedViolations].Reason != "and 4 more" {
+		t.Fatalf("violations = %v", vs)
+	}
+}
+
+func TestHTTPBridge_InvalidPayload(t *testing.T) {
+	spec := loginSchemaSpec(t)
+	cs, err := spec.CommandSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	protocol.RegisterFullMethodCommand(spec.Method, spec.ID)
+	r := NewRouter()
+	r.Use(ValidatePayloads(map[uint16]CommandSchema{spec.ID: cs}))
+	r.Register(spec.ID, func(ctx context.Context, m *protocol.Message) (*protocol.Message, error) {
+		return &protocol.Message{Command: m.Command, RequestID: m.RequestID, Payload: m.Payload}, nil
+	})
+	srv := httptest.NewServer(NewHTTPBridge(r))
+	defer srv.Close()
+
+	for body, status := range map[string]int{
+		`{"user":"ann"}`: http.StatusOK,
+		`{"attempts":9}`: http.StatusUnprocessableEntity,
+	} {
+		resp, err := http.Post(srv.URL+"/v1/call/UserService/Login", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res HTTPCallResult
+		_ = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("%s: status = %d, want %d (%+v)", body, resp.StatusCode, status, res)
+		}
+		if status == http.StatusOK {
+			continue
+		}
+		if res.Code != protocol.StatusInvalidPayload || res.Error != "invalid payload" || len(res.Violations) != 2 {
+			t.Fatalf("%s: result %+v", body, res)
+		}
+	}
+}
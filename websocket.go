@@ -0,0 +1,123 @@
+package novagate
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketListener accepts WebSocket upgrades over HTTP and exposes every
+// upgraded connection as a net.Conn.
+//
+// Binary WS messages are concatenated into the byte stream seen by the frame
+// decoder, so a message may carry one frame, several frames, or part of one.
+// Each response frame is written as a single binary WS message.
+type WebSocketListener struct {
+	ln    net.Listener
+	srv   *http.Server
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// ListenWebSocket listens on addr and upgrades requests for path (default "/").
+func ListenWebSocket(addr, path string) (*WebSocketListener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewWebSocketListener(ln, path), nil
+}
+
+// NewWebSocketListener serves WebSocket upgrades for path on an existing listener.
+// Origin is not checked; put the gateway behind a proxy if browsers from
+// untrusted origins must be rejected.
+func NewWebSocketListener(ln net.Listener, path string) *WebSocketListener {
+	if path == "" {
+		path = "/"
+	}
+	l := &WebSocketListener{
+		ln:    ln,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   l.handle,
+	})
+	l.srv = &http.Server{Handler: mux}
+	go func() {
+		_ = l.srv.Serve(ln)
+	}()
+	return l
+}
+
+// handle hands the upgraded connection to Accept and blocks until it is closed,
+// because the websocket package closes the connection when the handler returns.
+// Once handed out, the connection belongs to its owner: closing the listener
+// does not end it.
+func (l *WebSocketListener) handle(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	c := &wsConn{Conn: ws, remote: ws.Request().RemoteAddr, closed: make(chan struct{})}
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		return
+	}
+	<-c.closed
+}
+
+// Accept waits for the next upgraded WebSocket connection.
+func (l *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting upgrades. Connections already handed out by Accept
+// stay open until their owner closes them.
+func (l *WebSocketListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.srv.Close()
+	})
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Addr returns the underlying TCP listener address.
+func (l *WebSocketListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// wsConn reports the peer's TCP address instead of the WS Origin and lets the
+// HTTP handler goroutine know when the connection is done.
+type wsConn struct {
+	*websocket.Conn
+	remote string
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	if addr, err := net.ResolveTCPAddr("tcp", c.remote); err == nil {
+		return addr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.closed) })
+	return err
+}
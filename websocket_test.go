@@ -0,0 +1,75 @@
+package novagate
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketListener_BinaryFrames(t *testing.T) {
+	ln, err := ListenWebSocket("127.0.0.1:0", "/ws")
+	if err != nil {
+		t.Fatalf("ListenWebSocket: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = ServeListeners(ctx, []net.Listener{ln}, echoSetup)
+	}()
+
+	addr := ln.Addr().String()
+	ws, err := websocket.Dial("ws://"+addr+"/ws", "", "http://"+addr)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer ws.Close()
+	ws.PayloadType = websocket.BinaryFrame
+
+	for i := uint64(1); i <= 2; i++ {
+		resp := pingRoundTrip(t, ws, i, []byte("over-ws"))
+		if resp.RequestID != i || !bytes.Equal(resp.Payload, []byte("over-ws")) {
+			t.Fatalf("unexpected response %+v", resp)
+		}
+	}
+}
+
+func TestWebSocketListener_CloseKeepsAcceptedConns(t *testing.T) {
+	ln, err := ListenWebSocket("127.0.0.1:0", "/")
+	if err != nil {
+		t.Fatalf("ListenWebSocket: %v", err)
+	}
+	addr := ln.Addr().String()
+	ws, err := websocket.Dial("ws://"+addr+"/", "", "http://"+addr)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer ws.Close()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ln.Accept(); err == nil {
+		t.Fatal("Accept succeeded after Close")
+	}
+	// Give a handler that wrongly returns on Close time to drop the conn.
+	time.Sleep(20 * time.Millisecond)
+	if _, err := c.Write([]byte("still open")); err != nil {
+		t.Fatalf("write after listener Close: %v", err)
+	}
+	_ = ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, len("still open"))
+	if _, err := io.ReadFull(ws, buf); err != nil || string(buf) != "still open" {
+		t.Fatalf("read = %q, %v", buf, err)
+	}
+}